@@ -2,24 +2,36 @@ package main
 
 import (
 	"bufio"
-	"encoding/base64"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 	"zep/utils"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"golang.org/x/term"
 )
 
 var (
 	username    string
 	keyPath     string
+	backendSpec string
+	dryRun      bool
+	output      string // --output of the listing and info commands
 	historyFile = filepath.Join(os.TempDir(), ".zephyrus_history")
 )
 
 func main() {
+	if err := newRootCmd().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+// newRootCmd builds the zep command tree
+func newRootCmd() *cobra.Command {
 	var rootCmd = &cobra.Command{
 		Use:   "zep",
 		Short: "Zephyrus CLI - Secure Vault on GitHub",
@@ -27,9 +39,21 @@ func main() {
 
 	// Persistent flag allows -u to be used across all subcommands
 	rootCmd.PersistentFlags().StringVarP(&username, "user", "u", "", "GitHub username (forces stateless mode if no session exists)")
+	rootCmd.PersistentFlags().StringVar(&backendSpec, "backend", utils.DefaultBackendSpec, "Vault storage backend: github, gitea:<host> or local:<dir>")
+	rootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "Print what would be pushed to the vault without pushing anything")
+	rootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		utils.SetBackendSpec(backendSpec)
+		utils.SetDryRun(dryRun)
+		utils.SetProgressOutput(os.Stdout)
+	}
+	rootCmd.PersistentPostRun = func(cmd *cobra.Command, args []string) {
+		if dryRun {
+			fmt.Println("Dry run: the vault and the local session were not changed.")
+		}
+	}
 
 	// --- SESSION HELPER ---
-	// This logic prioritizes the local zephyrus.conf, but falls back to
+	// This logic prioritizes the persistent session, but falls back to
 	// manual auth if -u is provided or if the user is not connected.
 	getEffectiveSession := func() (*utils.Session, error) {
 		// 1. Check for active local session
@@ -37,10 +61,16 @@ func main() {
 		if err == nil {
 			return sess, nil
 		}
+		if errors.Is(err, utils.ErrSessionLocked) {
+			fmt.Fprintf(os.Stderr, "🔒 %v\n", err)
+			if username == "" {
+				username = utils.SavedSessionUser()
+			}
+		}
 
 		// 2. Stateless Fallback: If not connected, prompt for info
 		if username == "" {
-			fmt.Print("No active session. Enter GitHub Username: ")
+			fmt.Fprint(os.Stderr, "No active session. Enter GitHub Username: ")
 			fmt.Scanln(&username)
 		}
 
@@ -49,10 +79,26 @@ func main() {
 			return nil, err
 		}
 
-		fmt.Println("Authenticating and fetching index (Stateless Mode)...")
+		fmt.Fprintln(os.Stderr, "Authenticating and fetching index (Stateless Mode)...")
 		return utils.FetchSessionStateless(username, pass)
 	}
 
+	// --- OUTPUT FORMAT ---
+	// parseOutput validates --output of the listing and info commands. For
+	// json and jsonl, progress goes to stderr so stdout only holds the records.
+	parseOutput := func() (string, bool) {
+		format, err := utils.ParseOutputFormat(output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return "", false
+		}
+		if format != utils.OutputTable {
+			utils.SetProgressOutput(os.Stderr)
+		}
+		return format, true
+	}
+	const outputUsage = "Output format: table, json or jsonl"
+
 	// --- SETUP ---
 	var setupCmd = &cobra.Command{
 		Use:   "setup [username] [key-path]",
@@ -176,9 +222,8 @@ func main() {
 		Short:   "Change your vault password",
 		Args:    cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
-			// Check if the config file exists BEFORE starting
-			_, err := os.Stat("zephyrus.conf")
-			isPersistent := err == nil
+			// Check if a persistent session exists BEFORE starting
+			isPersistent := utils.IsConnected()
 
 			session, err := getEffectiveSession()
 			if err != nil {
@@ -244,11 +289,41 @@ func main() {
 		},
 	}
 
+	// --- UPGRADE KDF ---
+	var upgradeKDFCmd = &cobra.Command{
+		Use:   "upgrade-kdf",
+		Short: "Re-encrypt the vault's password-protected data with Argon2id",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			isPersistent := utils.IsConnected()
+
+			session, err := getEffectiveSession()
+			if err != nil {
+				fmt.Printf("❌ Authentication failed: %v\n", err)
+				return
+			}
+
+			err = utils.UpgradeKDF(session)
+			if err != nil {
+				fmt.Printf("❌ KDF upgrade failed: %v\n", err)
+				return
+			}
+
+			if isPersistent {
+				session.Save()
+			}
+			fmt.Println("✔ Key derivation upgraded.")
+			fmt.Println("Older versions of zep can no longer open this vault.")
+		},
+	}
+
 	// --- TRANSFER VAULT ---
+	var transferOpts utils.TransferOptions
 	var transferVaultCmd = &cobra.Command{
 		Use:     "transfer-vault [source-username] [dest-username]",
 		Aliases: []string{"transfer", "xfer", "copy-vault"},
 		Short:   "Transfer all files from one vault to another",
+		Long:    "Copies files from the source vault into the destination vault, next to the files already there.\nAn interrupted transfer resumes where it stopped when the same command is run again.",
 		Args:    cobra.ExactArgs(2),
 		Run: func(cmd *cobra.Command, args []string) {
 			sourceUsername := args[0]
@@ -258,6 +333,12 @@ func main() {
 				fmt.Println("❌ Source and destination vaults must be different.")
 				return
 			}
+			switch transferOpts.Conflict {
+			case utils.ConflictSkip, utils.ConflictOverwrite, utils.ConflictRename:
+			default:
+				fmt.Printf("❌ Unknown --on-conflict '%s' (use skip, overwrite or rename)\n", transferOpts.Conflict)
+				return
+			}
 
 			// Get source vault password
 			fmt.Printf("Source vault authentication (%s):\n", sourceUsername)
@@ -276,8 +357,22 @@ func main() {
 			}
 
 			// Confirm transfer
-			fmt.Printf("\n⚠️  You are about to transfer all files from %s to %s.\n", sourceUsername, destUsername)
-			fmt.Print("This will copy all vault contents. Continue? (y/n): ")
+			what := "all files"
+			if transferOpts.Path != "" {
+				what = "'" + transferOpts.Path + "'"
+			}
+			fmt.Printf("\n⚠️  You are about to transfer %s from %s to %s.\n", what, sourceUsername, destUsername)
+			switch transferOpts.Conflict {
+			case utils.ConflictOverwrite:
+				fmt.Println("Files that already exist in the destination will be overwritten.")
+			case utils.ConflictRename:
+				fmt.Println("Files that already exist in the destination will be kept; transferred copies get a new name.")
+			}
+			if transferOpts.Settings {
+				fmt.Println("The destination's settings will be replaced with the source's.")
+			}
+			fmt.Println("Shares of the transferred files and folders will be moved to the destination.")
+			fmt.Print("Continue? (y/n): ")
 			var confirm string
 			fmt.Scanln(&confirm)
 			if confirm != "y" && confirm != "yes" {
@@ -286,18 +381,22 @@ func main() {
 			}
 
 			// Perform transfer
-			err = utils.TransferVault(sourceUsername, sourcePass, destUsername, destPass)
+			err = utils.TransferVault(sourceUsername, sourcePass, destUsername, destPass, transferOpts)
 			if err != nil {
 				fmt.Printf("❌ Transfer failed: %v\n", err)
 				return
 			}
 
 			fmt.Println("✔ Vault transfer complete!")
-			fmt.Printf("All files have been successfully transferred from %s to %s\n", sourceUsername, destUsername)
 		},
 	}
+	transferVaultCmd.Flags().IntVarP(&transferOpts.Jobs, "jobs", "j", utils.DefaultJobs, "Number of files to re-encrypt at once")
+	transferVaultCmd.Flags().StringVarP(&transferOpts.Path, "path", "p", "", "Transfer only this file or folder of the source vault")
+	transferVaultCmd.Flags().StringVar(&transferOpts.Conflict, "on-conflict", utils.ConflictSkip, "What to do with files that exist in the destination: skip, overwrite or rename")
+	transferVaultCmd.Flags().BoolVar(&transferOpts.Settings, "settings", false, "Also copy the source vault's settings")
 
 	// --- CONNECT ---
+	var idleTimeout time.Duration
 	var connectCmd = &cobra.Command{
 		Use:     "connect [username]",
 		Aliases: []string{"conn", "login", "auth", "signin", "con", "cn"},
@@ -313,7 +412,7 @@ func main() {
 				fmt.Scanln(&target)
 			}
 			pass, _ := utils.GetPassword("Enter Password: ")
-			err := utils.Connect(target, pass)
+			err := utils.Connect(target, pass, idleTimeout)
 			if err != nil {
 				fmt.Printf("❌ Connection failed: %v\n", err)
 				return
@@ -322,6 +421,35 @@ func main() {
 		},
 	}
 
+	connectCmd.Flags().DurationVar(&idleTimeout, "idle-timeout", utils.DefaultIdleTimeout, "Lock the session after this long without use (0 to never lock)")
+
+	// --- LOCK ---
+	var lockCmd = &cobra.Command{
+		Use:   "lock",
+		Short: "Lock the persistent session until the next 'connect'",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := utils.Lock(); err != nil {
+				fmt.Printf("❌ Lock failed: %v\n", err)
+				return
+			}
+			fmt.Println("✔ Session locked.")
+		},
+	}
+
+	// --- SESSION AGENT ---
+	// Started by connect to keep the persistent session's secrets in memory
+	var agentCmd = &cobra.Command{
+		Use:    utils.AgentCommand,
+		Hidden: true,
+		Args:   cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := utils.RunSessionAgent(); err != nil {
+				fmt.Fprintf(os.Stderr, "❌ Session agent failed: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
 	// --- UPLOAD ---
 	var uploadCmd = &cobra.Command{
 		Use:     "upload [local-path] [vault-path]",
@@ -338,9 +466,8 @@ func main() {
 				vaultPath = filepath.Base(localPath)
 			}
 
-			// 1. Check if the config file exists BEFORE starting
-			_, err := os.Stat("zephyrus.conf")
-			isPersistent := err == nil
+			// 1. Check if a persistent session exists BEFORE starting
+			isPersistent := utils.IsConnected()
 
 			session, err := getEffectiveSession()
 			if err != nil {
@@ -379,6 +506,7 @@ func main() {
 
 	// --- DOWNLOAD ---
 	var sharedFlag string
+	var downloadJobs int
 	var downloadCmd = &cobra.Command{
 		Use:     "download [vault-path] [local-path]",
 		Aliases: []string{"down", "d", "get"},
@@ -396,6 +524,10 @@ func main() {
 
 			// Check if downloading a shared file
 			if sharedFlag != "" {
+				// Without a local path, the name in the share link is used
+				if len(args) < 2 {
+					localPath = ""
+				}
 				err := utils.DownloadSharedFile(sharedFlag, localPath)
 				if err != nil {
 					fmt.Printf("❌ Shared file download failed: %v\n", err)
@@ -421,7 +553,7 @@ func main() {
 			var downloadErr error
 			if entry.Type == "folder" {
 				// Directory download
-				downloadErr = utils.DownloadDirectory(vaultPath, localPath, session)
+				downloadErr = utils.DownloadDirectory(vaultPath, localPath, downloadJobs, session)
 			} else {
 				// Single file download
 				downloadErr = utils.DownloadFile(vaultPath, localPath, session)
@@ -434,7 +566,8 @@ func main() {
 			fmt.Println("✔ Download successful.")
 		},
 	}
-	downloadCmd.Flags().StringVar(&sharedFlag, "shared", "", "Download a shared file using share string (username:storage_id:key)")
+	downloadCmd.Flags().StringVar(&sharedFlag, "shared", "", "Download a shared file or folder using a share link or web share URL")
+	downloadCmd.Flags().IntVarP(&downloadJobs, "jobs", "j", utils.DefaultJobs, "Number of files to download at once when downloading a directory")
 
 	// --- DELETE ---
 	var deleteCmd = &cobra.Command{
@@ -443,8 +576,7 @@ func main() {
 		Short:   "Delete a file or folder (recursive)",
 		Args:    cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			_, err := os.Stat("zephyrus.conf")
-			isPersistent := err == nil
+			isPersistent := utils.IsConnected()
 
 			session, err := getEffectiveSession()
 			if err != nil {
@@ -465,14 +597,131 @@ func main() {
 		},
 	}
 
+	// --- MOVE ---
+	var moveForce bool
+	var mvCmd = &cobra.Command{
+		Use:     "mv [source] [destination]",
+		Aliases: []string{"move", "rename"},
+		Short:   "Move or rename a file or folder inside the vault",
+		Args:    cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			isPersistent := utils.IsConnected()
+
+			session, err := getEffectiveSession()
+			if err != nil {
+				fmt.Printf("❌ Authentication failed: %v\n", err)
+				return
+			}
+
+			err = utils.MovePath(args[0], args[1], moveForce, session)
+			if err != nil {
+				fmt.Printf("❌ Move failed: %v\n", err)
+				return
+			}
+
+			if isPersistent {
+				session.Save()
+			}
+			fmt.Println("✔ Item moved.")
+		},
+	}
+	mvCmd.Flags().BoolVarP(&moveForce, "force", "f", false, "Overwrite the destination if it already exists")
+
+	// --- COPY ---
+	var copyForce, copyDuplicate bool
+	var cpCmd = &cobra.Command{
+		Use:     "cp [source] [destination]",
+		Aliases: []string{"copy"},
+		Short:   "Copy a file or folder inside the vault",
+		Args:    cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			isPersistent := utils.IsConnected()
+
+			session, err := getEffectiveSession()
+			if err != nil {
+				fmt.Printf("❌ Authentication failed: %v\n", err)
+				return
+			}
+
+			err = utils.CopyPath(args[0], args[1], copyForce, copyDuplicate, session)
+			if err != nil {
+				fmt.Printf("❌ Copy failed: %v\n", err)
+				return
+			}
+
+			if isPersistent {
+				session.Save()
+			}
+			fmt.Println("✔ Item copied.")
+		},
+	}
+	cpCmd.Flags().BoolVarP(&copyForce, "force", "f", false, "Overwrite the destination if it already exists")
+	cpCmd.Flags().BoolVar(&copyDuplicate, "duplicate", false, "Copy the storage objects instead of sharing them with the original")
+
+	// --- SYNC ---
+	var syncMode string
+	var syncDelete bool
+	var syncCmd = &cobra.Command{
+		Use:   "sync [local-dir] [vault-dir]",
+		Short: "Synchronize a local folder with a vault folder",
+		Long:  "Compares a local folder with a vault folder and transfers only files that changed.\nModes: push (local -> vault), pull (vault -> local), both (two-way, default).",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			mode, err := utils.ParseSyncMode(syncMode)
+			if err != nil {
+				fmt.Printf("❌ %v\n", err)
+				return
+			}
+
+			isPersistent := utils.IsConnected()
+
+			session, err := getEffectiveSession()
+			if err != nil {
+				fmt.Printf("❌ Authentication failed: %v\n", err)
+				return
+			}
+
+			opts := utils.SyncOptions{Mode: mode, Delete: syncDelete, DryRun: utils.DryRun()}
+			opts.Confirm = func(deletions int) bool {
+				fmt.Printf("⚠️  Confirm sync? %d file(s) will be deleted. (y/N): ", deletions)
+				var confirm string
+				fmt.Scanln(&confirm)
+				return confirm == "y"
+			}
+			err = utils.SyncFolder(args[0], args[1], opts, session)
+			if errors.Is(err, utils.ErrSyncCancelled) {
+				fmt.Println("Sync cancelled.")
+				return
+			}
+			if err != nil {
+				fmt.Printf("❌ Sync failed: %v\n", err)
+				return
+			}
+
+			if utils.DryRun() {
+				return
+			}
+			if isPersistent {
+				session.Save()
+			}
+			fmt.Println("✔ Sync complete.")
+		},
+	}
+	syncCmd.Flags().StringVarP(&syncMode, "mode", "m", "both", "Sync direction: push, pull or both")
+	syncCmd.Flags().BoolVar(&syncDelete, "delete", false, "Propagate deletions instead of restoring missing files")
+
 	// --- LIST ---
 	var listCmd = &cobra.Command{
 		Use:   "ls [folder]",
 		Short: "List vault contents",
 		Run: func(cmd *cobra.Command, args []string) {
+			format, ok := parseOutput()
+			if !ok {
+				return
+			}
 			session, err := getEffectiveSession()
 			if err != nil {
-				fmt.Printf("❌ Authentication failed: %v\n", err)
+				fmt.Fprintf(os.Stderr, "❌ Authentication failed: %v\n", err)
 				return
 			}
 
@@ -480,25 +729,102 @@ func main() {
 			if len(args) > 0 {
 				path = args[0]
 			}
-			utils.ListFiles(session, path)
+			if err := utils.ListFiles(session, path, format); err != nil {
+				fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			}
 		},
 	}
+	listCmd.Flags().StringVarP(&output, "output", "o", utils.OutputTable, outputUsage)
 
 	// --- SEARCH ---
+	type searchFlagValues struct {
+		regex          bool
+		entryType      string
+		minSize        string
+		maxSize        string
+		modifiedAfter  string
+		modifiedBefore string
+		limit          int
+	}
+	var searchFlags searchFlagValues
 	var searchCmd = &cobra.Command{
-		Use:     "search [query]",
+		Use:     "search [pattern]",
 		Aliases: []string{"s"},
 		Short:   "Search the vault index",
-		Args:    cobra.ExactArgs(1),
+		Long: `Lists the vault entries matching a pattern, sorted by path.
+
+A plain pattern matches anywhere in the path, ignoring case. Patterns with
+*, ? or [...] are globs: * stays within one folder, ** spans folders
+("**/*.pdf"), and a glob without a slash matches names at any depth.
+With --regex the pattern is a regular expression matched against the full
+path. Size and date filters only match files uploaded with metadata.`,
+		Args: cobra.MaximumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
+			// Flags keep their value between commands in the shell
+			defer func() { searchFlags = searchFlagValues{} }()
+
+			format, ok := parseOutput()
+			if !ok {
+				return
+			}
+			opts := utils.SearchOptions{Regex: searchFlags.regex, Limit: searchFlags.limit}
+			if len(args) > 0 {
+				opts.Pattern = args[0]
+			}
+			if opts.Limit < 0 {
+				fmt.Fprintln(os.Stderr, "❌ --limit must not be negative")
+				return
+			}
+			var err error
+			if opts.Type, err = utils.ParseEntryType(searchFlags.entryType); err != nil {
+				fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+				return
+			}
+			parseSize := func(flag, value string, dst *int64) bool {
+				if value == "" {
+					return true
+				}
+				if *dst, err = utils.ParseByteSize(value); err != nil {
+					fmt.Fprintf(os.Stderr, "❌ Invalid %s: %v\n", flag, err)
+					return false
+				}
+				return true
+			}
+			parseTime := func(flag, value string, dst *time.Time) bool {
+				if value == "" {
+					return true
+				}
+				if *dst, err = utils.ParseTimeBound(value); err != nil {
+					fmt.Fprintf(os.Stderr, "❌ Invalid %s: %v\n", flag, err)
+					return false
+				}
+				return true
+			}
+			if !parseSize("--min-size", searchFlags.minSize, &opts.MinSize) ||
+				!parseSize("--max-size", searchFlags.maxSize, &opts.MaxSize) ||
+				!parseTime("--modified-after", searchFlags.modifiedAfter, &opts.ModifiedAfter) ||
+				!parseTime("--modified-before", searchFlags.modifiedBefore, &opts.ModifiedBefore) {
+				return
+			}
+
 			session, err := getEffectiveSession()
 			if err != nil {
-				fmt.Printf("❌ Authentication failed: %v\n", err)
+				fmt.Fprintf(os.Stderr, "❌ Authentication failed: %v\n", err)
 				return
 			}
-			utils.SearchFiles(session, args[0])
+			if err := utils.SearchFiles(session, opts, format); err != nil {
+				fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			}
 		},
 	}
+	searchCmd.Flags().StringVarP(&output, "output", "o", utils.OutputTable, outputUsage)
+	searchCmd.Flags().BoolVar(&searchFlags.regex, "regex", false, "Treat the pattern as a regular expression")
+	searchCmd.Flags().StringVarP(&searchFlags.entryType, "type", "t", "", "Only list entries of this type: file or dir")
+	searchCmd.Flags().StringVar(&searchFlags.minSize, "min-size", "", "Only list files of at least this size (e.g. 10M)")
+	searchCmd.Flags().StringVar(&searchFlags.maxSize, "max-size", "", "Only list files of at most this size (e.g. 1G)")
+	searchCmd.Flags().StringVar(&searchFlags.modifiedAfter, "modified-after", "", "Only list files modified after this date (2006-01-02) or within this age (e.g. 30d)")
+	searchCmd.Flags().StringVar(&searchFlags.modifiedBefore, "modified-before", "", "Only list files modified before this date (2006-01-02) or longer ago than this age (e.g. 2w)")
+	searchCmd.Flags().IntVarP(&searchFlags.limit, "limit", "n", 0, "Stop after this many matches (0 for all)")
 
 	// --- PURGE ---
 	var purgeCmd = &cobra.Command{
@@ -506,8 +832,7 @@ func main() {
 		Short: "Wipe all remote data",
 		Run: func(cmd *cobra.Command, args []string) {
 			// Check if we are persistent BEFORE running
-			_, statErr := os.Stat("zephyrus.conf")
-			isPersistent := statErr == nil
+			isPersistent := utils.IsConnected()
 
 			session, err := getEffectiveSession()
 			if err != nil {
@@ -537,6 +862,222 @@ func main() {
 		},
 	}
 
+	// --- FSCK ---
+	var fsckCmd = &cobra.Command{
+		Use:   "fsck",
+		Short: "Check the vault for missing, orphaned or unreadable objects",
+		Long: `Compares the files stored in the vault with the index and the shared index and
+reports every inconsistency: index entries whose objects are missing, file keys
+that no longer decrypt, broken share pointers, and stored objects nothing refers to.
+Orphaned objects and dangling share pointers can be removed with 'zep gc'.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			isPersistent := utils.IsConnected()
+			session, err := getEffectiveSession()
+			if err != nil {
+				fmt.Printf("❌ Authentication failed: %v\n", err)
+				return
+			}
+
+			report, err := utils.CheckVault(session)
+			if err != nil {
+				fmt.Printf("❌ Check failed: %v\n", err)
+				return
+			}
+			if isPersistent {
+				session.Save()
+			}
+
+			fmt.Printf("Checked %d stored files, %d indexed files and %d shares\n", report.Stored, report.Files, report.Shares)
+			if report.Pending > 0 {
+				fmt.Printf("%d upload(s) in progress; their objects are kept\n", report.Pending)
+			}
+			for _, issue := range report.Issues {
+				fmt.Printf("  %s\n", issue)
+			}
+			if len(report.Issues) == 0 {
+				fmt.Println("✔ No problems found")
+				return
+			}
+			fmt.Printf("❌ %d problem(s) found\n", len(report.Issues))
+			if len(report.Garbage) > 0 {
+				fmt.Printf("Run 'zep gc' to remove %d orphaned object(s) and pointer(s).\n", len(report.Garbage))
+			}
+		},
+	}
+
+	// --- GC ---
+	var gcApply bool
+	var gcCmd = &cobra.Command{
+		Use:   "gc",
+		Short: "Remove orphaned objects and dangling share pointers",
+		Long: `Removes stored objects that neither the index nor any share refers to, and
+share pointers without a share, in one commit. By default only lists what
+would be removed; pass --apply to remove it.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			isPersistent := utils.IsConnected()
+			session, err := getEffectiveSession()
+			if err != nil {
+				fmt.Printf("❌ Authentication failed: %v\n", err)
+				return
+			}
+
+			report, err := utils.CollectGarbage(!gcApply, session)
+			if isPersistent {
+				session.Save()
+			}
+			if err != nil {
+				fmt.Printf("❌ Garbage collection failed: %v\n", err)
+				return
+			}
+
+			if report.Pending > 0 {
+				fmt.Printf("Keeping the objects of %d upload(s) in progress\n", report.Pending)
+			}
+			if len(report.Garbage) == 0 {
+				fmt.Println("✔ Nothing to remove")
+				return
+			}
+			for _, path := range report.Garbage {
+				fmt.Printf("  %s\n", path)
+			}
+			if !gcApply {
+				fmt.Printf("%d file(s) would be removed. Run 'zep gc --apply' to remove them.\n", len(report.Garbage))
+				return
+			}
+			fmt.Printf("✔ Removed %d file(s)\n", len(report.Garbage))
+		},
+	}
+	gcCmd.Flags().BoolVar(&gcApply, "apply", false, "Remove the files instead of only listing them")
+
+	// --- COMPACT ---
+	var compactKeepSince string
+	var compactCmd = &cobra.Command{
+		Use:   "compact",
+		Short: "Squash the vault history down to the objects still in use",
+		Long: `Replaces the vault history with a single commit holding only what the vault
+still refers to: its configuration, shares and the objects of current files.
+With --keep-since, commits made after that time are kept and only older
+history is squashed. The new history is verified to decrypt before it is
+force-pushed; older versions of files can no longer be restored afterwards.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var keepSince time.Time
+			if compactKeepSince != "" {
+				t, err := utils.ParseTimeBound(compactKeepSince)
+				if err != nil {
+					fmt.Printf("❌ Invalid --keep-since: %v\n", err)
+					return
+				}
+				keepSince = t
+			}
+
+			isPersistent := utils.IsConnected()
+			session, err := getEffectiveSession()
+			if err != nil {
+				fmt.Printf("❌ Authentication failed: %v\n", err)
+				return
+			}
+
+			if keepSince.IsZero() {
+				fmt.Print("⚠️  Confirm COMPACT? All history is replaced by one commit; older file versions are lost. (y/N): ")
+			} else {
+				fmt.Printf("⚠️  Confirm COMPACT? History before %s is squashed; older file versions are lost. (y/N): ", keepSince.Format("2006-01-02 15:04"))
+			}
+			var confirm string
+			fmt.Scanln(&confirm)
+			if confirm != "y" {
+				return
+			}
+
+			result, err := utils.CompactVault(keepSince, session)
+			if isPersistent {
+				session.Save()
+			}
+			if err != nil {
+				fmt.Printf("❌ Compact failed: %v\n", err)
+				return
+			}
+			if result.Commits == 0 {
+				return
+			}
+			for _, path := range result.Removed {
+				fmt.Printf("  removed %s\n", path)
+			}
+			fmt.Printf("✔ History compacted from %d to %d commit(s)\n", result.OldCommits, result.Commits)
+		},
+	}
+	compactCmd.Flags().StringVar(&compactKeepSince, "keep-since", "", "Keep commits made after this date (2006-01-02) or within this age (e.g. 30d)")
+
+	// --- VERIFY ---
+	var verifyJobs int
+	var verifyCmd = &cobra.Command{
+		Use:   "verify [path]",
+		Short: "Decrypt every file to prove the vault can be restored",
+		Long: `Fetches and decrypts every file in the vault (or below path) and compares it
+with the checksum recorded when it was uploaded. Prints a result per file and a
+summary, or with --output json|jsonl a machine-readable report. Exits with
+status 1 if any file fails, so it can run unattended (e.g. from cron).`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true
+			format, ok := parseOutput()
+			if !ok {
+				return fmt.Errorf("invalid --output")
+			}
+			vaultPath := ""
+			if len(args) > 0 {
+				vaultPath = strings.Trim(args[0], "/")
+			}
+
+			isPersistent := utils.IsConnected()
+			session, err := getEffectiveSession()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "❌ Authentication failed: %v\n", err)
+				return err
+			}
+
+			var progress func(i int, n int, result utils.VerifyResult)
+			if format == utils.OutputTable {
+				progress = func(i int, n int, result utils.VerifyResult) {
+					switch result.Status {
+					case utils.VerifyOK:
+						fmt.Printf("  ✔ %s\n", result.Path)
+					case utils.VerifyUnverified:
+						fmt.Printf("  ~ %s (decrypts; no checksum recorded)\n", result.Path)
+					default:
+						fmt.Printf("  ✗ %s: %s\n", result.Path, result.Error)
+					}
+				}
+			}
+			report, err := utils.VerifyVault(vaultPath, verifyJobs, progress, session)
+			if isPersistent {
+				session.Save()
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "❌ Verification failed: %v\n", err)
+				return err
+			}
+			if err := utils.PrintVerifyReport(report, format); err != nil {
+				return err
+			}
+
+			sum := report.Summary
+			if sum.Failed > 0 {
+				fmt.Fprintf(os.Stderr, "❌ %d file(s) cannot be restored\n", sum.Failed)
+				return fmt.Errorf("%d of %d files failed verification", sum.Failed, sum.Files)
+			}
+			if format == utils.OutputTable {
+				fmt.Println("✔ Vault verified")
+			}
+			return nil
+		},
+	}
+	verifyCmd.Flags().IntVarP(&verifyJobs, "jobs", "j", utils.DefaultJobs, "Number of files to verify at once")
+	verifyCmd.Flags().StringVarP(&output, "output", "o", utils.OutputTable, outputUsage)
+
 	// --- DISCONNECT ---
 	var disconnectCmd = &cobra.Command{
 		Use:     "disconnect",
@@ -549,14 +1090,25 @@ func main() {
 	}
 
 	// --- SHARE ---
+	var shareExpires string
+	var shareTo string
 	var shareCmd = &cobra.Command{
 		Use:   "share [vault-path]",
-		Short: "Generate a share string for a file",
+		Short: "Generate a share link for a file or folder",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			// Check if the config file exists BEFORE starting
-			_, err := os.Stat("zephyrus.conf")
-			isPersistent := err == nil
+			// Check if a persistent session exists BEFORE starting
+			isPersistent := utils.IsConnected()
+
+			var expires time.Duration
+			if shareExpires != "" {
+				var err error
+				expires, err = utils.ParseShareExpiry(shareExpires)
+				if err != nil {
+					fmt.Printf("❌ %v\n", err)
+					return
+				}
+			}
 
 			session, err := getEffectiveSession()
 			if err != nil {
@@ -564,6 +1116,26 @@ func main() {
 				return
 			}
 
+			// Shares for another Zephyrus user are sealed to their public key; no password to hand over
+			if shareTo != "" {
+				fingerprint, err := utils.ShareFileTo(args[0], shareTo, expires, session)
+				if err != nil {
+					fmt.Printf("❌ Share failed: %v\n", err)
+					return
+				}
+				if isPersistent {
+					session.Save()
+				}
+
+				fmt.Printf("\n✔ Shared %s with %s.\n", filepath.Base(args[0]), shareTo)
+				fmt.Printf("Their key fingerprint: %s (they see theirs in 'zep inbox')\n", fingerprint)
+				fmt.Printf("\nIf they have not received anything from you before, they add you once with:\n  zep inbox add %s\n", session.Username)
+				if expires > 0 {
+					fmt.Printf("\nThe share expires on %s.\n", time.Now().Add(expires).Format("2006-01-02 15:04"))
+				}
+				return
+			}
+
 			// Prompt for share password
 			sharePassword, _ := utils.GetPassword("Enter Share Password (recipients will use this to decrypt): ")
 			if sharePassword == "" {
@@ -571,7 +1143,7 @@ func main() {
 				return
 			}
 
-			shareString, err := utils.ShareFile(args[0], sharePassword, session)
+			link, err := utils.ShareFile(args[0], sharePassword, expires, session)
 			if err != nil {
 				fmt.Printf("❌ Share failed: %v\n", err)
 				return
@@ -585,26 +1157,44 @@ func main() {
 			// Extract filename for display
 			filename := filepath.Base(args[0])
 
-			fmt.Println("\n✔ File shared successfully!")
-			fmt.Printf("Filename: %s\n", filename)
-			fmt.Println("\nShare this string with recipient:")
-			fmt.Println(shareString)
-			fmt.Println("\nWeb Share Link:")
-			fmt.Printf("  https://zep.ftp.sh/shared/#%s\n", shareString)
-			fmt.Println("\nRecipient can download with:")
-			fmt.Printf("  zep download _ output.file --shared \"%s\"\n", shareString)
-
-			fmt.Println("\nOr read with:")
-			fmt.Printf("  zep read _ --shared \"%s\"\n", shareString)
+			if entry, err := session.Index.FindEntry(args[0]); err == nil && entry.Type == "folder" {
+				fmt.Println("\n✔ Folder shared successfully!")
+				fmt.Printf("Folder: %s\n", filename)
+				fmt.Println("\nShare this link with recipient:")
+				fmt.Println(link)
+				fmt.Println("\nRecipient can download the folder with:")
+				fmt.Printf("  zep download _ %s --shared \"%s\"\n", filename, link)
+
+				fmt.Println("\nOr list its files with:")
+				fmt.Printf("  zep read _ --shared \"%s\"\n", link)
+			} else {
+				fmt.Println("\n✔ File shared successfully!")
+				fmt.Printf("Filename: %s\n", filename)
+				fmt.Println("\nShare this link with recipient:")
+				fmt.Println(link)
+				fmt.Println("\nWeb Share Link:")
+				fmt.Printf("  %s\n", link.URL())
+				fmt.Println("\nRecipient can download with:")
+				fmt.Printf("  zep download _ %s --shared \"%s\"\n", filename, link)
+
+				fmt.Println("\nOr read with:")
+				fmt.Printf("  zep read _ --shared \"%s\"\n", link)
+			}
+
+			if expires > 0 {
+				fmt.Printf("\nThe link expires on %s.\n", time.Now().Add(expires).Format("2006-01-02 15:04"))
+			}
 		},
 	}
+	shareCmd.Flags().StringVar(&shareExpires, "expires", "", "Stop the link from working after this long (e.g. 12h, 7d, 2w)")
+	shareCmd.Flags().StringVar(&shareTo, "to", "", "Share with another Zephyrus user through their inbox instead of a link")
 
 	// --- READ ---
 	var readSharedFlag string
 	var readCmd = &cobra.Command{
 		Use:     "read [vault-path]",
 		Aliases: []string{"cat"},
-		Short:   "Read and display file content (no download)",
+		Short:   "Read and display file content (no download), or list a shared folder",
 		Args:    cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			// Check if reading a shared file
@@ -630,7 +1220,7 @@ func main() {
 			}
 		},
 	}
-	readCmd.Flags().StringVar(&readSharedFlag, "shared", "", "Read a shared file using share string (username:storage_id:key)")
+	readCmd.Flags().StringVar(&readSharedFlag, "shared", "", "Read a shared file, or list a shared folder, using a share link or web share URL")
 
 	// --- SHARED MANAGEMENT ---
 	var sharedCmd = &cobra.Command{
@@ -654,61 +1244,29 @@ Examples:
   zep shared search report         # Same as find (alias)`,
 		Args: cobra.MaximumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			session, err := getEffectiveSession()
-			if err != nil {
-				fmt.Printf("❌ Authentication failed: %v\n", err)
-				return
-			}
-
-			// If no arguments, list all shared files
-			if len(args) == 0 {
-				files := utils.ListSharedFiles(session)
-				if len(files) == 0 {
-					fmt.Println("No shared files.")
-					return
-				}
-
-				fmt.Println("\n📤 SHARED FILES")
-				fmt.Println("REFERENCE  FILE NAME              SHARED AT")
-				fmt.Println("---------  ----------              ---------")
-				for _, f := range files {
-					fmt.Printf("%-9s %-24s %s\n", f.Reference, f.OriginalPath, f.SharedAt.Format("2006-01-02 15:04"))
-				}
-				fmt.Println()
+			format, ok := parseOutput()
+			if !ok {
 				return
 			}
-
-			// If argument provided, search by name
-			nameQuery := args[0]
-			matches, err := utils.FindSharedFilesByName(nameQuery, session)
+			session, err := getEffectiveSession()
 			if err != nil {
-				fmt.Printf("❌ %v\n", err)
+				fmt.Fprintf(os.Stderr, "❌ Authentication failed: %v\n", err)
 				return
 			}
 
-			if len(matches) == 0 {
-				fmt.Printf("❌ No shared files found matching '%s'\n", nameQuery)
-				return
+			// Without arguments every shared file is listed
+			nameQuery := ""
+			if len(args) > 0 {
+				nameQuery = args[0]
 			}
-
-			fmt.Printf("\n📂 Found %d match(es) for '%s':\n\n", len(matches), nameQuery)
-			for i, match := range matches {
-				fmt.Printf("[%d] %s\n", i+1, match.FileName)
-				fmt.Printf("    Vault Path: %s\n", match.OriginalPath)
-				fmt.Printf("    Reference:  %s\n", match.Reference)
-				fmt.Printf("    Match Type: ")
-				if match.MatchScore == 0 {
-					fmt.Println("Exact match")
-				} else if match.MatchScore < 50 {
-					fmt.Println("Prefix match")
-				} else {
-					fmt.Println("Substring match")
-				}
-				fmt.Println()
+			if err := utils.PrintSharedFilesFormatted(nameQuery, session, format); err != nil {
+				fmt.Fprintf(os.Stderr, "❌ %v\n", err)
 			}
 		},
 	}
+	sharedLsCmd.Flags().StringVarP(&output, "output", "o", utils.OutputTable, outputUsage)
 
+	var revokeRotate bool
 	var sharedRmCmd = &cobra.Command{
 		Use:     "rm [reference-or-name]",
 		Aliases: []string{"revoke", "delete", "remove"},
@@ -724,7 +1282,11 @@ Fuzzy matching is supported for file names:
   - Prefix match: "report"
   - Substring match: "port.pdf"
 
-If multiple files match a name, you'll be prompted to be more specific.`,
+If multiple files match a name, you'll be prompted to be more specific.
+
+The share pointer is deleted from the vault, so the link stops working. Use
+--rotate to also re-encrypt the file with a new key, for when someone may have
+kept the file key from the link; other shares of the file get the new key.`,
 		Args: cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			session, err := getEffectiveSession()
@@ -774,55 +1336,225 @@ If multiple files match a name, you'll be prompted to be more specific.`,
 				return
 			}
 
-			err = utils.RevokeSharedFile(reference, session)
+			err = utils.RevokeSharedFile(reference, revokeRotate, session)
 			if err != nil {
 				fmt.Printf("❌ Revoke failed: %v\n", err)
 				return
 			}
 
 			// Save updated session if persistent
-			_, statErr := os.Stat("zephyrus.conf")
-			if statErr == nil {
+			if utils.IsConnected() {
 				session.Save()
 			}
 
 			fmt.Printf("✔ Shared file '%s' revoked.\n", displayName)
 		},
 	}
+	sharedRmCmd.Flags().BoolVar(&revokeRotate, "rotate", false, "Re-encrypt the file with a new key so the old key from the link is useless")
 
 	var sharedInfoCmd = &cobra.Command{
 		Use:   "info [reference]",
 		Short: "Show info about a shared file",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
+			format, ok := parseOutput()
+			if !ok {
+				return
+			}
+			session, err := getEffectiveSession()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "❌ Authentication failed: %v\n", err)
+				return
+			}
+
+			entry, err := utils.GetSharedFileInfo(args[0], session)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+				return
+			}
+			if err := utils.PrintSharedFileInfo(entry, session, format); err != nil {
+				fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			}
+		},
+	}
+	sharedInfoCmd.Flags().StringVarP(&output, "output", "o", utils.OutputTable, outputUsage)
+
+	var sharedPruneCmd = &cobra.Command{
+		Use:   "prune",
+		Short: "Delete all expired shares",
+		Long: `Remove every share whose expiry (set with 'zep share --expires') has passed.
+Their pointers and shared index entries are deleted in one commit.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			isPersistent := utils.IsConnected()
+
 			session, err := getEffectiveSession()
 			if err != nil {
 				fmt.Printf("❌ Authentication failed: %v\n", err)
 				return
 			}
 
-			reference := args[0]
-			entry, err := utils.GetSharedFileInfo(reference, session)
+			pruned, err := utils.PruneExpiredShares(session)
+			if err != nil {
+				fmt.Printf("❌ Prune failed: %v\n", err)
+				return
+			}
+			if len(pruned) == 0 {
+				fmt.Println("No expired shares.")
+				return
+			}
+
+			if isPersistent {
+				session.Save()
+			}
+
+			for _, entry := range pruned {
+				fmt.Printf("  - %-9s %s (expired %s)\n", entry.Reference, entry.OriginalPath, entry.ExpiresAt.Local().Format("2006-01-02 15:04"))
+			}
+			fmt.Printf("✔ Pruned %d expired share(s).\n", len(pruned))
+		},
+	}
+
+	sharedCmd.AddCommand(sharedLsCmd, sharedRmCmd, sharedInfoCmd, sharedPruneCmd)
+
+	// --- INBOX ---
+	var inboxCmd = &cobra.Command{
+		Use:   "inbox",
+		Short: "List files other Zephyrus users shared with you",
+		Long: `List the files other Zephyrus users shared with you using 'zep share --to'.
+
+The first run publishes this vault's public key (.config/pubkey), which
+others need to share with you. Your inbox checks the vaults you added
+with 'zep inbox add <user>'.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			session, err := getEffectiveSession()
+			if err != nil {
+				fmt.Printf("❌ Authentication failed: %v\n", err)
+				return
+			}
+
+			pub, created, err := utils.EnsureKeyPair(session)
 			if err != nil {
 				fmt.Printf("❌ %v\n", err)
 				return
 			}
+			if created {
+				fmt.Printf("✔ Published your public key. Others can now share with you: zep share <path> --to %s\n", session.Username)
+			}
+			fmt.Printf("Your key fingerprint: %s\n", utils.KeyFingerprint(pub))
 
-			// Encode filename to base64 for share string
-			encodedFilename := base64.StdEncoding.EncodeToString([]byte(entry.Name))
-			shareString := fmt.Sprintf("%s:%s:%s:%s", session.Username, entry.Reference, entry.Password, encodedFilename)
+			senders, err := utils.InboxSenders(session)
+			if err != nil {
+				fmt.Printf("❌ %v\n", err)
+				return
+			}
+			if len(senders) == 0 {
+				fmt.Println("\nYour inbox does not check any vaults yet. Add a sender with: zep inbox add <user>")
+				return
+			}
 
-			fmt.Printf("\n📄 SHARED FILE INFO\n")
-			fmt.Printf("Reference:     %s\n", entry.Reference)
-			fmt.Printf("File Name:     %s\n", entry.OriginalPath)
-			fmt.Printf("Shared At:     %s\n", entry.SharedAt.Format("2006-01-02 15:04:05"))
-			fmt.Printf("Password:      %s\n", entry.Password)
-			fmt.Printf("\nShare String:  %s\n", shareString)
-			fmt.Printf("\nWeb Share Link: https://zep.ftp.sh/shared/#%s\n\n", shareString)
+			items, warnings, err := utils.ListInbox(session)
+			if err != nil {
+				fmt.Printf("❌ %v\n", err)
+				return
+			}
+			if len(items) == 0 {
+				fmt.Printf("\nNo shares in your inbox (checking: %s).\n", strings.Join(senders, ", "))
+			} else {
+				fmt.Println("\n📥 INBOX")
+				fmt.Println("ID                    NAME                     SHARED AT         EXPIRES")
+				fmt.Println("--                    ----                     ---------         -------")
+				for _, item := range items {
+					fmt.Printf("%-21s %-24s %-17s %s\n", item.ID, item.Name, item.SharedAt.Local().Format("2006-01-02 15:04"), item.ExpiryString())
+				}
+				fmt.Println("\nRead with 'zep inbox read <id>', or copy into your vault with 'zep inbox import <id> [vault-path]'.")
+			}
+			for _, warning := range warnings {
+				fmt.Printf("⚠️  Could not check %s\n", warning)
+			}
 		},
 	}
 
-	sharedCmd.AddCommand(sharedLsCmd, sharedRmCmd, sharedInfoCmd)
+	var inboxAddCmd = &cobra.Command{
+		Use:   "add [username]",
+		Short: "Check another user's vault for files they share with you",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			session, err := getEffectiveSession()
+			if err != nil {
+				fmt.Printf("❌ Authentication failed: %v\n", err)
+				return
+			}
+
+			added, err := utils.AddInboxSender(args[0], session)
+			if err != nil {
+				fmt.Printf("❌ %v\n", err)
+				return
+			}
+			if !added {
+				fmt.Printf("Your inbox already checks %s.\n", args[0])
+				return
+			}
+			fmt.Printf("✔ Your inbox now checks %s.\n", args[0])
+		},
+	}
+
+	var inboxReadCmd = &cobra.Command{
+		Use:     "read [id]",
+		Aliases: []string{"cat"},
+		Short:   "Display a file from your inbox, or list a shared folder",
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			session, err := getEffectiveSession()
+			if err != nil {
+				fmt.Printf("❌ Authentication failed: %v\n", err)
+				return
+			}
+
+			item, err := utils.FindInboxItem(args[0], session)
+			if err != nil {
+				fmt.Printf("❌ %v\n", err)
+				return
+			}
+			if err := utils.ReadSharedFile(item.Link.String()); err != nil {
+				fmt.Printf("❌ Read failed: %v\n", err)
+			}
+		},
+	}
+
+	var inboxImportCmd = &cobra.Command{
+		Use:   "import [id] [vault-path]",
+		Short: "Copy a file or folder from your inbox into your vault",
+		Long: `Copy a share from your inbox into your own vault, re-encrypted with new keys.
+The copy stays when the sender revokes the share. Without vault-path it is
+imported to inbox/<sender>/<name>.`,
+		Args: cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			isPersistent := utils.IsConnected()
+			session, err := getEffectiveSession()
+			if err != nil {
+				fmt.Printf("❌ Authentication failed: %v\n", err)
+				return
+			}
+
+			vaultPath := ""
+			if len(args) > 1 {
+				vaultPath = args[1]
+			}
+			imported, count, err := utils.ImportInboxItem(args[0], vaultPath, session)
+			if err != nil {
+				fmt.Printf("❌ Import failed: %v\n", err)
+				return
+			}
+			if isPersistent {
+				session.Save()
+			}
+			fmt.Printf("✔ Imported %d file(s) to %s\n", count, imported)
+		},
+	}
+
+	inboxCmd.AddCommand(inboxAddCmd, inboxReadCmd, inboxImportCmd)
 
 	// --- SETTINGS MANAGEMENT ---
 	var settingsCmd = &cobra.Command{
@@ -902,15 +1634,14 @@ If multiple files match a name, you'll be prompted to be more specific.`,
 			}
 
 			// Save settings to remote vault
-			err = utils.SaveSettings(session.Username, session.Password, session.RawKey, session.Settings)
+			err = utils.SaveSettings(session)
 			if err != nil {
 				fmt.Printf("❌ Failed to save settings: %v\n", err)
 				return
 			}
 
 			// Save updated session if persistent
-			_, statErr := os.Stat("zephyrus.conf")
-			if statErr == nil {
+			if utils.IsConnected() {
 				session.Save()
 			}
 
@@ -920,6 +1651,63 @@ If multiple files match a name, you'll be prompted to be more specific.`,
 
 	settingsCmd.AddCommand(settingsInfoCmd, settingsSetCmd)
 
+	// --- CACHE ---
+	var cacheCmd = &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the local cache of encrypted vault objects",
+		Long: `Files read from the vault are cached on this computer, still encrypted, so
+reading them again does not download them again. The cache is kept in
+$ZEPHYRUS_CACHE_DIR (default: the user cache directory) and trimmed to
+$ZEPHYRUS_CACHE_SIZE (default 512M; 0 turns it off), least recently used first.`,
+	}
+
+	var cacheStatsCmd = &cobra.Command{
+		Use:   "stats",
+		Short: "Show the size and location of the cache",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			stats, err := utils.GetCacheStats()
+			if err != nil {
+				fmt.Printf("❌ %v\n", err)
+				return
+			}
+
+			fmt.Println("\n🗄️  OBJECT CACHE")
+			fmt.Println("─────────────────────────────────────────")
+			fmt.Printf("Location:       %s\n", stats.Dir)
+			fmt.Printf("Objects:        %d\n", stats.Objects)
+			fmt.Printf("Commit Trees:   %d\n", stats.Trees)
+			if stats.Limit == 0 {
+				fmt.Printf("Size:           %s (cache disabled)\n", utils.FormatSize(stats.Size))
+			} else {
+				fmt.Printf("Size:           %s of %s\n", utils.FormatSize(stats.Size), utils.FormatSize(stats.Limit))
+			}
+			if !stats.Oldest.IsZero() {
+				fmt.Printf("Least Recent:   %s\n", stats.Oldest.Format("2006-01-02 15:04"))
+			}
+			if stats.Hits+stats.Misses > 0 {
+				fmt.Printf("This Session:   %d hit(s), %d miss(es)\n", stats.Hits, stats.Misses)
+			}
+			fmt.Println("─────────────────────────────────────────")
+		},
+	}
+
+	var cacheClearCmd = &cobra.Command{
+		Use:   "clear",
+		Short: "Delete everything in the cache",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			count, size, err := utils.ClearCache()
+			if err != nil {
+				fmt.Printf("❌ %v\n", err)
+				return
+			}
+			fmt.Printf("✔ Cleared %d cached file(s) (%s)\n", count, utils.FormatSize(size))
+		},
+	}
+
+	cacheCmd.AddCommand(cacheStatsCmd, cacheClearCmd)
+
 	// --- INFO ---
 	var infoCmd = &cobra.Command{
 		Use:   "info [file-path]",
@@ -934,28 +1722,34 @@ Examples:
   zep info documents/file.pdf # Show file information`,
 		Args: cobra.MaximumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			// 1. Check if the config file exists BEFORE starting
-			_, err := os.Stat("zephyrus.conf")
-			isPersistent := err == nil
+			format, ok := parseOutput()
+			if !ok {
+				return
+			}
+			// 1. Check if a persistent session exists BEFORE starting
+			isPersistent := utils.IsConnected()
 
 			session, err := getEffectiveSession()
 			if err != nil {
-				fmt.Printf("❌ Authentication failed: %v\n", err)
+				fmt.Fprintf(os.Stderr, "❌ Authentication failed: %v\n", err)
 				return
 			}
 
 			if len(args) == 0 {
 				// Show general vault information
-				utils.PrintVaultInfo(session)
+				err = utils.PrintVaultInfo(session, format)
 			} else {
 				// Show specific file information
 				filePath := args[0]
 				fileInfo, err := utils.GetFileInfo(filePath, session)
 				if err != nil {
-					fmt.Printf("❌ Failed to get file info: %v\n", err)
+					fmt.Fprintf(os.Stderr, "❌ Failed to get file info: %v\n", err)
 					return
 				}
-				utils.PrintFileInfo(fileInfo)
+				err = utils.PrintFileInfo(fileInfo, format)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "❌ %v\n", err)
 			}
 
 			// Save session if persistent
@@ -964,6 +1758,89 @@ Examples:
 			}
 		},
 	}
+	infoCmd.Flags().StringVarP(&output, "output", "o", utils.OutputTable, outputUsage)
+
+	// --- HISTORY ---
+	var historyCmd = &cobra.Command{
+		Use:     "history [vault-path]",
+		Aliases: []string{"versions"},
+		Short:   "List previous versions of a file",
+		Long: `List every stored version of a file, found by walking the vault's git history.
+
+Versions are numbered from 1 (the oldest). Use the number with 'zep restore'.
+
+Examples:
+  zep history documents/report.pdf`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			isPersistent := utils.IsConnected()
+
+			session, err := getEffectiveSession()
+			if err != nil {
+				fmt.Printf("❌ Authentication failed: %v\n", err)
+				return
+			}
+
+			versions, err := utils.GetFileHistory(args[0], session)
+			if err != nil {
+				fmt.Printf("❌ Failed to load history: %v\n", err)
+				return
+			}
+			utils.PrintFileHistory(args[0], versions)
+
+			if isPersistent {
+				session.Save()
+			}
+		},
+	}
+
+	// --- RESTORE ---
+	var restoreVersion int
+	var restoreTo string
+	var restoreCmd = &cobra.Command{
+		Use:   "restore [vault-path]",
+		Short: "Restore a previous version of a file",
+		Long: `Restore a previous version of a file (see 'zep history' for version numbers).
+
+Without --to, the old version becomes the current version in the vault.
+With --to, it is decrypted to a local file and the vault is left unchanged.
+
+Examples:
+  zep restore documents/report.pdf --version 2
+  zep restore documents/report.pdf --version 2 --to ./report-v2.pdf`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if restoreVersion < 1 {
+				fmt.Println("❌ Please specify a version with --version (see 'zep history')")
+				return
+			}
+
+			isPersistent := utils.IsConnected()
+
+			session, err := getEffectiveSession()
+			if err != nil {
+				fmt.Printf("❌ Authentication failed: %v\n", err)
+				return
+			}
+
+			err = utils.RestoreFileVersion(args[0], restoreVersion, restoreTo, session)
+			if err != nil {
+				fmt.Printf("❌ Restore failed: %v\n", err)
+				return
+			}
+
+			if isPersistent {
+				session.Save()
+			}
+			if restoreTo != "" {
+				fmt.Printf("✔ Version %d saved to %s.\n", restoreVersion, restoreTo)
+			} else {
+				fmt.Printf("✔ Version %d restored.\n", restoreVersion)
+			}
+		},
+	}
+	restoreCmd.Flags().IntVar(&restoreVersion, "version", 0, "Version number to restore (from 'zep history')")
+	restoreCmd.Flags().StringVar(&restoreTo, "to", "", "Save the version to a local path instead of restoring it in the vault")
 
 	// --- SHELL ---
 	var shellCmd = &cobra.Command{
@@ -1005,16 +1882,15 @@ Examples:
 	}
 
 	rootCmd.AddCommand(
-		setupCmd, connectCmd, resetPasswordCmd, transferVaultCmd, disconnectCmd,
-		uploadCmd, downloadCmd, deleteCmd,
-		listCmd, searchCmd, purgeCmd, shareCmd, readCmd, sharedCmd, settingsCmd, infoCmd,
+		setupCmd, connectCmd, lockCmd, agentCmd, resetPasswordCmd, upgradeKDFCmd, transferVaultCmd, disconnectCmd,
+		uploadCmd, downloadCmd, deleteCmd, mvCmd, cpCmd, syncCmd,
+		listCmd, searchCmd, purgeCmd, compactCmd, fsckCmd, gcCmd, verifyCmd, shareCmd, readCmd, sharedCmd, inboxCmd, settingsCmd, cacheCmd, infoCmd,
+		historyCmd, restoreCmd,
 		locallsCmd, localdirCmd,
 		shellCmd,
 	)
 
-	if err := rootCmd.Execute(); err != nil {
-		os.Exit(1)
-	}
+	return rootCmd
 }
 
 func resetTerminal() {
@@ -1093,13 +1969,36 @@ func runInteractiveShell(rootCmd *cobra.Command) {
 			break
 		}
 
-		// Handle commands
-		args := strings.Fields(input)
-		rootCmd.SetArgs(args)
+		runShellLine(rootCmd, input)
+	}
+}
+
+// runShellLine runs one command typed in the interactive shell
+func runShellLine(rootCmd *cobra.Command, input string) {
+	// Flags keep their value between commands, so a flag given to one
+	// command (e.g. gc --apply) would carry over to the next. The user and
+	// backend the shell was started with describe its session and stay.
+	user, backend := username, backendSpec
+	resetFlags(rootCmd)
+	username, backendSpec = user, backend
 
-		// We capture the error here so a failed command doesn't kill the shell
-		if cmdErr := rootCmd.Execute(); cmdErr != nil {
-			fmt.Printf("❌ Error: %v\n", cmdErr)
-		}
+	rootCmd.SetArgs(strings.Fields(input))
+
+	// We capture the error here so a failed command doesn't kill the shell
+	if cmdErr := rootCmd.Execute(); cmdErr != nil {
+		fmt.Printf("❌ Error: %v\n", cmdErr)
+	}
+}
+
+// resetFlags returns every flag of cmd and its subcommands to its default
+func resetFlags(cmd *cobra.Command) {
+	reset := func(f *pflag.Flag) {
+		f.Value.Set(f.DefValue)
+		f.Changed = false
+	}
+	cmd.PersistentFlags().VisitAll(reset)
+	cmd.Flags().VisitAll(reset)
+	for _, sub := range cmd.Commands() {
+		resetFlags(sub)
 	}
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"zep/utils"
+)
+
+func TestShellResetsFlagsBetweenCommands(t *testing.T) {
+	t.Setenv("ZEPHYRUS_CONFIG_DIR", t.TempDir())
+	t.Setenv("ZEPHYRUS_CACHE_DIR", t.TempDir())
+
+	dir := filepath.Join(t.TempDir(), "vault")
+	backend, err := utils.NewLocalBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	encryptedKey, err := utils.Encrypt([]byte("ssh key"), "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := utils.CommitInfo{Message: "setup", AuthorName: "Test", AuthorEmail: "test@example.com"}
+	if err := backend.Reset(map[string][]byte{".config/key": encryptedKey}, info); err != nil {
+		t.Fatal(err)
+	}
+
+	// As if the shell was started with --user and --backend
+	rootCmd := newRootCmd()
+	username, backendSpec = "test", "local:"+dir
+	utils.SetBackendSpec(backendSpec)
+	session, err := utils.FetchSessionStateless(username, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.SetGlobalSession(session)
+	t.Cleanup(func() { utils.SetGlobalSession(nil) })
+
+	runShellLine(rootCmd, "gc --apply")
+
+	// An object nothing refers to appears; a plain gc must only report it
+	head, err := backend.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.WriteBatch(utils.Batch{Files: map[string][]byte{"bb22": []byte("orphan")}, Commit: info, Parent: head}); err != nil {
+		t.Fatal(err)
+	}
+	runShellLine(rootCmd, "gc")
+
+	stored, err := backend.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(stored, "bb22") {
+		t.Fatalf("a plain gc after gc --apply removed the orphan; stored: %v", stored)
+	}
+	if backendSpec != "local:"+dir || username != "test" {
+		t.Errorf("the shell's session flags were reset: backend %q, user %q", backendSpec, username)
+	}
+}
@@ -0,0 +1,421 @@
+/**
+ * Argon2id key derivation (RFC 9106) for Zephyrus pages
+ * WebCrypto has no Argon2, so this is a plain JavaScript implementation,
+ * including the BLAKE2b hash (RFC 7693) it is built on. 64-bit words are
+ * stored as pairs of 32-bit halves, low half first.
+ */
+
+const ARGON2 = {
+    VERSION: 0x13,
+    TYPE_ID: 2,
+    BLOCK_WORDS: 256, // 1024-byte blocks as 32-bit halves
+    SYNC_POINTS: 4,
+
+    BLAKE2B_IV: new Uint32Array([
+        0xf3bcc908, 0x6a09e667, 0x84caa73b, 0xbb67ae85,
+        0xfe94f82b, 0x3c6ef372, 0x5f1d36f1, 0xa54ff53a,
+        0xade682d1, 0x510e527f, 0x2b3e6c1f, 0x9b05688c,
+        0xfb41bd6b, 0x1f83d9ab, 0x137e2179, 0x5be0cd19
+    ]),
+
+    BLAKE2B_SIGMA: [
+        [0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15],
+        [14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3],
+        [11, 8, 12, 0, 5, 2, 15, 13, 10, 14, 3, 6, 7, 1, 9, 4],
+        [7, 9, 3, 1, 13, 12, 11, 14, 2, 6, 5, 10, 4, 0, 15, 8],
+        [9, 0, 5, 7, 2, 4, 10, 15, 14, 1, 11, 12, 6, 8, 3, 13],
+        [2, 12, 6, 10, 0, 11, 8, 3, 4, 13, 7, 5, 15, 14, 1, 9],
+        [12, 5, 1, 15, 14, 13, 4, 10, 0, 7, 6, 3, 9, 2, 8, 11],
+        [13, 11, 7, 14, 12, 1, 3, 9, 5, 0, 15, 4, 8, 6, 2, 10],
+        [6, 15, 14, 9, 11, 3, 0, 8, 12, 2, 13, 7, 1, 4, 10, 5],
+        [10, 2, 8, 4, 7, 6, 1, 5, 15, 11, 9, 14, 3, 12, 13, 0],
+        [0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15],
+        [14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3]
+    ],
+
+    /**
+     * Derive a key the same way as the CLI's argon2.IDKey
+     * (no secret, no associated data)
+     */
+    deriveKey(password, salt, time, memory, threads, keyLength) {
+        const lanes = threads;
+        const laneLength = Math.floor(memory / (this.SYNC_POINTS * lanes)) * this.SYNC_POINTS;
+        const segmentLength = laneLength / this.SYNC_POINTS;
+        const blockCount = laneLength * lanes;
+        const memoryBlocks = new Uint32Array(blockCount * this.BLOCK_WORDS);
+
+        // H0 over the parameters, password and salt
+        const h0Input = this.concat(
+            this.le32(lanes), this.le32(keyLength), this.le32(memory), this.le32(time),
+            this.le32(this.VERSION), this.le32(this.TYPE_ID),
+            this.le32(password.length), password,
+            this.le32(salt.length), salt,
+            this.le32(0), this.le32(0)
+        );
+        const h0 = this.blake2b(h0Input, 64);
+
+        // The first two blocks of each lane
+        for (let lane = 0; lane < lanes; lane++) {
+            for (let i = 0; i < 2; i++) {
+                const block = this.hashLong(this.concat(h0, this.le32(i), this.le32(lane)), 1024);
+                this.bytesToWords(block, memoryBlocks, (lane * laneLength + i) * this.BLOCK_WORDS);
+            }
+        }
+
+        const ctx = {
+            memoryBlocks, lanes, laneLength, segmentLength, blockCount, time,
+            scratch: new Uint32Array(this.BLOCK_WORDS),
+            tmp: new Uint32Array(this.BLOCK_WORDS),
+            zero: new Uint32Array(this.BLOCK_WORDS),
+            input: new Uint32Array(this.BLOCK_WORDS),
+            addresses: new Uint32Array(this.BLOCK_WORDS)
+        };
+        for (let pass = 0; pass < time; pass++) {
+            for (let slice = 0; slice < this.SYNC_POINTS; slice++) {
+                for (let lane = 0; lane < lanes; lane++) {
+                    this.fillSegment(ctx, pass, lane, slice);
+                }
+            }
+        }
+
+        // XOR of the last block of every lane, hashed to the key length
+        const final = memoryBlocks.slice((laneLength - 1) * this.BLOCK_WORDS, laneLength * this.BLOCK_WORDS);
+        for (let lane = 1; lane < lanes; lane++) {
+            const offset = (lane * laneLength + laneLength - 1) * this.BLOCK_WORDS;
+            for (let i = 0; i < this.BLOCK_WORDS; i++) {
+                final[i] ^= memoryBlocks[offset + i];
+            }
+        }
+        return this.hashLong(this.wordsToBytes(final), keyLength);
+    },
+
+    fillSegment(ctx, pass, lane, slice) {
+        const { memoryBlocks, lanes, laneLength, segmentLength } = ctx;
+        const W = this.BLOCK_WORDS;
+        const independent = pass === 0 && slice < this.SYNC_POINTS / 2;
+
+        if (independent) {
+            ctx.input.fill(0);
+            ctx.input[0] = pass;
+            ctx.input[2] = lane;
+            ctx.input[4] = slice;
+            ctx.input[6] = ctx.blockCount;
+            ctx.input[8] = ctx.time;
+            ctx.input[10] = this.TYPE_ID;
+        }
+
+        let start = 0;
+        if (pass === 0 && slice === 0) {
+            start = 2;
+            if (independent) {
+                this.nextAddresses(ctx);
+            }
+        }
+
+        let current = lane * laneLength + slice * segmentLength + start;
+        let previous = current % laneLength === 0 ? current + laneLength - 1 : current - 1;
+
+        for (let index = start; index < segmentLength; index++, current++, previous++) {
+            if (current % laneLength === 1) {
+                previous = current - 1;
+            }
+
+            let j1, j2;
+            if (independent) {
+                if (index % 128 === 0) {
+                    this.nextAddresses(ctx);
+                }
+                j1 = ctx.addresses[(index % 128) * 2];
+                j2 = ctx.addresses[(index % 128) * 2 + 1];
+            } else {
+                j1 = memoryBlocks[previous * W];
+                j2 = memoryBlocks[previous * W + 1];
+            }
+
+            let refLane = j2 % lanes;
+            if (pass === 0 && slice === 0) {
+                refLane = lane;
+            }
+            const sameLane = refLane === lane;
+
+            // Size of the area the reference block is picked from
+            let areaSize;
+            if (pass === 0) {
+                if (slice === 0) {
+                    areaSize = index - 1;
+                } else if (sameLane) {
+                    areaSize = slice * segmentLength + index - 1;
+                } else {
+                    areaSize = slice * segmentLength + (index === 0 ? -1 : 0);
+                }
+            } else if (sameLane) {
+                areaSize = laneLength - segmentLength + index - 1;
+            } else {
+                areaSize = laneLength - segmentLength + (index === 0 ? -1 : 0);
+            }
+
+            const x = this.mulHigh(j1, j1);
+            const y = this.mulHigh(areaSize, x);
+            const relative = areaSize - 1 - y;
+            const startPosition = pass !== 0 && slice !== this.SYNC_POINTS - 1 ? (slice + 1) * segmentLength : 0;
+            const refIndex = (startPosition + relative) % laneLength;
+            const reference = refLane * laneLength + refIndex;
+
+            this.fillBlock(ctx, memoryBlocks, previous * W, memoryBlocks, reference * W, memoryBlocks, current * W, pass !== 0);
+        }
+    },
+
+    /**
+     * The next block of pseudo-random addresses for data-independent indexing
+     */
+    nextAddresses(ctx) {
+        // Increment the 64-bit counter in word 6
+        ctx.input[12] = (ctx.input[12] + 1) >>> 0;
+        if (ctx.input[12] === 0) {
+            ctx.input[13] = (ctx.input[13] + 1) >>> 0;
+        }
+        this.fillBlock(ctx, ctx.zero, 0, ctx.input, 0, ctx.addresses, 0, false);
+        this.fillBlock(ctx, ctx.zero, 0, ctx.addresses, 0, ctx.addresses, 0, false);
+    },
+
+    /**
+     * next = G(prev, ref), XORed into the existing block from the second pass on
+     */
+    fillBlock(ctx, prevBuf, prevOffset, refBuf, refOffset, nextBuf, nextOffset, withXor) {
+        const W = this.BLOCK_WORDS;
+        const r = ctx.scratch;
+        const tmp = ctx.tmp;
+        for (let i = 0; i < W; i++) {
+            r[i] = prevBuf[prevOffset + i] ^ refBuf[refOffset + i];
+        }
+        for (let i = 0; i < W; i++) {
+            tmp[i] = withXor ? r[i] ^ nextBuf[nextOffset + i] : r[i];
+        }
+
+        // Rows: 8 groups of 16 consecutive 64-bit words
+        for (let i = 0; i < 8; i++) {
+            const b = i * 32;
+            this.permute(r, b, b + 2, b + 4, b + 6, b + 8, b + 10, b + 12, b + 14,
+                b + 16, b + 18, b + 20, b + 22, b + 24, b + 26, b + 28, b + 30);
+        }
+        // Columns: word pairs 2i, 2i+1 of every row
+        for (let i = 0; i < 8; i++) {
+            const b = i * 4;
+            this.permute(r, b, b + 2, b + 32, b + 34, b + 64, b + 66, b + 96, b + 98,
+                b + 128, b + 130, b + 160, b + 162, b + 192, b + 194, b + 224, b + 226);
+        }
+
+        for (let i = 0; i < W; i++) {
+            nextBuf[nextOffset + i] = tmp[i] ^ r[i];
+        }
+    },
+
+    /**
+     * The BLAKE2b round with multiplications (BlaMka) over 16 words
+     */
+    permute(v, v0, v1, v2, v3, v4, v5, v6, v7, v8, v9, v10, v11, v12, v13, v14, v15) {
+        this.gb(v, v0, v4, v8, v12);
+        this.gb(v, v1, v5, v9, v13);
+        this.gb(v, v2, v6, v10, v14);
+        this.gb(v, v3, v7, v11, v15);
+        this.gb(v, v0, v5, v10, v15);
+        this.gb(v, v1, v6, v11, v12);
+        this.gb(v, v2, v7, v8, v13);
+        this.gb(v, v3, v4, v9, v14);
+    },
+
+    gb(v, a, b, c, d) {
+        this.blaMka(v, a, b);
+        this.rotr64(v, d, a, 32);
+        this.blaMka(v, c, d);
+        this.rotr64(v, b, c, 24);
+        this.blaMka(v, a, b);
+        this.rotr64(v, d, a, 16);
+        this.blaMka(v, c, d);
+        this.rotr64(v, b, c, 63);
+    },
+
+    /**
+     * v[a] = v[a] + v[b] + 2 * lo32(v[a]) * lo32(v[b]), modulo 2^64
+     */
+    blaMka(v, a, b) {
+        const al = v[a], bl = v[b];
+        const a0 = al & 0xffff, a1 = al >>> 16, b0 = bl & 0xffff, b1 = bl >>> 16;
+        const mid = a0 * b1 + a1 * b0;
+        const low = a0 * b0 + (mid % 65536) * 65536;
+        const pl = low >>> 0;
+        const ph = (a1 * b1 + Math.floor(mid / 65536) + Math.floor(low / 4294967296)) >>> 0;
+        const ml = (pl << 1) >>> 0;
+        const mh = ((ph << 1) | (pl >>> 31)) >>> 0;
+        const lo = al + bl + ml;
+        v[a] = lo;
+        v[a + 1] = v[a + 1] + v[b + 1] + mh + Math.floor(lo / 4294967296);
+    },
+
+    /**
+     * v[d] = (v[d] XOR v[a]) rotated right by n bits (24, 32, 16 or 63)
+     */
+    rotr64(v, d, a, n) {
+        const lo = v[d] ^ v[a];
+        const hi = v[d + 1] ^ v[a + 1];
+        if (n === 32) {
+            v[d] = hi;
+            v[d + 1] = lo;
+        } else if (n === 63) {
+            v[d] = (lo << 1) | (hi >>> 31);
+            v[d + 1] = (hi << 1) | (lo >>> 31);
+        } else {
+            v[d] = (lo >>> n) | (hi << (32 - n));
+            v[d + 1] = (hi >>> n) | (lo << (32 - n));
+        }
+    },
+
+    /**
+     * floor(a * b / 2^32) for 32-bit a and b, exactly
+     */
+    mulHigh(a, b) {
+        const a0 = a & 0xffff, a1 = a >>> 16, b0 = b & 0xffff, b1 = b >>> 16;
+        const mid = a0 * b1 + a1 * b0;
+        const low = a0 * b0 + (mid % 65536) * 65536;
+        return a1 * b1 + Math.floor(mid / 65536) + Math.floor(low / 4294967296);
+    },
+
+    /**
+     * The variable-length hash H' of RFC 9106
+     */
+    hashLong(input, outLength) {
+        const prefixed = this.concat(this.le32(outLength), input);
+        if (outLength <= 64) {
+            return this.blake2b(prefixed, outLength);
+        }
+        const out = new Uint8Array(outLength);
+        let v = this.blake2b(prefixed, 64);
+        out.set(v.subarray(0, 32), 0);
+        let pos = 32;
+        while (outLength - pos > 64) {
+            v = this.blake2b(v, 64);
+            out.set(v.subarray(0, 32), pos);
+            pos += 32;
+        }
+        out.set(this.blake2b(v, outLength - pos), pos);
+        return out;
+    },
+
+    /**
+     * One-shot unkeyed BLAKE2b with outLength bytes of output
+     */
+    blake2b(input, outLength) {
+        const h = new Uint32Array(this.BLAKE2B_IV);
+        h[0] ^= 0x01010000 ^ outLength;
+        const v = new Uint32Array(32);
+        const m = new Uint32Array(32);
+        const block = new Uint8Array(128);
+
+        let offset = 0;
+        for (;;) {
+            const size = Math.min(128, input.length - offset);
+            const last = offset + size === input.length;
+            block.fill(0);
+            block.set(input.subarray(offset, offset + size));
+            offset += size;
+            for (let i = 0; i < 32; i++) {
+                m[i] = block[i * 4] | (block[i * 4 + 1] << 8) | (block[i * 4 + 2] << 16) | (block[i * 4 + 3] << 24);
+            }
+            this.blake2bCompress(h, v, m, offset, last);
+            if (last) {
+                break;
+            }
+        }
+
+        const out = new Uint8Array(outLength);
+        for (let i = 0; i < outLength; i++) {
+            out[i] = h[i >> 2] >>> (8 * (i & 3));
+        }
+        return out;
+    },
+
+    blake2bCompress(h, v, m, counter, last) {
+        for (let i = 0; i < 16; i++) {
+            v[i] = h[i];
+            v[i + 16] = this.BLAKE2B_IV[i];
+        }
+        v[24] ^= counter >>> 0;
+        v[25] ^= Math.floor(counter / 4294967296);
+        if (last) {
+            v[28] = ~v[28];
+            v[29] = ~v[29];
+        }
+        for (let round = 0; round < 12; round++) {
+            const s = this.BLAKE2B_SIGMA[round];
+            this.blake2bG(v, m, 0, 8, 16, 24, s[0], s[1]);
+            this.blake2bG(v, m, 2, 10, 18, 26, s[2], s[3]);
+            this.blake2bG(v, m, 4, 12, 20, 28, s[4], s[5]);
+            this.blake2bG(v, m, 6, 14, 22, 30, s[6], s[7]);
+            this.blake2bG(v, m, 0, 10, 20, 30, s[8], s[9]);
+            this.blake2bG(v, m, 2, 12, 22, 24, s[10], s[11]);
+            this.blake2bG(v, m, 4, 14, 16, 26, s[12], s[13]);
+            this.blake2bG(v, m, 6, 8, 18, 28, s[14], s[15]);
+        }
+        for (let i = 0; i < 16; i++) {
+            h[i] ^= v[i] ^ v[i + 16];
+        }
+    },
+
+    blake2bG(v, m, a, b, c, d, x, y) {
+        this.add64(v, a, v[b], v[b + 1]);
+        this.add64(v, a, m[x * 2], m[x * 2 + 1]);
+        this.rotr64(v, d, a, 32);
+        this.add64(v, c, v[d], v[d + 1]);
+        this.rotr64(v, b, c, 24);
+        this.add64(v, a, v[b], v[b + 1]);
+        this.add64(v, a, m[y * 2], m[y * 2 + 1]);
+        this.rotr64(v, d, a, 16);
+        this.add64(v, c, v[d], v[d + 1]);
+        this.rotr64(v, b, c, 63);
+    },
+
+    add64(v, a, lo, hi) {
+        const sum = v[a] + lo;
+        v[a] = sum;
+        v[a + 1] = v[a + 1] + hi + (sum >= 4294967296 ? 1 : 0);
+    },
+
+    le32(n) {
+        return new Uint8Array([n & 0xff, (n >>> 8) & 0xff, (n >>> 16) & 0xff, (n >>> 24) & 0xff]);
+    },
+
+    concat(...parts) {
+        const out = new Uint8Array(parts.reduce((n, p) => n + p.length, 0));
+        let pos = 0;
+        for (const p of parts) {
+            out.set(p, pos);
+            pos += p.length;
+        }
+        return out;
+    },
+
+    bytesToWords(bytes, words, offset) {
+        for (let i = 0; i < bytes.length / 4; i++) {
+            words[offset + i] = bytes[i * 4] | (bytes[i * 4 + 1] << 8) | (bytes[i * 4 + 2] << 16) | (bytes[i * 4 + 3] << 24);
+        }
+    },
+
+    wordsToBytes(words) {
+        const bytes = new Uint8Array(words.length * 4);
+        for (let i = 0; i < words.length; i++) {
+            bytes[i * 4] = words[i];
+            bytes[i * 4 + 1] = words[i] >>> 8;
+            bytes[i * 4 + 2] = words[i] >>> 16;
+            bytes[i * 4 + 3] = words[i] >>> 24;
+        }
+        return bytes;
+    }
+};
+
+// Loaded as a worker by crypto.js: derive one key per message
+if (typeof WorkerGlobalScope !== 'undefined' && self instanceof WorkerGlobalScope) {
+    self.onmessage = (event) => {
+        const r = event.data;
+        self.postMessage(ARGON2.deriveKey(r.password, r.salt, r.time, r.memory, r.threads, r.keyLength));
+    };
+}
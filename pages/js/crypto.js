@@ -1,43 +1,165 @@
 /**
  * Shared cryptography utilities for Zephyrus pages
- * Provides AES-GCM encryption/decryption, PBKDF2 key derivation
+ * Provides AES-GCM encryption/decryption, PBKDF2 and Argon2id key derivation
+ * (Argon2id comes from argon2.js, which must be loaded before this file)
  */
 
+// Where argon2.js lives, so Argon2id can run in a worker off the page's thread
+const ARGON2_WORKER_URL = typeof document !== 'undefined' && document.currentScript
+    ? new URL('argon2.js', document.currentScript.src).href
+    : null;
+
 const CRYPTO = {
     SALT_SIZE: 16,
     NONCE_SIZE: 12,
+    CHUNK_PREFIX_SIZE: 7,
     ITERATIONS: 100000,
     KEY_SIZE: 256,
 
     /**
-     * Decrypt a file using a password (with PBKDF2 key derivation)
-     * Format: [Salt (16 bytes)][Nonce (12 bytes)][Ciphertext]
+     * Read the key derivation header written by the CLI:
+     * [magic "ZEPH"][version 1][KDF id 1][params][Salt][Nonce][Ciphertext]
+     * PBKDF2 params are the iteration count (uint32); Argon2id params are
+     * passes (uint32), memory in KiB (uint32) and threads (uint8), big-endian.
+     * Data without the magic is the legacy layout (PBKDF2, 100,000 iterations).
      */
-    async decryptWithPassword(encryptedData, password) {
-        const view = new Uint8Array(encryptedData);
-        const salt = view.slice(0, this.SALT_SIZE);
-        const nonce = view.slice(this.SALT_SIZE, this.SALT_SIZE + this.NONCE_SIZE);
-        const ciphertext = view.slice(this.SALT_SIZE + this.NONCE_SIZE);
+    parseHeader(view) {
+        const magic = [0x5a, 0x45, 0x50, 0x48]; // "ZEPH"
+        if (view.length < 10 || !magic.every((b, i) => view[i] === b) || view[4] !== 1) {
+            return { kdf: 1, iterations: this.ITERATIONS, offset: 0, header: null };
+        }
+        const params = new DataView(view.buffer, view.byteOffset + 6);
+        if (view[5] === 1) {
+            return { kdf: 1, iterations: params.getUint32(0), offset: 10, header: view.slice(0, 10) };
+        }
+        if (view[5] === 2 && view.length >= 15) {
+            const time = params.getUint32(0);
+            const memory = params.getUint32(4);
+            const threads = view[14];
+            // Same bounds as the CLI, so a crafted header cannot exhaust the browser
+            if (time === 0 || time > 64 || threads === 0 || memory < 8 * threads || memory > 4 * 1024 * 1024) {
+                throw new Error('Invalid Argon2id parameters');
+            }
+            return { kdf: 2, time: time, memory: memory, threads: threads, offset: 15, header: view.slice(0, 15) };
+        }
+        throw new Error('Unsupported key derivation function');
+    },
 
-        // Derive key using PBKDF2
-        const keyMaterial = await window.crypto.subtle.importKey(
-            'raw',
-            new TextEncoder().encode(password),
-            'PBKDF2',
-            false,
-            ['deriveBits']
-        );
+    /**
+     * Derive an AES key with Argon2id, in a worker when the page allows it
+     * so the page stays responsive during the few seconds it takes
+     */
+    async deriveArgon2id(password, salt, params) {
+        const request = {
+            password: new TextEncoder().encode(password),
+            salt: salt,
+            time: params.time,
+            memory: params.memory,
+            threads: params.threads,
+            keyLength: this.KEY_SIZE / 8
+        };
+        if (ARGON2_WORKER_URL && typeof Worker !== 'undefined') {
+            try {
+                return await new Promise((resolve, reject) => {
+                    const worker = new Worker(ARGON2_WORKER_URL);
+                    worker.onmessage = (event) => {
+                        worker.terminate();
+                        resolve(event.data);
+                    };
+                    worker.onerror = (event) => {
+                        worker.terminate();
+                        reject(event);
+                    };
+                    worker.postMessage(request);
+                });
+            } catch (e) {
+                console.warn('Argon2id worker unavailable, deriving on the main thread:', e);
+            }
+        }
+        return ARGON2.deriveKey(request.password, request.salt, request.time, request.memory, request.threads, request.keyLength);
+    },
 
-        const derivedBits = await window.crypto.subtle.deriveBits(
+    /**
+     * Whether a file key from the index is wrapped with the vault
+     * key-encryption key (KDF id 3) instead of the vault password
+     */
+    isVaultKeyWrapped(view) {
+        const magic = [0x5a, 0x45, 0x50, 0x48]; // "ZEPH"
+        return view.length > 6 && magic.every((b, i) => view[i] === b) && view[4] === 1 && view[5] === 3;
+    },
+
+    /**
+     * Derive the vault key-encryption key from the decrypted master key
+     * (HKDF-SHA256, no salt, info "zephyrus/file-key-wrapping/v1")
+     */
+    async deriveKEK(masterKey) {
+        const keyMaterial = await window.crypto.subtle.importKey('raw', masterKey, 'HKDF', false, ['deriveBits']);
+        const bits = await window.crypto.subtle.deriveBits(
             {
-                name: 'PBKDF2',
-                salt: salt,
-                iterations: this.ITERATIONS,
-                hash: 'SHA-256'
+                name: 'HKDF',
+                hash: 'SHA-256',
+                salt: new Uint8Array(0),
+                info: new TextEncoder().encode('zephyrus/file-key-wrapping/v1')
             },
             keyMaterial,
             this.KEY_SIZE
         );
+        return new Uint8Array(bits);
+    },
+
+    /**
+     * Unwrap a file key wrapped with the key-encryption key
+     * Format: [magic "ZEPH"][version 1][3][Nonce (12 bytes)][Ciphertext], header authenticated
+     */
+    async unwrapFileKey(view, kek) {
+        const header = view.slice(0, 6);
+        const nonce = view.slice(6, 6 + this.NONCE_SIZE);
+        const ciphertext = view.slice(6 + this.NONCE_SIZE);
+        const key = await window.crypto.subtle.importKey('raw', kek, 'AES-GCM', false, ['decrypt']);
+        const decrypted = await window.crypto.subtle.decrypt(
+            { name: 'AES-GCM', iv: nonce, additionalData: header },
+            key,
+            ciphertext
+        );
+        return new Uint8Array(decrypted);
+    },
+
+    /**
+     * Decrypt a file using a password (with PBKDF2 or Argon2id key derivation)
+     * Format: [Header][Salt (16 bytes)][Nonce (12 bytes)][Ciphertext], see parseHeader
+     */
+    async decryptWithPassword(encryptedData, password) {
+        const view = new Uint8Array(encryptedData);
+        const params = this.parseHeader(view);
+        const { offset, header } = params;
+        const salt = view.slice(offset, offset + this.SALT_SIZE);
+        const nonce = view.slice(offset + this.SALT_SIZE, offset + this.SALT_SIZE + this.NONCE_SIZE);
+        const ciphertext = view.slice(offset + this.SALT_SIZE + this.NONCE_SIZE);
+
+        let derivedBits;
+        if (params.kdf === 2) {
+            derivedBits = await this.deriveArgon2id(password, salt, params);
+        } else {
+            // Derive key using PBKDF2
+            const keyMaterial = await window.crypto.subtle.importKey(
+                'raw',
+                new TextEncoder().encode(password),
+                'PBKDF2',
+                false,
+                ['deriveBits']
+            );
+
+            derivedBits = await window.crypto.subtle.deriveBits(
+                {
+                    name: 'PBKDF2',
+                    salt: salt,
+                    iterations: params.iterations,
+                    hash: 'SHA-256'
+                },
+                keyMaterial,
+                this.KEY_SIZE
+            );
+        }
 
         const key = await window.crypto.subtle.importKey(
             'raw',
@@ -49,10 +171,7 @@ const CRYPTO = {
 
         // Decrypt using AES-GCM
         const decrypted = await window.crypto.subtle.decrypt(
-            {
-                name: 'AES-GCM',
-                iv: nonce
-            },
+            header ? { name: 'AES-GCM', iv: nonce, additionalData: header } : { name: 'AES-GCM', iv: nonce },
             key,
             ciphertext
         );
@@ -91,6 +210,63 @@ const CRYPTO = {
         return new Uint8Array(decrypted);
     },
 
+    /**
+     * Decrypt a chunked file, fetching its chunk objects one at a time in order.
+     * Each chunk is [Nonce (12 bytes)][Ciphertext] with the nonce laid out as
+     * [prefix 7][chunk index uint32][last flag 1]; the index and last flag are
+     * also the additional data, so reordered, mixed or truncated chunks fail.
+     */
+    async decryptChunks(chunkIDs, fetchChunk, keyBuffer) {
+        if (!chunkIDs.length) {
+            throw new Error('Chunked file has no chunks');
+        }
+        const key = await window.crypto.subtle.importKey('raw', keyBuffer, 'AES-GCM', false, ['decrypt']);
+
+        const parts = [];
+        let prefix = null;
+        let total = 0;
+        for (let i = 0; i < chunkIDs.length; i++) {
+            const view = new Uint8Array(await fetchChunk(chunkIDs[i]));
+            if (view.length < this.NONCE_SIZE) {
+                throw new Error(`Chunk ${i} (${chunkIDs[i]}) is too short`);
+            }
+
+            const nonce = view.slice(0, this.NONCE_SIZE);
+            const position = new Uint8Array(5);
+            new DataView(position.buffer).setUint32(0, i);
+            position[4] = i === chunkIDs.length - 1 ? 1 : 0;
+            if (!position.every((b, j) => nonce[this.CHUNK_PREFIX_SIZE + j] === b)) {
+                throw new Error(`Chunk ${i} (${chunkIDs[i]}) is out of place`);
+            }
+            if (prefix === null) {
+                prefix = nonce.slice(0, this.CHUNK_PREFIX_SIZE);
+            } else if (!prefix.every((b, j) => nonce[j] === b)) {
+                throw new Error(`Chunk ${i} (${chunkIDs[i]}) belongs to a different upload`);
+            }
+
+            let plaintext;
+            try {
+                plaintext = await window.crypto.subtle.decrypt(
+                    { name: 'AES-GCM', iv: nonce, additionalData: position },
+                    key,
+                    view.slice(this.NONCE_SIZE)
+                );
+            } catch (e) {
+                throw new Error(`Decryption failed for chunk ${i} (${chunkIDs[i]})`);
+            }
+            parts.push(new Uint8Array(plaintext));
+            total += plaintext.byteLength;
+        }
+
+        const result = new Uint8Array(total);
+        let offset = 0;
+        for (const part of parts) {
+            result.set(part, offset);
+            offset += part.length;
+        }
+        return result;
+    },
+
     /**
      * Convert a hex string to Uint8Array
      */
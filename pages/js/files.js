@@ -10,6 +10,7 @@ class FileVault {
         this.index = null;
         this.sharedIndex = null;
         this.currentPath = '';
+        this.kek = null;
         this.repoURL = `https://raw.githubusercontent.com/${username}/.zephyrus/master`;
     }
 
@@ -90,13 +91,17 @@ class FileVault {
      * Generate share link from shared entry
      */
     generateShareLink(sharedEntry) {
-        const filename = sharedEntry.name || sharedEntry.Name || '';
-        const encodedFilename = btoa(filename);
+        const name = sharedEntry.name || sharedEntry.Name || '';
         const reference = sharedEntry.reference || sharedEntry.Reference;
         const password = sharedEntry.password || sharedEntry.Password;
-        
-        // Format: username:reference:password:base64filename
-        return `${this.username}:${reference}:${password}:${encodedFilename}`;
+
+        // Same encoding as ShareLink in the CLI, see sharelink.js
+        return SHARE_LINK.encode({
+            username: this.username,
+            reference: reference,
+            password: password,
+            name: name.split('/').pop()
+        });
     }
 
     /**
@@ -157,6 +162,7 @@ class FileVault {
                                 path: this.currentPath + '/' + fileName,
                                 realName: realName,
                                 fileKey: fileKey,
+                                chunks: fileEntry.chunks || null,
                                 size: fileEntry.Size || fileEntry.size
                             });
                         }
@@ -204,6 +210,7 @@ class FileVault {
                     path: vaultPath,
                     realName: realName,
                     fileKey: fileKey,
+                    chunks: fileEntry.chunks || null,
                     size: fileEntry.Size || fileEntry.size
                 });
             } else if (parts.length > 1) {
@@ -229,6 +236,23 @@ class FileVault {
         });
     }
 
+    /**
+     * Derive the key-encryption key that wraps file keys, from the master key
+     * in .config/key (fetched and decrypted once)
+     */
+    async getKEK() {
+        if (this.kek) {
+            return this.kek;
+        }
+        const response = await fetch(`${this.repoURL}/.config/key`);
+        if (!response.ok) {
+            throw new Error(`Failed to fetch vault key (${response.status})`);
+        }
+        const masterKey = await CRYPTO.decryptWithPassword(await response.arrayBuffer(), this.password);
+        this.kek = await CRYPTO.deriveKEK(masterKey);
+        return this.kek;
+    }
+
     /**
      * Navigate to a directory
      */
@@ -245,6 +269,17 @@ class FileVault {
         this.currentPath = parts.join('/');
     }
 
+    /**
+     * Fetch one encrypted storage object from the vault
+     */
+    async fetchObject(storageID) {
+        const response = await fetch(`${this.repoURL}/${storageID}`);
+        if (!response.ok) {
+            throw new Error(`Failed to fetch ${storageID} (${response.status}). File may not exist in vault.`);
+        }
+        return response.arrayBuffer();
+    }
+
     /**
      * Download and decrypt a file
      */
@@ -252,19 +287,7 @@ class FileVault {
         try {
             console.log('Starting download for:', fileEntry.name, 'realName:', fileEntry.realName);
             
-            const fileUrl = `${this.repoURL}/${fileEntry.realName}`;
-            console.log('Fetching from URL:', fileUrl);
-            
-            const response = await fetch(fileUrl);
-
-            if (!response.ok) {
-                throw new Error(`Failed to fetch file (${response.status}). File may not exist in vault.`);
-            }
-
-            const encryptedBuffer = await response.arrayBuffer();
-            console.log('Encrypted file size:', encryptedBuffer.byteLength, 'bytes');
-            
-            // First, decrypt the file key using the vault password
+            // First, decrypt the file key (with the key-encryption key, or the vault password for older keys)
             const encryptedKeyHex = fileEntry.fileKey;
             console.log('Encrypted file key (hex):', encryptedKeyHex.substring(0, 20) + '...');
             
@@ -273,7 +296,11 @@ class FileVault {
             
             let fileKeyBuffer;
             try {
-                fileKeyBuffer = await CRYPTO.decryptWithPassword(encryptedKeyBuffer, this.password);
+                if (CRYPTO.isVaultKeyWrapped(encryptedKeyBuffer)) {
+                    fileKeyBuffer = await CRYPTO.unwrapFileKey(encryptedKeyBuffer, await this.getKEK());
+                } else {
+                    fileKeyBuffer = await CRYPTO.decryptWithPassword(encryptedKeyBuffer, this.password);
+                }
                 console.log('Decrypted file key size:', fileKeyBuffer.length, 'bytes');
             } catch (e) {
                 throw new Error(`Failed to decrypt file key: ${e.message}`);
@@ -283,8 +310,17 @@ class FileVault {
                 throw new Error(`Invalid file key length after decryption: expected 32 bytes, got ${fileKeyBuffer.length}`);
             }
             
-            // Now decrypt the file using the decrypted key
-            const decryptedBuffer = await CRYPTO.decryptWithKey(encryptedBuffer, fileKeyBuffer);
+            // Chunked files are fetched and decrypted chunk by chunk; files
+            // stored as one object are decrypted in one piece
+            let decryptedBuffer;
+            if (fileEntry.chunks && fileEntry.chunks.length > 0) {
+                console.log('Fetching', fileEntry.chunks.length, 'chunks');
+                decryptedBuffer = await CRYPTO.decryptChunks(fileEntry.chunks, id => this.fetchObject(id), fileKeyBuffer);
+            } else {
+                const encryptedBuffer = await this.fetchObject(fileEntry.realName);
+                console.log('Encrypted file size:', encryptedBuffer.byteLength, 'bytes');
+                decryptedBuffer = await CRYPTO.decryptWithKey(encryptedBuffer, fileKeyBuffer);
+            }
             console.log('Decrypted file size:', decryptedBuffer.byteLength, 'bytes');
 
             return decryptedBuffer;
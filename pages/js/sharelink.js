@@ -0,0 +1,135 @@
+/**
+ * Share links for Zephyrus pages
+ * Mirrors ShareLink in the CLI (utils/share_link.go):
+ * "zep_" + base64url([version 1][u16 len][username][u16 len][reference][u16 len][password][u16 len][name][CRC-32])
+ * Lengths are big-endian; the CRC-32 (IEEE) covers every byte before it.
+ * Older links use "username:reference:password[:base64filename]".
+ */
+
+const SHARE_LINK = {
+    PREFIX: 'zep_',
+    VERSION: 1,
+
+    /**
+     * CRC-32 (IEEE) of a Uint8Array
+     */
+    crc32(bytes) {
+        if (!this.crcTable) {
+            this.crcTable = new Uint32Array(256);
+            for (let n = 0; n < 256; n++) {
+                let c = n;
+                for (let k = 0; k < 8; k++) {
+                    c = c & 1 ? 0xedb88320 ^ (c >>> 1) : c >>> 1;
+                }
+                this.crcTable[n] = c >>> 0;
+            }
+        }
+        let crc = 0xffffffff;
+        for (const b of bytes) {
+            crc = this.crcTable[(crc ^ b) & 0xff] ^ (crc >>> 8);
+        }
+        return (crc ^ 0xffffffff) >>> 0;
+    },
+
+    /**
+     * Encode { username, reference, password, name } as a share link
+     */
+    encode({ username, reference, password, name = '' }) {
+        const encoder = new TextEncoder();
+        const fields = [username, reference, password, name].map(f => encoder.encode(f));
+        const length = 1 + fields.reduce((sum, f) => sum + 2 + f.length, 0) + 4;
+        const bytes = new Uint8Array(length);
+        const view = new DataView(bytes.buffer);
+        bytes[0] = this.VERSION;
+        let offset = 1;
+        for (const field of fields) {
+            view.setUint16(offset, field.length);
+            bytes.set(field, offset + 2);
+            offset += 2 + field.length;
+        }
+        view.setUint32(offset, this.crc32(bytes.subarray(0, offset)));
+
+        const base64 = btoa(String.fromCharCode(...bytes));
+        return this.PREFIX + base64.replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+    },
+
+    /**
+     * Parse a share link or an older share string
+     * Returns { username, reference, password, name }
+     */
+    parse(text) {
+        text = text.trim();
+        if (text.includes('%')) {
+            try {
+                text = decodeURIComponent(text);
+            } catch (e) {
+                // Keep the text as it is
+            }
+        }
+
+        const link = text.startsWith(this.PREFIX) ? this.decode(text.slice(this.PREFIX.length)) : this.parseLegacy(text);
+        if (!link.username || !link.reference || !link.password) {
+            throw new Error('Invalid share link - missing components.');
+        }
+        return link;
+    },
+
+    decode(encoded) {
+        let base64 = encoded.replace(/-/g, '+').replace(/_/g, '/');
+        base64 += '='.repeat((4 - base64.length % 4) % 4);
+        let bytes;
+        try {
+            bytes = Uint8Array.from(atob(base64), c => c.charCodeAt(0));
+        } catch (e) {
+            throw new Error('Invalid share link encoding.');
+        }
+        if (bytes.length < 5) {
+            throw new Error('Invalid share link - too short.');
+        }
+
+        const view = new DataView(bytes.buffer);
+        const end = bytes.length - 4;
+        if (this.crc32(bytes.subarray(0, end)) !== view.getUint32(end)) {
+            throw new Error('Invalid share link - checksum mismatch, the link may be incomplete.');
+        }
+        if (bytes[0] !== this.VERSION) {
+            throw new Error(`Unsupported share link version ${bytes[0]}.`);
+        }
+
+        const decoder = new TextDecoder();
+        const fields = [];
+        let offset = 1;
+        for (let i = 0; i < 4; i++) {
+            if (offset + 2 > end) {
+                throw new Error('Invalid share link - truncated.');
+            }
+            const length = view.getUint16(offset);
+            offset += 2;
+            if (offset + length > end) {
+                throw new Error('Invalid share link - truncated.');
+            }
+            fields.push(decoder.decode(bytes.subarray(offset, offset + length)));
+            offset += length;
+        }
+        if (offset !== end) {
+            throw new Error('Invalid share link - unexpected trailing data.');
+        }
+        return { username: fields[0], reference: fields[1], password: fields[2], name: fields[3] };
+    },
+
+    parseLegacy(text) {
+        const parts = text.split(':');
+        if (parts.length < 3 || parts.length > 4) {
+            throw new Error('Invalid share string format.');
+        }
+        let name = '';
+        if (parts[3]) {
+            try {
+                name = new TextDecoder().decode(Uint8Array.from(atob(parts[3]), c => c.charCodeAt(0)));
+            } catch (e) {
+                console.warn('Could not decode filename:', e);
+            }
+        }
+        return { username: parts[0], reference: parts[1], password: parts[2], name: name };
+    }
+};
@@ -3,13 +3,14 @@ package utils
 import (
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
-const configPath = "zephyrus.conf"
-
 // globalSession stores the session in RAM for the REPL/Stateless mode
 var globalSession *Session
 
@@ -20,51 +21,274 @@ type Session struct {
 	Index       VaultIndex    `json:"index"`
 	SharedIndex *SharedIndex  `json:"shared_index"`
 	Settings    VaultSettings `json:"settings"`
+	BackendSpec string        `json:"backend,omitempty"`
+	Head        string        `json:"head,omitempty"` // Commit the index was loaded from
+
+	sessionKey  []byte        // Seals the persistent session (see session_store.go)
+	idleTimeout time.Duration // Persistent session locks after this long unused
+	fileKEK     []byte        // Wraps file keys; derived from RawKey on first use (see keywrap.go)
+	backend     Backend       // Opened on first use and kept, so consecutive pushes share one clone
 }
 
+// ErrConflict is returned when a concurrent change touched the same path as ours
+var ErrConflict = errors.New("conflicting changes in vault")
+
+// maxPushAttempts bounds how often a push is merged onto concurrent changes
+const maxPushAttempts = 5
+
 // SetGlobalSession injects a session into RAM (used by the REPL)
 func SetGlobalSession(s *Session) {
 	globalSession = s
 }
 
-// Connect initializes the session and syncs the index locally
-func Connect(username string, password string) error {
+// Connect initializes the session and stores it encrypted in the config
+// directory. The session locks after idleTimeout without use (0 never locks).
+func Connect(username string, password string, idleTimeout time.Duration) error {
 	fmt.Printf("Connecting and syncing vault for %s...\n", username)
 
 	session, err := FetchSessionStateless(username, password)
 	if err != nil {
 		return err
 	}
-
-	return session.Save()
+	session.idleTimeout = idleTimeout
+	return saveStoredSession(session)
 }
 
+// Save stores the session as the persistent session. The indexes are only
+// written encrypted, and the password and SSH key are kept by the session
+// agent instead of on disk; see session_store.go.
 func (s *Session) Save() error {
-	data, _ := json.MarshalIndent(s, "", "  ")
-	return os.WriteFile(configPath, data, 0600)
+	if dryRun {
+		return nil // The session describes changes that were never pushed
+	}
+	if s.sessionKey == nil && s.idleTimeout == 0 {
+		// Stateless session saved over a persistent one: keep its timeout
+		s.idleTimeout = DefaultIdleTimeout
+		if stored, err := readStoredSession(); err == nil {
+			s.idleTimeout = time.Duration(stored.IdleTimeout) * time.Second
+		}
+	}
+	return saveStoredSession(s)
+}
+
+// clone returns a deep copy of the session
+func (s *Session) clone() (*Session, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	c := &Session{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	c.sessionKey, c.idleTimeout, c.fileKEK = s.sessionKey, s.idleTimeout, s.fileKEK
+	return c, nil
+}
+
+// Backend opens the storage backend this session's vault lives in. The
+// backend is kept for the session's lifetime: git backends hold on to the
+// clone of their last push, so the next push from the same head (e.g. the
+// next flush of an upload) does not clone the vault again. A backend opened
+// before --dry-run was switched (in the interactive shell) is not reused. In
+// dry-run mode the backend gets the vault password, to name vault paths in
+// the change sets it prints. Like kek, it must be called once before workers
+// share the session, so they only read the kept backend.
+func (s *Session) Backend() (Backend, error) {
+	if s.backend != nil {
+		if _, wrapped := s.backend.(dryRunBackend); wrapped == dryRun {
+			return s.backend, nil
+		}
+	}
+	backend, err := OpenBackend(s.BackendSpec, s.Username, s.RawKey)
+	if err != nil {
+		return nil, err
+	}
+	s.backend = withVaultPassword(backend, s.Password)
+	return s.backend, nil
+}
+
+// Fetch reads a single object from the session's vault. Storage objects of
+// the commit the session was loaded from are served from the local cache.
+func (s *Session) Fetch(path string) ([]byte, error) {
+	backend, err := s.Backend()
+	if err != nil {
+		return nil, err
+	}
+	return cachedFetch(backend, s.Head, path)
+}
+
+// CommitInfo returns the commit message and author configured in the vault settings
+func (s *Session) CommitInfo() CommitInfo {
+	return CommitInfo{
+		Message:     s.Settings.CommitMessage,
+		AuthorName:  s.Settings.CommitAuthorName,
+		AuthorEmail: s.Settings.CommitAuthorEmail,
+	}
+}
+
+// Push writes and removes objects in the session's vault as a single commit.
+// If the vault changed since the session was loaded, the remote index and
+// shared index are three-way merged with ours and the push is retried; it only
+// fails when both sides changed the same path.
+func (s *Session) Push(files map[string][]byte, deletes []string) error {
+	return s.push(files, deletes, true)
+}
+
+func (s *Session) push(files map[string][]byte, deletes []string, merge bool) error {
+	// Without the commit the session was loaded from, a push could silently
+	// overwrite concurrent changes (sessions saved by older versions lack it)
+	if s.Head == "" {
+		return fmt.Errorf("the session does not know which vault commit it was loaded from; reconnect and try again")
+	}
+	backend, err := s.Backend()
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		head, err := backend.WriteBatch(Batch{Files: files, Deletes: deletes, Commit: s.CommitInfo(), Parent: s.Head})
+		if err == nil {
+			s.Head = head
+			return nil
+		}
+		if !errors.Is(err, ErrStaleHead) || !merge {
+			return err
+		}
+		if attempt >= maxPushAttempts {
+			return fmt.Errorf("%w (gave up after %d attempts)", err, attempt)
+		}
+
+		fmt.Fprintln(progressOut, "Vault changed remotely, merging concurrent changes...")
+		if err := s.rebase(backend, files); err != nil {
+			return err
+		}
+	}
+}
+
+// rebase moves the session onto the current remote head, merging the remote
+// indexes into the session and into any index files staged in files. The
+// session indexes are merged even when they are not staged, so that they
+// always describe the commit s.Head points to.
+func (s *Session) rebase(backend Backend, files map[string][]byte) error {
+	head, err := backend.Head()
+	if err != nil {
+		return fmt.Errorf("failed to read remote head: %w", err)
+	}
+
+	base, err := fetchIndexAt(backend, s.Head, s.Password)
+	if err != nil {
+		return err
+	}
+	theirs, err := fetchIndexAt(backend, head, s.Password)
+	if err != nil {
+		return err
+	}
+	merged, conflicts := MergeIndex(base, s.Index, theirs)
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%w at %s; reconnect and try again", ErrConflict, strings.Join(conflicts, ", "))
+	}
+	s.Index = merged
+	if _, ok := files[".config/index"]; ok {
+		files[".config/index"], err = merged.ToBytes(s.Password)
+		if err != nil {
+			return err
+		}
+	}
+
+	baseShared, err := fetchSharedIndexAt(backend, s.Head, s.Password)
+	if err != nil {
+		return err
+	}
+	theirsShared, err := fetchSharedIndexAt(backend, head, s.Password)
+	if err != nil {
+		return err
+	}
+	oursShared := s.SharedIndex
+	if oursShared == nil {
+		oursShared = NewSharedIndex()
+	}
+	mergedShared, conflicts := MergeSharedIndex(baseShared, oursShared, theirsShared)
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%w in shared files %s; reconnect and try again", ErrConflict, strings.Join(conflicts, ", "))
+	}
+	s.SharedIndex = mergedShared
+	if _, ok := files["shared/.config/index"]; ok {
+		files["shared/.config/index"], err = mergedShared.EncryptForRemote(s.Password)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.Head = head
+	return nil
+}
+
+// fetchIndexAt loads the vault index as of a commit ("" or missing means empty)
+func fetchIndexAt(backend Backend, rev string, password string) (VaultIndex, error) {
+	if rev == "" {
+		return NewIndex(), nil
+	}
+	data, err := backend.FetchAt(rev, ".config/index")
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return NewIndex(), nil
+		}
+		return nil, err
+	}
+	return FromBytes(data, password)
+}
+
+// fetchSharedIndexAt loads the shared index as of a commit ("" or missing means empty)
+func fetchSharedIndexAt(backend Backend, rev string, password string) (*SharedIndex, error) {
+	if rev == "" {
+		return NewSharedIndex(), nil
+	}
+	data, err := backend.FetchAt(rev, "shared/.config/index")
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return NewSharedIndex(), nil
+		}
+		return nil, err
+	}
+	return DecryptSharedIndex(data, password)
 }
 
-// GetSession now checks memory first (REPL cache), then falls back to disk
+// GetSession now checks memory first (REPL cache), then falls back to the
+// encrypted session store
 func GetSession() (*Session, error) {
 	// 1. Check RAM (REPL/Interactive mode)
 	if globalSession != nil {
+		if dryRun {
+			// A dry run changes the session's indexes as if it had pushed;
+			// it must not leave those changes in the REPL's session
+			return globalSession.clone()
+		}
 		return globalSession, nil
 	}
 
-	// 2. Check Disk (Standard CLI mode)
-	data, err := os.ReadFile(configPath)
+	// 2. Move a plaintext zephyrus.conf left by an older version into the store
+	if _, err := os.Stat(legacyConfigPath); err == nil {
+		if err := migrateLegacySession(); err != nil {
+			return nil, err
+		}
+	}
+
+	// 3. Check Disk (Standard CLI mode)
+	stored, err := readStoredSession()
 	if err != nil {
 		return nil, fmt.Errorf("not connected: run 'connect' first or use -u")
 	}
-	var s Session
-	err = json.Unmarshal(data, &s)
+	s, err := openSession(stored)
+	if err != nil {
+		return nil, err
+	}
 
-	// 3. Ensure SharedIndex is initialized
+	// 4. Ensure SharedIndex is initialized
 	if s.SharedIndex == nil {
 		s.SharedIndex = NewSharedIndex()
 	}
 
-	// 4. Apply defaults to settings if missing (for backward compatibility with old zephyrus.conf files)
+	// 5. Apply defaults to settings if missing (for backward compatibility with old sessions)
 	if s.Settings.CommitAuthorName == "" {
 		s.Settings.CommitAuthorName = "Zephyrus"
 	}
@@ -81,35 +305,63 @@ func GetSession() (*Session, error) {
 		s.Settings.ShareHashLength = 6
 	}
 
-	return &s, err
+	return s, nil
 }
 
+// Disconnect removes the persistent session (and a leftover plaintext
+// zephyrus.conf) and stops the session agent
 func Disconnect() error {
 	globalSession = nil // Clear memory cache
-	return os.Remove(configPath)
+	stopSessionAgent()
+	os.Remove(legacyConfigPath)
+	dir, err := ConfigDir()
+	if err != nil {
+		return err
+	}
+	os.Remove(filepath.Join(dir, legacyLocalKeyFileName))
+	return os.Remove(filepath.Join(dir, sessionFileName))
 }
 
 // FetchSessionStateless performs the authentication and index fetch without saving to disk
 func FetchSessionStateless(username string, password string) (*Session, error) {
+	spec := ActiveBackendSpec()
+	backend, err := OpenBackend(spec, username, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pin every read to the current head so a later push can detect concurrent
+	// changes. Without a known head that check is impossible, so fail instead.
+	head, err := backend.Head()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vault head: %w", err)
+	}
+	if head == "" {
+		return nil, fmt.Errorf("master key not found: %w", ErrNotFound)
+	}
+	fetch := func(path string) ([]byte, error) {
+		return backend.FetchAt(head, path)
+	}
+
 	// 1. Fetch & Decrypt Master Key
-	encryptedKey, err := FetchRaw(username, ".config/key")
+	encryptedKey, err := fetch(".config/key")
 	if err != nil {
 		return nil, fmt.Errorf("master key not found: %w", err)
 	}
 	rawKey, err := Decrypt(encryptedKey, password)
 	if err != nil {
-		return nil, fmt.Errorf("auth failed: invalid password")
+		return nil, fmt.Errorf("%w: invalid password", ErrAuth)
 	}
 
-	// 2. Fetch & Decrypt Index
+	// 2. Fetch & Decrypt Index. Only a missing index means an empty vault; any
+	// other failure must not be mistaken for one, or the next push would empty it.
 	var index VaultIndex
-	rawIndex, err := FetchRaw(username, ".config/index")
+	rawIndex, err := fetch(".config/index")
 	if err != nil {
-		if strings.Contains(err.Error(), "404") {
-			index = NewIndex()
-		} else {
-			index = NewIndex() // Fallback for new vaults
+		if !errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("failed to fetch index: %w", err)
 		}
+		index = NewIndex()
 	} else {
 		index, err = FromBytes(rawIndex, password)
 		if err != nil {
@@ -119,8 +371,11 @@ func FetchSessionStateless(username string, password string) (*Session, error) {
 
 	// 3. Fetch & Decrypt Shared Index
 	var sharedIndex *SharedIndex
-	rawSharedIndex, err := FetchRaw(username, "shared/.config/index")
+	rawSharedIndex, err := fetch("shared/.config/index")
 	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("failed to fetch shared index: %w", err)
+		}
 		// Shared index doesn't exist yet, that's fine
 		sharedIndex = NewSharedIndex()
 	} else {
@@ -132,8 +387,11 @@ func FetchSessionStateless(username string, password string) (*Session, error) {
 
 	// 4. Fetch & Decrypt Settings (use defaults if not present)
 	var settings VaultSettings
-	rawSettings, err := FetchRaw(username, ".config/settings")
+	rawSettings, err := fetch(".config/settings")
 	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("failed to fetch settings: %w", err)
+		}
 		// Settings don't exist yet, use defaults
 		settings = DefaultSettings()
 	} else {
@@ -151,13 +409,16 @@ func FetchSessionStateless(username string, password string) (*Session, error) {
 		Index:       index,
 		SharedIndex: sharedIndex,
 		Settings:    settings,
+		BackendSpec: spec,
+		Head:        head,
 	}, nil
 }
 
-// ResetPassword changes the vault password and re-encrypts all protected data
+// ResetPassword changes the vault password and re-encrypts all protected data.
+// File keys are wrapped with the key-encryption key derived from the master
+// key, which does not change, so only keys left over from older versions
+// (still encrypted with the old password) need re-wrapping.
 func ResetPassword(session *Session, newPassword string) error {
-	repoURL := fmt.Sprintf("git@github.com:%s/.zephyrus.git", session.Username)
-
 	PrintProgressStep(1, 5, "Validating new password...")
 	if newPassword == "" {
 		return fmt.Errorf("new password cannot be empty")
@@ -173,9 +434,13 @@ func ResetPassword(session *Session, newPassword string) error {
 	PrintCompletionLine("Master key re-encrypted")
 
 	// Re-encrypt index with new password
-	// First, we need to update all file keys in the index
+	// First, move any file keys still encrypted with the old password to the KEK
 	PrintProgressStep(3, 5, "Re-encrypting vault index...")
-	err = updateIndexFileKeysForPassword(session.Index, session.Password, newPassword)
+	kek, err := session.kek()
+	if err != nil {
+		return err
+	}
+	migrated, err := migrateFileKeys(session.Index, session.Password, kek)
 	if err != nil {
 		return fmt.Errorf("failed to update file keys: %w", err)
 	}
@@ -184,7 +449,11 @@ func ResetPassword(session *Session, newPassword string) error {
 	if err != nil {
 		return fmt.Errorf("failed to encrypt index: %w", err)
 	}
-	PrintCompletionLine("Vault index re-encrypted")
+	if migrated > 0 {
+		PrintCompletionLine(fmt.Sprintf("Vault index re-encrypted (%d file keys moved off the old password)", migrated))
+	} else {
+		PrintCompletionLine("Vault index re-encrypted")
+	}
 
 	// Re-encrypt settings with new password
 	PrintProgressStep(4, 5, "Re-encrypting settings...")
@@ -201,7 +470,7 @@ func ResetPassword(session *Session, newPassword string) error {
 	}
 
 	// Push all re-encrypted files to GitHub
-	PrintProgressStep(5, 5, "Pushing updated files to GitHub...")
+	PrintProgressStep(5, 5, "Pushing updated files to vault...")
 	filesToPush := map[string][]byte{
 		".config/key":          newMasterKeyEncrypted,
 		".config/index":        indexBytes,
@@ -209,11 +478,17 @@ func ResetPassword(session *Session, newPassword string) error {
 		"shared/.config/index": sharedIndexEncrypted,
 	}
 
-	err = PushFilesWithAuthor(repoURL, session.RawKey, filesToPush, session.Settings.CommitMessage, session.Settings.CommitAuthorName, session.Settings.CommitAuthorEmail)
+	if err := reencryptKeyFiles(session, newPassword, filesToPush); err != nil {
+		return err
+	}
+
+	// Everything is re-encrypted under the new password, so concurrent
+	// changes cannot be merged in; the push fails instead.
+	err = session.push(filesToPush, nil, false)
 	if err != nil {
 		return fmt.Errorf("failed to push updated files: %w", err)
 	}
-	PrintCompletionLine("Files pushed to GitHub")
+	PrintCompletionLine("Files pushed to vault")
 
 	// Update session password and save locally if persistent
 	session.Password = newPassword
@@ -222,36 +497,24 @@ func ResetPassword(session *Session, newPassword string) error {
 	return nil
 }
 
-// updateIndexFileKeysForPassword recursively updates all file key encryption in the index
-func updateIndexFileKeysForPassword(vi VaultIndex, oldPassword string, newPassword string) error {
-	return updateIndexTreeFileKeys(vi, oldPassword, newPassword)
-}
-
-// updateIndexTreeFileKeys recursively walks the index and updates file key encryption
-func updateIndexTreeFileKeys(entries VaultIndex, oldPassword string, newPassword string) error {
-	for name, entry := range entries {
-		if entry.Type == "file" {
-			// Decrypt file key with old password
-			encryptedKey, err := DecryptHexString(entry.FileKey, oldPassword)
-			if err != nil {
-				return fmt.Errorf("failed to decrypt file key: %w", err)
-			}
-
-			// Re-encrypt with new password
-			newEncryptedKey, err := Encrypt(encryptedKey, newPassword)
-			if err != nil {
-				return fmt.Errorf("failed to re-encrypt file key: %w", err)
-			}
-
-			// Update the entry with hex-encoded new encrypted key
-			entry.FileKey = HexEncodeBytes(newEncryptedKey)
-			entries[name] = entry // Write back to map
-		} else if entry.Type == "folder" && entry.Contents != nil {
-			// Recurse into subdirectories
-			err := updateIndexTreeFileKeys(entry.Contents, oldPassword, newPassword)
-			if err != nil {
-				return err
+// reencryptKeyFiles re-encrypts the private key and inbox (see pubkey.go and
+// inbox.go) with password into files. Vaults that never used the inbox have
+// neither.
+func reencryptKeyFiles(session *Session, password string, files map[string][]byte) error {
+	for _, path := range []string{privateKeyPath, inboxPath} {
+		data, err := session.Fetch(path)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
 			}
+			return fmt.Errorf("failed to fetch %s: %w", path, err)
+		}
+		plaintext, err := Decrypt(data, session.Password)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", path, err)
+		}
+		if files[path], err = Encrypt(plaintext, password); err != nil {
+			return fmt.Errorf("failed to encrypt %s: %w", path, err)
 		}
 	}
 	return nil
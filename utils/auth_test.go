@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConcurrentPushMergesQuietly(t *testing.T) {
+	session := newTestSession(t)
+	other, err := session.clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := os.WriteFile(filepath.Join(source, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := UploadFile(filepath.Join(source, "a.txt"), "a.txt", other); err != nil {
+		t.Fatalf("UploadFile from the other session: %v", err)
+	}
+
+	// Structured output owns stdout, so the merge notice goes to progress output
+	var progress bytes.Buffer
+	SetProgressOutput(&progress)
+	defer SetProgressOutput(os.Stdout)
+	stdout := captureStdout(t, func() {
+		if err := UploadFile(filepath.Join(source, "b.txt"), "b.txt", session); err != nil {
+			t.Errorf("UploadFile: %v", err)
+		}
+	})
+
+	if strings.Contains(stdout, "merging concurrent changes") {
+		t.Errorf("printed the merge notice to stdout: %q", stdout)
+	}
+	if !strings.Contains(progress.String(), "merging concurrent changes") {
+		t.Errorf("progress output %q does not report the merge", progress.String())
+	}
+	for _, path := range []string{"a.txt", "b.txt"} {
+		if _, err := session.Index.FindEntry(path); err != nil {
+			t.Errorf("%s missing from the merged index: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// ErrStaleHead is returned by WriteBatch when the vault has moved past batch.Parent
+var ErrStaleHead = errors.New("remote vault has changed since it was loaded")
+
+// Backend abstracts the storage that holds a vault's encrypted objects
+type Backend interface {
+	// Fetch returns the contents of a single object (e.g. a storage ID or ".config/index")
+	Fetch(path string) ([]byte, error)
+	// FetchAt returns the contents of an object as of a specific commit
+	FetchAt(rev string, path string) ([]byte, error)
+	// Head returns the commit the vault currently points to ("" for an empty vault)
+	Head() (string, error)
+	// WriteBatch writes and removes objects in a single commit and returns the new head
+	WriteBatch(batch Batch) (string, error)
+	// DeleteBatch removes objects in a single commit
+	DeleteBatch(paths []string, info CommitInfo) error
+	// List returns the path of every object currently stored
+	List() ([]string, error)
+	// Tree returns the git blob hash of each top-level object (the storage objects) as of a specific commit
+	Tree(rev string) (map[string]string, error)
+	// History returns a repository holding the full commit history of the
+	// vault. release frees what it takes (e.g. a temporary clone) and must be
+	// called once the repository is no longer used.
+	History() (r *git.Repository, release func(), err error)
+	// Reset replaces the entire vault history with one commit containing exactly files
+	Reset(files map[string][]byte, info CommitInfo) error
+	// ReplaceHistory force-pushes the master branch of r, which must hold every
+	// object it refers to, as the vault's history. It fails with ErrStaleHead
+	// unless the vault still points at expected.
+	ReplaceHistory(r *git.Repository, expected string) error
+	// Ensure checks that the storage location exists and can hold a new vault
+	Ensure() error
+	// Describe returns a human-readable location for messages
+	Describe() string
+}
+
+// CommitInfo carries the commit message and author for a write
+type CommitInfo struct {
+	Message     string
+	AuthorName  string
+	AuthorEmail string
+}
+
+// Batch is a set of object writes and removals applied as one commit.
+// When Parent is set the write only succeeds if the vault is still at that commit.
+type Batch struct {
+	Files   map[string][]byte
+	Deletes []string
+	Commit  CommitInfo
+	Parent  string
+}
+
+// DefaultBackendSpec selects the GitHub backend
+const DefaultBackendSpec = "github"
+
+// activeBackendSpec is used for vaults opened without a session (set by --backend)
+var activeBackendSpec = DefaultBackendSpec
+
+// SetBackendSpec selects the backend used for new sessions and share links
+func SetBackendSpec(spec string) {
+	if spec == "" {
+		spec = DefaultBackendSpec
+	}
+	activeBackendSpec = spec
+}
+
+// ActiveBackendSpec returns the backend spec selected for this process
+func ActiveBackendSpec() string {
+	return activeBackendSpec
+}
+
+// OpenBackend resolves a backend spec into a Backend for the given vault owner.
+// Supported specs:
+//
+//	github            git@github.com:<user>/.zephyrus.git (default)
+//	gitea:<host>      git@<host>:<user>/.zephyrus.git on a Gitea/Forgejo server
+//	local:<dir>       a bare git repository on the local filesystem
+//
+// rawKey may be nil when only reads are needed. In dry-run mode the backend
+// only prints what each write would change (see dryrun.go).
+func OpenBackend(spec string, username string, rawKey []byte) (Backend, error) {
+	backend, err := openBackend(spec, username, rawKey)
+	if err != nil || !dryRun {
+		return backend, err
+	}
+	return dryRunBackend{Backend: backend, held: &heldObjects{}}, nil
+}
+
+func openBackend(spec string, username string, rawKey []byte) (Backend, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "", "github":
+		return NewGitHubBackend(username, rawKey), nil
+	case "gitea":
+		if arg == "" {
+			return nil, fmt.Errorf("gitea backend requires a host (gitea:<host>)")
+		}
+		return NewGiteaBackend(arg, username, rawKey), nil
+	case "local":
+		if arg == "" {
+			return nil, fmt.Errorf("local backend requires a directory (local:<dir>)")
+		}
+		return NewLocalBackend(arg)
+	default:
+		return nil, fmt.Errorf("unknown backend '%s' (expected github, gitea:<host> or local:<dir>)", spec)
+	}
+}
+
+// RemoteBackend stores the vault in a repository on a git hosting service.
+// Writes are pushed over SSH; reads go through the host's raw file endpoint.
+type RemoteBackend struct {
+	RepoURL      string // SSH clone URL
+	WebURL       string // Repository page, used to verify it exists and for anonymous ls-remote
+	RawURL       string // Format string taking the object path
+	RawCommitURL string // Format string taking a commit hash and the object path
+	TreeURL      string // Format string taking a commit hash and a page number; the host's git trees API
+	RawKey       []byte // SSH deploy key; nil for read-only use
+
+	checkout gitCheckout // Clone kept between pushes
+}
+
+// NewGitHubBackend returns the backend for <username>/.zephyrus on GitHub
+func NewGitHubBackend(username string, rawKey []byte) *RemoteBackend {
+	return &RemoteBackend{
+		RepoURL:      fmt.Sprintf("git@github.com:%s/.zephyrus.git", username),
+		WebURL:       fmt.Sprintf("https://github.com/%s/.zephyrus", username),
+		RawURL:       "https://raw.githubusercontent.com/" + username + "/.zephyrus/master/%s",
+		RawCommitURL: "https://raw.githubusercontent.com/" + username + "/.zephyrus/%s/%s",
+		TreeURL:      "https://api.github.com/repos/" + username + "/.zephyrus/git/trees/%s?page=%d",
+		RawKey:       rawKey,
+	}
+}
+
+// NewGiteaBackend returns the backend for <username>/.zephyrus on a self-hosted Gitea server
+func NewGiteaBackend(host string, username string, rawKey []byte) *RemoteBackend {
+	return &RemoteBackend{
+		RepoURL:      fmt.Sprintf("git@%s:%s/.zephyrus.git", host, username),
+		WebURL:       fmt.Sprintf("https://%s/%s/.zephyrus", host, username),
+		RawURL:       "https://" + host + "/" + username + "/.zephyrus/raw/branch/master/%s",
+		RawCommitURL: "https://" + host + "/" + username + "/.zephyrus/raw/commit/%s/%s",
+		TreeURL:      "https://" + host + "/api/v1/repos/" + username + "/.zephyrus/git/trees/%s?page=%d",
+		RawKey:       rawKey,
+	}
+}
+
+func (b *RemoteBackend) remote() (gitRemote, error) {
+	if b.RawKey == nil {
+		return gitRemote{}, fmt.Errorf("no SSH key available for %s", b.RepoURL)
+	}
+	auth, err := sshAuth(b.RawKey)
+	if err != nil {
+		return gitRemote{}, err
+	}
+	return gitRemote{url: b.RepoURL, auth: auth, shallow: true, kept: &b.checkout}, nil
+}
+
+func (b *RemoteBackend) Fetch(path string) ([]byte, error) {
+	return fetchURL(fmt.Sprintf(b.RawURL, path))
+}
+
+func (b *RemoteBackend) FetchAt(rev string, path string) ([]byte, error) {
+	return fetchURL(fmt.Sprintf(b.RawCommitURL, rev, path))
+}
+
+// Tree reads the commit's top-level tree from the host's API, which GitHub and
+// Gitea both serve in the same format (Gitea in pages)
+func (b *RemoteBackend) Tree(rev string) (map[string]string, error) {
+	objects := make(map[string]string)
+	for page := 1; ; page++ {
+		data, err := fetchURL(fmt.Sprintf(b.TreeURL, rev, page))
+		if err != nil {
+			return nil, err
+		}
+		var listing struct {
+			Tree []struct {
+				Path string `json:"path"`
+				Type string `json:"type"`
+				SHA  string `json:"sha"`
+			} `json:"tree"`
+			Truncated bool `json:"truncated"`
+		}
+		if err := json.Unmarshal(data, &listing); err != nil {
+			return nil, fmt.Errorf("invalid tree listing: %w", err)
+		}
+		before := len(objects)
+		for _, entry := range listing.Tree {
+			if entry.Type == "blob" {
+				objects[entry.Path] = entry.SHA
+			}
+		}
+		if !listing.Truncated {
+			return objects, nil
+		}
+		if len(objects) == before {
+			return nil, fmt.Errorf("tree listing of %s is incomplete", rev)
+		}
+	}
+}
+
+// Head lists the remote refs anonymously over HTTPS, so it works before the key is decrypted
+func (b *RemoteBackend) Head() (string, error) {
+	var head string
+	err := retry(func() error {
+		var err error
+		head, err = gitRemote{url: b.WebURL + ".git"}.lsRemote()
+		return gitError(err)
+	})
+	return head, err
+}
+
+// WriteBatch pushes the batch, retrying transient failures. A retry after a
+// push that did land sees a moved head and returns ErrStaleHead, which
+// Session.Push resolves by merging.
+func (b *RemoteBackend) WriteBatch(batch Batch) (string, error) {
+	remote, err := b.remote()
+	if err != nil {
+		return "", err
+	}
+	var head string
+	err = retry(func() error {
+		var err error
+		head, err = remote.push(batch)
+		return gitError(err)
+	})
+	return head, err
+}
+
+func (b *RemoteBackend) DeleteBatch(paths []string, info CommitInfo) error {
+	_, err := b.WriteBatch(Batch{Deletes: paths, Commit: info})
+	return err
+}
+
+func (b *RemoteBackend) List() ([]string, error) {
+	remote, err := b.remote()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	err = retry(func() error {
+		var err error
+		paths, err = remote.list()
+		return gitError(err)
+	})
+	return paths, err
+}
+
+// History clones the complete history (regular operations only clone depth 1)
+// into a temporary bare repository on disk, so that every version of every
+// file is not held in memory. release removes the clone.
+func (b *RemoteBackend) History() (*git.Repository, func(), error) {
+	remote, err := b.remote()
+	if err != nil {
+		return nil, nil, err
+	}
+	dir, err := os.MkdirTemp("", "zephyrus-history-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create temporary clone directory: %w", err)
+	}
+	release := func() { os.RemoveAll(dir) }
+
+	var r *git.Repository
+	err = retry(func() error {
+		os.RemoveAll(dir) // Left over from a failed attempt
+		var err error
+		r, err = remote.cloneBare(dir)
+		return gitError(err)
+	})
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return r, release, nil
+}
+
+// Reset force-pushes a single commit; repeating it is harmless
+func (b *RemoteBackend) Reset(files map[string][]byte, info CommitInfo) error {
+	remote, err := b.remote()
+	if err != nil {
+		return err
+	}
+	return retry(func() error {
+		return gitError(remote.reset(files, info))
+	})
+}
+
+// ReplaceHistory is retried like Reset; the lease makes a retry after a push
+// that went through fail with ErrStaleHead rather than push twice
+func (b *RemoteBackend) ReplaceHistory(r *git.Repository, expected string) error {
+	remote, err := b.remote()
+	if err != nil {
+		return err
+	}
+	return retry(func() error {
+		return gitError(remote.replace(r, expected))
+	})
+}
+
+func (b *RemoteBackend) Ensure() error {
+	resp, err := http.Head(b.WebURL)
+	if err != nil {
+		return fmt.Errorf("repository '.zephyrus' not found at %s. Please create it manually first", b.WebURL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("repository '.zephyrus' not found at %s. Please create it manually first", b.WebURL)
+	}
+	return nil
+}
+
+func (b *RemoteBackend) Describe() string {
+	return b.RepoURL
+}
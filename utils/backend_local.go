@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+)
+
+var installFileTransport sync.Once
+
+// LocalBackend stores the vault in a bare git repository on the local filesystem.
+// It needs no network access or SSH key, which makes it suitable for test fixtures.
+type LocalBackend struct {
+	Dir string
+
+	checkout gitCheckout // Clone kept between pushes
+}
+
+// NewLocalBackend returns a backend for the bare repository at dir
+func NewLocalBackend(dir string) (*LocalBackend, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vault directory: %w", err)
+	}
+
+	// Serve file:// URLs in-process so no git binary is required
+	installFileTransport.Do(func() {
+		client.InstallProtocol("file", server.DefaultServer)
+	})
+
+	return &LocalBackend{Dir: absDir}, nil
+}
+
+func (b *LocalBackend) remote() gitRemote {
+	return gitRemote{url: b.Dir, kept: &b.checkout}
+}
+
+func (b *LocalBackend) open() (*git.Repository, error) {
+	r, err := git.PlainOpen(b.Dir)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		return nil, fmt.Errorf("%w: no vault at %s", ErrNotFound, b.Dir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open vault at %s: %w", b.Dir, err)
+	}
+	return r, nil
+}
+
+func (b *LocalBackend) Fetch(path string) ([]byte, error) {
+	head, err := b.Head()
+	if err != nil {
+		return nil, err
+	}
+	if head == "" {
+		return nil, fmt.Errorf("%w: %s (empty vault)", ErrNotFound, path) // Nothing has been pushed yet
+	}
+	return b.FetchAt(head, path)
+}
+
+func (b *LocalBackend) FetchAt(rev string, path string) ([]byte, error) {
+	r, err := b.open()
+	if err != nil {
+		return nil, err
+	}
+	commit, err := r.CommitObject(plumbing.NewHash(rev))
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := commit.File(path)
+	if errors.Is(err, object.ErrFileNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := f.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+func (b *LocalBackend) Tree(rev string) (map[string]string, error) {
+	r, err := b.open()
+	if err != nil {
+		return nil, err
+	}
+	commit, err := r.CommitObject(plumbing.NewHash(rev))
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	objects := make(map[string]string)
+	for _, entry := range tree.Entries {
+		if entry.Mode.IsFile() {
+			objects[entry.Name] = entry.Hash.String()
+		}
+	}
+	return objects, nil
+}
+
+func (b *LocalBackend) Head() (string, error) {
+	r, err := b.open()
+	if err != nil {
+		return "", err
+	}
+	return headHash(r), nil
+}
+
+func (b *LocalBackend) WriteBatch(batch Batch) (string, error) {
+	return b.remote().push(batch)
+}
+
+func (b *LocalBackend) DeleteBatch(paths []string, info CommitInfo) error {
+	_, err := b.WriteBatch(Batch{Deletes: paths, Commit: info})
+	return err
+}
+
+func (b *LocalBackend) List() ([]string, error) {
+	r, err := b.open()
+	if err != nil {
+		return nil, err
+	}
+	return listHeadTree(r)
+}
+
+// History opens the bare repository directly; it already holds every commit,
+// so there is nothing to release
+func (b *LocalBackend) History() (*git.Repository, func(), error) {
+	r, err := b.open()
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, func() {}, nil
+}
+
+func (b *LocalBackend) Reset(files map[string][]byte, info CommitInfo) error {
+	return b.remote().reset(files, info)
+}
+
+// ReplaceHistory pushes the new history into the bare repository, then repacks
+// it and removes the objects only the old history used, so it actually shrinks.
+// Cleaning up is best effort: the new history is in place either way.
+func (b *LocalBackend) ReplaceHistory(r *git.Repository, expected string) error {
+	if err := b.remote().replace(r, expected); err != nil {
+		return err
+	}
+	repo, err := b.open()
+	if err != nil {
+		return nil
+	}
+	if err := repo.RepackObjects(&git.RepackConfig{}); err == nil {
+		repo.Prune(git.PruneOptions{Handler: repo.DeleteObject})
+	}
+	return nil
+}
+
+// Ensure creates the bare repository if it does not exist yet
+func (b *LocalBackend) Ensure() error {
+	if _, err := git.PlainOpen(b.Dir); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(b.Dir, 0700); err != nil {
+		return fmt.Errorf("failed to create vault directory: %w", err)
+	}
+	if _, err := git.PlainInit(b.Dir, true); err != nil {
+		return fmt.Errorf("failed to initialize vault at %s: %w", b.Dir, err)
+	}
+	return nil
+}
+
+func (b *LocalBackend) Describe() string {
+	return b.Dir
+}
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func newTestLocalBackend(t *testing.T, dir string) *LocalBackend {
+	t.Helper()
+	b, err := NewLocalBackend(dir)
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	if err := b.Ensure(); err != nil {
+		t.Fatalf("Ensure: %v", err)
+	}
+	return b
+}
+
+func fetchString(t *testing.T, b Backend, path string) string {
+	t.Helper()
+	data, err := b.Fetch(path)
+	if err != nil {
+		t.Fatalf("Fetch(%q): %v", path, err)
+	}
+	return string(data)
+}
+
+func TestLocalBackendRoundTrip(t *testing.T) {
+	b := newTestLocalBackend(t, filepath.Join(t.TempDir(), "vault"))
+	info := CommitInfo{Message: "test", AuthorName: "Test", AuthorEmail: "test@example.com"}
+
+	head, err := b.Head()
+	if err != nil || head != "" {
+		t.Fatalf("Head of a new vault = %q, %v; want empty", head, err)
+	}
+	if _, err := b.Fetch(".config/index"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Fetch from a new vault: got %v, want ErrNotFound", err)
+	}
+
+	if err := b.Reset(map[string][]byte{".config/index": []byte("index v1"), "aa11": []byte("object")}, info); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	first, err := b.Head()
+	if err != nil || first == "" {
+		t.Fatalf("Head after Reset = %q, %v", first, err)
+	}
+	if got := fetchString(t, b, "aa11"); got != "object" {
+		t.Errorf("Fetch(aa11) = %q, want %q", got, "object")
+	}
+
+	second, err := b.WriteBatch(Batch{
+		Files:   map[string][]byte{".config/index": []byte("index v2"), "bb22": []byte("other")},
+		Deletes: []string{"aa11"},
+		Commit:  info,
+		Parent:  first,
+	})
+	if err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+	if head, _ := b.Head(); head != second {
+		t.Errorf("Head = %q, want the pushed commit %q", head, second)
+	}
+
+	if got := fetchString(t, b, ".config/index"); got != "index v2" {
+		t.Errorf("Fetch(.config/index) = %q, want %q", got, "index v2")
+	}
+	if _, err := b.Fetch("aa11"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Fetch of a deleted object: got %v, want ErrNotFound", err)
+	}
+	old, err := b.FetchAt(first, ".config/index")
+	if err != nil || string(old) != "index v1" {
+		t.Errorf("FetchAt(first) = %q, %v; want %q", old, err, "index v1")
+	}
+
+	paths, err := b.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	slices.Sort(paths)
+	if want := []string{".config/index", "bb22"}; !slices.Equal(paths, want) {
+		t.Errorf("List = %v, want %v", paths, want)
+	}
+}
+
+func TestLocalBackendStaleParent(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "vault")
+	info := CommitInfo{Message: "test", AuthorName: "Test", AuthorEmail: "test@example.com"}
+
+	ours := newTestLocalBackend(t, dir)
+	if err := ours.Reset(map[string][]byte{".config/index": []byte("base")}, info); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	base, _ := ours.Head()
+
+	// Push once so ours keeps a clone of base's successor
+	if _, err := ours.WriteBatch(Batch{Files: map[string][]byte{"aa11": []byte("a")}, Commit: info, Parent: base}); err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+	ahead, _ := ours.Head()
+
+	// Another machine pushes in the meantime
+	theirs := newTestLocalBackend(t, dir)
+	if _, err := theirs.WriteBatch(Batch{Files: map[string][]byte{"bb22": []byte("b")}, Commit: info, Parent: ahead}); err != nil {
+		t.Fatalf("WriteBatch from the other backend: %v", err)
+	}
+
+	_, err := ours.WriteBatch(Batch{Files: map[string][]byte{"cc33": []byte("c")}, Commit: info, Parent: ahead})
+	if !errors.Is(err, ErrStaleHead) {
+		t.Fatalf("WriteBatch from a stale parent: got %v, want ErrStaleHead", err)
+	}
+	if _, err := ours.Fetch("cc33"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("the rejected write was stored: %v", err)
+	}
+	if got := fetchString(t, ours, "bb22"); got != "b" {
+		t.Errorf("Fetch(bb22) = %q, want the other machine's object", got)
+	}
+}
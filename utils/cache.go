@@ -0,0 +1,343 @@
+package utils
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheLimit is the size the object cache is trimmed to unless
+// $ZEPHYRUS_CACHE_SIZE says otherwise
+const DefaultCacheLimit = 512 << 20
+
+// The cache holds encrypted storage objects only, so it is as safe on disk as
+// the vault itself. Objects are named <storage ID>.<git blob hash> and only
+// served when the session's commit still has that blob at that storage ID.
+const (
+	cacheObjectsDir = "objects"
+	cacheTreesDir   = "trees" // Top-level tree of each commit seen, as JSON
+)
+
+// objectCache is the process-wide state of the on-disk cache
+var objectCache struct {
+	sync.Mutex
+	trees  map[string]map[string]string // Commit -> storage ID -> blob hash
+	size   int64                        // Bytes on disk; -1 until measured
+	hits   int
+	misses int
+}
+
+func init() {
+	objectCache.size = -1
+}
+
+// CacheDir returns the directory of the object cache: $ZEPHYRUS_CACHE_DIR if
+// set, otherwise "zephyrus" in the user cache directory ($XDG_CACHE_HOME or
+// ~/.cache on Linux, %LocalAppData% on Windows, ~/Library/Caches on macOS)
+func CacheDir() (string, error) {
+	if dir := os.Getenv("ZEPHYRUS_CACHE_DIR"); dir != "" {
+		return dir, nil
+	}
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot locate cache directory: %w", err)
+	}
+	return filepath.Join(base, "zephyrus"), nil
+}
+
+// CacheLimit returns the maximum size of the cache in bytes, from
+// $ZEPHYRUS_CACHE_SIZE (e.g. 200M, 2G; 0 disables the cache)
+func CacheLimit() (int64, error) {
+	value := os.Getenv("ZEPHYRUS_CACHE_SIZE")
+	if value == "" {
+		return DefaultCacheLimit, nil
+	}
+	limit, err := ParseByteSize(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ZEPHYRUS_CACHE_SIZE: %w", err)
+	}
+	return limit, nil
+}
+
+// ParseByteSize parses a size such as "512M", "2G", "64k" or a plain number of
+// bytes. Units are binary (1K = 1024 bytes).
+func ParseByteSize(value string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	s = strings.TrimSuffix(s, "I")
+	shift := 0
+	if s != "" {
+		if i := strings.IndexByte("KMGT", s[len(s)-1]); i >= 0 {
+			shift = 10 * (i + 1)
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("'%s' is not a size (use e.g. 512M or 2G)", value)
+	}
+	return n << shift, nil
+}
+
+// gitBlobHash returns the hash git gives an object with this content
+func gitBlobHash(data []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(data))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cachedFetch fetches a storage object through the cache. Only top-level
+// objects of commit rev are cached; everything else (indexes, settings, share
+// pointers) is always fetched fresh. Any cache problem falls back to backend.
+func cachedFetch(backend Backend, rev string, path string) ([]byte, error) {
+	limit, err := CacheLimit()
+	if rev == "" || strings.Contains(path, "/") || err != nil || limit == 0 {
+		return backend.Fetch(path)
+	}
+	dir, err := CacheDir()
+	if err != nil {
+		return backend.Fetch(path)
+	}
+	tree, err := cachedTree(backend, dir, rev)
+	if err != nil {
+		return backend.Fetch(path)
+	}
+	blobHash, ok := tree[path]
+	if !ok {
+		return backend.Fetch(path)
+	}
+
+	objectPath := filepath.Join(dir, cacheObjectsDir, path+"."+blobHash)
+	if data, err := os.ReadFile(objectPath); err == nil {
+		if gitBlobHash(data) == blobHash {
+			now := time.Now()
+			os.Chtimes(objectPath, now, now) // Most recently used
+			objectCache.Lock()
+			objectCache.hits++
+			objectCache.Unlock()
+			return data, nil
+		}
+		os.Remove(objectPath) // Damaged on disk
+	}
+
+	data, err := backend.Fetch(path)
+	if err != nil {
+		return nil, err
+	}
+	objectCache.Lock()
+	objectCache.misses++
+	objectCache.Unlock()
+	if gitBlobHash(data) == blobHash {
+		storeCacheFile(dir, objectPath, data, limit)
+	}
+	return data, nil
+}
+
+// cachedTree returns the storage objects of commit rev with their blob hashes.
+// A commit's tree never changes, so it is kept in memory and on disk.
+func cachedTree(backend Backend, dir string, rev string) (map[string]string, error) {
+	objectCache.Lock()
+	tree, ok := objectCache.trees[rev]
+	objectCache.Unlock()
+	if ok {
+		return tree, nil
+	}
+
+	treePath := filepath.Join(dir, cacheTreesDir, rev)
+	if data, err := os.ReadFile(treePath); err == nil && json.Unmarshal(data, &tree) == nil {
+		now := time.Now()
+		os.Chtimes(treePath, now, now)
+	} else {
+		tree, err = backend.Tree(rev)
+		if err != nil {
+			return nil, err
+		}
+		if data, err := json.Marshal(tree); err == nil {
+			limit, _ := CacheLimit()
+			storeCacheFile(dir, treePath, data, limit)
+		}
+	}
+
+	objectCache.Lock()
+	if objectCache.trees == nil {
+		objectCache.trees = make(map[string]map[string]string)
+	}
+	objectCache.trees[rev] = tree
+	objectCache.Unlock()
+	return tree, nil
+}
+
+// storeCacheFile writes a cache file atomically, then trims the cache to limit
+// if it grew past it. Failures only mean the file is not cached.
+func storeCacheFile(dir string, path string, data []byte, limit int64) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	objectCache.Lock()
+	defer objectCache.Unlock()
+	if objectCache.size < 0 {
+		files, _ := cacheFiles(dir)
+		objectCache.size = 0
+		for _, f := range files {
+			objectCache.size += f.size
+		}
+	} else {
+		objectCache.size += int64(len(data))
+	}
+	if objectCache.size > limit {
+		objectCache.size = evictCache(dir, limit*9/10)
+	}
+}
+
+// cacheFile is a file in the cache directory
+type cacheFile struct {
+	path    string
+	size    int64
+	lastUse time.Time
+}
+
+// cacheFiles lists the cached objects and trees
+func cacheFiles(dir string) ([]cacheFile, error) {
+	var files []cacheFile
+	for _, sub := range []string{cacheObjectsDir, cacheTreesDir} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			files = append(files, cacheFile{
+				path:    filepath.Join(dir, sub, entry.Name()),
+				size:    info.Size(),
+				lastUse: info.ModTime(),
+			})
+		}
+	}
+	return files, nil
+}
+
+// evictCache removes the least recently used files until the cache is at most
+// target bytes, and returns the remaining size
+func evictCache(dir string, target int64) int64 {
+	files, err := cacheFiles(dir)
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, f := range files {
+		size += f.size
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].lastUse.Before(files[j].lastUse) })
+	for _, f := range files {
+		if size <= target {
+			break
+		}
+		if os.Remove(f.path) == nil {
+			size -= f.size
+		}
+	}
+	return size
+}
+
+// CacheStats describes the object cache
+type CacheStats struct {
+	Dir     string
+	Objects int
+	Trees   int
+	Size    int64
+	Limit   int64
+	Oldest  time.Time // Least recent use, zero when empty
+	Hits    int       // Objects served from the cache by this process
+	Misses  int       // Objects fetched and cached by this process
+}
+
+// GetCacheStats measures the object cache
+func GetCacheStats() (CacheStats, error) {
+	dir, err := CacheDir()
+	if err != nil {
+		return CacheStats{}, err
+	}
+	limit, err := CacheLimit()
+	if err != nil {
+		return CacheStats{}, err
+	}
+	files, err := cacheFiles(dir)
+	if err != nil {
+		return CacheStats{}, fmt.Errorf("failed to read cache: %w", err)
+	}
+
+	stats := CacheStats{Dir: dir, Limit: limit}
+	for _, f := range files {
+		if filepath.Base(filepath.Dir(f.path)) == cacheTreesDir {
+			stats.Trees++
+		} else {
+			stats.Objects++
+		}
+		stats.Size += f.size
+		if stats.Oldest.IsZero() || f.lastUse.Before(stats.Oldest) {
+			stats.Oldest = f.lastUse
+		}
+	}
+	objectCache.Lock()
+	stats.Hits, stats.Misses = objectCache.hits, objectCache.misses
+	objectCache.Unlock()
+	return stats, nil
+}
+
+// ClearCache deletes every cached object and tree, returning how many files
+// and bytes were removed
+func ClearCache() (int, int64, error) {
+	dir, err := CacheDir()
+	if err != nil {
+		return 0, 0, err
+	}
+	files, err := cacheFiles(dir)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read cache: %w", err)
+	}
+	var size int64
+	for _, f := range files {
+		size += f.size
+	}
+	for _, sub := range []string{cacheObjectsDir, cacheTreesDir} {
+		if err := os.RemoveAll(filepath.Join(dir, sub)); err != nil {
+			return 0, 0, fmt.Errorf("failed to clear cache: %w", err)
+		}
+	}
+
+	objectCache.Lock()
+	objectCache.trees = nil
+	objectCache.size = 0
+	objectCache.Unlock()
+	return len(files), size, nil
+}
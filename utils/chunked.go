@@ -0,0 +1,392 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const (
+	ChunkSize       = 8 << 20  // Plaintext bytes sealed into each chunk object (8 MiB)
+	chunkPrefixSize = 7        // Random per-upload nonce prefix
+	chunkTagSize    = 16       // GCM authentication tag appended to each chunk
+	maxBatchBytes   = 64 << 20 // Ciphertext held in memory before pending objects are pushed early
+)
+
+// Chunk nonces are laid out as [prefix 7][chunk index uint32][last flag 1].
+// The index and last flag are also passed as additional data, so chunks
+// cannot be reordered, swapped between uploads, or truncated undetected.
+
+// chunkPosition encodes a chunk's index and whether it is the final chunk
+func chunkPosition(index uint32, last bool) []byte {
+	pos := make([]byte, 5)
+	binary.BigEndian.PutUint32(pos, index)
+	if last {
+		pos[4] = 1
+	}
+	return pos
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ChunkWriter encrypts a plaintext stream into ChunkSize pieces. Each sealed
+// chunk ([Nonce][Ciphertext]) is handed to emit as soon as it is complete.
+// Close must be called to seal the final chunk.
+type ChunkWriter struct {
+	gcm    cipher.AEAD
+	prefix []byte
+	buf    []byte
+	index  uint32
+	emit   func(index int, sealed []byte) error
+}
+
+// NewChunkWriter returns a writer that seals chunks with the given file key
+func NewChunkWriter(key []byte, emit func(index int, sealed []byte) error) (*ChunkWriter, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, chunkPrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+
+	return &ChunkWriter{gcm: gcm, prefix: prefix, emit: emit}, nil
+}
+
+func (w *ChunkWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	// Keep at least one byte buffered so the final chunk is only sealed by Close
+	for len(w.buf) > ChunkSize {
+		if err := w.seal(w.buf[:ChunkSize], false); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[ChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+// Close seals whatever is buffered as the final chunk
+func (w *ChunkWriter) Close() error {
+	err := w.seal(w.buf, true)
+	w.buf = nil
+	return err
+}
+
+func (w *ChunkWriter) seal(plaintext []byte, last bool) error {
+	pos := chunkPosition(w.index, last)
+	nonce := append(append([]byte{}, w.prefix...), pos...)
+
+	sealed := w.gcm.Seal(nonce, nonce, plaintext, pos)
+	if err := w.emit(int(w.index), sealed); err != nil {
+		return err
+	}
+	w.index++
+	return nil
+}
+
+// ChunkReader decrypts a chunked file as a stream, fetching one chunk object
+// at a time in the order listed in the entry.
+type ChunkReader struct {
+	gcm    cipher.AEAD
+	ids    []string
+	fetch  func(storageID string) ([]byte, error)
+	prefix []byte
+	index  int
+	buf    []byte
+}
+
+// NewChunkReader returns a reader over the chunk objects ids, sealed with key
+func NewChunkReader(key []byte, ids []string, fetch func(storageID string) ([]byte, error)) (*ChunkReader, error) {
+	if len(ids) == 0 {
+		return nil, errors.New("chunked file has no chunks")
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkReader{gcm: gcm, ids: ids, fetch: fetch}, nil
+}
+
+func (r *ChunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.index >= len(r.ids) {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next fetches and opens the chunk at r.index
+func (r *ChunkReader) next() error {
+	id := r.ids[r.index]
+	data, err := r.fetch(id)
+	if err != nil {
+		return fmt.Errorf("failed to fetch chunk %d (%s): %w", r.index, id, err)
+	}
+	if len(data) < NonceSize {
+		return fmt.Errorf("chunk %d (%s) is too short", r.index, id)
+	}
+
+	nonce := data[:NonceSize]
+	pos := chunkPosition(uint32(r.index), r.index == len(r.ids)-1)
+	if !bytes.Equal(nonce[chunkPrefixSize:], pos) {
+		return fmt.Errorf("chunk %d (%s) is out of place", r.index, id)
+	}
+	if r.prefix == nil {
+		r.prefix = append([]byte{}, nonce[:chunkPrefixSize]...)
+	} else if !bytes.Equal(nonce[:chunkPrefixSize], r.prefix) {
+		return fmt.Errorf("chunk %d (%s) belongs to a different upload", r.index, id)
+	}
+
+	plaintext, err := r.gcm.Open(nil, nonce, data[NonceSize:], pos)
+	if err != nil {
+		return fmt.Errorf("decryption failed for chunk %d (%s): %w", r.index, id, err)
+	}
+	r.buf = plaintext
+	r.index++
+	return nil
+}
+
+// NewEntryReader returns the decrypted contents of a file entry as a stream.
+// Chunked entries are fetched chunk by chunk; single-blob entries written
+// before chunking existed are fetched and decrypted in one piece.
+func NewEntryReader(entry *Entry, fileKey []byte, fetch func(storageID string) ([]byte, error)) (io.Reader, error) {
+	if entry.IsChunked() {
+		return NewChunkReader(fileKey, entry.Chunks, fetch)
+	}
+
+	encryptedData, err := fetch(entry.RealName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch storage file from remote: %w", err)
+	}
+	decryptedData, err := DecryptWithKey(encryptedData, fileKey)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %w", err)
+	}
+	return bytes.NewReader(decryptedData), nil
+}
+
+// pendingUploadsDir holds a manifest for each upload that pushed objects
+// before the index naming them, so gc does not take them for orphans
+const pendingUploadsDir = ".config/pending/"
+
+// PendingUploadTimeout is how long gc honours a pending upload manifest after
+// its last flush. An upload silent for longer is assumed to have died.
+const PendingUploadTimeout = 24 * time.Hour
+
+// pendingUpload is the manifest of an upload in progress
+type pendingUpload struct {
+	Updated time.Time `json:"updated"` // Time of the last flush
+	Objects []string  `json:"objects"` // Every object flushed so far
+}
+
+// uploadBatch collects the encrypted objects of an upload. Once more than
+// maxBatchBytes are pending they are pushed early (without the index), so
+// large uploads never have to be held in memory in full.
+type uploadBatch struct {
+	session  *Session
+	files    map[string][]byte
+	deletes  []string
+	pending  int
+	manifest string   // Pending upload manifest, once the batch has flushed
+	flushed  []string // Objects pushed by earlier flushes
+}
+
+func newUploadBatch(session *Session) *uploadBatch {
+	return &uploadBatch{session: session, files: make(map[string][]byte)}
+}
+
+// add stages an object, flushing pending objects if the batch grew too large
+func (b *uploadBatch) add(storageID string, data []byte) error {
+	b.files[storageID] = data
+	b.pending += len(data)
+	if b.pending >= maxBatchBytes {
+		return b.flush()
+	}
+	return nil
+}
+
+// drop unstages objects that have not been pushed yet, e.g. the chunks of a
+// file that failed halfway. Objects an earlier flush pushed stay behind as
+// orphans for gc.
+func (b *uploadBatch) drop(storageIDs []string) {
+	for _, id := range storageIDs {
+		if data, ok := b.files[id]; ok {
+			delete(b.files, id)
+			b.pending -= len(data)
+		}
+	}
+}
+
+// flush pushes the pending objects. Chunk objects are always freshly named and
+// not referenced by the index yet, so an interrupted upload leaves the previous
+// version of a chunked file intact. The same commit updates the batch's
+// pending upload manifest, which keeps gc away from the objects until commit.
+func (b *uploadBatch) flush() error {
+	if len(b.files) == 0 {
+		return nil
+	}
+	fmt.Fprintf(progressOut, "  → Pushing %d pending objects (%d bytes)...\n", len(b.files), b.pending)
+	if b.manifest == "" {
+		b.manifest = pendingUploadsDir + GenerateRandomName()
+	}
+	for id := range b.files {
+		b.flushed = append(b.flushed, id)
+	}
+	manifest, err := json.Marshal(pendingUpload{Updated: time.Now().UTC(), Objects: b.flushed})
+	if err != nil {
+		return err
+	}
+	b.files[b.manifest] = manifest
+	if err := b.session.Push(b.files, nil); err != nil {
+		return err
+	}
+	b.files = make(map[string][]byte)
+	b.pending = 0
+	return nil
+}
+
+// commit pushes the remaining objects together with the encrypted index and
+// removes objects that are no longer referenced and the pending upload
+// manifest, all in one commit
+func (b *uploadBatch) commit(indexBytes []byte) error {
+	b.files[".config/index"] = indexBytes
+	deletes := b.deletes
+	if b.manifest != "" {
+		deletes = append(slices.Clone(deletes), b.manifest)
+	}
+	return b.session.Push(b.files, deletes)
+}
+
+// stageFile encrypts the local file at sourcePath into batch and points the
+// index entry at vaultPath to the new objects. previous is the entry being
+// replaced (nil for new files).
+func stageFile(sourcePath string, vaultPath string, fileKey []byte, encryptedKeyHex string, previous *Entry, session *Session, batch *uploadBatch) error {
+	f, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	meta := FileMetadata{
+		Modified: info.ModTime().UTC(),
+		Mode:     info.Mode().Perm(),
+		MimeType: mime.TypeByExtension(filepath.Ext(sourcePath)),
+	}
+	return stageStream(f, info.Size(), vaultPath, meta, fileKey, encryptedKeyHex, previous, session, batch)
+}
+
+// stageStream encrypts size bytes of plaintext read from r into batch and
+// records the entry with meta, filling in size, hash, MIME type and creation
+// time. Files up to ChunkSize are stored as a single blob; larger files are
+// streamed into freshly named chunk objects.
+func stageStream(r io.Reader, size int64, vaultPath string, meta FileMetadata, fileKey []byte, encryptedKeyHex string, previous *Entry, session *Session, batch *uploadBatch) error {
+	hashByteLength := session.Settings.FileHashLength / 2 // Convert hex chars to bytes
+
+	// Hash the plaintext as it streams past, and sniff its type if the extension didn't tell
+	hash := sha256.New()
+	counter := &countingWriter{}
+	buffered := bufio.NewReader(r)
+	if meta.MimeType == "" {
+		head, _ := buffered.Peek(512)
+		meta.MimeType = http.DetectContentType(head)
+	}
+	r = io.TeeReader(buffered, io.MultiWriter(hash, counter))
+
+	var storageIDs []string
+	if size <= ChunkSize {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		encryptedData, err := EncryptWithKey(data, fileKey)
+		if err != nil {
+			return err
+		}
+
+		// Always a new object: overwriting the previous version's object would
+		// break the committed index if the upload stopped after an early flush
+		realName := GenerateRandomNameWithLength(hashByteLength)
+		if err := batch.add(realName, encryptedData); err != nil {
+			return err
+		}
+		session.Index.AddFile(vaultPath, realName, encryptedKeyHex)
+		storageIDs = []string{realName}
+	} else {
+		writer, err := NewChunkWriter(fileKey, func(index int, sealed []byte) error {
+			id := GenerateRandomNameWithLength(hashByteLength)
+			storageIDs = append(storageIDs, id)
+			return batch.add(id, sealed)
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(writer, r); err != nil {
+			return fmt.Errorf("failed to encrypt %s: %w", vaultPath, err)
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		session.Index.AddChunkedFile(vaultPath, storageIDs, encryptedKeyHex)
+	}
+
+	// Record metadata; the creation time survives updates
+	meta.Size = counter.n
+	meta.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	meta.Created = time.Now().UTC()
+	if previous != nil && !previous.Created.IsZero() {
+		meta.Created = previous.Created
+	}
+	if err := session.Index.SetFileMetadata(vaultPath, meta); err != nil {
+		return err
+	}
+
+	// Objects of the previous version that nothing refers to anymore are removed in the final commit
+	if previous != nil {
+		batch.deletes = append(batch.deletes, session.Index.Unreferenced(previous.StorageIDs())...)
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sealChunks encrypts plaintext with ChunkWriter and returns the chunk
+// objects and their storage IDs (upload followed by the index), in order
+func sealChunks(t *testing.T, upload string, key, plaintext []byte) (map[string][]byte, []string) {
+	t.Helper()
+	objects := make(map[string][]byte)
+	var ids []string
+	w, err := NewChunkWriter(key, func(index int, sealed []byte) error {
+		id := fmt.Sprintf("%s%d", upload, index)
+		objects[id] = append([]byte{}, sealed...)
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("NewChunkWriter: %v", err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return objects, ids
+}
+
+func readChunks(key []byte, ids []string, objects map[string][]byte) ([]byte, error) {
+	r, err := NewChunkReader(key, ids, func(id string) ([]byte, error) {
+		data, ok := objects[id]
+		if !ok {
+			return nil, ErrNotFound
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+	key := randomBytes(t, 32)
+	for _, tt := range []struct {
+		name   string
+		size   int
+		chunks int
+	}{
+		{"empty", 0, 1},
+		{"small", 100, 1},
+		{"exactly one chunk", ChunkSize, 1},
+		{"several chunks", 2*ChunkSize + 100, 3},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext := randomBytes(t, tt.size)
+			objects, ids := sealChunks(t, "c", key, plaintext)
+			if len(ids) != tt.chunks {
+				t.Fatalf("sealed %d chunks, want %d", len(ids), tt.chunks)
+			}
+			got, err := readChunks(key, ids, objects)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Fatalf("read %d bytes that differ from the %d written", len(got), len(plaintext))
+			}
+		})
+	}
+}
+
+func TestChunkReaderRejectsTampering(t *testing.T) {
+	key := randomBytes(t, 32)
+	objects, ids := sealChunks(t, "c", key, randomBytes(t, 2*ChunkSize+100))
+	otherObjects, otherIDs := sealChunks(t, "other", key, randomBytes(t, 2*ChunkSize+100))
+	for id, data := range otherObjects {
+		objects[id] = data
+	}
+
+	flipped := append([]byte{}, objects[ids[1]]...)
+	flipped[len(flipped)-1] ^= 1
+	objects["flipped"] = flipped
+
+	// The nonce claims chunk 1, but the position is also the additional data
+	// it was sealed with, so moving it is caught by authentication
+	moved := append([]byte{}, objects[ids[0]]...)
+	copy(moved[chunkPrefixSize:NonceSize], chunkPosition(1, false))
+	objects["moved"] = moved
+
+	for _, tt := range []struct {
+		name string
+		ids  []string
+		want string
+	}{
+		{"reordered", []string{ids[1], ids[0], ids[2]}, "chunk 0 (" + ids[1] + ") is out of place"},
+		{"truncated", ids[:2], "chunk 1 (" + ids[1] + ") is out of place"},
+		{"extended", append(append([]string{}, ids...), otherIDs[2]), "chunk 2 (" + ids[2] + ") is out of place"},
+		{"mixed uploads", []string{ids[0], otherIDs[1], ids[2]}, "chunk 1 (" + otherIDs[1] + ") belongs to a different upload"},
+		{"modified ciphertext", []string{ids[0], "flipped", ids[2]}, "decryption failed for chunk 1 (flipped)"},
+		{"moved position", []string{ids[0], "moved", ids[2]}, "decryption failed for chunk 1 (moved)"},
+		{"missing chunk", []string{ids[0], "gone", ids[2]}, "failed to fetch chunk 1 (gone)"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readChunks(key, tt.ids, objects)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := readChunks(randomBytes(t, 32), ids, objects); err == nil || !strings.Contains(err.Error(), "decryption failed for chunk 0") {
+		t.Errorf("wrong key: got error %v", err)
+	}
+}
+
+func TestInterruptedUpdateKeepsPreviousVersion(t *testing.T) {
+	session := newTestSession(t)
+	source := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(source, []byte("first version"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := UploadFile(source, "notes.txt", session); err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	committed, err := session.clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stage an update and push its object early, then stop before the index commit
+	if err := os.WriteFile(source, []byte("second version"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	previous, fileKey, encryptedKeyHex, err := fileKeyFor("notes.txt", session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := newUploadBatch(session)
+	if err := stageFile(source, "notes.txt", fileKey, encryptedKeyHex, previous, session, batch); err != nil {
+		t.Fatalf("stageFile: %v", err)
+	}
+	if err := batch.flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	// The committed index, read at the vault's new head, still opens the first version
+	committed.Head = session.Head
+	output := filepath.Join(t.TempDir(), "notes.txt")
+	if err := DownloadFile("notes.txt", output, committed); err != nil {
+		t.Fatalf("DownloadFile: %v", err)
+	}
+	if got, _ := os.ReadFile(output); string(got) != "first version" {
+		t.Errorf("downloaded %q, want %q", got, "first version")
+	}
+}
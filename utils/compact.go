@@ -0,0 +1,345 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// CompactResult describes what CompactVault did
+type CompactResult struct {
+	OldCommits int      // Commits in the history before compacting
+	Commits    int      // Commits in the new history (0 if nothing was done)
+	Removed    []string // Unreferenced files left out of the new history
+	Head       string   // New head commit
+}
+
+// CompactVault replaces the vault history with a fresh one. Without
+// keepSince it is a single commit holding the current tree minus the orphan
+// objects and dangling share pointers fsck reports; with keepSince, commits
+// made after that time are kept as they are on top of a new root commit
+// holding the tree as it was at that time. The new history is checked to
+// decrypt completely before it is force-pushed, and the push only happens
+// if nobody changed the vault in the meantime.
+func CompactVault(keepSince time.Time, session *Session) (*CompactResult, error) {
+	backend, err := session.Backend()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open vault backend: %w", err)
+	}
+
+	// 1. The vault must be consistent: data missing from the current tree may
+	// still be recoverable from the history we are about to drop
+	PrintProgressStep(1, 5, "Checking vault...")
+	report, err := CheckVault(session)
+	if err != nil {
+		return nil, err
+	}
+	for _, issue := range report.Issues {
+		switch issue.Kind {
+		case FsckOrphanObject, FsckDanglingPointer, FsckUnknownFile:
+		default:
+			return nil, fmt.Errorf("vault has problems that older commits may be needed for (%s); run fsck first", issue)
+		}
+	}
+	PrintCompletionLine(fmt.Sprintf("%d stored files checked", report.Stored))
+
+	// 2. Load the complete history, which must end at the commit just checked
+	PrintProgressStep(2, 5, "Loading vault history...")
+	src, release, err := backend.History()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load vault history: %w", err)
+	}
+	defer release()
+	if headHash(src) != session.Head {
+		return nil, fmt.Errorf("vault changed while it was being checked; run compact again")
+	}
+	commits, err := firstParentChain(src, plumbing.NewHash(session.Head))
+	if err != nil {
+		return nil, err
+	}
+	result := &CompactResult{OldCommits: len(commits), Head: session.Head}
+	PrintCompletionLine(fmt.Sprintf("%d commits loaded", len(commits)))
+
+	// Commits to keep (newest first) and the commit whose tree becomes the new root
+	kept := 0
+	if !keepSince.IsZero() {
+		for kept < len(commits) && commits[kept].Committer.When.After(keepSince) {
+			kept++
+		}
+		if kept == len(commits) {
+			fmt.Println("Every commit is newer than --keep-since, nothing to compact.")
+			return result, nil
+		}
+	}
+	drop := map[string]bool{}
+	if kept == 0 {
+		result.Removed = report.Garbage
+		for _, path := range report.Garbage {
+			drop[path] = true
+		}
+		if len(commits) == 1 && len(drop) == 0 {
+			fmt.Println("History is already a single commit with no unreferenced files, nothing to compact.")
+			return result, nil
+		}
+	}
+
+	// 3. Build the new history in a temporary repository on disk, so the vault
+	// is not held in memory a second time
+	PrintProgressStep(3, 5, "Building new history...")
+	dir, err := os.MkdirTemp("", "zephyrus-compact-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary repository: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	dst, err := git.PlainInit(dir, true)
+	if err != nil {
+		return nil, err
+	}
+	base := commits[kept]
+	rootTree, _, err := copyTree(src.Storer, dst.Storer, base.TreeHash, "", drop)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy vault tree: %w", err)
+	}
+	var root *object.Commit
+	if kept == 0 {
+		sig := session.CommitInfo().signature()
+		root = &object.Commit{Author: *sig, Committer: *sig, Message: session.CommitInfo().Message}
+	} else {
+		root = &object.Commit{Author: base.Author, Committer: base.Committer, Message: base.Message}
+	}
+	root.TreeHash = rootTree
+	head, err := storeCommit(dst.Storer, root)
+	if err != nil {
+		return nil, err
+	}
+	for i := kept - 1; i >= 0; i-- {
+		c := commits[i]
+		tree, _, err := copyTree(src.Storer, dst.Storer, c.TreeHash, "", nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy commit %s: %w", c.Hash, err)
+		}
+		head, err = storeCommit(dst.Storer, &object.Commit{
+			Author:       c.Author,
+			Committer:    c.Committer,
+			Message:      c.Message,
+			TreeHash:     tree,
+			ParentHashes: []plumbing.Hash{head},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := dst.Storer.SetReference(plumbing.NewHashReference("refs/heads/master", head)); err != nil {
+		return nil, err
+	}
+	result.Commits = kept + 1
+	PrintCompletionLine(fmt.Sprintf("%d commits, %d unreferenced files left out", result.Commits, len(result.Removed)))
+
+	// 4. Prove the new head opens with our password and every file and share decrypts
+	PrintProgressStep(4, 5, "Verifying new history...")
+	commit, err := dst.CommitObject(head)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyCompactedTree(commit, session); err != nil {
+		return nil, fmt.Errorf("new history failed verification, nothing was pushed: %w", err)
+	}
+	PrintCompletionLine("Every file and share decrypts")
+
+	// 5. Replace the history, unless the vault changed since it was checked
+	PrintProgressStep(5, 5, "Force pushing to "+backend.Describe()+"...")
+	err = backend.ReplaceHistory(dst, session.Head)
+	if errors.Is(err, ErrStaleHead) {
+		return nil, fmt.Errorf("vault changed while it was being compacted, nothing was replaced; run compact again")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to push new history: %w", err)
+	}
+	session.Head = head.String()
+	result.Head = session.Head
+	PrintCompletionLine("History replaced")
+	return result, nil
+}
+
+// firstParentChain returns the commits from head back to the root, newest
+// first, following first parents (vault history is linear)
+func firstParentChain(r *git.Repository, head plumbing.Hash) ([]*object.Commit, error) {
+	var commits []*object.Commit
+	for hash := head; ; {
+		c, err := r.CommitObject(hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read commit %s: %w", hash, err)
+		}
+		commits = append(commits, c)
+		if len(c.ParentHashes) == 0 {
+			return commits, nil
+		}
+		hash = c.ParentHashes[0]
+	}
+}
+
+// copyTree copies the tree hash and everything below it from src to dst,
+// leaving out the paths in drop. Folders left empty are left out as well;
+// ok is false if nothing remains.
+func copyTree(src, dst storer.EncodedObjectStorer, hash plumbing.Hash, prefix string, drop map[string]bool) (plumbing.Hash, bool, error) {
+	tree, err := object.GetTree(src, hash)
+	if err != nil {
+		return plumbing.ZeroHash, false, err
+	}
+	out := &object.Tree{}
+	for _, e := range tree.Entries {
+		path := prefix + e.Name
+		if drop[path] {
+			continue
+		}
+		if e.Mode == filemode.Dir {
+			sub, ok, err := copyTree(src, dst, e.Hash, path+"/", drop)
+			if err != nil {
+				return plumbing.ZeroHash, false, err
+			}
+			if !ok {
+				continue
+			}
+			e.Hash = sub
+		} else if err := copyObject(src, dst, e.Hash); err != nil {
+			return plumbing.ZeroHash, false, fmt.Errorf("%s: %w", path, err)
+		}
+		out.Entries = append(out.Entries, e)
+	}
+	if len(out.Entries) == 0 {
+		return plumbing.ZeroHash, false, nil
+	}
+
+	obj := dst.NewEncodedObject()
+	if err := out.Encode(obj); err != nil {
+		return plumbing.ZeroHash, false, err
+	}
+	hash, err = dst.SetEncodedObject(obj)
+	return hash, true, err
+}
+
+// copyObject copies one object from src to dst, unless dst already has it
+func copyObject(src, dst storer.EncodedObjectStorer, hash plumbing.Hash) error {
+	if dst.HasEncodedObject(hash) == nil {
+		return nil
+	}
+	obj, err := src.EncodedObject(plumbing.AnyObject, hash)
+	if err != nil {
+		return err
+	}
+	reader, err := obj.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	copied := dst.NewEncodedObject()
+	copied.SetType(obj.Type())
+	copied.SetSize(obj.Size())
+	writer, err := copied.Writer()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		return err
+	}
+	writer.Close()
+	_, err = dst.SetEncodedObject(copied)
+	return err
+}
+
+// storeCommit writes a commit object and returns its hash
+func storeCommit(s storer.EncodedObjectStorer, c *object.Commit) (plumbing.Hash, error) {
+	obj := s.NewEncodedObject()
+	if err := c.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return s.SetEncodedObject(obj)
+}
+
+// verifyCompactedTree checks that commit holds a vault the session can open:
+// the master key and indexes decrypt, every file decrypts and matches its
+// checksum, and every share pointer decrypts and has its objects
+func verifyCompactedTree(commit *object.Commit, session *Session) error {
+	fetch := func(path string) ([]byte, error) {
+		f, err := commit.File(path)
+		if errors.Is(err, object.ErrFileNotFound) {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		contents, err := f.Contents()
+		return []byte(contents), err
+	}
+
+	data, err := fetch(".config/key")
+	if err != nil {
+		return fmt.Errorf("master key: %w", err)
+	}
+	rawKey, err := Decrypt(data, session.Password)
+	if err != nil || !bytes.Equal(rawKey, session.RawKey) {
+		return fmt.Errorf("master key does not decrypt to the session's key")
+	}
+
+	index := NewIndex()
+	if data, err = fetch(".config/index"); err == nil {
+		if index, err = FromBytes(data, session.Password); err != nil {
+			return fmt.Errorf("failed to decrypt index: %w", err)
+		}
+	} else if !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("index: %w", err)
+	}
+	sharedIndex := NewSharedIndex()
+	if data, err = fetch("shared/.config/index"); err == nil {
+		if sharedIndex, err = DecryptSharedIndex(data, session.Password); err != nil {
+			return fmt.Errorf("failed to decrypt shared index: %w", err)
+		}
+	} else if !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("shared index: %w", err)
+	}
+
+	files := IndexFiles(index, "")
+	failures := FileErrors{Total: len(files) + len(sharedIndex.Files)}
+	for i, file := range files {
+		PrintProgressBar("Decrypting files", i+1, len(files))
+		if result := verifyFile(file.Path, &file.Entry, session, fetch); result.Status == VerifyFailed {
+			failures.Errors = append(failures.Errors, fmt.Errorf("%s: %s", file.Path, result.Error))
+		}
+	}
+	if len(files) > 0 {
+		fmt.Fprintln(progressOut)
+	}
+	for ref, shared := range sharedIndex.Files {
+		data, err := fetch("shared/" + ref)
+		if err != nil {
+			failures.Errors = append(failures.Errors, fmt.Errorf("share %s: %w", shared.Name, err))
+			continue
+		}
+		pointer, err := decryptSharePointer(data, shared.Password)
+		if err != nil {
+			failures.Errors = append(failures.Errors, fmt.Errorf("share %s: %w", shared.Name, err))
+			continue
+		}
+		for _, file := range pointerFiles(pointer) {
+			for _, id := range file.entry().StorageIDs() {
+				if _, err := commit.File(id); err != nil {
+					failures.Errors = append(failures.Errors, fmt.Errorf("share %s: object %s missing", shared.Name, id))
+				}
+			}
+		}
+	}
+	if len(failures.Errors) > 0 {
+		return &failures
+	}
+	return nil
+}
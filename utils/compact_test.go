@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCompactVault(t *testing.T) {
+	session := newTestSession(t)
+	source := filepath.Join(t.TempDir(), "notes.txt")
+	for _, content := range []string{"first version", "second version"} {
+		if err := os.WriteFile(source, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := UploadFile(source, "notes.txt", session); err != nil {
+			t.Fatalf("UploadFile: %v", err)
+		}
+	}
+	if err := session.Push(map[string][]byte{"bb22": []byte("orphan")}, nil); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+
+	// The new history is built in a temporary repository that must not outlive the compaction
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	result, err := CompactVault(time.Time{}, session)
+	if err != nil {
+		t.Fatalf("CompactVault: %v", err)
+	}
+	if result.Commits != 1 || !slices.Equal(result.Removed, []string{"bb22"}) {
+		t.Errorf("result = %+v, want 1 commit with bb22 removed", result)
+	}
+	if left, _ := os.ReadDir(tmp); len(left) != 0 {
+		t.Errorf("temporary files left behind: %v", left)
+	}
+
+	backend, err := session.Backend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head, _ := backend.Head(); head != session.Head {
+		t.Errorf("vault is at %q, session at %q", head, session.Head)
+	}
+	output := filepath.Join(t.TempDir(), "notes.txt")
+	if err := DownloadFile("notes.txt", output, session); err != nil {
+		t.Fatalf("DownloadFile after compacting: %v", err)
+	}
+	if got, _ := os.ReadFile(output); string(got) != "second version" {
+		t.Errorf("downloaded %q, want %q", got, "second version")
+	}
+}
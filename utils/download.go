@@ -1,10 +1,8 @@
 package utils
 
 import (
-	"encoding/base64"
-	"encoding/hex"
-	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -13,7 +11,7 @@ import (
 
 func DownloadFile(vaultPath string, outputPath string, session *Session) error {
 	// 1. Use your custom FindEntry logic to navigate the nested maps
-	PrintProgressStep(1, 5, "Locating file in vault...")
+	PrintProgressStep(1, 4, "Locating file in vault...")
 	entry, err := session.Index.FindEntry(vaultPath)
 	if err != nil {
 		return fmt.Errorf("could not find file in vault: %w", err)
@@ -27,47 +25,93 @@ func DownloadFile(vaultPath string, outputPath string, session *Session) error {
 
 	fmt.Printf("Downloading %s (Storage ID: %s)...\n", vaultPath, entry.RealName)
 
-	// 3. Fetch the encrypted hex-named file from GitHub
-	PrintProgressStep(2, 5, "Fetching encrypted file from GitHub...")
-	encryptedData, err := FetchRaw(session.Username, entry.RealName)
+	// 3. Decrypt the file key from the index
+	PrintProgressStep(2, 4, "Decrypting file key...")
+	fileKey, err := session.UnwrapFileKey(entry.FileKey)
 	if err != nil {
-		return fmt.Errorf("failed to fetch storage file from remote: %w", err)
+		return fmt.Errorf("failed to decrypt file key: %w", err)
 	}
-	PrintCompletionLine("File fetched from GitHub")
+	PrintCompletionLine("File key decrypted")
 
-	// 4. Decrypt the file key from the index
-	PrintProgressStep(3, 5, "Decrypting file key...")
-	encryptedKey, err := hex.DecodeString(entry.FileKey)
+	// 4. Open the encrypted file in the vault (chunked files are fetched as they are written)
+	PrintProgressStep(3, 4, "Fetching encrypted file from vault...")
+	reader, err := NewEntryReader(entry, fileKey, session.Fetch)
 	if err != nil {
-		return fmt.Errorf("invalid file key in index: %w", err)
+		return err
 	}
-	fileKey, err := Decrypt(encryptedKey, session.Password)
-	if err != nil {
-		return fmt.Errorf("failed to decrypt file key: check your password")
+	if entry.IsChunked() {
+		PrintCompletionLine(fmt.Sprintf("Streaming %d chunks from vault", len(entry.Chunks)))
+	} else {
+		PrintCompletionLine("File fetched from vault")
 	}
-	PrintCompletionLine("File key decrypted")
 
-	// 5. Decrypt the file data with the file key
-	PrintProgressStep(4, 5, "Decrypting file contents...")
-	time.Sleep(time.Millisecond * 100) // Simulate work for visibility
-	decryptedData, err := DecryptWithKey(encryptedData, fileKey)
+	// 5. Decrypt the file contents into the local output path
+	PrintProgressStep(4, 4, "Saving file to "+outputPath+"...")
+	err = saveStream(reader, outputPath)
 	if err != nil {
-		return fmt.Errorf("decryption failed: %w", err)
+		return err
 	}
-	PrintCompletionLine("File contents decrypted")
+	applyFileMetadata(outputPath, entry)
+	PrintCompletionLine("File saved successfully")
+	return nil
+}
 
-	// 6. Save to the local output path
-	PrintProgressStep(5, 5, "Saving file to "+outputPath+"...")
-	err = os.WriteFile(outputPath, decryptedData, 0644)
+// saveStream writes decrypted contents to outputPath, removing the partial
+// file if decryption fails midway
+func saveStream(reader io.Reader, outputPath string) error {
+	out, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
-	PrintCompletionLine("File saved successfully")
+	_, err = io.Copy(out, reader)
+	closeErr := out.Close()
+	if err != nil {
+		os.Remove(outputPath)
+		return err
+	}
+	return closeErr
+}
+
+// applyFileMetadata restores the original permissions and modification time of
+// a downloaded file, when the entry recorded them. Failures are not fatal.
+func applyFileMetadata(path string, entry *Entry) {
+	if entry.Mode != 0 {
+		os.Chmod(path, entry.Mode)
+	}
+	if !entry.Modified.IsZero() {
+		os.Chtimes(path, time.Time{}, entry.Modified)
+	}
+}
+
+// downloadEntry decrypts a file entry into outputPath and restores its metadata
+func downloadEntry(entry *Entry, vaultPath string, outputPath string, session *Session) error {
+	fileKey, err := session.UnwrapFileKey(entry.FileKey)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt file key for %s: %w", vaultPath, err)
+	}
+
+	reader, err := NewEntryReader(entry, fileKey, session.Fetch)
+	if err != nil {
+		return fmt.Errorf("failed to fetch file %s: %w", vaultPath, err)
+	}
+	if err := saveStream(reader, outputPath); err != nil {
+		return fmt.Errorf("failed to save file %s: %w", outputPath, err)
+	}
+	applyFileMetadata(outputPath, entry)
 	return nil
 }
 
-// DownloadDirectory downloads an entire directory recursively from the vault
-func DownloadDirectory(vaultPath string, outputPath string, session *Session) error {
+// directoryFile is one file of a directory download
+type directoryFile struct {
+	entry     Entry
+	vaultPath string
+	localPath string
+}
+
+// DownloadDirectory downloads an entire directory recursively from the vault,
+// fetching and decrypting up to jobs files at once. A file that fails does not
+// stop the others; all failures are returned together as *FileErrors.
+func DownloadDirectory(vaultPath string, outputPath string, jobs int, session *Session) error {
 	// 1. Verify the path is a directory
 	PrintProgressStep(1, 3, "Locating directory in vault...")
 	entry, err := session.Index.FindEntry(vaultPath)
@@ -89,179 +133,99 @@ func DownloadDirectory(vaultPath string, outputPath string, session *Session) er
 		return fmt.Errorf("failed to create output directory: %w", err)
 	}
 
-	fileCount := 0
-
-	// 4. Recursively download all files in the directory
-	var downloadFiles func(currentEntry Entry, currentVaultPath string, currentLocalPath string) error
-	downloadFiles = func(currentEntry Entry, currentVaultPath string, currentLocalPath string) error {
-		// Process all entries in the current folder
-		for name, subEntry := range currentEntry.Contents {
-			var nextVaultPath string
-			if currentVaultPath == "" {
-				nextVaultPath = name
-			} else {
-				nextVaultPath = currentVaultPath + "/" + name
-			}
-
-			nextLocalPath := filepath.Join(currentLocalPath, name)
-
-			if subEntry.Type == "file" {
-				fileCount++
-				fmt.Printf("Downloading file (%d): %s\n", fileCount, name)
-
-				// 5. Fetch the encrypted file from GitHub
-				encryptedData, err := FetchRaw(session.Username, subEntry.RealName)
-				if err != nil {
-					return fmt.Errorf("failed to fetch file %s: %w", nextVaultPath, err)
-				}
-
-				// 6. Decrypt the file key from the index
-				encryptedKey, err := hex.DecodeString(subEntry.FileKey)
-				if err != nil {
-					return fmt.Errorf("invalid file key in index for %s: %w", nextVaultPath, err)
-				}
-				fileKey, err := Decrypt(encryptedKey, session.Password)
-				if err != nil {
-					return fmt.Errorf("failed to decrypt file key for %s: %w", nextVaultPath, err)
-				}
-
-				// 7. Decrypt the file data with the file key
-				decryptedData, err := DecryptWithKey(encryptedData, fileKey)
-				if err != nil {
-					return fmt.Errorf("decryption failed for %s: %w", nextVaultPath, err)
-				}
-
-				// 8. Save to local path
-				err = os.WriteFile(nextLocalPath, decryptedData, 0644)
-				if err != nil {
-					return fmt.Errorf("failed to save file %s: %w", nextLocalPath, err)
-				}
-
-				fmt.Printf("  → Saved: %s\n", nextLocalPath)
-
-			} else if subEntry.Type == "folder" {
-				// Create subdirectory
-				err := os.MkdirAll(nextLocalPath, 0755)
-				if err != nil {
-					return fmt.Errorf("failed to create directory %s: %w", nextLocalPath, err)
-				}
-
-				// Recursively download contents
-				err = downloadFiles(subEntry, nextVaultPath, nextLocalPath)
-				if err != nil {
-					return err
-				}
+	// 4. Recreate the folder tree and list its files in a stable order
+	var files []directoryFile
+	err = WalkIndex(entry.Contents, "", func(rel string, subEntry *Entry) error {
+		localPath := filepath.Join(outputPath, filepath.FromSlash(rel))
+		if subEntry.Type == "folder" {
+			if err := os.MkdirAll(localPath, 0755); err != nil {
+				return fmt.Errorf("failed to create directory %s: %w", localPath, err)
 			}
+			return nil
 		}
-
+		files = append(files, directoryFile{entry: *subEntry, vaultPath: joinVaultPath(strings.Trim(vaultPath, "/"), rel), localPath: localPath})
 		return nil
-	}
-
-	// Start recursive download from the directory entry
-	err = downloadFiles(*entry, vaultPath, outputPath)
+	})
 	if err != nil {
 		return err
 	}
 
-	if fileCount == 0 {
+	if len(files) == 0 {
 		return fmt.Errorf("no files found in directory: %s", vaultPath)
 	}
 
+	// 5. Decrypt the file keys, then fetch, decrypt and save the files in parallel.
+	// The key-encryption key is derived and the backend opened once, before
+	// the workers share the session.
+	if _, err := session.kek(); err != nil {
+		return err
+	}
+	if _, err := session.Backend(); err != nil {
+		return err
+	}
+	saved := 0
+	err = runJobs(len(files), jobs, func(i int) error {
+		return downloadEntry(&files[i].entry, files[i].vaultPath, files[i].localPath, session)
+	}, func(i int, err error) {
+		fmt.Printf("Downloading file (%d/%d): %s\n", i+1, len(files), files[i].vaultPath)
+		if err != nil {
+			fmt.Printf("  ✗ Failed: %v\n", err)
+			return
+		}
+		saved++
+		fmt.Printf("  → Saved: %s\n", files[i].localPath)
+	})
+	if err != nil {
+		fmt.Printf("Downloaded %d of %d files\n", saved, len(files))
+		return err
+	}
+
 	PrintProgressStep(2, 3, "Finalizing download...")
 	PrintCompletionLine("Decryption complete")
 
 	PrintProgressStep(3, 3, "Writing files to disk...")
 	PrintCompletionLine("Files written successfully")
 
-	fmt.Printf("✔ Successfully downloaded %d files from directory\n", fileCount)
+	fmt.Printf("✔ Successfully downloaded %d files from directory\n", saved)
 	return nil
 }
 
-// DownloadSharedFile downloads a file using a share string (username:reference:sharepassword:base64filename)
+// DownloadSharedFile downloads a shared file or folder. shareString can be a
+// share link, a web share URL or an older share string (see ParseShareLink).
+// Without outputPath, the name in the link is used.
 func DownloadSharedFile(shareString string, outputPath string) error {
-	// 1. Parse the share string (supports both old 3-part and new 4-part formats)
-	parts := strings.Split(shareString, ":")
-	if len(parts) < 3 || len(parts) > 4 {
-		return fmt.Errorf("invalid share string format, expected 'username:reference:sharepassword' or 'username:reference:sharepassword:base64filename'")
-	}
-
-	username := parts[0]
-	reference := parts[1]
-	sharePassword := parts[2]
-	var filename string
-
-	// Decode filename if provided in share string
-	if len(parts) == 4 {
-		decoded, err := base64.StdEncoding.DecodeString(parts[3])
-		if err != nil {
-			return fmt.Errorf("invalid filename encoding in share string: %w", err)
-		}
-		filename = string(decoded)
-	}
-
-	// Use provided outputPath, or construct from filename if available
-	finalOutputPath := outputPath
-	if filename != "" && outputPath == "" {
-		finalOutputPath = filename
-	}
-
-	if filename != "" {
-		fmt.Printf("Downloading '%s' from %s (Reference: %s)...\n", filename, username, reference)
-	} else {
-		fmt.Printf("Downloading shared file from %s (Reference: %s)...\n", username, reference)
-	}
-
-	// 2. Fetch the share pointer from the /shared/ folder
-	sharedPath := fmt.Sprintf("shared/%s", reference)
-	pointerData, err := FetchRaw(username, sharedPath)
+	// 1. Parse the share link
+	link, err := ParseShareLink(shareString)
 	if err != nil {
-		return fmt.Errorf("failed to fetch share pointer from remote: %w", err)
+		return err
 	}
-
-	// 3. Decrypt the pointer with the share password to get storage ID and file key
-	decryptedPointer, err := Decrypt(pointerData, sharePassword)
-	if err != nil {
-		return fmt.Errorf("decryption failed: invalid share password")
+	if outputPath == "" {
+		outputPath = link.DefaultName()
 	}
 
-	// 4. Parse the pointer JSON to get storage ID and encrypted file key
-	var pointerMap map[string]string
-	err = json.Unmarshal(decryptedPointer, &pointerMap)
-	if err != nil {
-		return fmt.Errorf("invalid share pointer format: %w", err)
-	}
-
-	storageID, ok := pointerMap["storageID"]
-	if !ok {
-		return fmt.Errorf("share pointer missing storageID")
-	}
-	fileKeyHex, ok := pointerMap["fileKey"]
-	if !ok {
-		return fmt.Errorf("share pointer missing fileKey")
+	if link.Name != "" {
+		fmt.Printf("Downloading '%s' from %s (Reference: %s)...\n", link.Name, link.Username, link.Reference)
+	} else {
+		fmt.Printf("Downloading shared file from %s (Reference: %s)...\n", link.Username, link.Reference)
 	}
 
-	// 5. Fetch the actual encrypted file from main storage
-	encryptedFileData, err := FetchRaw(username, storageID)
+	// 2. Fetch the share pointer and decrypt it with the share password
+	pointer, backend, err := openShareLink(link)
 	if err != nil {
-		return fmt.Errorf("failed to fetch file from remote: %w", err)
+		return err
 	}
 
-	// 6. Decrypt the file key (it's encrypted with the share password for this transfer)
-	encryptedKeyBytes, err := hex.DecodeString(fileKeyHex)
-	if err != nil {
-		return fmt.Errorf("invalid file key encoding: %w", err)
-	}
-	fileKey, err := Decrypt(encryptedKeyBytes, sharePassword)
-	if err != nil {
-		return fmt.Errorf("failed to decrypt file key: %w", err)
+	// 3. Folder shares list their files; recreate the subtree
+	if pointer.IsFolder() {
+		return downloadSharedFolder(pointer, outputPath, backend)
 	}
 
-	// 7. Decrypt the file content with the file key
-	decryptedData, err := DecryptWithKey(encryptedFileData, fileKey)
+	// 4. Fetch the file from the sharer's vault and decrypt it with the file key
+	reader, err := pointer.fileReader(backend)
 	if err != nil {
-		return fmt.Errorf("file decryption failed: %w", err)
+		return err
 	}
 
-	// 8. Save to the local output path
-	return os.WriteFile(finalOutputPath, decryptedData, 0644)
+	// 5. Save to the local output path
+	return saveStream(reader, outputPath)
 }
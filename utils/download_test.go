@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestSession returns a session on a new vault in a local bare repository,
+// as FetchSessionStateless would load it after setup
+func newTestSession(t *testing.T) *Session {
+	t.Helper()
+	t.Setenv("ZEPHYRUS_CACHE_DIR", t.TempDir())
+
+	dir := filepath.Join(t.TempDir(), "vault")
+	b := newTestLocalBackend(t, dir)
+	rawKey := make([]byte, 32)
+	if _, err := rand.Read(rawKey); err != nil {
+		t.Fatal(err)
+	}
+	encryptedKey, err := Encrypt(rawKey, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Reset(map[string][]byte{".config/key": encryptedKey}, CommitInfo{Message: "setup", AuthorName: "Test", AuthorEmail: "test@example.com"}); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	head, err := b.Head()
+	if err != nil {
+		t.Fatalf("Head: %v", err)
+	}
+
+	return &Session{
+		Username:    "test",
+		Password:    "password",
+		RawKey:      rawKey,
+		Index:       NewIndex(),
+		SharedIndex: NewSharedIndex(),
+		Settings:    DefaultSettings(),
+		BackendSpec: "local:" + dir,
+		Head:        head,
+	}
+}
+
+func TestDownloadDirectoryParallel(t *testing.T) {
+	session := newTestSession(t)
+
+	source := t.TempDir()
+	want := make(map[string][]byte)
+	for i := 0; i < 8; i++ {
+		name := filepath.Join(fmt.Sprintf("dir%d", i%2), fmt.Sprintf("file%d.bin", i))
+		data := make([]byte, 1000+i)
+		rand.Read(data)
+		want[name] = data
+		if err := os.MkdirAll(filepath.Join(source, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(source, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := UploadDirectory(source, "docs", session); err != nil {
+		t.Fatalf("UploadDirectory: %v", err)
+	}
+
+	// A fresh copy has no backend open yet, like a session loaded from disk;
+	// the workers must not race to open it
+	fresh, err := session.clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := t.TempDir()
+	if err := DownloadDirectory("docs", output, 4, fresh); err != nil {
+		t.Fatalf("DownloadDirectory: %v", err)
+	}
+
+	for name, data := range want {
+		got, err := os.ReadFile(filepath.Join(output, name))
+		if err != nil {
+			t.Errorf("%s was not downloaded: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: downloaded content differs", name)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package utils
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// dryRun is set by --dry-run: backends print what a write would change instead of writing
+var dryRun bool
+
+// SetDryRun turns dry-run mode on or off for this process
+func SetDryRun(enabled bool) {
+	dryRun = enabled
+}
+
+// DryRun reports whether writes are only printed
+func DryRun() bool {
+	return dryRun
+}
+
+// dryRunBackend wraps a backend so that every write prints its change set
+// and leaves the vault untouched. Reads go to the wrapped backend, so a
+// command computes exactly what it would push (encrypting new files to get
+// their storage IDs and sizes) before it is dropped here.
+type dryRunBackend struct {
+	Backend
+	password string       // Decrypts the indexes a write changes; "" lists storage paths only
+	held     *heldObjects // Early flushes of an upload, printed with its final commit
+}
+
+// heldObjects are the objects a large upload pushed early (see uploadBatch),
+// by path with their size. They are printed as part of the commit that
+// writes the upload's index, so the upload shows as one change set.
+type heldObjects map[string]int64
+
+// withVaultPassword lets a dry-run backend read the vault's indexes, so its
+// change sets name vault paths. Other backends are returned unchanged.
+func withVaultPassword(backend Backend, password string) Backend {
+	if b, ok := backend.(dryRunBackend); ok {
+		b.password = password
+		return b
+	}
+	return backend
+}
+
+// Change kinds printed for a dry run
+const (
+	changeAdd     = "add"
+	changeUpdate  = "update"
+	changeRemove  = "remove"
+	changeMove    = "move"
+	changeShare   = "share"
+	changeUnshare = "unshare"
+)
+
+// vaultChange is one vault path a write would change, as seen in the index
+type vaultChange struct {
+	Kind   string
+	Path   string
+	Detail string // Previous path of a move, reference of a share
+	Size   int64  // Plaintext bytes of added and updated files
+}
+
+// storedChange is one path a write would touch
+type storedChange struct {
+	Kind string
+	Path string
+	Size int64 // Bytes written (0 for removals)
+}
+
+// WriteBatch prints the batch and returns the parent as the "new" head, so
+// the session stays on the commit it was loaded from
+func (b dryRunBackend) WriteBatch(batch Batch) (string, error) {
+	sizes := objectSizes(batch.Files)
+	if isEarlyFlush(batch) {
+		for path, size := range sizes {
+			(*b.held)[path] = size
+		}
+		return batch.Parent, nil
+	}
+
+	// Objects held from early flushes are part of this commit. The pending
+	// upload manifest it removes was never stored, so it is left out.
+	deletes := batch.Deletes
+	if len(*b.held) > 0 {
+		deletes = nil
+		for _, path := range batch.Deletes {
+			if _, held := (*b.held)[path]; !held {
+				deletes = append(deletes, path)
+			}
+		}
+		for path, size := range *b.held {
+			if _, written := sizes[path]; !written && !slices.Contains(batch.Deletes, path) {
+				sizes[path] = size
+			}
+		}
+		clear(*b.held)
+	}
+
+	stored, err := b.stored()
+	if err != nil {
+		return "", err
+	}
+	vault, names := b.vaultChanges(batch.Parent, batch.Files, false)
+	printChangeSet(fmt.Sprintf("commit %q", batch.Commit.Message), vault, names, diffBatch(stored, sizes, deletes))
+	return batch.Parent, nil
+}
+
+// isEarlyFlush reports whether a batch pushes the objects of an upload ahead
+// of its index, with the upload's pending manifest
+func isEarlyFlush(batch Batch) bool {
+	if _, ok := batch.Files[".config/index"]; ok {
+		return false
+	}
+	for path := range batch.Files {
+		if strings.HasPrefix(path, pendingUploadsDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// objectSizes maps each path of files to the bytes written there
+func objectSizes(files map[string][]byte) map[string]int64 {
+	sizes := make(map[string]int64, len(files))
+	for path, data := range files {
+		sizes[path] = int64(len(data))
+	}
+	return sizes
+}
+
+func (b dryRunBackend) DeleteBatch(paths []string, info CommitInfo) error {
+	_, err := b.WriteBatch(Batch{Deletes: paths, Commit: info})
+	return err
+}
+
+// Reset removes everything stored and writes files as the only commit
+func (b dryRunBackend) Reset(files map[string][]byte, info CommitInfo) error {
+	stored, err := b.stored()
+	if err != nil {
+		return err
+	}
+	deletes := make([]string, 0, len(stored))
+	for path := range stored {
+		if _, ok := files[path]; !ok {
+			deletes = append(deletes, path)
+		}
+	}
+	vault, names := b.vaultChanges("", files, true)
+	printChangeSet("replacing the whole history with one commit", vault, names, diffBatch(stored, objectSizes(files), deletes))
+	return nil
+}
+
+func (b dryRunBackend) ReplaceHistory(r *git.Repository, expected string) error {
+	commits := 0
+	if ref, err := r.Reference(plumbing.ReferenceName("refs/heads/master"), true); err == nil {
+		if chain, err := firstParentChain(r, ref.Hash()); err == nil {
+			commits = len(chain)
+		}
+	}
+	fmt.Printf("\nDry run: the history would be replaced by %d commit(s) ending at %s; nothing was pushed.\n", commits, headHash(r))
+	return nil
+}
+
+// stored returns the paths the vault holds now
+func (b dryRunBackend) stored() (map[string]bool, error) {
+	paths, err := b.Backend.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list vault contents: %w", err)
+	}
+	stored := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		stored[p] = true
+	}
+	return stored, nil
+}
+
+// diffBatch classifies the writes and removals of a batch against what is
+// stored, in path order. Removals of paths that are not stored are dropped,
+// as a real push would ignore them.
+func diffBatch(stored map[string]bool, files map[string]int64, deletes []string) []storedChange {
+	var changes []storedChange
+	for path, size := range files {
+		kind := changeAdd
+		if stored[path] {
+			kind = changeUpdate
+		}
+		changes = append(changes, storedChange{Kind: kind, Path: path, Size: size})
+	}
+	for _, path := range deletes {
+		if _, written := files[path]; stored[path] && !written {
+			changes = append(changes, storedChange{Kind: changeRemove, Path: path})
+		}
+	}
+	slices.SortFunc(changes, func(a, b storedChange) int { return strings.Compare(a.Path, b.Path) })
+	return slices.CompactFunc(changes, func(a, b storedChange) bool { return a.Path == b.Path })
+}
+
+// vaultChanges compares the indexes a write stages in files with those of the
+// parent commit and returns the vault paths that change, in path order, with
+// the vault path each storage object and share pointer belongs to. An index
+// missing from files is unchanged, or empty when reset is set, in which case
+// the indexes are compared with the current head instead. Without the
+// vault password, or if an index cannot be read, it returns nothing and the
+// change set lists storage paths only.
+func (b dryRunBackend) vaultChanges(parent string, files map[string][]byte, reset bool) ([]vaultChange, map[string]string) {
+	if b.password == "" {
+		return nil, nil
+	}
+	if reset {
+		head, err := b.Backend.Head()
+		if err != nil {
+			return nil, nil
+		}
+		parent = head
+	}
+	names := make(map[string]string)
+	var changes []vaultChange
+
+	if data, staged := files[".config/index"]; staged || reset {
+		before, err := fetchIndexAt(b.Backend, parent, b.password)
+		if err != nil {
+			return nil, nil
+		}
+		after := NewIndex()
+		if staged {
+			if after, err = FromBytes(data, b.password); err != nil {
+				return nil, nil
+			}
+		}
+		changes = diffIndexes(before, after, names)
+	}
+
+	if data, staged := files["shared/.config/index"]; staged || reset {
+		before, err := fetchSharedIndexAt(b.Backend, parent, b.password)
+		if err != nil {
+			return nil, nil
+		}
+		after := NewSharedIndex()
+		if staged {
+			if after, err = DecryptSharedIndex(data, b.password); err != nil {
+				return nil, nil
+			}
+		}
+		for ref, share := range after.Files {
+			names["shared/"+ref] = share.OriginalPath
+			if _, existed := before.Files[ref]; !existed {
+				changes = append(changes, vaultChange{Kind: changeShare, Path: share.OriginalPath, Detail: ref})
+			}
+		}
+		for ref, share := range before.Files {
+			if _, kept := after.Files[ref]; !kept {
+				names["shared/"+ref] = share.OriginalPath
+				changes = append(changes, vaultChange{Kind: changeUnshare, Path: share.OriginalPath, Detail: ref})
+			}
+		}
+	}
+
+	slices.SortFunc(changes, func(a, b vaultChange) int {
+		if c := strings.Compare(a.Path, b.Path); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Kind, b.Kind)
+	})
+	return changes, names
+}
+
+// diffIndexes lists the files and empty folders that differ between two
+// indexes; folders with contents follow from their files. A file removed in one place and added in another with the same
+// storage objects is a move. names is filled with the vault path of every
+// storage object of either index.
+func diffIndexes(before, after VaultIndex, names map[string]string) []vaultChange {
+	old, current := indexPaths(before), indexPaths(after)
+	for _, entries := range []map[string]Entry{old, current} {
+		for p, entry := range entries {
+			if entry.Type != "file" {
+				continue
+			}
+			for _, id := range entry.StorageIDs() {
+				names[id] = p
+			}
+		}
+	}
+
+	var changes []vaultChange
+	removed := make(map[string]string) // First storage object of a removed file -> its path
+	for p, entry := range old {
+		if _, kept := current[p]; kept {
+			continue
+		}
+		if entry.Type != "file" {
+			if len(entry.Contents) == 0 {
+				changes = append(changes, vaultChange{Kind: changeRemove, Path: p + "/"})
+			}
+		} else if ids := entry.StorageIDs(); len(ids) > 0 {
+			removed[ids[0]] = p
+		} else {
+			changes = append(changes, vaultChange{Kind: changeRemove, Path: p})
+		}
+	}
+	for p, entry := range current {
+		previous, existed := old[p]
+		switch {
+		case entry.Type != "file":
+			if !existed && len(entry.Contents) == 0 {
+				changes = append(changes, vaultChange{Kind: changeAdd, Path: p + "/"})
+			}
+		case !existed:
+			if ids := entry.StorageIDs(); len(ids) > 0 {
+				if from, ok := removed[ids[0]]; ok {
+					delete(removed, ids[0])
+					changes = append(changes, vaultChange{Kind: changeMove, Path: p, Detail: from})
+					continue
+				}
+			}
+			changes = append(changes, vaultChange{Kind: changeAdd, Path: p, Size: entry.Size})
+		case !sameEntry(previous, true, entry, true):
+			changes = append(changes, vaultChange{Kind: changeUpdate, Path: p, Size: entry.Size})
+		}
+	}
+	for _, p := range removed {
+		changes = append(changes, vaultChange{Kind: changeRemove, Path: p})
+	}
+	return changes
+}
+
+// indexPaths maps the vault path of every file and folder in index to its
+// entry
+func indexPaths(index VaultIndex) map[string]Entry {
+	paths := make(map[string]Entry)
+	WalkIndex(index, "", func(vaultPath string, entry *Entry) error {
+		paths[vaultPath] = *entry
+		return nil
+	})
+	return paths
+}
+
+// describeStoredPath says what a stored path is, for the change set
+func describeStoredPath(path string) string {
+	switch {
+	case path == ".config/index":
+		return "vault index"
+	case path == ".config/key":
+		return "master key"
+	case path == ".config/settings":
+		return "settings"
+	case path == publicKeyPath:
+		return "public key"
+	case path == privateKeyPath:
+		return "private key"
+	case path == inboxPath:
+		return "inbox"
+	case path == "shared/.config/index":
+		return "shared index"
+	case strings.HasPrefix(path, outboxPath("")):
+		return "outbox"
+	case strings.HasPrefix(path, "shared/"):
+		return "share pointer"
+	case !strings.Contains(path, "/") && isStorageID(path):
+		return "storage object"
+	}
+	return ""
+}
+
+// printChangeSet prints what a write, described by what, would change: the
+// vault paths first, when known, then the stored paths behind them. names
+// gives the vault path of storage objects and share pointers.
+func printChangeSet(what string, vault []vaultChange, names map[string]string, changes []storedChange) {
+	if len(changes) == 0 {
+		fmt.Printf("\nDry run: %s would change nothing.\n", what)
+		return
+	}
+
+	indent := "  "
+	if len(vault) > 0 {
+		fmt.Printf("\nDry run: %s would change %d vault path(s):\n", what, len(vault))
+		for _, c := range vault {
+			switch c.Kind {
+			case changeMove:
+				fmt.Printf("  %-7s %s (from %s)\n", c.Kind, c.Path, c.Detail)
+			case changeShare, changeUnshare:
+				fmt.Printf("  %-7s %s (reference %s)\n", c.Kind, c.Path, c.Detail)
+			case changeRemove:
+				fmt.Printf("  %-7s %s\n", c.Kind, c.Path)
+			default:
+				size := ""
+				if !strings.HasSuffix(c.Path, "/") {
+					size = FormatSize(c.Size)
+				}
+				fmt.Printf("  %-7s %-34s %10s\n", c.Kind, c.Path, size)
+			}
+		}
+		fmt.Printf("  Stored as %d path(s):\n", len(changes))
+		indent = "    "
+	} else {
+		fmt.Printf("\nDry run: %s would change %d path(s):\n", what, len(changes))
+	}
+
+	counts := map[string]int{}
+	var bytes int64
+	for _, c := range changes {
+		size := ""
+		if c.Kind != changeRemove {
+			size = FormatSize(c.Size)
+		}
+		description := describeStoredPath(c.Path)
+		if name, ok := names[c.Path]; ok {
+			description += " of " + name
+		}
+		fmt.Printf("%s%-7s %-34s %10s  %s\n", indent, c.Kind, c.Path, size, description)
+		counts[c.Kind]++
+		bytes += c.Size
+	}
+	fmt.Printf("  %d added, %d updated, %d removed; %s to push. Nothing was pushed.\n",
+		counts[changeAdd], counts[changeUpdate], counts[changeRemove], FormatSize(bytes))
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDiffIndexes(t *testing.T) {
+	before := testIndex(map[string]string{"a.txt": "a1", "docs/b.txt": "b1", "docs/c.txt": "c1", "old/d.txt": "d1"})
+	before["empty"] = Entry{Type: "folder", Contents: map[string]Entry{}}
+
+	after := testIndex(map[string]string{"a.txt": "a2", "docs/b.txt": "b1", "archive/c.txt": "c1", "new/e.txt": "e1"})
+	after["new"].Contents["sub"] = Entry{Type: "folder", Contents: map[string]Entry{}}
+	after["empty"] = Entry{Type: "folder", Contents: testIndex(map[string]string{"f.txt": "f1"})}
+
+	names := make(map[string]string)
+	changes := diffIndexes(before, after, names)
+	slices.SortFunc(changes, func(a, b vaultChange) int { return strings.Compare(a.Path, b.Path) })
+
+	want := []vaultChange{
+		{Kind: changeUpdate, Path: "a.txt"},
+		{Kind: changeMove, Path: "archive/c.txt", Detail: "docs/c.txt"},
+		{Kind: changeAdd, Path: "empty/f.txt"},
+		{Kind: changeAdd, Path: "new/e.txt"},
+		{Kind: changeAdd, Path: "new/sub/"},
+		{Kind: changeRemove, Path: "old/d.txt"},
+	}
+	if !slices.Equal(changes, want) {
+		t.Errorf("changes = %v, want %v", changes, want)
+	}
+
+	for id, path := range map[string]string{"a1": "a.txt", "a2": "a.txt", "c1": "archive/c.txt", "d1": "old/d.txt", "f1": "empty/f.txt"} {
+		if names[id] != path {
+			t.Errorf("names[%s] = %q, want %q", id, names[id], path)
+		}
+	}
+}
+
+// captureStdout returns what fn prints to stdout
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan string)
+	go func() {
+		out, _ := io.ReadAll(r)
+		done <- string(out)
+	}()
+	defer func() { os.Stdout = stdout }()
+	fn()
+	w.Close()
+	return <-done
+}
+
+func TestDryRunUploadIsOneChangeSet(t *testing.T) {
+	session := newTestSession(t)
+	SetDryRun(true)
+	t.Cleanup(func() { SetDryRun(false) })
+
+	var err error
+	out := captureStdout(t, func() {
+		// An upload large enough to push its first objects early
+		batch := newUploadBatch(session)
+		if err = batch.add("aa11", []byte("first chunk")); err != nil {
+			return
+		}
+		if err = batch.flush(); err != nil {
+			return
+		}
+		if err = batch.add("bb22", []byte("second chunk")); err != nil {
+			return
+		}
+		session.Index.AddChunkedFile("big.bin", []string{"aa11", "bb22"}, "key")
+		var indexBytes []byte
+		if indexBytes, err = session.Index.ToBytes(session.Password); err != nil {
+			return
+		}
+		err = batch.commit(indexBytes)
+	})
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+
+	if n := strings.Count(out, "Dry run:"); n != 1 {
+		t.Fatalf("printed %d change sets, want 1:\n%s", n, out)
+	}
+	for _, want := range []string{"add     big.bin", "storage object of big.bin", "aa11", "bb22", "3 added, 0 updated, 0 removed"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("change set lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, pendingUploadsDir) {
+		t.Errorf("change set lists the pending upload manifest:\n%s", out)
+	}
+}
@@ -1,39 +1,186 @@
 package utils
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/pbkdf2"
 )
 
 const (
 	SaltSize   = 16
-	Iterations = 100000
-	KeySize    = 32 // AES-256
-	NonceSize  = 12 // Standard for GCM
+	Iterations = 100000 // PBKDF2 iterations of the legacy format
+	KeySize    = 32     // AES-256
+	NonceSize  = 12     // Standard for GCM
 )
 
-// Encrypt handles key derivation via PBKDF2 and encryption via AES-GCM
+// KDF identifiers stored in the ciphertext header
+const (
+	KDFPBKDF2   byte = 1 // PBKDF2-HMAC-SHA256
+	KDFArgon2id byte = 2 // Argon2id (RFC 9106)
+	KDFVaultKey byte = 3 // No password: wrapped with the vault key-encryption key (see keywrap.go)
+)
+
+// Ciphertexts written by Encrypt start with a header describing how their key
+// was derived:
+//
+//	[magic "ZEPH"][version 1][KDF id 1][KDF params][salt 16][nonce 12][ciphertext]
+//
+// PBKDF2 params are the iteration count (uint32); Argon2id params are passes
+// (uint32), memory in KiB (uint32) and threads (uint8), all big-endian. The
+// header is authenticated as GCM additional data. Data without the magic is the
+// legacy [salt][nonce][ciphertext] layout with PBKDF2 at Iterations.
+var headerMagic = []byte("ZEPH")
+
+const headerVersion = 1
+
+// KDFParams selects a password key derivation function and its cost
+type KDFParams struct {
+	ID      byte
+	Time    uint32 // Argon2id passes, or PBKDF2 iterations
+	Memory  uint32 // Argon2id memory in KiB
+	Threads uint8  // Argon2id parallelism
+}
+
+var (
+	// DefaultKDF is used for everything Encrypt writes (RFC 9106's second recommended option)
+	DefaultKDF = KDFParams{ID: KDFArgon2id, Time: 3, Memory: 64 * 1024, Threads: 4}
+	// LegacyKDF describes ciphertexts written before headers existed
+	LegacyKDF = KDFParams{ID: KDFPBKDF2, Time: Iterations}
+	// ShareKDF protects share pointers. The share page derives their keys
+	// with WebCrypto's PBKDF2 and has no Argon2id of its own.
+	ShareKDF = KDFParams{ID: KDFPBKDF2, Time: 600000}
+)
+
+// Upper bounds on header parameters, so a crafted ciphertext (e.g. a share
+// pointer from someone else) cannot make Decrypt allocate or spin without limit
+const (
+	maxArgon2Memory  = 4 << 20 // 4 GiB in KiB
+	maxArgon2Time    = 64
+	maxPBKDF2Rounds  = 50000000
+	argon2ParamsSize = 9
+	pbkdf2ParamsSize = 4
+)
+
+func (p KDFParams) String() string {
+	switch p.ID {
+	case KDFPBKDF2:
+		return fmt.Sprintf("PBKDF2-SHA256 (%d iterations)", p.Time)
+	case KDFArgon2id:
+		return fmt.Sprintf("Argon2id (t=%d, m=%d MiB, p=%d)", p.Time, p.Memory/1024, p.Threads)
+	case KDFVaultKey:
+		return "vault key-encryption key"
+	}
+	return fmt.Sprintf("unknown KDF %d", p.ID)
+}
+
+// deriveKey derives the AES key for a password and salt
+func (p KDFParams) deriveKey(password string, salt []byte) ([]byte, error) {
+	switch p.ID {
+	case KDFPBKDF2:
+		if p.Time == 0 || p.Time > maxPBKDF2Rounds {
+			return nil, fmt.Errorf("invalid PBKDF2 iteration count %d", p.Time)
+		}
+		return pbkdf2.Key([]byte(password), salt, int(p.Time), KeySize, sha256.New), nil
+	case KDFArgon2id:
+		if p.Time == 0 || p.Time > maxArgon2Time || p.Memory < 8*uint32(p.Threads) || p.Memory > maxArgon2Memory || p.Threads == 0 {
+			return nil, fmt.Errorf("invalid Argon2id parameters %s", p)
+		}
+		return argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, KeySize), nil
+	case KDFVaultKey:
+		return nil, errors.New("data is wrapped with the vault key, not a password")
+	}
+	return nil, fmt.Errorf("unsupported KDF id %d", p.ID)
+}
+
+// header encodes the self-describing header for these parameters
+func (p KDFParams) header() []byte {
+	h := append(append([]byte{}, headerMagic...), headerVersion, p.ID)
+	switch p.ID {
+	case KDFPBKDF2:
+		h = binary.BigEndian.AppendUint32(h, p.Time)
+	case KDFArgon2id:
+		h = binary.BigEndian.AppendUint32(h, p.Time)
+		h = binary.BigEndian.AppendUint32(h, p.Memory)
+		h = append(h, p.Threads)
+	}
+	return h
+}
+
+// parseHeader decodes the header at the start of data. ok is false for the
+// legacy layout; err is set for a header this version cannot read.
+func parseHeader(data []byte) (params KDFParams, headerLen int, ok bool, err error) {
+	if !bytes.HasPrefix(data, headerMagic) {
+		return LegacyKDF, 0, false, nil
+	}
+	n := len(headerMagic)
+	if len(data) < n+2 {
+		return LegacyKDF, 0, false, nil
+	}
+	if data[n] != headerVersion {
+		return LegacyKDF, 0, false, fmt.Errorf("unsupported encryption format version %d: update zep", data[n])
+	}
+	params.ID = data[n+1]
+	n += 2
+
+	switch params.ID {
+	case KDFPBKDF2:
+		if len(data) < n+pbkdf2ParamsSize {
+			return LegacyKDF, 0, false, nil
+		}
+		params.Time = binary.BigEndian.Uint32(data[n:])
+		n += pbkdf2ParamsSize
+	case KDFArgon2id:
+		if len(data) < n+argon2ParamsSize {
+			return LegacyKDF, 0, false, nil
+		}
+		params.Time = binary.BigEndian.Uint32(data[n:])
+		params.Memory = binary.BigEndian.Uint32(data[n+4:])
+		params.Threads = data[n+8]
+		n += argon2ParamsSize
+	case KDFVaultKey:
+		// No parameters and no salt: [header][nonce 12][ciphertext]
+	default:
+		return LegacyKDF, 0, false, fmt.Errorf("unsupported KDF id %d: update zep", params.ID)
+	}
+	return params, n, true, nil
+}
+
+// KDFOf reports which key derivation a ciphertext from Encrypt uses
+func KDFOf(data []byte) KDFParams {
+	params, _, ok, _ := parseHeader(data)
+	if !ok {
+		return LegacyKDF
+	}
+	return params
+}
+
+// Encrypt derives a key from the password with DefaultKDF and encrypts with AES-GCM
 func Encrypt(plaintext []byte, password string) ([]byte, error) {
+	return EncryptWithKDF(plaintext, password, DefaultKDF)
+}
+
+// EncryptWithKDF encrypts with a key derived by the given KDF
+func EncryptWithKDF(plaintext []byte, password string, params KDFParams) ([]byte, error) {
 	salt := make([]byte, SaltSize)
 	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
 		return nil, err
 	}
 
-	// Derive key using PBKDF2
-	key := pbkdf2.Key([]byte(password), salt, Iterations, KeySize, sha256.New)
-
-	block, err := aes.NewCipher(key)
+	key, err := params.deriveKey(password, salt)
 	if err != nil {
 		return nil, err
 	}
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := newGCM(key)
 	if err != nil {
 		return nil, err
 	}
@@ -43,17 +190,45 @@ func Encrypt(plaintext []byte, password string) ([]byte, error) {
 		return nil, err
 	}
 
-	ciphertext := gcm.Seal(nil, nonce, plaintext, nil)
+	// Bundle as: [Header][Salt][Nonce][Ciphertext], authenticating the header
+	header := params.header()
+	result := append(header, salt...)
+	result = append(result, nonce...)
+	return gcm.Seal(result, nonce, plaintext, header), nil
+}
 
-	// Bundle as: [Salt][Nonce][Ciphertext]
-	result := append(salt, nonce...)
-	result = append(result, ciphertext...)
+// Decrypt reads the header (or recognizes the legacy layout), re-derives the key, and decrypts the data
+func Decrypt(data []byte, password string) ([]byte, error) {
+	params, headerLen, ok, headerErr := parseHeader(data)
+	if !ok {
+		plaintext, err := decryptLegacy(data, password)
+		if err != nil && headerErr != nil {
+			return nil, headerErr
+		}
+		return plaintext, err
+	}
 
-	return result, nil
+	if len(data) < headerLen+SaltSize+NonceSize {
+		return nil, errors.New("ciphertext too short")
+	}
+	header := data[:headerLen]
+	salt := data[headerLen : headerLen+SaltSize]
+	nonce := data[headerLen+SaltSize : headerLen+SaltSize+NonceSize]
+	ciphertext := data[headerLen+SaltSize+NonceSize:]
+
+	key, err := params.deriveKey(password, salt)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, nonce, ciphertext, header)
 }
 
-// Decrypt extracts the salt, re-derives the key, and decrypts the data
-func Decrypt(data []byte, password string) ([]byte, error) {
+// decryptLegacy decrypts the headerless [Salt][Nonce][Ciphertext] layout
+func decryptLegacy(data []byte, password string) ([]byte, error) {
 	if len(data) < SaltSize+NonceSize {
 		return nil, errors.New("ciphertext too short")
 	}
@@ -66,15 +241,10 @@ func Decrypt(data []byte, password string) ([]byte, error) {
 	// Re-derive key
 	key := pbkdf2.Key([]byte(password), salt, Iterations, KeySize, sha256.New)
 
-	block, err := aes.NewCipher(key)
+	gcm, err := newGCM(key)
 	if err != nil {
 		return nil, err
 	}
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
-	}
-
 	return gcm.Open(nil, nonce, ciphertext, nil)
 }
 
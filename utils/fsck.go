@@ -0,0 +1,244 @@
+package utils
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Kinds of problem CheckVault reports
+const (
+	FsckMissingObject   = "missing-object"   // An index entry refers to an object that is not stored
+	FsckBadKey          = "bad-key"          // A file key in the index does not decrypt
+	FsckOrphanObject    = "orphan-object"    // A stored object nothing refers to (removed by gc)
+	FsckDanglingPointer = "dangling-pointer" // A shared/<ref> pointer without a shared index entry (removed by gc)
+	FsckMissingPointer  = "missing-pointer"  // A shared index entry whose pointer is not stored
+	FsckBadPointer      = "bad-pointer"      // A pointer that does not decrypt with its share password, or holds a bad key
+	FsckSharedMissing   = "shared-missing"   // A share pointer refers to an object that is not stored
+	FsckStaleUpload     = "stale-upload"     // A pending upload manifest older than PendingUploadTimeout (removed by gc)
+	FsckUnknownFile     = "unknown-file"     // A stored file zep does not know about (never removed)
+)
+
+// Files a vault may hold besides storage objects and share pointers
+var knownVaultFiles = map[string]bool{
+	"README.md":            true,
+	".config/key":          true,
+	".config/index":        true,
+	".config/settings":     true,
+	publicKeyPath:          true,
+	privateKeyPath:         true,
+	inboxPath:              true,
+	"shared/.config/index": true,
+}
+
+// FsckIssue is one inconsistency found in the vault
+type FsckIssue struct {
+	Kind   string
+	Path   string // Vault path, share reference or stored file concerned
+	Object string // Storage object concerned, if any
+	Detail string
+}
+
+func (i FsckIssue) String() string {
+	s := fmt.Sprintf("%-16s %s", i.Kind, i.Path)
+	if i.Object != "" && i.Object != i.Path {
+		s += " (" + i.Object + ")"
+	}
+	if i.Detail != "" {
+		s += ": " + i.Detail
+	}
+	return s
+}
+
+// FsckReport is the result of CheckVault
+type FsckReport struct {
+	Head    string      // Commit that was checked
+	Stored  int         // Files stored in the vault
+	Files   int         // Files in the index
+	Shares  int         // Entries in the shared index
+	Pending int         // Uploads in progress, whose objects are kept
+	Issues  []FsckIssue // In the order found: index, shares, then stored files
+	Garbage []string    // Stored files gc removes: orphan objects and dangling pointers
+}
+
+// CheckVault compares the files stored in the vault with the index and the
+// shared index, and reports every inconsistency. The session is moved to the
+// vault's current commit first, so the check sees what is stored now.
+func CheckVault(session *Session) (*FsckReport, error) {
+	backend, err := session.Backend()
+	if err != nil {
+		return nil, err
+	}
+
+	// 1. Load the indexes as of the current commit and list what is stored there
+	head, err := backend.Head()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read remote head: %w", err)
+	}
+	if head != session.Head {
+		if session.Index, err = fetchIndexAt(backend, head, session.Password); err != nil {
+			return nil, err
+		}
+		if session.SharedIndex, err = fetchSharedIndexAt(backend, head, session.Password); err != nil {
+			return nil, err
+		}
+		session.Head = head
+	}
+	if session.SharedIndex == nil {
+		session.SharedIndex = NewSharedIndex()
+	}
+	paths, err := backend.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list vault contents: %w", err)
+	}
+	stored := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		stored[p] = true
+	}
+
+	report := &FsckReport{Head: head, Stored: len(paths), Shares: len(session.SharedIndex.Files)}
+	referenced := make(map[string]bool)
+	issue := func(kind, path, object, detail string) {
+		report.Issues = append(report.Issues, FsckIssue{Kind: kind, Path: path, Object: object, Detail: detail})
+	}
+
+	// 2. Every file in the index must have its objects and a usable key
+	for _, file := range IndexFiles(session.Index, "") {
+		report.Files++
+		for _, id := range file.Entry.StorageIDs() {
+			referenced[id] = true
+			if !stored[id] {
+				issue(FsckMissingObject, file.Path, id, "object not stored")
+			}
+		}
+		if _, err := session.UnwrapFileKey(file.Entry.FileKey); err != nil {
+			issue(FsckBadKey, file.Path, "", err.Error())
+		}
+	}
+
+	// 3. Every share must have a pointer that opens with its password and
+	// refers to stored objects. Those objects stay referenced even when the
+	// index no longer uses them, so gc never breaks a live link.
+	for _, ref := range slices.Sorted(maps.Keys(session.SharedIndex.Files)) {
+		shared := session.SharedIndex.Files[ref]
+		pointerPath := "shared/" + ref
+		if !stored[pointerPath] {
+			issue(FsckMissingPointer, shared.Name, pointerPath, "share link is broken")
+			continue
+		}
+		data, err := backend.FetchAt(head, pointerPath)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				issue(FsckMissingPointer, shared.Name, pointerPath, "share link is broken")
+				continue
+			}
+			return nil, fmt.Errorf("failed to fetch %s: %w", pointerPath, err)
+		}
+		pointer, err := decryptSharePointer(data, shared.Password)
+		if err != nil {
+			issue(FsckBadPointer, shared.Name, pointerPath, err.Error())
+			continue
+		}
+		for _, file := range pointerFiles(pointer) {
+			if _, err := hex.DecodeString(file.FileKey); err != nil || file.FileKey == "" {
+				issue(FsckBadPointer, joinVaultPath(shared.Name, file.Path), pointerPath, "invalid file key")
+			}
+			for _, id := range file.entry().StorageIDs() {
+				referenced[id] = true
+				if !stored[id] {
+					issue(FsckSharedMissing, shared.Name, id, "object of "+pointerPath+" not stored")
+				}
+			}
+		}
+	}
+
+	// 4. Uploads in progress push objects before the index that names them;
+	// their manifests keep those objects until the upload commits or dies
+	for _, p := range slices.Sorted(maps.Keys(stored)) {
+		if !strings.HasPrefix(p, pendingUploadsDir) {
+			continue
+		}
+		data, err := backend.FetchAt(head, p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch %s: %w", p, err)
+		}
+		var pending pendingUpload
+		if err := json.Unmarshal(data, &pending); err != nil || time.Since(pending.Updated) > PendingUploadTimeout {
+			issue(FsckStaleUpload, p, p, "upload never finished")
+			report.Garbage = append(report.Garbage, p)
+			continue
+		}
+		report.Pending++
+		for _, id := range pending.Objects {
+			referenced[id] = true
+		}
+	}
+
+	// 5. Every stored file must be known or referenced
+	for _, p := range slices.Sorted(maps.Keys(stored)) {
+		switch {
+		case knownVaultFiles[p] || strings.HasPrefix(p, outboxPath("")) || strings.HasPrefix(p, pendingUploadsDir):
+		case !strings.Contains(p, "/") && isStorageID(p):
+			if !referenced[p] {
+				issue(FsckOrphanObject, p, p, "not referenced by the index or a share")
+				report.Garbage = append(report.Garbage, p)
+			}
+		case strings.HasPrefix(p, "shared/") && !strings.Contains(strings.TrimPrefix(p, "shared/"), "/"):
+			if _, ok := session.SharedIndex.Files[strings.TrimPrefix(p, "shared/")]; !ok {
+				issue(FsckDanglingPointer, p, p, "no share uses this pointer")
+				report.Garbage = append(report.Garbage, p)
+			}
+		default:
+			issue(FsckUnknownFile, p, p, "")
+		}
+	}
+	return report, nil
+}
+
+// pointerFiles returns the files a share pointer gives access to
+func pointerFiles(p *sharePointer) []sharedFolderFile {
+	if p.IsFolder() {
+		return p.Files
+	}
+	file := sharedFolderFile{StorageID: p.StorageID, FileKey: p.FileKey}
+	if p.Chunks != "" {
+		file.Chunks = strings.Split(p.Chunks, ",")
+	}
+	return []sharedFolderFile{file}
+}
+
+// isStorageID reports whether name has the form of a storage object name
+func isStorageID(name string) bool {
+	_, err := hex.DecodeString(name)
+	return err == nil && name != ""
+}
+
+// CollectGarbage removes the orphan objects, dangling share pointers and stale
+// upload manifests that CheckVault finds, in one commit. With dryRun nothing
+// is removed. Objects of uploads in progress are kept through their pending
+// upload manifests, and if the vault changes while it is being checked
+// nothing is removed either, since a new object could look orphaned before
+// the index naming it is pushed.
+func CollectGarbage(dryRun bool, session *Session) (*FsckReport, error) {
+	report, err := CheckVault(session)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun || len(report.Garbage) == 0 {
+		return report, nil
+	}
+
+	err = session.push(map[string][]byte{}, report.Garbage, false)
+	if errors.Is(err, ErrStaleHead) {
+		return nil, fmt.Errorf("vault changed while it was being checked, nothing was removed; run gc again")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove garbage: %w", err)
+	}
+	return report, nil
+}
@@ -1,82 +1,314 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/go-git/go-billy/v5"
 	"github.com/go-git/go-billy/v5/memfs"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	"github.com/go-git/go-git/v5/storage/memory"
 	cryptossh "golang.org/x/crypto/ssh"
 )
 
-// PushFiles performs a stateless append/update to the repository.
-// It preserves existing files on GitHub without downloading them.
-// Pass empty string for commitAuthorName/Email to use defaults
-func PushFiles(repoURL string, rawPrivateKey []byte, files map[string][]byte, commitMsg string) error {
-	return PushFilesWithAuthor(repoURL, rawPrivateKey, files, commitMsg, "Zephyrus", "auchrio@proton.me")
+// gitRemote describes a git repository that vault changes are pushed to
+type gitRemote struct {
+	url     string
+	auth    transport.AuthMethod
+	shallow bool         // Depth 1 clones; not supported by the in-process file transport
+	kept    *gitCheckout // Where push keeps its clone for the next push; nil clones every time
 }
 
-// PushFilesWithAuthor performs a push with custom commit author
-func PushFilesWithAuthor(repoURL string, rawPrivateKey []byte, files map[string][]byte, commitMsg string, authorName string, authorEmail string) error {
-	publicKeys, _ := ssh.NewPublicKeys("git", rawPrivateKey, "")
+// gitCheckout is an in-memory clone kept after a successful push, so that a
+// series of pushes (the flushes of one upload) does not clone the vault again
+// for each one
+type gitCheckout struct {
+	repo *git.Repository
+	fs   billy.Filesystem
+}
+
+// sshAuth builds SSH credentials from a raw private key
+func sshAuth(rawPrivateKey []byte) (transport.AuthMethod, error) {
+	publicKeys, err := ssh.NewPublicKeys("git", rawPrivateKey, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load private key: %w", err)
+	}
 	publicKeys.HostKeyCallback = cryptossh.InsecureIgnoreHostKey()
+	return publicKeys, nil
+}
 
+// clone fetches the current master branch into memory.
+// An empty remote yields a fresh in-memory repository instead of an error.
+func (g gitRemote) clone() (*git.Repository, billy.Filesystem, error) {
 	storer := memory.NewStorage()
 	fs := memfs.New()
 
-	// 1. Clone the repo to get the current state
-	r, err := git.Clone(storer, fs, &git.CloneOptions{
-		URL:           repoURL,
-		Auth:          publicKeys,
+	opts := &git.CloneOptions{
+		URL:           g.url,
+		Auth:          g.auth,
+		ReferenceName: plumbing.ReferenceName("refs/heads/master"),
+		SingleBranch:  true,
+	}
+	if g.shallow {
+		opts.Depth = 1
+	}
+
+	r, err := git.Clone(storer, fs, opts)
+	if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		r, err = git.Init(storer, fs)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to clone: %w", err)
+	}
+	return r, fs, nil
+}
+
+// cloneBare clones the full history into a bare repository at dir, on disk
+// rather than in memory
+func (g gitRemote) cloneBare(dir string) (*git.Repository, error) {
+	r, err := git.PlainClone(dir, true, &git.CloneOptions{
+		URL:           g.url,
+		Auth:          g.auth,
 		ReferenceName: plumbing.ReferenceName("refs/heads/master"),
 		SingleBranch:  true,
-		Depth:         1,
 	})
+	if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		r, err = git.PlainInit(dir, true)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to clone: %w", err)
+		return nil, fmt.Errorf("failed to clone: %w", err)
 	}
+	return r, nil
+}
 
+// checkout returns the clone kept by the previous push if it is still at
+// parent, and a fresh clone otherwise. The kept clone is taken either way:
+// push only hands it back once it succeeds.
+func (g gitRemote) checkout(parent string) (*git.Repository, billy.Filesystem, error) {
+	if g.kept != nil && g.kept.repo != nil {
+		r, fs := g.kept.repo, g.kept.fs
+		*g.kept = gitCheckout{}
+		if parent != "" && headHash(r) == parent {
+			return r, fs, nil
+		}
+	}
+	return g.clone()
+}
+
+// keep stores a clone for the next push
+func (g gitRemote) keep(r *git.Repository, fs billy.Filesystem) {
+	if g.kept != nil {
+		*g.kept = gitCheckout{repo: r, fs: fs}
+	}
+}
+
+// push applies a batch on top of the remote master branch in a single commit
+// and returns the resulting head. If batch.Parent is set and the remote has
+// moved on since, ErrStaleHead is returned and nothing is written.
+func (g gitRemote) push(batch Batch) (string, error) {
+	r, fs, err := g.checkout(batch.Parent)
+	if err != nil {
+		return "", err
+	}
+	head := headHash(r)
+	if batch.Parent != "" && head != batch.Parent {
+		return "", ErrStaleHead
+	}
 	w, _ := r.Worktree()
 
-	// 2. Write files using the names provided in the 'files' map
-	for path, content := range files {
+	// 1. Write files using the names provided in the batch
+	for path, content := range batch.Files {
 		// If 'path' is the same 16-char string as before,
 		// this Create call will overwrite the virtual file in memfs.
 		f, err := fs.Create(path)
 		if err != nil {
-			return err
+			return "", err
 		}
 		f.Write(content)
 		f.Close()
 
-		// 3. Re-stage the path
-		// Git sees the same filename but new content.
-		// It calculates a new content hash (SHA-1) but keeps the file identity.
-		_, err = w.Add(path)
-		if err != nil {
-			return err
+		// Re-stage the path. Git sees the same filename but new content.
+		if _, err := w.Add(path); err != nil {
+			return "", err
 		}
 	}
 
-	// 4. Commit and Push
+	// 2. Remove deleted objects from the tree
+	for _, path := range batch.Deletes {
+		if _, err := w.Remove(path); err != nil {
+			fmt.Fprintf(progressOut, "Skipping %s (already gone from remote)\n", path)
+		}
+	}
+
+	// 3. Commit and Push
 	status, _ := w.Status()
 	if status.IsClean() {
-		return nil // No changes to push
+		g.keep(r, fs)
+		return head, nil // No changes to push
 	}
 
-	commit, _ := w.Commit(commitMsg, &git.CommitOptions{
-		Author: &object.Signature{Name: authorName, Email: authorEmail, When: time.Now()},
+	commit, err := w.Commit(batch.Commit.Message, &git.CommitOptions{
+		Author: batch.Commit.signature(),
 	})
+	if err != nil {
+		return "", fmt.Errorf("failed to commit: %w", err)
+	}
 
-	return r.Push(&git.PushOptions{
-		Auth: publicKeys,
+	err = r.Push(&git.PushOptions{
+		Auth: g.auth,
 		RefSpecs: []config.RefSpec{
 			config.RefSpec(fmt.Sprintf("%s:refs/heads/master", commit)),
 		},
 	})
+	if err != nil {
+		// Someone pushed between our clone and our push
+		if strings.Contains(err.Error(), "non-fast-forward") || errors.Is(err, plumbing.ErrObjectNotFound) {
+			return "", ErrStaleHead
+		}
+		return "", err
+	}
+	g.keep(r, fs)
+	return commit.String(), nil
+}
+
+// headHash returns the commit master points to, or "" for an empty repository
+func headHash(r *git.Repository) string {
+	ref, err := r.Reference(plumbing.ReferenceName("refs/heads/master"), true)
+	if err != nil {
+		return ""
+	}
+	return ref.Hash().String()
+}
+
+// lsRemote returns the commit the remote master points to without cloning
+func (g gitRemote) lsRemote() (string, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: "origin", URLs: []string{g.url}})
+	refs, err := remote.List(&git.ListOptions{Auth: g.auth})
+	if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, ref := range refs {
+		if ref.Name() == plumbing.ReferenceName("refs/heads/master") {
+			return ref.Hash().String(), nil
+		}
+	}
+	return "", nil
+}
+
+// reset replaces the remote history with a single commit containing exactly files
+func (g gitRemote) reset(files map[string][]byte, info CommitInfo) error {
+	storer := memory.NewStorage()
+	fs := memfs.New()
+	r, _ := git.Init(storer, fs)
+	w, _ := r.Worktree()
+
+	for path, content := range files {
+		f, err := fs.Create(path)
+		if err != nil {
+			return err
+		}
+		f.Write(content)
+		f.Close()
+		if _, err := w.Add(path); err != nil {
+			return err
+		}
+	}
+
+	commit, err := w.Commit(info.Message, &git.CommitOptions{
+		Author:            info.signature(),
+		AllowEmptyCommits: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create commit: %w", err)
+	}
+
+	_, err = r.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{g.url}})
+	if err != nil {
+		return err
+	}
+
+	return r.Push(&git.PushOptions{
+		RemoteName: "origin",
+		Auth:       g.auth,
+		RefSpecs:   []config.RefSpec{config.RefSpec(fmt.Sprintf("%s:refs/heads/master", commit))},
+		Force:      true, // Overwrites whatever history the remote had
+	})
+}
+
+// replace force-pushes the master branch of r as the remote's master, with a
+// lease: the push only happens if the remote master is still at expected
+func (g gitRemote) replace(r *git.Repository, expected string) error {
+	master := plumbing.ReferenceName("refs/heads/master")
+	// The lease is checked against the remote-tracking branch
+	tracking := plumbing.NewHashReference("refs/remotes/origin/master", plumbing.NewHash(expected))
+	if err := r.Storer.SetReference(tracking); err != nil {
+		return err
+	}
+	if _, err := r.Remote("origin"); err != nil {
+		if _, err := r.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{g.url}}); err != nil {
+			return err
+		}
+	}
+
+	err := r.Push(&git.PushOptions{
+		RemoteName:     "origin",
+		Auth:           g.auth,
+		RefSpecs:       []config.RefSpec{config.RefSpec("+" + master + ":" + master)},
+		ForceWithLease: &git.ForceWithLease{RefName: master, Hash: plumbing.NewHash(expected)},
+	})
+	if errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil
+	}
+	if err != nil && strings.Contains(err.Error(), "non-fast-forward") {
+		return ErrStaleHead
+	}
+	return err
+}
+
+// list returns every file path in the remote master tree
+func (g gitRemote) list() ([]string, error) {
+	r, _, err := g.clone()
+	if err != nil {
+		return nil, err
+	}
+	return listHeadTree(r)
+}
+
+// listHeadTree returns every file path in the tree of the master branch
+func listHeadTree(r *git.Repository) ([]string, error) {
+	ref, err := r.Reference(plumbing.ReferenceName("refs/heads/master"), true)
+	if err != nil {
+		// No commits yet: the vault is empty
+		return []string{}, nil
+	}
+	commit, err := r.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	err = tree.Files().ForEach(func(f *object.File) error {
+		paths = append(paths, f.Name)
+		return nil
+	})
+	return paths, err
+}
+
+// signature builds the git author for a commit
+func (c CommitInfo) signature() *object.Signature {
+	return &object.Signature{Name: c.AuthorName, Email: c.AuthorEmail, When: time.Now()}
 }
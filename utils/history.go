@@ -0,0 +1,321 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// FileVersion is one stored version of a file, as found in the vault history
+type FileVersion struct {
+	Number  int       // 1 is the oldest version
+	Commit  string    // Commit that introduced this version
+	When    time.Time // Time of that commit
+	Size    int64     // Plaintext size in bytes
+	Entry   Entry     // Index entry describing the version's storage objects
+	Current bool      // Whether this is the version the vault points to now
+}
+
+// fileHistory is the result of walking the vault history for one path
+type fileHistory struct {
+	repo     *git.Repository
+	release  func()        // Frees repo, see Backend.History
+	versions []FileVersion // Newest first
+}
+
+// loadFileHistory walks every commit of the vault (newest first), looks up
+// vaultPath in the index of each commit and records a new version whenever
+// the entry's storage objects change. Indexes that can no longer be
+// decrypted (from before a password reset) fall back to the newest entry seen
+// so far whose objects exist in that commit, since password resets keep
+// storage IDs and file keys unchanged.
+func loadFileHistory(vaultPath string, session *Session) (*fileHistory, error) {
+	backend, err := session.Backend()
+	if err != nil {
+		return nil, err
+	}
+	repo, release, err := backend.History()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load vault history: %w", err)
+	}
+	history := &fileHistory{repo: repo, release: release}
+	if err := history.walk(vaultPath, session); err != nil {
+		release()
+		return nil, err
+	}
+	return history, nil
+}
+
+// walk fills h.versions from the history in h.repo
+func (h *fileHistory) walk(vaultPath string, session *Session) error {
+	ref, err := h.repo.Reference(plumbing.ReferenceName("refs/heads/master"), true)
+	if err != nil {
+		return fmt.Errorf("vault has no history yet")
+	}
+	commits, err := h.repo.Log(&git.LogOptions{From: ref.Hash()})
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[plumbing.Hash]*Entry) // Decrypted index blob -> entry at vaultPath
+	var known []*Entry                        // Entries from readable indexes, newest first
+	var lastKey string
+	first := true
+
+	err = commits.ForEach(func(c *object.Commit) error {
+		isHead := first
+		first = false
+
+		// 1. Find the entry for vaultPath in this commit's index
+		indexFile, err := c.File(".config/index")
+		if err != nil {
+			lastKey = ""
+			return nil
+		}
+		entry, seen := entries[indexFile.Hash]
+		if !seen {
+			var readable bool
+			entry, readable = entryFromIndexBlob(indexFile, vaultPath, session.Password)
+			if readable {
+				if entry != nil {
+					known = append(known, entry)
+				}
+			} else {
+				entry = fallbackEntry(c, known)
+			}
+			entries[indexFile.Hash] = entry
+		}
+		if entry == nil || entry.Type != "file" {
+			lastKey = ""
+			return nil
+		}
+
+		// 2. Identify the version by its storage objects' blob hashes
+		var key strings.Builder
+		var size int64
+		ids := entry.StorageIDs()
+		for _, id := range ids {
+			f, err := c.File(id)
+			if err != nil {
+				lastKey = "" // Objects missing: not a readable version
+				return nil
+			}
+			key.WriteString(id + ":" + f.Hash.String() + ",")
+			size += f.Size
+		}
+		size -= int64(len(ids) * (NonceSize + chunkTagSize))
+
+		// 3. Consecutive commits with the same objects are one version; keep the oldest commit
+		if key.String() == lastKey {
+			v := &h.versions[len(h.versions)-1]
+			v.Commit = c.Hash.String()
+			v.When = c.Author.When
+			return nil
+		}
+		lastKey = key.String()
+		h.versions = append(h.versions, FileVersion{
+			Commit:  c.Hash.String(),
+			When:    c.Author.When,
+			Size:    size,
+			Entry:   *entry,
+			Current: isHead,
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(h.versions) == 0 {
+		return fmt.Errorf("no versions of '%s' found in vault history", vaultPath)
+	}
+	for i := range h.versions {
+		h.versions[i].Number = len(h.versions) - i
+	}
+	return nil
+}
+
+// entryFromIndexBlob decrypts an index blob and returns the entry at vaultPath
+// (nil if the path does not exist in it). readable is false if the index
+// cannot be decrypted with password.
+func entryFromIndexBlob(f *object.File, vaultPath string, password string) (entry *Entry, readable bool) {
+	contents, err := f.Contents()
+	if err != nil {
+		return nil, false
+	}
+	index, err := FromBytes([]byte(contents), password)
+	if err != nil {
+		return nil, false
+	}
+	entry, err = index.FindEntry(vaultPath)
+	if err != nil {
+		return nil, true
+	}
+	return entry, true
+}
+
+// fallbackEntry returns the newest known entry whose storage objects all exist in commit c
+func fallbackEntry(c *object.Commit, known []*Entry) *Entry {
+	for _, entry := range known {
+		found := entry.Type == "file"
+		for _, id := range entry.StorageIDs() {
+			if _, err := c.File(id); err != nil {
+				found = false
+				break
+			}
+		}
+		if found {
+			return entry
+		}
+	}
+	return nil
+}
+
+// version returns the version with the given number
+func (h *fileHistory) version(number int) (*FileVersion, error) {
+	for i := range h.versions {
+		if h.versions[i].Number == number {
+			return &h.versions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("version %d not found (available: 1-%d)", number, len(h.versions))
+}
+
+// open returns the decrypted contents of a version, read from its commit
+func (h *fileHistory) open(v *FileVersion, session *Session) (io.Reader, error) {
+	commit, err := h.repo.CommitObject(plumbing.NewHash(v.Commit))
+	if err != nil {
+		return nil, err
+	}
+
+	fileKey, err := session.UnwrapFileKey(v.Entry.FileKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt file key: %w", err)
+	}
+
+	return NewEntryReader(&v.Entry, fileKey, func(storageID string) ([]byte, error) {
+		f, err := commit.File(storageID)
+		if err != nil {
+			return nil, err
+		}
+		contents, err := f.Contents()
+		return []byte(contents), err
+	})
+}
+
+// GetFileHistory lists every stored version of a file, newest first
+func GetFileHistory(vaultPath string, session *Session) ([]FileVersion, error) {
+	PrintProgressStep(1, 1, "Walking vault history...")
+	history, err := loadFileHistory(vaultPath, session)
+	if err != nil {
+		return nil, err
+	}
+	defer history.release()
+	PrintCompletionLine(fmt.Sprintf("Found %d versions", len(history.versions)))
+	return history.versions, nil
+}
+
+// PrintFileHistory prints the versions of a file as a table
+func PrintFileHistory(vaultPath string, versions []FileVersion) {
+	fmt.Printf("\nHistory of %s:\n\n", vaultPath)
+	fmt.Printf("%-9s %-20s %-12s %s\n", "VERSION", "DATE", "SIZE", "COMMIT")
+	fmt.Println(strings.Repeat("-", 60))
+	for _, v := range versions {
+		marker := ""
+		if v.Current {
+			marker = " (current)"
+		}
+		fmt.Printf("%-9d %-20s %-12d %s%s\n", v.Number, v.When.Local().Format("2006-01-02 15:04:05"), v.Size, v.Commit[:10], marker)
+	}
+	fmt.Println()
+}
+
+// RestoreFileVersion restores an older version of a file. With a localPath the
+// version is decrypted to that file; otherwise it is re-uploaded as the
+// current version of vaultPath.
+func RestoreFileVersion(vaultPath string, number int, localPath string, session *Session) error {
+	// 1. Find the requested version
+	PrintProgressStep(1, 3, "Walking vault history...")
+	history, err := loadFileHistory(vaultPath, session)
+	if err != nil {
+		return err
+	}
+	defer history.release()
+	v, err := history.version(number)
+	if err != nil {
+		return err
+	}
+	if v.Current && localPath == "" {
+		return fmt.Errorf("version %d is already the current version of '%s'", number, vaultPath)
+	}
+	PrintCompletionLine(fmt.Sprintf("Version %d from %s located", v.Number, v.When.Local().Format("2006-01-02 15:04:05")))
+
+	// 2. Decrypt the old objects with the version's file key
+	PrintProgressStep(2, 3, "Decrypting version...")
+	reader, err := history.open(v, session)
+	if err != nil {
+		return err
+	}
+	PrintCompletionLine("Version decrypted")
+
+	// 3a. Save it locally
+	if localPath != "" {
+		PrintProgressStep(3, 3, "Saving file to "+localPath+"...")
+		if err := saveStream(reader, localPath); err != nil {
+			return err
+		}
+		applyFileMetadata(localPath, &v.Entry)
+		PrintCompletionLine("File saved successfully")
+		return nil
+	}
+
+	// 3b. Or upload it as the new current version, keeping the current file key
+	PrintProgressStep(3, 3, "Uploading restored version to vault...")
+	previous, err := session.Index.FindEntry(vaultPath)
+	if err != nil || previous.Type != "file" {
+		previous = nil
+	}
+	keyEntry := &v.Entry
+	if previous != nil {
+		keyEntry = previous
+	}
+	fileKey, err := session.UnwrapFileKey(keyEntry.FileKey)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt file key: %w", err)
+	}
+	encryptedKeyHex := keyEntry.FileKey
+	if !IsKEKWrapped(encryptedKeyHex) {
+		if encryptedKeyHex, err = session.WrapFileKey(fileKey); err != nil {
+			return err
+		}
+	}
+
+	batch := newUploadBatch(session)
+	if err := stageStream(reader, v.Size, vaultPath, restoredMetadata(v), fileKey, encryptedKeyHex, previous, session, batch); err != nil {
+		return err
+	}
+	indexBytes, err := session.Index.ToBytes(session.Password)
+	if err != nil {
+		return err
+	}
+	if err := batch.commit(indexBytes); err != nil {
+		return err
+	}
+	PrintCompletionLine("Restored version uploaded to vault")
+	return nil
+}
+
+// restoredMetadata carries over what is known about a version's source file;
+// size, hash and creation time are filled in again when it is staged
+func restoredMetadata(v *FileVersion) FileMetadata {
+	return FileMetadata{
+		Modified: v.Entry.Modified,
+		Mode:     v.Entry.Mode,
+		MimeType: v.Entry.MimeType,
+	}
+}
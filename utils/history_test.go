@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRestoreFileVersion(t *testing.T) {
+	session := newTestSession(t)
+	source := filepath.Join(t.TempDir(), "notes.txt")
+	for _, content := range []string{"first version", "second version"} {
+		if err := os.WriteFile(source, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := UploadFile(source, "notes.txt", session); err != nil {
+			t.Fatalf("UploadFile: %v", err)
+		}
+	}
+
+	versions, err := GetFileHistory("notes.txt", session)
+	if err != nil {
+		t.Fatalf("GetFileHistory: %v", err)
+	}
+	if len(versions) != 2 || !versions[0].Current || versions[1].Number != 1 {
+		t.Fatalf("versions = %+v, want 2 with the newest current", versions)
+	}
+
+	restored := filepath.Join(t.TempDir(), "restored.txt")
+	if err := RestoreFileVersion("notes.txt", 1, restored, session); err != nil {
+		t.Fatalf("RestoreFileVersion: %v", err)
+	}
+	if got, _ := os.ReadFile(restored); string(got) != "first version" {
+		t.Errorf("restored %q, want %q", got, "first version")
+	}
+}
+
+func TestCloneBareKeepsHistoryOnDisk(t *testing.T) {
+	session := newTestSession(t)
+	source := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(source, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := UploadFile(source, "a.txt", session); err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "clone")
+	r, err := gitRemote{url: strings.TrimPrefix(session.BackendSpec, "local:")}.cloneBare(dir)
+	if err != nil {
+		t.Fatalf("cloneBare: %v", err)
+	}
+	if head := headHash(r); head != session.Head {
+		t.Errorf("clone is at %q, want %q", head, session.Head)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "objects")); err != nil {
+		t.Errorf("clone is not a bare repository on disk: %v", err)
+	}
+}
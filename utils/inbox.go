@@ -0,0 +1,389 @@
+package utils
+
+import (
+	"crypto/ecdh"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// inboxPath holds the recipient's list of vaults to check for shares, encrypted
+// with the vault password
+const inboxPath = ".config/inbox"
+
+// outbox is the file shared/outbox/<recipient> in the sender's vault. It lists
+// the shares sealed to the recipient's public key; only the recipient can read
+// the messages, but anyone can see how many there are.
+type outbox struct {
+	Version  int             `json:"version"`
+	Messages []outboxMessage `json:"messages"`
+}
+
+// outboxMessage is one share for the recipient
+type outboxMessage struct {
+	ID     string `json:"id"`     // Share reference
+	Sealed []byte `json:"sealed"` // inboxMessage sealed with sealTo
+}
+
+// inboxMessage is what a share sealed to a recipient contains: the share link
+// without the sender's username, which is implied by the vault it is found in
+type inboxMessage struct {
+	Reference string    `json:"reference"`
+	Password  string    `json:"password"`
+	Name      string    `json:"name"`
+	SharedAt  time.Time `json:"shared_at"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// inboxState is the recipient's side: the vaults to check for shares
+type inboxState struct {
+	Senders []string `json:"senders"`
+}
+
+// InboxItem is a share another vault sealed to this vault's public key
+type InboxItem struct {
+	ID        string // "<sender>/<reference>", as accepted by the inbox commands
+	From      string
+	Name      string
+	SharedAt  time.Time
+	ExpiresAt time.Time
+	Link      ShareLink
+}
+
+// Expired reports whether the share has an expiry and it has passed
+func (item InboxItem) Expired() bool {
+	return !item.ExpiresAt.IsZero() && time.Now().After(item.ExpiresAt)
+}
+
+// ExpiryString describes when the share expires, for listings
+func (item InboxItem) ExpiryString() string {
+	return expiryString(item.ExpiresAt)
+}
+
+// outboxPath is where a vault keeps the shares it sealed to recipient.
+// Usernames are case-insensitive.
+func outboxPath(recipient string) string {
+	return "shared/outbox/" + strings.ToLower(recipient)
+}
+
+// fetchOutbox fetches an outbox; a missing one is empty
+func fetchOutbox(fetch func(string) ([]byte, error), recipient string) (*outbox, error) {
+	data, err := fetch(outboxPath(recipient))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return &outbox{Version: 1}, nil
+		}
+		return nil, err
+	}
+	var box outbox
+	if err := json.Unmarshal(data, &box); err != nil {
+		return nil, fmt.Errorf("invalid outbox for %s: %w", recipient, err)
+	}
+	return &box, nil
+}
+
+// stageOutboxMessage seals a share to the recipient's public key and stages
+// the updated outbox in files, adding to an outbox files already holds
+func stageOutboxMessage(recipient string, recipientPub []byte, msg inboxMessage, session *Session, files map[string][]byte) error {
+	fetch := session.Fetch
+	if staged, ok := files[outboxPath(recipient)]; ok {
+		fetch = func(string) ([]byte, error) { return staged, nil }
+	}
+	box, err := fetchOutbox(fetch, recipient)
+	if err != nil {
+		return err
+	}
+	plaintext, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	sealed, err := sealTo(plaintext, recipientPub)
+	if err != nil {
+		return fmt.Errorf("failed to seal share for %s: %w", recipient, err)
+	}
+	box.Messages = append(box.Messages, outboxMessage{ID: msg.Reference, Sealed: sealed})
+
+	data, err := json.Marshal(box)
+	if err != nil {
+		return err
+	}
+	files[outboxPath(recipient)] = data
+	return nil
+}
+
+// stageOutboxRemoval removes the messages for the given references from an
+// outbox, staging the updated outbox in files (or its deletion, once empty)
+func stageOutboxRemoval(recipient string, refs []string, session *Session, files map[string][]byte, deletes *[]string) error {
+	box, err := fetchOutbox(session.Fetch, recipient)
+	if err != nil {
+		return err
+	}
+	remove := make(map[string]bool, len(refs))
+	for _, ref := range refs {
+		remove[ref] = true
+	}
+	kept := box.Messages[:0]
+	for _, msg := range box.Messages {
+		if !remove[msg.ID] {
+			kept = append(kept, msg)
+		}
+	}
+	box.Messages = kept
+
+	if len(box.Messages) == 0 {
+		*deletes = append(*deletes, outboxPath(recipient))
+		return nil
+	}
+	data, err := json.Marshal(box)
+	if err != nil {
+		return err
+	}
+	files[outboxPath(recipient)] = data
+	return nil
+}
+
+// loadInboxState fetches the vaults this vault checks for shares
+func loadInboxState(session *Session) (*inboxState, error) {
+	data, err := session.Fetch(inboxPath)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return &inboxState{}, nil
+		}
+		return nil, fmt.Errorf("failed to fetch inbox: %w", err)
+	}
+	decrypted, err := Decrypt(data, session.Password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt inbox: %w", err)
+	}
+	var state inboxState
+	if err := json.Unmarshal(decrypted, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse inbox: %w", err)
+	}
+	return &state, nil
+}
+
+// AddInboxSender makes the inbox check sender's vault for shares. It returns
+// false if the sender was already on the list.
+func AddInboxSender(sender string, session *Session) (bool, error) {
+	sender = strings.TrimSpace(sender)
+	if sender == "" {
+		return false, fmt.Errorf("username cannot be empty")
+	}
+	state, err := loadInboxState(session)
+	if err != nil {
+		return false, err
+	}
+	for _, existing := range state.Senders {
+		if strings.EqualFold(existing, sender) {
+			return false, nil
+		}
+	}
+	state.Senders = append(state.Senders, sender)
+	sort.Strings(state.Senders)
+
+	plaintext, err := json.Marshal(state)
+	if err != nil {
+		return false, err
+	}
+	encrypted, err := Encrypt(plaintext, session.Password)
+	if err != nil {
+		return false, fmt.Errorf("failed to encrypt inbox: %w", err)
+	}
+	if err := session.Push(map[string][]byte{inboxPath: encrypted}, nil); err != nil {
+		return false, fmt.Errorf("failed to update inbox: %w", err)
+	}
+	return true, nil
+}
+
+// InboxSenders returns the vaults the inbox checks for shares
+func InboxSenders(session *Session) ([]string, error) {
+	state, err := loadInboxState(session)
+	if err != nil {
+		return nil, err
+	}
+	return state.Senders, nil
+}
+
+// ListInbox checks every sender's outbox for shares sealed to this vault and
+// returns them, newest first. Senders that could not be checked are reported
+// in warnings rather than failing the whole listing.
+func ListInbox(session *Session) (items []InboxItem, warnings []string, err error) {
+	state, err := loadInboxState(session)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(state.Senders) == 0 {
+		return nil, nil, nil
+	}
+	key, err := session.privateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, sender := range state.Senders {
+		senderItems, err := senderInbox(sender, key, session)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %v", sender, err))
+			continue
+		}
+		items = append(items, senderItems...)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].SharedAt.After(items[j].SharedAt) })
+	return items, warnings, nil
+}
+
+// senderInbox reads the shares sender sealed to this vault. Messages sealed to
+// an older key pair cannot be opened and are skipped.
+func senderInbox(sender string, key *ecdh.PrivateKey, session *Session) ([]InboxItem, error) {
+	backend, err := OpenBackend(ActiveBackendSpec(), sender, nil)
+	if err != nil {
+		return nil, err
+	}
+	box, err := fetchOutbox(backend.Fetch, session.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []InboxItem
+	for _, sealedMsg := range box.Messages {
+		plaintext, err := openSealed(sealedMsg.Sealed, key)
+		if err != nil {
+			continue
+		}
+		var msg inboxMessage
+		if err := json.Unmarshal(plaintext, &msg); err != nil {
+			continue
+		}
+		items = append(items, InboxItem{
+			ID:        sender + "/" + msg.Reference,
+			From:      sender,
+			Name:      msg.Name,
+			SharedAt:  msg.SharedAt,
+			ExpiresAt: msg.ExpiresAt,
+			Link:      ShareLink{Username: sender, Reference: msg.Reference, Password: msg.Password, Name: msg.Name},
+		})
+	}
+	return items, nil
+}
+
+// FindInboxItem looks up a share by its inbox ID ("<sender>/<reference>").
+// Only that sender's vault is checked.
+func FindInboxItem(id string, session *Session) (InboxItem, error) {
+	sender, ref, ok := strings.Cut(id, "/")
+	if !ok || sender == "" || ref == "" {
+		return InboxItem{}, fmt.Errorf("invalid inbox ID '%s', expected <user>/<reference> as shown by 'zep inbox'", id)
+	}
+	key, err := session.privateKey()
+	if err != nil {
+		return InboxItem{}, err
+	}
+	items, err := senderInbox(sender, key, session)
+	if err != nil {
+		return InboxItem{}, err
+	}
+	for _, item := range items {
+		if item.Link.Reference == ref {
+			return item, nil
+		}
+	}
+	return InboxItem{}, fmt.Errorf("no share '%s' from %s in your inbox (it may have been revoked)", ref, sender)
+}
+
+// ImportInboxItem copies a share from the inbox into this vault at vaultPath
+// (default inbox/<sender>/<name>). The files are re-encrypted with new keys of
+// this vault, so they stay when the sender revokes the share. It returns the
+// vault path and the number of files imported.
+func ImportInboxItem(id string, vaultPath string, session *Session) (string, int, error) {
+	// 1. Resolve the share
+	PrintProgressStep(1, 3, "Opening share...")
+	item, err := FindInboxItem(id, session)
+	if err != nil {
+		return "", 0, err
+	}
+	if vaultPath == "" {
+		vaultPath = path.Join("inbox", item.From, item.Link.DefaultName())
+	}
+	vaultPath = strings.Trim(vaultPath, "/")
+	if _, err := session.Index.FindEntry(vaultPath); err == nil {
+		return "", 0, fmt.Errorf("'%s' already exists in your vault, choose another path", vaultPath)
+	}
+	pointer, backend, err := openShareLink(item.Link)
+	if err != nil {
+		return "", 0, err
+	}
+	PrintCompletionLine("Share opened: " + item.Name)
+
+	// 2. Re-encrypt each file into this vault
+	PrintProgressStep(2, 3, "Importing files...")
+	batch := newUploadBatch(session)
+	count := 0
+	if pointer.IsFolder() {
+		for _, file := range pointer.Files {
+			relPath := path.Clean(file.Path)
+			if _, err := sharedFolderTarget(".", file.Path); err != nil {
+				return "", count, err
+			}
+			fileKey, err := hex.DecodeString(file.FileKey)
+			if err != nil {
+				return "", count, fmt.Errorf("invalid file key for %s: %w", file.Path, err)
+			}
+			entry := file.entry()
+			reader, err := NewEntryReader(&entry, fileKey, backend.Fetch)
+			if err != nil {
+				return "", count, fmt.Errorf("failed to fetch file %s: %w", file.Path, err)
+			}
+			meta := FileMetadata{Modified: file.Modified, Mode: file.Mode, MimeType: file.MimeType}
+			if err := importSharedFile(reader, entry.IsChunked(), vaultPath+"/"+relPath, meta, session, batch); err != nil {
+				return "", count, err
+			}
+			count++
+		}
+	} else {
+		reader, err := pointer.fileReader(backend)
+		if err != nil {
+			return "", 0, err
+		}
+		if err := importSharedFile(reader, pointer.Chunks != "", vaultPath, FileMetadata{}, session, batch); err != nil {
+			return "", 0, err
+		}
+		count++
+	}
+	PrintCompletionLine(fmt.Sprintf("%d file(s) re-encrypted", count))
+
+	// 3. Push the objects and the index in one commit
+	PrintProgressStep(3, 3, "Updating vault...")
+	indexBytes, err := session.Index.ToBytes(session.Password)
+	if err != nil {
+		return "", count, fmt.Errorf("failed to encrypt index: %w", err)
+	}
+	if err := batch.commit(indexBytes); err != nil {
+		return "", count, fmt.Errorf("failed to push import: %w", err)
+	}
+	PrintCompletionLine("Imported to " + vaultPath)
+	return vaultPath, count, nil
+}
+
+// importSharedFile encrypts a shared file with a new key of this vault into
+// batch. Chunked files stay chunked; the size of single-blob files is only
+// known once read, so they stay single blobs.
+func importSharedFile(r io.Reader, chunked bool, vaultPath string, meta FileMetadata, session *Session, batch *uploadBatch) error {
+	fileKey := GenerateFileKey()
+	encryptedKeyHex, err := session.WrapFileKey(fileKey)
+	if err != nil {
+		return err
+	}
+	var size int64
+	if chunked {
+		size = ChunkSize + 1
+	}
+	if err := stageStream(r, size, vaultPath, meta, fileKey, encryptedKeyHex, nil, session, batch); err != nil {
+		return fmt.Errorf("failed to import %s: %w", vaultPath, err)
+	}
+	return nil
+}
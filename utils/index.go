@@ -1,9 +1,13 @@
 package utils
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"os"
+	"sort"
 	"strings"
+	"time"
 )
 
 // Entry represents either a file or a folder in the Zephyrus vault
@@ -11,7 +15,38 @@ type Entry struct {
 	Type     string           `json:"type"`
 	RealName string           `json:"realName,omitempty"`
 	FileKey  string           `json:"fileKey,omitempty"` // Hex-encoded encrypted file key
+	Chunks   []string         `json:"chunks,omitempty"`  // Storage IDs of a chunked file, in order
 	Contents map[string]Entry `json:"contents,omitempty"`
+	FileMetadata
+}
+
+// FileMetadata describes a file's plaintext. It is recorded at upload time;
+// entries written by older versions have none (see HasMetadata).
+type FileMetadata struct {
+	Size     int64       `json:"size,omitempty"`     // Plaintext size in bytes
+	SHA256   string      `json:"sha256,omitempty"`   // Hex-encoded SHA-256 of the plaintext
+	Created  time.Time   `json:"created,omitzero"`   // When the file was first uploaded to the vault
+	Modified time.Time   `json:"modified,omitzero"`  // Modification time of the uploaded source file
+	Mode     os.FileMode `json:"mode,omitempty"`     // Permission bits of the source file
+	MimeType string      `json:"mimeType,omitempty"` // Detected content type
+}
+
+// HasMetadata reports whether the entry carries file metadata
+func (e Entry) HasMetadata() bool {
+	return e.SHA256 != ""
+}
+
+// IsChunked reports whether the file is stored as multiple chunk objects
+func (e Entry) IsChunked() bool {
+	return len(e.Chunks) > 0
+}
+
+// StorageIDs returns every storage object that holds the file's contents
+func (e Entry) StorageIDs() []string {
+	if e.IsChunked() {
+		return e.Chunks
+	}
+	return []string{e.RealName}
 }
 
 // VaultIndex is the top-level structure for .config/index
@@ -94,6 +129,50 @@ func (vi VaultIndex) AddFile(path string, realName string, encryptedKeyHex strin
 	}
 }
 
+// AllStorageIDs returns the storage objects of a file, or of every file below a folder
+func (e Entry) AllStorageIDs() []string {
+	if e.Type == "file" {
+		return e.StorageIDs()
+	}
+	var ids []string
+	for _, file := range IndexFiles(e.Contents, "") {
+		ids = append(ids, file.Entry.StorageIDs()...)
+	}
+	return ids
+}
+
+// Clone returns a deep copy of the entry, so the copy's folder contents can
+// be changed without affecting the original
+func (e Entry) Clone() Entry {
+	if e.Chunks != nil {
+		e.Chunks = append([]string{}, e.Chunks...)
+	}
+	if e.Contents != nil {
+		contents := make(map[string]Entry, len(e.Contents))
+		for name, sub := range e.Contents {
+			contents[name] = sub.Clone()
+		}
+		e.Contents = contents
+	}
+	return e
+}
+
+// AddChunkedFile inserts a file stored as several chunk objects into the index.
+// RealName is set to the first chunk so the entry still has a single storage ID to display.
+func (vi VaultIndex) AddChunkedFile(path string, chunks []string, encryptedKeyHex string) {
+	vi.AddFile(path, chunks[0], encryptedKeyHex)
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	currentMap := vi
+	for _, part := range parts[:len(parts)-1] {
+		currentMap = currentMap[part].Contents
+	}
+
+	entry := currentMap[parts[len(parts)-1]]
+	entry.Chunks = chunks
+	currentMap[parts[len(parts)-1]] = entry
+}
+
 // UpdateFileKey updates the encrypted file key for an existing entry
 func (vi VaultIndex) UpdateFileKey(path string, encryptedKeyHex string) error {
 	parts := strings.Split(strings.Trim(path, "/"), "/")
@@ -118,6 +197,184 @@ func (vi VaultIndex) UpdateFileKey(path string, encryptedKeyHex string) error {
 	return nil
 }
 
+// RemoveEntry detaches the entry at path from the index and returns it
+func (vi VaultIndex) RemoveEntry(path string) (Entry, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	currentMap := vi
+
+	for i := 0; i < len(parts)-1; i++ {
+		entry, exists := currentMap[parts[i]]
+		if !exists || entry.Type != "folder" {
+			return Entry{}, fmt.Errorf("path component '%s' not found", parts[i])
+		}
+		currentMap = entry.Contents
+	}
+
+	name := parts[len(parts)-1]
+	entry, exists := currentMap[name]
+	if !exists {
+		return Entry{}, fmt.Errorf("path '%s' not found in vault", path)
+	}
+	delete(currentMap, name)
+	return entry, nil
+}
+
+// PutEntry places an entry (file or folder subtree) at path, replacing any
+// existing entry there and creating intermediate folders as needed
+func (vi VaultIndex) PutEntry(path string, entry Entry) error {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	currentMap := vi
+
+	for i := 0; i < len(parts)-1; i++ {
+		part := parts[i]
+		folder, exists := currentMap[part]
+		if !exists {
+			folder = Entry{
+				Type:     "folder",
+				Contents: make(map[string]Entry),
+			}
+			currentMap[part] = folder
+		} else if folder.Type != "folder" {
+			return fmt.Errorf("'%s' is a file, not a folder", part)
+		} else if folder.Contents == nil {
+			folder.Contents = make(map[string]Entry)
+			currentMap[part] = folder
+		}
+		currentMap = folder.Contents
+	}
+
+	currentMap[parts[len(parts)-1]] = entry
+	return nil
+}
+
+// Unreferenced returns the storage IDs from ids that no entry in the index uses.
+// Copies made with 'cp' share storage objects, so an object may only be
+// removed once the last entry referring to it is gone.
+func (vi VaultIndex) Unreferenced(ids []string) []string {
+	refs := vi.referenceCounts()
+	var unused []string
+	for _, id := range ids {
+		if refs[id] == 0 {
+			unused = append(unused, id)
+		}
+	}
+	return unused
+}
+
+// referenceCounts returns how many file entries use each storage ID
+func (vi VaultIndex) referenceCounts() map[string]int {
+	refs := make(map[string]int)
+	for _, file := range IndexFiles(vi, "") {
+		for _, id := range file.Entry.StorageIDs() {
+			refs[id]++
+		}
+	}
+	return refs
+}
+
+// SetFileMetadata replaces the metadata of an existing file entry
+func (vi VaultIndex) SetFileMetadata(path string, meta FileMetadata) error {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	currentMap := vi
+
+	for i := 0; i < len(parts)-1; i++ {
+		part := parts[i]
+		entry, exists := currentMap[part]
+		if !exists {
+			return fmt.Errorf("path component '%s' not found", part)
+		}
+		currentMap = entry.Contents
+	}
+
+	fileName := parts[len(parts)-1]
+	entry, exists := currentMap[fileName]
+	if !exists {
+		return fmt.Errorf("file '%s' not found", fileName)
+	}
+	entry.FileMetadata = meta
+	currentMap[fileName] = entry
+	return nil
+}
+
+// MergeIndex performs a three-way merge of two indexes that diverged from base.
+// Changes made on only one side are kept; folders changed on both sides are
+// merged recursively. It returns the merged index and the paths that were
+// changed differently on both sides (where ours is kept).
+func MergeIndex(base, ours, theirs VaultIndex) (VaultIndex, []string) {
+	var conflicts []string
+	merged := mergeEntries(base, ours, theirs, "", &conflicts)
+	sort.Strings(conflicts)
+	return merged, conflicts
+}
+
+func mergeEntries(base, ours, theirs map[string]Entry, prefix string, conflicts *[]string) map[string]Entry {
+	merged := make(map[string]Entry)
+
+	names := make(map[string]bool)
+	for _, m := range []map[string]Entry{base, ours, theirs} {
+		for name := range m {
+			names[name] = true
+		}
+	}
+
+	for name := range names {
+		b, inBase := base[name]
+		o, inOurs := ours[name]
+		t, inTheirs := theirs[name]
+
+		path := name
+		if prefix != "" {
+			path = prefix + "/" + name
+		}
+
+		switch {
+		case sameEntry(o, inOurs, t, inTheirs):
+			// Both sides agree (including both deleting it)
+			if inOurs {
+				merged[name] = o
+			}
+		case sameEntry(o, inOurs, b, inBase):
+			// Only theirs changed it
+			if inTheirs {
+				merged[name] = t
+			}
+		case sameEntry(t, inTheirs, b, inBase):
+			// Only ours changed it
+			if inOurs {
+				merged[name] = o
+			}
+		case inOurs && inTheirs && o.Type == "folder" && t.Type == "folder":
+			var baseContents map[string]Entry
+			if inBase && b.Type == "folder" {
+				baseContents = b.Contents
+			}
+			o.Contents = mergeEntries(baseContents, o.Contents, t.Contents, path, conflicts)
+			merged[name] = o
+		default:
+			*conflicts = append(*conflicts, path)
+			if inOurs {
+				merged[name] = o
+			}
+		}
+	}
+
+	return merged
+}
+
+// sameEntry compares two optional entries by their serialized form, so that
+// an empty folder and a folder with nil Contents are considered equal
+func sameEntry(a Entry, aExists bool, b Entry, bExists bool) bool {
+	if aExists != bExists {
+		return false
+	}
+	if !aExists {
+		return true
+	}
+	aJSON, _ := json.Marshal(a)
+	bJSON, _ := json.Marshal(b)
+	return bytes.Equal(aJSON, bJSON)
+}
+
 // PrintDebug prints the index structure to the console
 func (vi VaultIndex) PrintDebug() {
 	if len(vi) == 0 {
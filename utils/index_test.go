@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+// testIndex builds an index holding files at the given paths, each stored
+// under its storage ID
+func testIndex(files map[string]string) VaultIndex {
+	vi := NewIndex()
+	for path, storageID := range files {
+		vi.AddFile(path, storageID, "key")
+	}
+	return vi
+}
+
+func indexStorageIDs(vi VaultIndex) map[string]string {
+	ids := make(map[string]string)
+	for _, file := range IndexFiles(vi, "") {
+		ids[file.Path] = file.Entry.RealName
+	}
+	return ids
+}
+
+func TestMergeIndex(t *testing.T) {
+	base := map[string]string{"a.txt": "a1", "docs/b.txt": "b1", "docs/c.txt": "c1"}
+	for _, tt := range []struct {
+		name      string
+		ours      map[string]string
+		theirs    map[string]string
+		want      map[string]string
+		conflicts []string
+	}{
+		{
+			name:   "unchanged",
+			ours:   base,
+			theirs: base,
+			want:   base,
+		},
+		{
+			name:   "different files added on each side",
+			ours:   map[string]string{"a.txt": "a1", "docs/b.txt": "b1", "docs/c.txt": "c1", "ours.txt": "o1"},
+			theirs: map[string]string{"a.txt": "a1", "docs/b.txt": "b1", "docs/c.txt": "c1", "docs/theirs.txt": "t1"},
+			want:   map[string]string{"a.txt": "a1", "docs/b.txt": "b1", "docs/c.txt": "c1", "ours.txt": "o1", "docs/theirs.txt": "t1"},
+		},
+		{
+			name:   "different files changed in the same folder",
+			ours:   map[string]string{"a.txt": "a1", "docs/b.txt": "b2", "docs/c.txt": "c1"},
+			theirs: map[string]string{"a.txt": "a1", "docs/b.txt": "b1", "docs/c.txt": "c2"},
+			want:   map[string]string{"a.txt": "a1", "docs/b.txt": "b2", "docs/c.txt": "c2"},
+		},
+		{
+			name:   "deleted on one side",
+			ours:   map[string]string{"docs/b.txt": "b1", "docs/c.txt": "c1"},
+			theirs: map[string]string{"a.txt": "a1", "docs/b.txt": "b1", "docs/c.txt": "c2"},
+			want:   map[string]string{"docs/b.txt": "b1", "docs/c.txt": "c2"},
+		},
+		{
+			name:   "same change on both sides",
+			ours:   map[string]string{"a.txt": "a2", "docs/b.txt": "b1", "docs/c.txt": "c1"},
+			theirs: map[string]string{"a.txt": "a2", "docs/b.txt": "b1", "docs/c.txt": "c1"},
+			want:   map[string]string{"a.txt": "a2", "docs/b.txt": "b1", "docs/c.txt": "c1"},
+		},
+		{
+			name:      "changed differently on both sides",
+			ours:      map[string]string{"a.txt": "a2", "docs/b.txt": "b2", "docs/c.txt": "c1"},
+			theirs:    map[string]string{"a.txt": "a3", "docs/b.txt": "b3", "docs/c.txt": "c1"},
+			want:      map[string]string{"a.txt": "a2", "docs/b.txt": "b2", "docs/c.txt": "c1"},
+			conflicts: []string{"a.txt", "docs/b.txt"},
+		},
+		{
+			name:      "changed on one side, deleted on the other",
+			ours:      map[string]string{"a.txt": "a2", "docs/b.txt": "b1", "docs/c.txt": "c1"},
+			theirs:    map[string]string{"docs/b.txt": "b1", "docs/c.txt": "c1"},
+			want:      map[string]string{"a.txt": "a2", "docs/b.txt": "b1", "docs/c.txt": "c1"},
+			conflicts: []string{"a.txt"},
+		},
+		{
+			name:      "added differently on both sides",
+			ours:      map[string]string{"a.txt": "a1", "docs/b.txt": "b1", "docs/c.txt": "c1", "new.txt": "n1"},
+			theirs:    map[string]string{"a.txt": "a1", "docs/b.txt": "b1", "docs/c.txt": "c1", "new.txt": "n2"},
+			want:      map[string]string{"a.txt": "a1", "docs/b.txt": "b1", "docs/c.txt": "c1", "new.txt": "n1"},
+			conflicts: []string{"new.txt"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, conflicts := MergeIndex(testIndex(base), testIndex(tt.ours), testIndex(tt.theirs))
+			if got := indexStorageIDs(merged); !maps.Equal(got, tt.want) {
+				t.Errorf("merged = %v, want %v", got, tt.want)
+			}
+			if !slices.Equal(conflicts, tt.conflicts) {
+				t.Errorf("conflicts = %v, want %v", conflicts, tt.conflicts)
+			}
+		})
+	}
+}
@@ -3,42 +3,65 @@ package utils
 import (
 	"fmt"
 	"strings"
+	"time"
 )
 
 // VaultStats holds statistics about the vault
 type VaultStats struct {
-	TotalFiles   int
-	TotalFolders int
-	TotalSize    int64
+	TotalFiles   int   `json:"files"`
+	TotalFolders int   `json:"folders"`
+	TotalSize    int64 `json:"size"`               // Plaintext bytes of all files with metadata
+	UnknownSize  int   `json:"files_without_size"` // Files uploaded before metadata was recorded
+}
+
+// VaultInfo is what info shows about the vault as a whole
+type VaultInfo struct {
+	Username string `json:"username"`
+	VaultStats
+	Settings VaultSettings `json:"settings"`
+}
+
+// FileInfo is what info shows about one file
+type FileInfo struct {
+	Name          string    `json:"name"`
+	Path          string    `json:"path"`
+	StorageID     string    `json:"storage_id"`
+	Chunks        int       `json:"chunks"`         // 0 for files stored as one object
+	Size          int64     `json:"size"`           // Plaintext bytes
+	EncryptedSize int64     `json:"encrypted_size"` // Bytes stored in the vault
+	SHA256        string    `json:"sha256,omitempty"`
+	MimeType      string    `json:"mime_type,omitempty"`
+	Mode          string    `json:"mode,omitempty"` // Octal permission bits, e.g. "0644"
+	Created       time.Time `json:"created,omitzero"`
+	Modified      time.Time `json:"modified,omitzero"`
+	FileKey       string    `json:"file_key"` // Hex-encoded, wrapped with the vault key
+	HasMetadata   bool      `json:"has_metadata"`
 }
 
 // GetVaultStats calculates statistics about the vault
 func GetVaultStats(session *Session) VaultStats {
 	stats := VaultStats{}
 
-	// Recursively count files and folders
-	var countEntries func(Entry)
-	countEntries = func(e Entry) {
-		if e.Type == "file" {
-			stats.TotalFiles++
-		} else {
+	// Count every file and folder in the index
+	WalkIndex(session.Index, "", func(_ string, e *Entry) error {
+		if e.Type != "file" {
 			stats.TotalFolders++
-			for _, subEntry := range e.Contents {
-				countEntries(subEntry)
-			}
+			return nil
 		}
-	}
-
-	// Count all entries in the index
-	for _, entry := range session.Index {
-		countEntries(entry)
-	}
+		stats.TotalFiles++
+		if e.HasMetadata() {
+			stats.TotalSize += e.Size
+		} else {
+			stats.UnknownSize++
+		}
+		return nil
+	})
 
 	return stats
 }
 
 // GetFileInfo retrieves detailed information about a specific file
-func GetFileInfo(vaultPath string, session *Session) (map[string]interface{}, error) {
+func GetFileInfo(vaultPath string, session *Session) (*FileInfo, error) {
 	entry, err := session.Index.FindEntry(vaultPath)
 	if err != nil {
 		return nil, fmt.Errorf("could not find file in vault: %w", err)
@@ -48,54 +71,124 @@ func GetFileInfo(vaultPath string, session *Session) (map[string]interface{}, er
 		return nil, fmt.Errorf("'%s' is a directory, not a file", vaultPath)
 	}
 
-	// Fetch file from remote to get size
-	PrintProgressStep(1, 2, "Fetching file metadata...")
-	encryptedData, err := FetchRaw(session.Username, entry.RealName)
+	storageIDs := entry.StorageIDs()
+	overhead := int64(len(storageIDs) * (NonceSize + chunkTagSize))
+
+	info := &FileInfo{
+		Name:      vaultPath[strings.LastIndex(vaultPath, "/")+1:],
+		Path:      vaultPath,
+		StorageID: entry.RealName,
+		Chunks:    len(entry.Chunks),
+		FileKey:   entry.FileKey,
+	}
+
+	if entry.HasMetadata() {
+		info.HasMetadata = true
+		info.Size = entry.Size
+		info.EncryptedSize = entry.Size + overhead
+		info.SHA256 = entry.SHA256
+		info.MimeType = entry.MimeType
+		if entry.Mode != 0 {
+			info.Mode = fmt.Sprintf("%04o", entry.Mode.Perm())
+		}
+		info.Created = entry.Created.UTC()
+		info.Modified = entry.Modified.UTC()
+		return info, nil
+	}
+
+	// Entries from before metadata was recorded: fetch the file from remote to get
+	// its size. Every chunk but the last holds exactly ChunkSize bytes of
+	// plaintext, so only the last one has to be fetched.
+	PrintProgressStep(1, 1, "Fetching file metadata...")
+	lastObject, err := session.Fetch(storageIDs[len(storageIDs)-1])
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch file from remote: %w", err)
 	}
+	encryptedSize := int64(len(storageIDs)-1)*(NonceSize+ChunkSize+chunkTagSize) + int64(len(lastObject))
 	PrintCompletionLine("File metadata retrieved")
 
-	info := map[string]interface{}{
-		"name":          strings.Split(vaultPath, "/")[len(strings.Split(vaultPath, "/"))-1],
-		"vaultPath":     vaultPath,
-		"storageID":     entry.RealName,
-		"encryptedSize": len(encryptedData),
-		"fileKey":       entry.FileKey,
-	}
+	info.Size = encryptedSize - overhead
+	info.EncryptedSize = encryptedSize
 
 	return info, nil
 }
 
-// PrintVaultInfo prints formatted vault information
-func PrintVaultInfo(session *Session) {
-	stats := GetVaultStats(session)
+// PrintVaultInfo prints vault statistics and settings in the given output format
+func PrintVaultInfo(session *Session, format string) error {
+	info := VaultInfo{Username: session.Username, VaultStats: GetVaultStats(session), Settings: session.Settings}
+	if format != OutputTable {
+		return writeRecord(format, info)
+	}
 
 	fmt.Println("\n╔════════════════════════════════════════╗")
 	fmt.Println("║        VAULT INFORMATION               ║")
 	fmt.Println("╚════════════════════════════════════════╝")
-	fmt.Printf("Username:              %s\n", session.Username)
-	fmt.Printf("Total Files:           %d\n", stats.TotalFiles)
-	fmt.Printf("Total Folders:         %d\n", stats.TotalFolders)
+	fmt.Printf("Username:              %s\n", info.Username)
+	fmt.Printf("Total Files:           %d\n", info.TotalFiles)
+	fmt.Printf("Total Folders:         %d\n", info.TotalFolders)
+	if info.UnknownSize > 0 {
+		fmt.Printf("Total Size:            %s (%d files without size information)\n", FormatSize(info.TotalSize), info.UnknownSize)
+	} else {
+		fmt.Printf("Total Size:            %s\n", FormatSize(info.TotalSize))
+	}
 	fmt.Println("\n╔════════════════════════════════════════╗")
 	fmt.Println("║      VAULT SETTINGS                    ║")
 	fmt.Println("╚════════════════════════════════════════╝")
-	fmt.Printf("Commit Author:         %s <%s>\n", session.Settings.CommitAuthorName, session.Settings.CommitAuthorEmail)
-	fmt.Printf("Commit Message:        %s\n", session.Settings.CommitMessage)
-	fmt.Printf("File Hash Length:      %d characters\n", session.Settings.FileHashLength)
-	fmt.Printf("Share Hash Length:     %d characters\n", session.Settings.ShareHashLength)
+	fmt.Printf("Commit Author:         %s <%s>\n", info.Settings.CommitAuthorName, info.Settings.CommitAuthorEmail)
+	fmt.Printf("Commit Message:        %s\n", info.Settings.CommitMessage)
+	fmt.Printf("File Hash Length:      %d characters\n", info.Settings.FileHashLength)
+	fmt.Printf("Share Hash Length:     %d characters\n", info.Settings.ShareHashLength)
 	fmt.Println()
+	return nil
 }
 
-// PrintFileInfo prints formatted file information
-func PrintFileInfo(fileInfo map[string]interface{}) {
+// PrintFileInfo prints file information in the given output format
+func PrintFileInfo(info *FileInfo, format string) error {
+	if format != OutputTable {
+		return writeRecord(format, info)
+	}
+
 	fmt.Println("\n╔════════════════════════════════════════╗")
 	fmt.Println("║        FILE INFORMATION                ║")
 	fmt.Println("╚════════════════════════════════════════╝")
-	fmt.Printf("File Name:             %s\n", fileInfo["name"])
-	fmt.Printf("Vault Path:            %s\n", fileInfo["vaultPath"])
-	fmt.Printf("Storage ID (Hash):     %s\n", fileInfo["storageID"])
-	fmt.Printf("Encrypted Size:        %d bytes\n", fileInfo["encryptedSize"])
-	fmt.Printf("File Key (encrypted):  %s\n", fileInfo["fileKey"])
+	fmt.Printf("File Name:             %s\n", info.Name)
+	fmt.Printf("Vault Path:            %s\n", info.Path)
+	fmt.Printf("Storage ID (Hash):     %s\n", info.StorageID)
+	if info.Chunks > 0 {
+		fmt.Printf("Chunks:                %d\n", info.Chunks)
+	}
+	fmt.Printf("Size:                  %s (%d bytes)\n", FormatSize(info.Size), info.Size)
+	fmt.Printf("Encrypted Size:        %d bytes\n", info.EncryptedSize)
+	if info.HasMetadata {
+		fmt.Printf("SHA-256:               %s\n", info.SHA256)
+		fmt.Printf("MIME Type:             %s\n", info.MimeType)
+		if info.Mode != "" {
+			fmt.Printf("Mode:                  %s\n", info.Mode)
+		}
+		if !info.Created.IsZero() {
+			fmt.Printf("Created:               %s\n", info.Created.Local().Format("2006-01-02 15:04:05"))
+		}
+		if !info.Modified.IsZero() {
+			fmt.Printf("Modified:              %s\n", info.Modified.Local().Format("2006-01-02 15:04:05"))
+		}
+	} else {
+		fmt.Println("Metadata:              not recorded (re-upload the file to add it)")
+	}
+	fmt.Printf("File Key (encrypted):  %s\n", info.FileKey)
 	fmt.Println()
+	return nil
+}
+
+// FormatSize renders a byte count in human-readable units
+func FormatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
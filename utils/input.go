@@ -2,15 +2,17 @@ package utils
 
 import (
 	"fmt"
+	"os"
 	"strings"
 	"syscall"
 
 	"golang.org/x/term"
 )
 
-// GetPassword prompts the user for a password without echoing input to the terminal
+// GetPassword prompts the user for a password without echoing input to the
+// terminal. The prompt goes to stderr so it never mixes with command output.
 func GetPassword(prompt string) (string, error) {
-	fmt.Print(prompt)
+	fmt.Fprint(os.Stderr, prompt)
 
 	// syscall.Stdin is the file descriptor for standard input
 	bytePassword, err := term.ReadPassword(int(syscall.Stdin))
@@ -19,7 +21,7 @@ func GetPassword(prompt string) (string, error) {
 	}
 
 	// ReadPassword doesn't capture the newline character, so we print one manually
-	fmt.Println()
+	fmt.Fprintln(os.Stderr)
 
 	return strings.TrimSpace(string(bytePassword)), nil
 }
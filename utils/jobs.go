@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// DefaultJobs is how many files directory downloads and vault transfers
+// process at once unless --jobs says otherwise
+const DefaultJobs = 4
+
+// FileErrors collects the files that failed in a batch. One failure does not
+// stop the other files, so every failure is reported together at the end.
+type FileErrors struct {
+	Total  int     // Number of files in the batch
+	Errors []error // One per failed file, in batch order
+}
+
+func (e *FileErrors) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d of %d files failed:", len(e.Errors), e.Total)
+	for _, err := range e.Errors {
+		b.WriteString("\n  - ")
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+// Unwrap returns the individual failures, for errors.Is and errors.As
+func (e *FileErrors) Unwrap() []error {
+	return e.Errors
+}
+
+// runJobs calls work(i) for i in [0, n) on up to jobs goroutines. done(i, err)
+// is called on the calling goroutine in order of i, as soon as job i and every
+// job before it have finished, so progress output is the same for any number
+// of workers. work must only write state owned by job i; done may update
+// shared state. It returns the failed jobs' errors as *FileErrors, or nil.
+func runJobs(n int, jobs int, work func(i int) error, done func(i int, err error)) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+	if jobs > n {
+		jobs = n
+	}
+
+	results := make([]chan error, n)
+	for i := range results {
+		results[i] = make(chan error, 1)
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] <- work(i)
+			}
+		}()
+	}
+	go func() {
+		for i := range n {
+			next <- i
+		}
+		close(next)
+	}()
+
+	failures := &FileErrors{Total: n}
+	for i := range n {
+		err := <-results[i]
+		done(i, err)
+		if err != nil {
+			failures.Errors = append(failures.Errors, err)
+		}
+	}
+	wg.Wait()
+
+	if len(failures.Errors) > 0 {
+		return failures
+	}
+	return nil
+}
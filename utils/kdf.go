@@ -0,0 +1,77 @@
+package utils
+
+import "fmt"
+
+// UpgradeKDF re-encrypts everything protected by the vault password with
+// DefaultKDF: the master key, the index, the settings, the shared index and
+// the private key and inbox if any.
+// File keys still encrypted with the password are moved to the key-encryption
+// key (see keywrap.go). The password stays the same, and all changes are
+// pushed in one commit.
+func UpgradeKDF(session *Session) error {
+	// 1. Report what the vault uses now
+	PrintProgressStep(1, 4, "Checking key derivation...")
+	encryptedKey, err := session.Fetch(".config/key")
+	if err != nil {
+		return fmt.Errorf("master key not found: %w", err)
+	}
+	current := KDFOf(encryptedKey)
+	legacyKeys, totalKeys := countPasswordWrappedKeys(session.Index)
+	PrintCompletionLine(fmt.Sprintf("Vault key uses %s; %d of %d file keys are still encrypted with the password", current, legacyKeys, totalKeys))
+
+	// 2. Re-wrap the master key and the file keys
+	PrintProgressStep(2, 4, "Re-encrypting master key and file keys...")
+	masterKeyEncrypted, err := Encrypt(session.RawKey, session.Password)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt master key: %w", err)
+	}
+	kek, err := session.kek()
+	if err != nil {
+		return err
+	}
+	upgraded, err := migrateFileKeys(session.Index, session.Password, kek)
+	if err != nil {
+		return err
+	}
+	PrintCompletionLine(fmt.Sprintf("Master key re-encrypted, %d file keys moved to the key-encryption key", upgraded))
+
+	// 3. Re-encrypt the index, settings and shared index
+	PrintProgressStep(3, 4, "Re-encrypting index, settings and shared index...")
+	indexBytes, err := session.Index.ToBytes(session.Password)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt index: %w", err)
+	}
+	settingsBytes, err := session.Settings.ToBytes(session.Password)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt settings: %w", err)
+	}
+	sharedIndex := session.SharedIndex
+	if sharedIndex == nil {
+		sharedIndex = NewSharedIndex()
+	}
+	sharedIndexEncrypted, err := sharedIndex.EncryptForRemote(session.Password)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt shared index: %w", err)
+	}
+	PrintCompletionLine("Vault metadata re-encrypted")
+
+	// 4. Push everything in one commit
+	PrintProgressStep(4, 4, "Pushing updated files to vault...")
+	filesToPush := map[string][]byte{
+		".config/key":          masterKeyEncrypted,
+		".config/index":        indexBytes,
+		".config/settings":     settingsBytes,
+		"shared/.config/index": sharedIndexEncrypted,
+	}
+	if err := reencryptKeyFiles(session, session.Password, filesToPush); err != nil {
+		return err
+	}
+
+	// The master key and settings are replaced wholesale, so concurrent changes
+	// are not merged in; the push fails instead and can simply be retried.
+	if err := session.push(filesToPush, nil, false); err != nil {
+		return fmt.Errorf("failed to push updated files: %w", err)
+	}
+	PrintCompletionLine("Vault now uses " + DefaultKDF.String())
+	return nil
+}
@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// kekInfo binds the derived key to its single purpose, so the master key can
+// later be used to derive other keys without them being related
+const kekInfo = "zephyrus/file-key-wrapping/v1"
+
+// VaultKDF marks a file key wrapped with the vault key-encryption key
+var VaultKDF = KDFParams{ID: KDFVaultKey}
+
+// deriveKEK derives the vault key-encryption key from the master key stored in
+// .config/key. The master key never changes (a password change only re-encrypts
+// it), so file keys wrapped with the KEK survive password changes untouched.
+func deriveKEK(masterKey []byte) ([]byte, error) {
+	if len(masterKey) == 0 {
+		return nil, errors.New("vault master key is not loaded")
+	}
+	return hkdf.Key(sha256.New, masterKey, nil, kekInfo, KeySize)
+}
+
+// WrapKey encrypts a file key with a key-encryption key using AES-GCM. The
+// result uses the same header as Encrypt, with KDFVaultKey and no salt:
+//
+//	[magic "ZEPH"][version 1][KDFVaultKey][nonce 12][ciphertext]
+func WrapKey(fileKey []byte, kek []byte) ([]byte, error) {
+	gcm, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, NonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	header := VaultKDF.header()
+	result := append(header, nonce...)
+	return gcm.Seal(result, nonce, fileKey, header), nil
+}
+
+// UnwrapKey decrypts a file key written by WrapKey
+func UnwrapKey(wrapped []byte, kek []byte) ([]byte, error) {
+	params, headerLen, ok, err := parseHeader(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || params.ID != KDFVaultKey {
+		return nil, errors.New("file key is not wrapped with the vault key")
+	}
+	if len(wrapped) < headerLen+NonceSize {
+		return nil, errors.New("wrapped key too short")
+	}
+	gcm, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	header := wrapped[:headerLen]
+	nonce := wrapped[headerLen : headerLen+NonceSize]
+	return gcm.Open(nil, nonce, wrapped[headerLen+NonceSize:], header)
+}
+
+// IsKEKWrapped reports whether a hex-encoded file key from the index is wrapped
+// with the vault key-encryption key rather than the vault password
+func IsKEKWrapped(encryptedKeyHex string) bool {
+	data, err := hex.DecodeString(encryptedKeyHex)
+	return err == nil && KDFOf(data).ID == KDFVaultKey
+}
+
+// kek returns the session's key-encryption key, deriving it on first use
+func (s *Session) kek() ([]byte, error) {
+	if s.fileKEK == nil {
+		kek, err := deriveKEK(s.RawKey)
+		if err != nil {
+			return nil, err
+		}
+		s.fileKEK = kek
+	}
+	return s.fileKEK, nil
+}
+
+// WrapFileKey wraps a new file key for the index (hex-encoded)
+func (s *Session) WrapFileKey(fileKey []byte) (string, error) {
+	kek, err := s.kek()
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := WrapKey(fileKey, kek)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(wrapped), nil
+}
+
+// UnwrapFileKey decrypts a hex-encoded file key from the index. Keys written by
+// older versions are encrypted with the vault password and are still accepted.
+func (s *Session) UnwrapFileKey(encryptedKeyHex string) ([]byte, error) {
+	wrapped, err := hex.DecodeString(encryptedKeyHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file key in index: %w", err)
+	}
+	if KDFOf(wrapped).ID != KDFVaultKey {
+		return Decrypt(wrapped, s.Password)
+	}
+	kek, err := s.kek()
+	if err != nil {
+		return nil, err
+	}
+	return UnwrapKey(wrapped, kek)
+}
+
+// countPasswordWrappedKeys counts the file keys in the index still encrypted
+// with the vault password
+func countPasswordWrappedKeys(entries VaultIndex) (legacy int, total int) {
+	for _, entry := range entries {
+		if entry.Type == "folder" {
+			l, t := countPasswordWrappedKeys(entry.Contents)
+			legacy += l
+			total += t
+			continue
+		}
+		total++
+		if !IsKEKWrapped(entry.FileKey) {
+			legacy++
+		}
+	}
+	return legacy, total
+}
+
+// migrateFileKeys re-wraps every file key still encrypted with password using
+// the key-encryption key. Each of those costs one password derivation; keys
+// already wrapped with the KEK are skipped.
+func migrateFileKeys(entries VaultIndex, password string, kek []byte) (int, error) {
+	migrated := 0
+	for name, entry := range entries {
+		if entry.Type == "folder" {
+			n, err := migrateFileKeys(entry.Contents, password, kek)
+			migrated += n
+			if err != nil {
+				return migrated, err
+			}
+			continue
+		}
+		if IsKEKWrapped(entry.FileKey) {
+			continue
+		}
+
+		fileKey, err := DecryptHexToBytes(entry.FileKey, password)
+		if err != nil {
+			return migrated, fmt.Errorf("failed to decrypt file key for %s: %w", name, err)
+		}
+		wrapped, err := WrapKey(fileKey, kek)
+		if err != nil {
+			return migrated, fmt.Errorf("failed to wrap file key for %s: %w", name, err)
+		}
+		entry.FileKey = hex.EncodeToString(wrapped)
+		entries[name] = entry
+		migrated++
+	}
+	return migrated, nil
+}
@@ -2,16 +2,23 @@ package utils
 
 import (
 	"fmt"
+	"io/fs"
 	"os"
+	"path"
+	"strings"
 	"text/tabwriter"
 )
 
-func ListFiles(session *Session, folderPath string) error {
+// ListFiles prints the contents of a vault folder ("" for the root) in the
+// given output format (see output.go)
+func ListFiles(session *Session, folderPath string, format string) error {
 	// Start with the root map
 	currentMap := session.Index
 
-	// If a path is provided, navigate to that entry
-	if folderPath != "" && folderPath != "/" {
+	// If a path is provided, navigate to that entry. It is also the prefix of
+	// the listed paths, so "docs/" must not become "docs//a.txt"
+	folderPath = strings.Trim(folderPath, "/")
+	if folderPath != "" {
 		entry, err := session.Index.FindEntry(folderPath)
 		if err != nil {
 			return err
@@ -22,27 +29,51 @@ func ListFiles(session *Session, folderPath string) error {
 		currentMap = entry.Contents
 	}
 
-	if len(currentMap) == 0 {
+	var records []FileRecord
+	WalkIndex(currentMap, folderPath, func(vaultPath string, entry *Entry) error {
+		records = append(records, newFileRecord(vaultPath, path.Base(vaultPath), entry))
+		if entry.Type == "folder" {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if format != OutputTable {
+		return writeRecords(format, records)
+	}
+
+	if len(records) == 0 {
 		fmt.Println("Directory is empty.")
 		return nil
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
-	fmt.Fprintln(w, "NAME\tTYPE\tSTORAGE ID")
-	fmt.Fprintln(w, "----\t----\t----------")
-
-	for name, entry := range currentMap {
-		displayType := "[FILE]"
-		rName := entry.RealName
-		displayName := name
+	fmt.Fprintln(w, "NAME\tTYPE\tSIZE\tMODIFIED\tSTORAGE ID")
+	fmt.Fprintln(w, "----\t----\t----\t--------\t----------")
 
-		if entry.Type == "folder" {
-			displayType = "[DIR]"
-			rName = "-"
-			displayName = name + "/"
+	for _, record := range records {
+		displayType, size, modified, rName := recordColumns(record)
+		displayName := record.Name
+		if record.Type == "folder" {
+			displayName += "/"
 		}
-		fmt.Fprintf(w, "%s\t%s\t%s\n", displayName, displayType, rName)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", displayName, displayType, size, modified, rName)
 	}
 
 	return w.Flush()
-}
\ No newline at end of file
+}
+
+// recordColumns returns the TYPE, SIZE, MODIFIED and STORAGE ID cells of a
+// table row, shared by ls and search
+func recordColumns(record FileRecord) (displayType, size, modified, storageID string) {
+	if record.Type == "folder" {
+		return "[DIR]", "-", "-", "-"
+	}
+	size, modified = "-", "-"
+	if record.Size != nil {
+		size = FormatSize(*record.Size)
+		if !record.Modified.IsZero() {
+			modified = record.Modified.Local().Format("2006-01-02 15:04")
+		}
+	}
+	return "[FILE]", size, modified, record.StorageID
+}
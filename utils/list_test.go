@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestListFilesJSONPaths(t *testing.T) {
+	session := &Session{Index: testIndex(map[string]string{"docs/a.txt": "a1", "docs/sub/b.txt": "b1", "c.txt": "c1"})}
+
+	for _, tt := range []struct {
+		folder string
+		want   []string
+	}{
+		{"docs", []string{"docs/a.txt", "docs/sub"}},
+		{"docs/", []string{"docs/a.txt", "docs/sub"}},
+		{"/docs/sub/", []string{"docs/sub/b.txt"}},
+		{"/", []string{"c.txt", "docs"}},
+		{"", []string{"c.txt", "docs"}},
+	} {
+		var err error
+		out := captureStdout(t, func() { err = ListFiles(session, tt.folder, OutputJSON) })
+		if err != nil {
+			t.Fatalf("ListFiles(%q): %v", tt.folder, err)
+		}
+		var records []FileRecord
+		if err := json.Unmarshal([]byte(out), &records); err != nil {
+			t.Fatalf("ListFiles(%q) printed invalid JSON: %v\n%s", tt.folder, err, out)
+		}
+		var paths []string
+		for _, r := range records {
+			paths = append(paths, r.Path)
+		}
+		if !slices.Equal(paths, tt.want) {
+			t.Errorf("ListFiles(%q) paths = %v, want %v", tt.folder, paths, tt.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// resolveDestination works out where srcPath ends up when moved or copied to
+// dstPath. Like mv and cp, an existing folder (or a path ending in "/", or the
+// vault root) receives the source under its own name. It returns the final
+// path and the entry currently there, if any.
+func resolveDestination(srcPath, dstPath string, force bool, session *Session) (string, *Entry, error) {
+	src := strings.Trim(srcPath, "/")
+	dst := strings.Trim(dstPath, "/")
+
+	if dst == "" || strings.HasSuffix(dstPath, "/") {
+		dst = strings.TrimPrefix(dst+"/"+path.Base(src), "/")
+	} else if existing, err := session.Index.FindEntry(dst); err == nil && existing.Type == "folder" {
+		dst = dst + "/" + path.Base(src)
+	}
+
+	if dst == src {
+		return "", nil, fmt.Errorf("'%s' and '%s' are the same path", srcPath, dstPath)
+	}
+	if strings.HasPrefix(dst, src+"/") {
+		return "", nil, fmt.Errorf("cannot place '%s' inside itself", srcPath)
+	}
+
+	existing, err := session.Index.FindEntry(dst)
+	if err != nil {
+		return dst, nil, nil
+	}
+	if !force {
+		return "", nil, fmt.Errorf("'%s' already exists (use --force to overwrite)", dst)
+	}
+	return dst, existing, nil
+}
+
+// MovePath moves or renames a file or folder inside the vault. Only the index
+// changes; the storage objects keep their IDs, so just .config/index is pushed
+// (plus the removal of anything overwritten with force).
+func MovePath(srcPath, dstPath string, force bool, session *Session) error {
+	// 1. Locate the source and work out the destination
+	PrintProgressStep(1, 3, "Locating path in vault...")
+	if _, err := session.Index.FindEntry(srcPath); err != nil {
+		return err
+	}
+	target, replaced, err := resolveDestination(srcPath, dstPath, force, session)
+	if err != nil {
+		return err
+	}
+	PrintCompletionLine("Path located")
+
+	// 2. Detach the subtree and attach it at the destination
+	PrintProgressStep(2, 3, "Updating vault index...")
+	entry, err := session.Index.RemoveEntry(srcPath)
+	if err != nil {
+		return err
+	}
+	if err := session.Index.PutEntry(target, entry); err != nil {
+		session.Index.PutEntry(srcPath, entry)
+		return err
+	}
+	var deletes []string
+	if replaced != nil {
+		deletes = session.Index.Unreferenced(replaced.AllStorageIDs())
+	}
+
+	indexBytes, err := session.Index.ToBytes(session.Password)
+	if err != nil {
+		return err
+	}
+	PrintCompletionLine("Vault index updated")
+
+	// 3. Push the index (and removals) in one commit
+	PrintProgressStep(3, 3, "Uploading to vault...")
+	if err := session.Push(map[string][]byte{".config/index": indexBytes}, deletes); err != nil {
+		return err
+	}
+	PrintCompletionLine(fmt.Sprintf("Moved '%s' to '%s'", srcPath, target))
+	return nil
+}
+
+// CopyPath copies a file or folder inside the vault. By default the copy
+// shares the original's storage objects and file keys, so only the index is
+// pushed. With duplicate, every object is copied under a new storage ID, so
+// the copy no longer depends on the original.
+func CopyPath(srcPath, dstPath string, force bool, duplicate bool, session *Session) error {
+	// 1. Locate the source and work out the destination
+	PrintProgressStep(1, 3, "Locating path in vault...")
+	source, err := session.Index.FindEntry(srcPath)
+	if err != nil {
+		return err
+	}
+	target, replaced, err := resolveDestination(srcPath, dstPath, force, session)
+	if err != nil {
+		return err
+	}
+	PrintCompletionLine("Path located")
+
+	// 2. Attach a deep copy of the subtree at the destination, copying objects if asked to
+	PrintProgressStep(2, 3, "Updating vault index...")
+	entry := source.Clone()
+	batch := newUploadBatch(session)
+	if duplicate {
+		if err := duplicateObjects(&entry, session, batch); err != nil {
+			return err
+		}
+	}
+	if err := session.Index.PutEntry(target, entry); err != nil {
+		return err
+	}
+	if replaced != nil {
+		batch.deletes = session.Index.Unreferenced(replaced.AllStorageIDs())
+	}
+
+	indexBytes, err := session.Index.ToBytes(session.Password)
+	if err != nil {
+		return err
+	}
+	PrintCompletionLine("Vault index updated")
+
+	// 3. Push the index, any duplicated objects and removals
+	PrintProgressStep(3, 3, "Uploading to vault...")
+	if err := batch.commit(indexBytes); err != nil {
+		return err
+	}
+	PrintCompletionLine(fmt.Sprintf("Copied '%s' to '%s'", srcPath, target))
+	return nil
+}
+
+// duplicateObjects copies the storage objects of a file, or of every file in a
+// folder, under new storage IDs and points the entry at them. The ciphertext is
+// copied as is: chunk nonces do not depend on the storage ID, and the file key
+// stays the same.
+func duplicateObjects(entry *Entry, session *Session, batch *uploadBatch) error {
+	if entry.Type == "folder" {
+		for name, sub := range entry.Contents {
+			if err := duplicateObjects(&sub, session, batch); err != nil {
+				return err
+			}
+			entry.Contents[name] = sub
+		}
+		return nil
+	}
+
+	hashByteLength := session.Settings.FileHashLength / 2 // Convert hex chars to bytes
+	renamed := make(map[string]string)
+	for _, id := range entry.StorageIDs() {
+		data, err := session.Fetch(id)
+		if err != nil {
+			return fmt.Errorf("failed to fetch storage object %s: %w", id, err)
+		}
+		newID := GenerateRandomNameWithLength(hashByteLength)
+		if err := batch.add(newID, data); err != nil {
+			return err
+		}
+		renamed[id] = newID
+	}
+
+	entry.RealName = renamed[entry.RealName]
+	for i, id := range entry.Chunks {
+		entry.Chunks[i] = renamed[id]
+	}
+	return nil
+}
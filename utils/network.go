@@ -1,16 +1,85 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time" // Add this
 )
 
+// Errors vault hosts and backends report, for use with errors.Is
+var (
+	ErrNotFound    = errors.New("not found")    // The object (or vault) does not exist
+	ErrRateLimited = errors.New("rate limited") // The host asked us to slow down
+	ErrAuth        = errors.New("auth failed")  // Wrong password, or the host refused our credentials
+)
+
+// HTTPError is an unsuccessful response from a vault host
+type HTTPError struct {
+	StatusCode int
+	RetryAfter time.Duration // How long the host asked us to wait, if it said
+	rateLimit  bool          // A 403 that is GitHub's API rate limit rather than a refusal
+}
+
+func (e *HTTPError) Error() string {
+	switch {
+	case e.StatusCode == http.StatusNotFound:
+		return ErrNotFound.Error()
+	case e.rateLimited():
+		if e.RetryAfter > 0 {
+			return fmt.Sprintf("%v (HTTP %d, retry after %s)", ErrRateLimited, e.StatusCode, e.RetryAfter.Round(time.Second))
+		}
+		return fmt.Sprintf("%v (HTTP %d)", ErrRateLimited, e.StatusCode)
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+		return fmt.Sprintf("%v (HTTP %d)", ErrAuth, e.StatusCode)
+	}
+	return fmt.Sprintf("bad status: %d", e.StatusCode)
+}
+
+// Is matches the HTTPError against ErrNotFound, ErrRateLimited and ErrAuth
+func (e *HTTPError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrRateLimited:
+		return e.rateLimited()
+	case ErrAuth:
+		return (e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden) && !e.rateLimited()
+	}
+	return false
+}
+
+func (e *HTTPError) rateLimited() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.rateLimit
+}
+
 func FetchRaw(username, path string) ([]byte, error) {
 	// Use the most direct raw URL format
-	url := fmt.Sprintf("https://raw.githubusercontent.com/%s/.zephyrus/master/%s?t=%d",
-		username, path, time.Now().UnixNano())
+	return fetchURL(fmt.Sprintf("https://raw.githubusercontent.com/%s/.zephyrus/master/%s", username, path))
+}
+
+// fetchURL downloads a raw object, busting any CDN cache. Storage objects
+// fetched through a session are cached locally instead (see cache.go).
+// Transient failures are retried (see retry.go).
+func fetchURL(rawURL string) ([]byte, error) {
+	var data []byte
+	err := retry(func() error {
+		var err error
+		data, err = fetchURLOnce(rawURL)
+		return err
+	})
+	return data, err
+}
+
+func fetchURLOnce(rawURL string) ([]byte, error) {
+	separator := "?"
+	if strings.Contains(rawURL, "?") {
+		separator = "&"
+	}
+	url := fmt.Sprintf("%s%st=%d", rawURL, separator, time.Now().UnixNano())
 
 	client := &http.Client{Timeout: 10 * time.Second}
 	resp, err := client.Get(url)
@@ -19,13 +88,32 @@ func FetchRaw(username, path string) ([]byte, error) {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, fmt.Errorf("404") // Explicitly return 404 string for main.go to check
-	}
-
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("bad status: %d", resp.StatusCode)
+		return nil, newHTTPError(resp)
 	}
 
 	return io.ReadAll(resp.Body)
 }
+
+// newHTTPError describes an unsuccessful response, including how long the host
+// asked us to wait: Retry-After (seconds or a date), or GitHub's rate limit reset
+func newHTTPError(resp *http.Response) *HTTPError {
+	e := &HTTPError{StatusCode: resp.StatusCode}
+	if resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		e.rateLimit = true
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			e.RetryAfter = time.Until(time.Unix(reset, 0))
+		}
+	}
+	if value := resp.Header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			e.RetryAfter = time.Duration(seconds) * time.Second
+		} else if at, err := http.ParseTime(value); err == nil {
+			e.RetryAfter = time.Until(at)
+		}
+	}
+	if e.RetryAfter < 0 {
+		e.RetryAfter = 0
+	}
+	return e
+}
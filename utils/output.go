@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Output formats of the listing and info commands (--output)
+const (
+	OutputTable = "table" // Human-readable tables (default)
+	OutputJSON  = "json"  // One JSON document: an array for lists, an object for info
+	OutputJSONL = "jsonl" // One JSON object per line
+)
+
+// ParseOutputFormat validates an --output value
+func ParseOutputFormat(format string) (string, error) {
+	switch format {
+	case "", OutputTable:
+		return OutputTable, nil
+	case OutputJSON, OutputJSONL:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown output format '%s' (use table, json or jsonl)", format)
+}
+
+// FileRecord describes one vault entry in the output of ls and search
+type FileRecord struct {
+	Path      string    `json:"path"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`                 // "file" or "folder"
+	Size      *int64    `json:"size,omitempty"`       // Plaintext bytes; absent for folders and files uploaded without metadata
+	Modified  time.Time `json:"modified,omitzero"`    // Source file modification time, when recorded
+	StorageID string    `json:"storage_id,omitempty"` // Files only
+	Chunks    int       `json:"chunks,omitempty"`     // Number of chunks of a chunked file
+	SHA256    string    `json:"sha256,omitempty"`
+	MimeType  string    `json:"mime_type,omitempty"`
+}
+
+// newFileRecord describes the entry stored at vaultPath
+func newFileRecord(vaultPath string, name string, entry *Entry) FileRecord {
+	record := FileRecord{Path: vaultPath, Name: name, Type: entry.Type}
+	if entry.Type == "folder" {
+		return record
+	}
+	record.StorageID = entry.RealName
+	record.Chunks = len(entry.Chunks)
+	if entry.HasMetadata() {
+		size := entry.Size
+		record.Size = &size
+		record.Modified = entry.Modified.UTC()
+		record.SHA256 = entry.SHA256
+		record.MimeType = entry.MimeType
+	}
+	return record
+}
+
+// writeRecords prints a list as a JSON array (json) or one object per line (jsonl)
+func writeRecords[T any](format string, records []T) error {
+	if records == nil {
+		records = []T{}
+	}
+	if format == OutputJSONL {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, record := range records {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return writeRecord(format, records)
+}
+
+// writeRecord prints one value as indented JSON (json) or on a single line (jsonl)
+func writeRecord(format string, record any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	if format == OutputJSON {
+		encoder.SetIndent("", "  ")
+	}
+	return encoder.Encode(record)
+}
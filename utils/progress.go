@@ -2,6 +2,8 @@ package utils
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"strings"
 	"time"
 )
@@ -13,14 +15,23 @@ const (
 
 var spinnerIdx = 0
 
+// progressOut receives progress messages; structured output (--output json)
+// moves them to stderr so stdout only holds the records
+var progressOut io.Writer = os.Stdout
+
+// SetProgressOutput selects where progress messages are written
+func SetProgressOutput(w io.Writer) {
+	progressOut = w
+}
+
 // PrintProgress displays a formatted progress message with optional spinner
 func PrintProgress(message string, withSpinner bool) {
 	if withSpinner {
 		frame := string(spinnerFrames[spinnerIdx%len(spinnerFrames)])
 		spinnerIdx++
-		fmt.Printf("\r%s %s ", frame, message)
+		fmt.Fprintf(progressOut, "\r%s %s ", frame, message)
 	} else {
-		fmt.Printf("\r%s", message)
+		fmt.Fprintf(progressOut, "\r%s", message)
 	}
 }
 
@@ -44,29 +55,29 @@ func PrintProgressBar(message string, current, total int) {
 	}
 	bar += "]"
 
-	fmt.Printf("\r%s %s %3d%%", message, bar, percent)
+	fmt.Fprintf(progressOut, "\r%s %s %3d%%", message, bar, percent)
 }
 
 // PrintProgressStep displays a step in a multi-step process
 func PrintProgressStep(step, totalSteps int, message string) {
-	fmt.Printf("\r[%d/%d] %s", step, totalSteps, message)
+	fmt.Fprintf(progressOut, "\r[%d/%d] %s", step, totalSteps, message)
 }
 
 // ClearProgress clears the progress line
 func ClearProgress() {
-	fmt.Print("\r" + strings.Repeat(" ", 100) + "\r")
+	fmt.Fprint(progressOut, "\r"+strings.Repeat(" ", 100)+"\r")
 }
 
 // PrintCompletionLine prints a completion message and clears progress
 func PrintCompletionLine(message string) {
 	ClearProgress()
-	fmt.Printf("✓ %s\n", message)
+	fmt.Fprintf(progressOut, "✓ %s\n", message)
 }
 
 // PrintErrorLine prints an error message
 func PrintErrorLine(message string) {
 	ClearProgress()
-	fmt.Printf("✗ %s\n", message)
+	fmt.Fprintf(progressOut, "✗ %s\n", message)
 }
 
 // SpinnerDelay returns a duration for smooth spinner animation
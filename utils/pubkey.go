@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// sealInfo binds keys derived for sealed messages to their purpose
+const sealInfo = "zephyrus/share-to/v1"
+
+// Paths of the vault's key pair. The public key is stored as its raw 32 bytes
+// so anyone can fetch it; the private key is encrypted with the vault password.
+const (
+	publicKeyPath  = ".config/pubkey"
+	privateKeyPath = ".config/privkey"
+)
+
+// FetchPublicKey fetches the published X25519 public key of another vault
+func FetchPublicKey(username string) ([]byte, error) {
+	backend, err := OpenBackend(ActiveBackendSpec(), username, nil)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := backend.Fetch(publicKeyPath)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("%s has not published a public key yet; ask them to run 'zep inbox' once", username)
+		}
+		return nil, fmt.Errorf("failed to fetch public key of %s: %w", username, err)
+	}
+	if _, err := ecdh.X25519().NewPublicKey(pub); err != nil {
+		return nil, fmt.Errorf("invalid public key published by %s: %w", username, err)
+	}
+	return pub, nil
+}
+
+// KeyFingerprint formats a short fingerprint of a public key, for comparing
+// keys over another channel
+func KeyFingerprint(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	groups := make([]string, 4)
+	for i := range groups {
+		groups[i] = fmt.Sprintf("%x", sum[i*2:i*2+2])
+	}
+	return strings.Join(groups, ":")
+}
+
+// EnsureKeyPair returns the vault's public key, generating and publishing a
+// key pair first if the vault has none. created reports whether it did.
+func EnsureKeyPair(session *Session) (pub []byte, created bool, err error) {
+	pub, err = session.Fetch(publicKeyPath)
+	if err == nil {
+		return pub, false, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, false, fmt.Errorf("failed to fetch public key: %w", err)
+	}
+
+	files, pub, err := newKeyPairFiles(session.Password)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := session.Push(files, nil); err != nil {
+		return nil, false, fmt.Errorf("failed to publish public key: %w", err)
+	}
+	return pub, true, nil
+}
+
+// newKeyPairFiles generates an X25519 key pair and returns the vault files
+// that store it
+func newKeyPairFiles(password string) (map[string][]byte, []byte, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	encryptedPriv, err := Encrypt(priv.Bytes(), password)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encrypt private key: %w", err)
+	}
+	pub := priv.PublicKey().Bytes()
+	return map[string][]byte{
+		publicKeyPath:  pub,
+		privateKeyPath: encryptedPriv,
+	}, pub, nil
+}
+
+// privateKey fetches and decrypts the vault's private key
+func (s *Session) privateKey() (*ecdh.PrivateKey, error) {
+	encrypted, err := s.Fetch(privateKeyPath)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, errors.New("this vault has no key pair yet; run 'zep inbox' to create one")
+		}
+		return nil, fmt.Errorf("failed to fetch private key: %w", err)
+	}
+	raw, err := Decrypt(encrypted, s.Password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key: %w", err)
+	}
+	return ecdh.X25519().NewPrivateKey(raw)
+}
+
+// sealTo encrypts plaintext so only the holder of the private key for
+// recipientPub can read it. A fresh ephemeral key pair is used per message:
+//
+//	[ephemeral public key 32][nonce 12][ciphertext]
+//
+// The AES key is HKDF-SHA256 of the X25519 shared secret, salted with both
+// public keys.
+func sealTo(plaintext []byte, recipientPub []byte) ([]byte, error) {
+	curve := ecdh.X25519()
+	pub, err := curve.NewPublicKey(recipientPub)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := ephemeral.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralPub := ephemeral.PublicKey().Bytes()
+	gcm, err := sealCipher(secret, ephemeralPub, recipientPub)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, NonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	result := append(ephemeralPub, nonce...)
+	return gcm.Seal(result, nonce, plaintext, nil), nil
+}
+
+// openSealed decrypts a message written by sealTo
+func openSealed(sealed []byte, priv *ecdh.PrivateKey) ([]byte, error) {
+	if len(sealed) < 32+NonceSize {
+		return nil, errors.New("sealed message too short")
+	}
+	ephemeralPub, err := ecdh.X25519().NewPublicKey(sealed[:32])
+	if err != nil {
+		return nil, err
+	}
+	secret, err := priv.ECDH(ephemeralPub)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := sealCipher(secret, sealed[:32], priv.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	nonce := sealed[32 : 32+NonceSize]
+	return gcm.Open(nil, nonce, sealed[32+NonceSize:], nil)
+}
+
+// sealCipher derives the AES-GCM cipher of a sealed message
+func sealCipher(secret []byte, ephemeralPub []byte, recipientPub []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephemeralPub...), recipientPub...)
+	key, err := hkdf.Key(sha256.New, secret, salt, sealInfo, KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(key)
+}
@@ -1,11 +1,9 @@
 package utils
 
 import (
-	"encoding/base64"
-	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
-	"strings"
 )
 
 // ReadFile reads and decrypts a file, printing its content to stdout
@@ -21,36 +19,32 @@ func ReadFile(vaultPath string, session *Session) error {
 		return fmt.Errorf("'%s' is a directory, you can only read individual files", vaultPath)
 	}
 
-	// 3. Fetch the encrypted hex-named file from GitHub
-	encryptedData, err := FetchRaw(session.Username, entry.RealName)
+	// 3. Decrypt the file key from the index
+	fileKey, err := session.UnwrapFileKey(entry.FileKey)
 	if err != nil {
-		return fmt.Errorf("failed to fetch storage file from remote: %w", err)
+		return fmt.Errorf("failed to decrypt file key: %w", err)
 	}
 
-	// 4. Decrypt the file key from the index
-	encryptedKey, err := hex.DecodeString(entry.FileKey)
+	// 4. Fetch the encrypted file from the vault and decrypt it with the file key
+	reader, err := NewEntryReader(entry, fileKey, session.Fetch)
 	if err != nil {
-		return fmt.Errorf("invalid file key in index: %w", err)
-	}
-	fileKey, err := Decrypt(encryptedKey, session.Password)
-	if err != nil {
-		return fmt.Errorf("failed to decrypt file key: check your password")
+		return err
 	}
 
-	// 5. Decrypt the file data with the file key
-	decryptedData, err := DecryptWithKey(encryptedData, fileKey)
-	if err != nil {
-		return fmt.Errorf("decryption failed: %w", err)
-	}
+	// 5. Stream decrypted content to stdout (no file saved)
+	return writeToStdout(reader)
+}
 
-	// 6. Write decrypted content to stdout (no file saved)
-	_, err = os.Stdout.Write(decryptedData)
+// writeToStdout streams reader to stdout, ending the output with a newline if
+// the content does not
+func writeToStdout(reader io.Reader) error {
+	out := &lastByteWriter{w: os.Stdout}
+	_, err := io.Copy(out, reader)
 	if err != nil {
 		return fmt.Errorf("failed to write to stdout: %w", err)
 	}
 
-	// 7. Append newline if file doesn't end with one
-	if len(decryptedData) == 0 || decryptedData[len(decryptedData)-1] != '\n' {
+	if out.last != '\n' {
 		_, err = os.Stdout.Write([]byte("\n"))
 		if err != nil {
 			return fmt.Errorf("failed to write newline: %w", err)
@@ -60,60 +54,49 @@ func ReadFile(vaultPath string, session *Session) error {
 	return nil
 }
 
-// ReadSharedFile reads a shared file using a share string (username:reference:sharepassword:base64filename)
-func ReadSharedFile(shareString string) error {
-	// 1. Parse the share string (supports both old 3-part and new 4-part formats)
-	parts := strings.Split(shareString, ":")
-	if len(parts) < 3 || len(parts) > 4 {
-		return fmt.Errorf("invalid share string format, expected 'username:reference:sharepassword' or 'username:reference:sharepassword:base64filename'")
-	}
+// lastByteWriter passes writes through and remembers the last byte written
+type lastByteWriter struct {
+	w    io.Writer
+	last byte
+}
 
-	username := parts[0]
-	reference := parts[1]
-	sharePassword := parts[2]
-	var filename string
+func (lw *lastByteWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		lw.last = p[len(p)-1]
+	}
+	return lw.w.Write(p)
+}
 
-	// Decode filename if provided in share string
-	if len(parts) == 4 {
-		decoded, err := base64.StdEncoding.DecodeString(parts[3])
-		if err != nil {
-			return fmt.Errorf("invalid filename encoding in share string: %w", err)
-		}
-		filename = string(decoded)
+// ReadSharedFile prints a shared file to stdout, or lists the files of a
+// shared folder. shareString is parsed by ParseShareLink.
+func ReadSharedFile(shareString string) error {
+	// 1. Parse the share link
+	link, err := ParseShareLink(shareString)
+	if err != nil {
+		return err
 	}
 
-	if filename != "" {
-		fmt.Fprintf(os.Stderr, "Reading shared file '%s' from %s...\n", filename, username)
+	if link.Name != "" {
+		fmt.Fprintf(os.Stderr, "Reading shared file '%s' from %s...\n", link.Name, link.Username)
 	} else {
-		fmt.Fprintf(os.Stderr, "Reading shared file from %s (Reference: %s)...\n", username, reference)
+		fmt.Fprintf(os.Stderr, "Reading shared file from %s (Reference: %s)...\n", link.Username, link.Reference)
 	}
 
-	// 2. Fetch the encrypted file from the /shared/ folder
-	sharedPath := fmt.Sprintf("shared/%s", reference)
-	encryptedData, err := FetchRaw(username, sharedPath)
+	// 2. Fetch the share pointer and decrypt it with the share password
+	pointer, backend, err := openShareLink(link)
 	if err != nil {
-		return fmt.Errorf("failed to fetch shared file: %w", err)
+		return err
 	}
 
-	// 3. Decrypt with the share password
-	decryptedData, err := Decrypt(encryptedData, sharePassword)
-	if err != nil {
-		return fmt.Errorf("decryption failed: invalid share password")
+	// 3. Folder shares are listed rather than read
+	if pointer.IsFolder() {
+		return printSharedFolder(pointer, os.Stdout)
 	}
 
-	// 4. Write decrypted content to stdout
-	_, err = os.Stdout.Write(decryptedData)
+	// 4. Fetch the file from the sharer's vault and stream it to stdout
+	reader, err := pointer.fileReader(backend)
 	if err != nil {
-		return fmt.Errorf("failed to write to stdout: %w", err)
-	}
-
-	// 5. Append newline if file doesn't end with one
-	if len(decryptedData) == 0 || decryptedData[len(decryptedData)-1] != '\n' {
-		_, err = os.Stdout.Write([]byte("\n"))
-		if err != nil {
-			return fmt.Errorf("failed to write newline: %w", err)
-		}
+		return err
 	}
-
-	return nil
+	return writeToStdout(reader)
 }
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Retry policy for idempotent fetches and pushes
+const (
+	retryAttempts  = 5                      // Tries in total, including the first
+	retryBaseDelay = 500 * time.Millisecond // Delay after the first failure, doubled each time
+	retryMaxDelay  = 30 * time.Second       // Upper bound of the backoff
+	retryMaxWait   = 2 * time.Minute        // Longest Retry-After we wait for instead of failing
+)
+
+// retry calls fn until it succeeds, fails with an error that is not transient,
+// or has been tried retryAttempts times. Between attempts it waits as long as
+// the host asked (Retry-After), or with exponential backoff and jitter.
+func retry(fn func() error) error {
+	delay := retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == retryAttempts || !isTransient(err) {
+			return err
+		}
+
+		// Full jitter between half and all of the backoff, so parallel
+		// workers do not retry in lockstep
+		wait := delay/2 + rand.N(delay/2+1)
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) && httpErr.RetryAfter > 0 {
+			if httpErr.RetryAfter > retryMaxWait {
+				return err
+			}
+			wait = httpErr.RetryAfter
+		}
+		fmt.Fprintf(os.Stderr, "⚠️  %v; retrying in %s (attempt %d of %d)\n", err, wait.Round(100*time.Millisecond), attempt+1, retryAttempts)
+		time.Sleep(wait)
+		delay = min(delay*2, retryMaxDelay)
+	}
+}
+
+// isTransient reports whether a failed request may succeed if repeated:
+// rate limits, server errors, timeouts and dropped connections
+func isTransient(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.rateLimited() || httpErr.StatusCode >= 500
+	}
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrAuth) || errors.Is(err, ErrStaleHead) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	// go-git reports some transport failures only as text
+	msg := err.Error()
+	for _, transient := range []string{"connection reset", "i/o timeout", "unexpected EOF", "status code: 5"} {
+		if strings.Contains(msg, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// gitError maps go-git errors onto ErrAuth and ErrNotFound
+func gitError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, transport.ErrAuthenticationRequired), errors.Is(err, transport.ErrAuthorizationFailed),
+		strings.Contains(err.Error(), "unable to authenticate"):
+		return fmt.Errorf("%w: %v", ErrAuth, err)
+	case errors.Is(err, transport.ErrRepositoryNotFound):
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	return err
+}
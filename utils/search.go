@@ -3,52 +3,52 @@ package utils
 import (
 	"fmt"
 	"os"
-	"strings"
+	"path"
 	"text/tabwriter"
 )
 
-func SearchFiles(session *Session, query string) error {
-	fmt.Printf("Searching vault for: \"%s\"\n", query)
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
-	fmt.Fprintln(w, "VAULT PATH\tTYPE\tSTORAGE ID")
-	fmt.Fprintln(w, "----------\t----\t----------")
-
-	lowerQuery := strings.ToLower(query)
-	found := false
-
-	// Recursive helper to walk the Entry tree
-	var walk func(map[string]Entry, string)
-	walk = func(entries map[string]Entry, currentPath string) {
-		for name, entry := range entries {
-			fullPath := name
-			if currentPath != "" {
-				fullPath = currentPath + "/" + name
-			}
-
-			// Check if the current name or full path matches the query
-			if strings.Contains(strings.ToLower(fullPath), lowerQuery) {
-				found = true
-				displayType := "[FILE]"
-				rName := entry.RealName
-				if entry.Type == "folder" {
-					displayType = "[DIR]"
-					rName = "-"
-				}
-				fmt.Fprintf(w, "%s\t%s\t%s\n", fullPath, displayType, rName)
-			}
+// SearchFiles prints the vault entries matching opts (see FindEntries) in
+// path order, in the given output format (see output.go)
+func SearchFiles(session *Session, opts SearchOptions, format string) error {
+	limit := opts.Limit
+	if limit > 0 {
+		// One extra match tells whether the limit cut the results short
+		opts.Limit++
+	}
+	matches, err := FindEntries(session.Index, "", opts)
+	if err != nil {
+		return err
+	}
+	truncated := limit > 0 && len(matches) > limit
+	if truncated {
+		matches = matches[:limit]
+	}
 
-			// If it's a folder, dive deeper
-			if entry.Type == "folder" && entry.Contents != nil {
-				walk(entry.Contents, fullPath)
-			}
-		}
+	records := make([]FileRecord, 0, len(matches))
+	for _, m := range matches {
+		records = append(records, newFileRecord(m.Path, path.Base(m.Path), &m.Entry))
+	}
+	if format != OutputTable {
+		return writeRecords(format, records)
 	}
 
-	walk(session.Index, "")
+	if opts.Pattern != "" {
+		fmt.Printf("Searching vault for: \"%s\"\n", opts.Pattern)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "VAULT PATH\tTYPE\tSIZE\tMODIFIED\tSTORAGE ID")
+	fmt.Fprintln(w, "----------\t----\t----\t--------\t----------")
+	for _, record := range records {
+		displayType, size, modified, rName := recordColumns(record)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", record.Path, displayType, size, modified, rName)
+	}
 	w.Flush()
 
-	if !found {
+	switch {
+	case len(records) == 0:
 		fmt.Println("No matches found.")
+	case truncated:
+		fmt.Printf("Showing the first %d matches (--limit).\n", limit)
 	}
 	return nil
 }
@@ -0,0 +1,203 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	agentSocketName = "agent.sock"
+	// AgentCommand is the hidden zep command that runs the session agent
+	AgentCommand = "session-agent"
+)
+
+// agentSecrets are the parts of a persistent session that never touch the
+// disk: the key sealing session.json, the vault password and the SSH key
+type agentSecrets struct {
+	SessionKey  []byte `json:"session_key,omitempty"`
+	Password    string `json:"password,omitempty"`
+	RawKey      []byte `json:"raw_key,omitempty"`
+	IdleTimeout int64  `json:"idle_timeout,omitempty"` // Seconds; 0 never exits
+}
+
+// agentRequest is one call to the session agent
+type agentRequest struct {
+	Op      string        `json:"op"` // "get", "put" or "stop"
+	Secrets *agentSecrets `json:"secrets,omitempty"`
+}
+
+// agentSocketPath returns the path of the agent's socket in ConfigDir
+func agentSocketPath() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, agentSocketName), nil
+}
+
+// RunSessionAgent keeps the secrets read from standard input in memory and
+// hands them to zep commands over a socket only the user can open. It exits
+// when asked to, or once no command has used it for the idle timeout, taking
+// the secrets with it.
+func RunSessionAgent() error {
+	var secrets agentSecrets
+	if err := json.NewDecoder(os.Stdin).Decode(&secrets); err != nil {
+		return fmt.Errorf("failed to read session secrets: %w", err)
+	}
+
+	socketPath, err := agentSocketPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return err
+	}
+	os.Remove(socketPath) // Left behind by an agent that did not exit cleanly
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	// A new agent may already listen at the same path by the time this one
+	// exits, so only remove the socket while it is still ours
+	listener.SetUnlinkOnClose(false)
+	own, _ := os.Stat(socketPath)
+	defer listener.Close()
+	defer func() {
+		if current, err := os.Stat(socketPath); err == nil && own != nil && os.SameFile(own, current) {
+			os.Remove(socketPath)
+		}
+	}()
+
+	// Closing the terminal or pressing Ctrl-C in the command that started
+	// the agent must not end the session
+	signal.Ignore(syscall.SIGHUP, os.Interrupt)
+
+	idle := time.Duration(secrets.IdleTimeout) * time.Second
+	for {
+		if idle > 0 {
+			listener.SetDeadline(time.Now().Add(idle))
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			return nil // Idle timeout: the session is locked for good
+		}
+		if stop := serveAgentRequest(conn, &secrets); stop {
+			return nil
+		}
+	}
+}
+
+// serveAgentRequest answers one call and reports whether the agent should exit
+func serveAgentRequest(conn net.Conn, secrets *agentSecrets) bool {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var req agentRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return false
+	}
+	enc := json.NewEncoder(conn)
+	switch req.Op {
+	case "get":
+		enc.Encode(secrets)
+	case "put":
+		if req.Secrets != nil {
+			*secrets = *req.Secrets
+		}
+		enc.Encode(agentSecrets{})
+	case "stop":
+		enc.Encode(agentSecrets{})
+		return true
+	}
+	return false
+}
+
+// callAgent sends one request to the running session agent
+func callAgent(req agentRequest) (*agentSecrets, error) {
+	socketPath, err := agentSocketPath()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("unix", socketPath, 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	var secrets agentSecrets
+	if err := json.NewDecoder(conn).Decode(&secrets); err != nil {
+		return nil, err
+	}
+	return &secrets, nil
+}
+
+// startSessionAgent replaces any running agent with a new zep process holding
+// secrets, and waits until it answers
+func startSessionAgent(secrets agentSecrets) error {
+	stopSessionAgent()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("cannot start session agent: %w", err)
+	}
+	dir, err := ConfigDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, AgentCommand)
+	cmd.Dir = dir
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("cannot start session agent: %w", err)
+	}
+	err = json.NewEncoder(stdin).Encode(secrets)
+	stdin.Close()
+	if err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("cannot start session agent: %w", err)
+	}
+
+	for range 50 {
+		if _, err := callAgent(agentRequest{Op: "get"}); err == nil {
+			return cmd.Process.Release()
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	cmd.Process.Kill()
+	return fmt.Errorf("session agent did not start")
+}
+
+// storeAgentSecrets updates the secrets of the running agent, starting a new
+// one if it has exited
+func storeAgentSecrets(secrets agentSecrets) error {
+	if _, err := callAgent(agentRequest{Op: "put", Secrets: &secrets}); err == nil {
+		return nil
+	}
+	return startSessionAgent(secrets)
+}
+
+// stopSessionAgent ends the running agent, if any
+func stopSessionAgent() {
+	callAgent(agentRequest{Op: "stop"})
+}
@@ -0,0 +1,246 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	sessionFileName        = "session.json"
+	legacyLocalKeyFileName = "local.key"      // Wrapped the session key in older versions
+	legacyConfigPath       = "zephyrus.conf"  // Plaintext session file used by older versions, in the working directory
+	DefaultIdleTimeout     = 30 * time.Minute // Persistent sessions lock after this long without use
+)
+
+// ErrSessionLocked is returned when the persistent session was locked with
+// 'zep lock' or expired after being idle
+var ErrSessionLocked = errors.New("session is locked")
+
+// storedSession is the on-disk form of a persistent session. Only the username,
+// backend and idle timeout are readable. The indexes and settings are sealed
+// with a random session key; the session key, the password and the SSH key
+// are only held in memory by the session agent (see session_agent.go). Once
+// the agent exits, after the idle timeout or with 'zep lock', the sealed data
+// cannot be opened by anyone.
+type storedSession struct {
+	Username    string `json:"username"`
+	BackendSpec string `json:"backend,omitempty"`
+	IdleTimeout int64  `json:"idle_timeout"` // Seconds; 0 never locks
+	Data        []byte `json:"data,omitempty"`
+
+	// Written by older versions, which sealed the password and SSH key
+	// under a session key wrapped with local.key; dropped on sight
+	WrappedKey []byte `json:"wrapped_key,omitempty"`
+}
+
+// ConfigDir returns the directory holding the persistent session: $ZEPHYRUS_CONFIG_DIR
+// if set, otherwise "zephyrus" in the user config directory ($XDG_CONFIG_HOME or
+// ~/.config on Linux, %AppData% on Windows, ~/Library/Application Support on macOS)
+func ConfigDir() (string, error) {
+	if dir := os.Getenv("ZEPHYRUS_CONFIG_DIR"); dir != "" {
+		return dir, nil
+	}
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot locate config directory: %w", err)
+	}
+	return filepath.Join(base, "zephyrus"), nil
+}
+
+// IsConnected reports whether a persistent session exists, locked or not
+func IsConnected() bool {
+	dir, err := ConfigDir()
+	if err != nil {
+		return false
+	}
+	if _, err := os.Stat(filepath.Join(dir, sessionFileName)); err == nil {
+		return true
+	}
+	_, err = os.Stat(legacyConfigPath)
+	return err == nil
+}
+
+// SavedSessionUser returns the username of the persistent session, even when
+// it is locked ("" if there is none)
+func SavedSessionUser() string {
+	stored, err := readStoredSession()
+	if err != nil {
+		return ""
+	}
+	return stored.Username
+}
+
+// readStoredSession reads the session file without opening it
+func readStoredSession() (*storedSession, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, sessionFileName))
+	if err != nil {
+		return nil, err
+	}
+	var stored storedSession
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("session file is corrupted: %w", err)
+	}
+	return &stored, nil
+}
+
+// writeStoredSession replaces the session file atomically
+func writeStoredSession(stored *storedSession) error {
+	dir, err := ConfigDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, sessionFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// sealSession encrypts the session without its password and SSH key under
+// its session key, generating one for a new session
+func sealSession(s *Session) (*storedSession, error) {
+	if s.sessionKey == nil {
+		s.sessionKey = GenerateFileKey()
+	}
+	sealed := *s
+	sealed.Password = ""
+	sealed.RawKey = nil
+	payload, err := json.Marshal(&sealed)
+	if err != nil {
+		return nil, err
+	}
+	data, err := EncryptWithKey(payload, s.sessionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &storedSession{
+		Username:    s.Username,
+		BackendSpec: s.BackendSpec,
+		IdleTimeout: int64(s.idleTimeout / time.Second),
+		Data:        data,
+	}, nil
+}
+
+// saveStoredSession writes the sealed session and hands its secrets to the
+// session agent, starting one if none is running
+func saveStoredSession(s *Session) error {
+	stored, err := sealSession(s)
+	if err != nil {
+		return err
+	}
+	err = storeAgentSecrets(agentSecrets{
+		SessionKey:  s.sessionKey,
+		Password:    s.Password,
+		RawKey:      s.RawKey,
+		IdleTimeout: stored.IdleTimeout,
+	})
+	if err != nil {
+		return err
+	}
+	return writeStoredSession(stored)
+}
+
+// openSession fetches the secrets from the session agent and decrypts the
+// stored session. Without an agent the session is locked on the spot.
+func openSession(stored *storedSession) (*Session, error) {
+	if len(stored.WrappedKey) > 0 {
+		// Sealed by an older version with the password inside: remove it
+		lockStoredSession(stored)
+		if dir, err := ConfigDir(); err == nil {
+			os.Remove(filepath.Join(dir, legacyLocalKeyFileName))
+		}
+		return nil, fmt.Errorf("%w for %s: sessions saved by older versions must be reopened with 'connect', or use -u", ErrSessionLocked, stored.Username)
+	}
+	if len(stored.Data) == 0 {
+		return nil, fmt.Errorf("%w for %s: run 'connect' to unlock it, or use -u", ErrSessionLocked, stored.Username)
+	}
+	idle := time.Duration(stored.IdleTimeout) * time.Second
+
+	secrets, err := callAgent(agentRequest{Op: "get"})
+	if err != nil {
+		// The agent exited after the idle timeout (or the machine restarted)
+		lockStoredSession(stored)
+		if idle > 0 {
+			return nil, fmt.Errorf("%w for %s after %s idle: run 'connect' to unlock it, or use -u", ErrSessionLocked, stored.Username, idle)
+		}
+		return nil, fmt.Errorf("%w for %s: the session agent has stopped; run 'connect' to unlock it, or use -u", ErrSessionLocked, stored.Username)
+	}
+	payload, err := DecryptWithKey(stored.Data, secrets.SessionKey)
+	if err != nil {
+		return nil, fmt.Errorf("session does not match the session agent: run 'connect' again")
+	}
+
+	var s Session
+	if err := json.Unmarshal(payload, &s); err != nil {
+		return nil, err
+	}
+	s.Password = secrets.Password
+	s.RawKey = secrets.RawKey
+	s.sessionKey = secrets.SessionKey
+	s.idleTimeout = idle
+	return &s, nil
+}
+
+// lockStoredSession drops the sealed data
+func lockStoredSession(stored *storedSession) error {
+	stored.WrappedKey = nil
+	stored.Data = nil
+	return writeStoredSession(stored)
+}
+
+// migrateLegacySession moves a plaintext zephyrus.conf from the working
+// directory into the encrypted session store and deletes it
+func migrateLegacySession() error {
+	data, err := os.ReadFile(legacyConfigPath)
+	if err != nil {
+		return err
+	}
+	var s Session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("failed to read %s: %w", legacyConfigPath, err)
+	}
+	s.idleTimeout = DefaultIdleTimeout
+	if err := s.Save(); err != nil {
+		return err
+	}
+	if err := os.Remove(legacyConfigPath); err != nil {
+		return err
+	}
+	fmt.Fprintf(progressOut, "Moved the plaintext session in %s into the encrypted session store and deleted it.\n", legacyConfigPath)
+	return nil
+}
+
+// Lock locks the persistent session. The username and backend are kept, so
+// 'connect' can unlock it again with the password.
+func Lock() error {
+	globalSession = nil
+	stored, err := readStoredSession()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("not connected")
+		}
+		return err
+	}
+	stopSessionAgent()
+	if len(stored.Data) == 0 {
+		return fmt.Errorf("%w already", ErrSessionLocked)
+	}
+	return lockStoredSession(stored)
+}
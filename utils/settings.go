@@ -86,13 +86,14 @@ func (s VaultSettings) Validate() error {
 	return nil
 }
 
-// SaveSettings encrypts and pushes settings to .config/settings on remote
-func SaveSettings(username string, password string, rawKey []byte, settings VaultSettings) error {
+// SaveSettings encrypts and pushes the session settings to .config/settings on remote
+func SaveSettings(session *Session) error {
+	settings := session.Settings
 	if err := settings.Validate(); err != nil {
 		return err
 	}
 
-	settingsBytes, err := settings.ToBytes(password)
+	settingsBytes, err := settings.ToBytes(session.Password)
 	if err != nil {
 		return fmt.Errorf("failed to encrypt settings: %w", err)
 	}
@@ -101,6 +102,5 @@ func SaveSettings(username string, password string, rawKey []byte, settings Vaul
 		".config/settings": settingsBytes,
 	}
 
-	repoURL := fmt.Sprintf("git@github.com:%s/.zephyrus.git", username)
-	return PushFilesWithAuthor(repoURL, rawKey, filesToPush, settings.CommitMessage, settings.CommitAuthorName, settings.CommitAuthorEmail)
+	return session.Push(filesToPush, nil)
 }
@@ -7,15 +7,6 @@ import (
 	"net/http"
 	"os"
 	"strings"
-	"time"
-
-	"github.com/go-git/go-billy/v5/memfs"
-	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/config"
-	"github.com/go-git/go-git/v5/plumbing/object"
-	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
-	"github.com/go-git/go-git/v5/storage/memory"
-	cryptossh "golang.org/x/crypto/ssh"
 )
 
 func SetupVault(githubUser string, keyFilePath string, password string) error {
@@ -28,12 +19,13 @@ func SetupVault(githubUser string, keyFilePath string, password string) error {
 		githubUser = strings.TrimSpace(githubUser)
 	}
 
-	// 2. Verify Repo (Public Check)
-	repoURL := fmt.Sprintf("git@github.com:%s/.zephyrus.git", githubUser)
-	repoWebURL := fmt.Sprintf("https://github.com/%s/.zephyrus", githubUser)
-	resp, err := http.Head(repoWebURL)
-	if err != nil || resp.StatusCode != 200 {
-		return fmt.Errorf("repository '.zephyrus' not found at %s. Please create it manually on GitHub first", repoWebURL)
+	// 2. Verify the storage location (repository exists / bare repo created)
+	backend, err := OpenBackend(ActiveBackendSpec(), githubUser, nil)
+	if err != nil {
+		return err
+	}
+	if err := backend.Ensure(); err != nil {
+		return err
 	}
 
 	// 3. Resolve Key Path
@@ -60,46 +52,38 @@ func SetupVault(githubUser string, keyFilePath string, password string) error {
 		return err
 	}
 
-	storer := memory.NewStorage()
-	fs := memfs.New()
-	r, _ := git.Init(storer, fs)
-	w, _ := r.Worktree()
+	files := map[string][]byte{
+		".config/key": encryptedKey,
+	}
 
-	fs.MkdirAll(".config", 0755)
-	f, _ := fs.Create(".config/key")
-	f.Write(encryptedKey)
-	f.Close()
-	w.Add(".config/key")
+	// Publish a key pair so others can share with this vault (see pubkey.go)
+	keyFiles, _, err := newKeyPairFiles(password)
+	if err != nil {
+		return err
+	}
+	for path, data := range keyFiles {
+		files[path] = data
+	}
 
 	// Fetch and add README from the application source repository
-	resp, err = http.Get("https://raw.githubusercontent.com/zephyrus-development/zephyrus-cli/main/README.md")
+	resp, err := http.Get("https://raw.githubusercontent.com/zephyrus-development/zephyrus-cli/main/README.md")
 	if err == nil {
 		defer resp.Body.Close()
 		readmeContent, readErr := io.ReadAll(resp.Body)
 		if readErr == nil {
-			f, _ := fs.Create("README.md")
-			f.Write(readmeContent)
-			f.Close()
-			w.Add("README.md")
+			files["README.md"] = readmeContent
 		}
 	}
 
-	commit, _ := w.Commit("Zephyrus: Updated Vault", &git.CommitOptions{
-		Author: &object.Signature{Name: "Zephyrus", Email: "Auchrio@proton.me", When: time.Now()},
-	})
-
-	publicKeys, _ := ssh.NewPublicKeys("git", rawKey, "")
-	publicKeys.HostKeyCallback = cryptossh.InsecureIgnoreHostKey()
-
-	_, err = r.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{repoURL}})
+	// Re-open the backend with the key so it can push
+	backend, err = OpenBackend(ActiveBackendSpec(), githubUser, rawKey)
 	if err != nil {
 		return err
 	}
 
-	return r.Push(&git.PushOptions{
-		RemoteName: "origin",
-		Auth:       publicKeys,
-		RefSpecs:   []config.RefSpec{config.RefSpec(fmt.Sprintf("%s:refs/heads/master", commit))},
-		Force:      true,
+	return backend.Reset(files, CommitInfo{
+		Message:     "Zephyrus: Updated Vault",
+		AuthorName:  "Zephyrus",
+		AuthorEmail: "Auchrio@proton.me",
 	})
 }
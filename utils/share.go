@@ -2,14 +2,21 @@ package utils
 
 import (
 	"crypto/rand"
-	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math/big"
-	"path/filepath"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// ErrShareExpired is returned when a share link is used after its expiry
+var ErrShareExpired = errors.New("share link has expired")
+
 // GenerateShareReference generates a base62 reference with default 6 characters
 func GenerateShareReference() (string, error) {
 	return GenerateShareReferenceWithLength(6)
@@ -29,76 +36,116 @@ func GenerateShareReferenceWithLength(length int) (string, error) {
 	return string(ref), nil
 }
 
-// ShareFile generates a share string with a new 6-char reference
-// The shared file stores only a pointer (storage ID + encrypted file key) instead of a copy
-func ShareFile(vaultPath string, sharePassword string, session *Session) (string, error) {
+// ParseShareExpiry parses a share lifetime such as "7d", "2w" or "12h" (any
+// Go duration, plus d for days and w for weeks)
+func ParseShareExpiry(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty expiry")
+	}
+	units := map[byte]time.Duration{'d': 24 * time.Hour, 'w': 7 * 24 * time.Hour}
+	var d time.Duration
+	if unit, ok := units[s[len(s)-1]]; ok && len(s) > 1 {
+		n, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil {
+			return 0, fmt.Errorf("invalid expiry '%s': use e.g. 7d, 2w or 12h", s)
+		}
+		d = time.Duration(n) * unit
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("invalid expiry '%s': use e.g. 7d, 2w or 12h", s)
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("expiry must be positive")
+	}
+	return d, nil
+}
+
+// ShareFile shares a file and returns its share link, with a new 6-char reference
+// The shared file stores only a pointer (storage ID + encrypted file key) instead of a copy.
+// Folders are shared with a pointer listing every file below them.
+// With expires > 0 the link stops working after that long.
+func ShareFile(vaultPath string, sharePassword string, expires time.Duration, session *Session) (ShareLink, error) {
+	return shareFile(vaultPath, sharePassword, expires, nil, session)
+}
+
+// shareRecipient is the Zephyrus user a share is sealed to
+type shareRecipient struct {
+	Username  string
+	PublicKey []byte
+}
+
+// ShareFileTo shares a file or folder with another Zephyrus user. Nothing has
+// to be handed over: the share password is random and sealed to the
+// recipient's public key in shared/outbox/<recipient>, where their 'zep inbox'
+// finds it. It returns the fingerprint of the recipient's key.
+func ShareFileTo(vaultPath string, recipient string, expires time.Duration, session *Session) (string, error) {
+	recipientPub, err := FetchPublicKey(recipient)
+	if err != nil {
+		return "", err
+	}
+	sharePassword, err := GenerateShareReferenceWithLength(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate share password: %w", err)
+	}
+	_, err = shareFile(vaultPath, sharePassword, expires, &shareRecipient{Username: recipient, PublicKey: recipientPub}, session)
+	if err != nil {
+		return "", err
+	}
+	return KeyFingerprint(recipientPub), nil
+}
+
+// shareFile creates a share; with a recipient, its link is also sealed to the
+// recipient's outbox
+func shareFile(vaultPath string, sharePassword string, expires time.Duration, recipient *shareRecipient, session *Session) (ShareLink, error) {
 	// 1. Find the file entry in the index
 	PrintProgressStep(1, 5, "Locating file in vault...")
 	entry, err := session.Index.FindEntry(vaultPath)
 	if err != nil {
-		return "", fmt.Errorf("could not find file in vault: %w", err)
+		return ShareLink{}, fmt.Errorf("could not find file in vault: %w", err)
 	}
 
-	// 2. Ensure it's a file, not a folder
 	if entry.Type == "folder" {
-		return "", fmt.Errorf("'%s' is a directory, you can only share individual files", vaultPath)
+		PrintCompletionLine("Folder located")
+	} else {
+		PrintCompletionLine("File located")
 	}
-	PrintCompletionLine("File located")
 
-	// 3. Generate a new reference with configurable length from settings
+	// 2. Generate a new reference with configurable length from settings
 	PrintProgressStep(2, 5, "Generating share reference...")
 	ref, err := GenerateShareReferenceWithLength(session.Settings.ShareHashLength)
 	if err != nil {
-		return "", fmt.Errorf("failed to generate share reference: %w", err)
+		return ShareLink{}, fmt.Errorf("failed to generate share reference: %w", err)
 	}
 	PrintCompletionLine("Share reference generated: " + ref)
 
-	// 4. Decrypt the file key with vault password to get raw 32-byte key
-	PrintProgressStep(3, 5, "Preparing file key...")
-	fileKeyBytes, err := DecryptHexToBytes(entry.FileKey, session.Password)
-	if err != nil {
-		return "", fmt.Errorf("failed to decrypt file key: %w", err)
+	// 3. Unwrap the file key(s); a folder share lists every file below the folder
+	PrintProgressStep(3, 5, "Preparing file keys...")
+	var expiresAt time.Time
+	if expires > 0 {
+		expiresAt = time.Now().Add(expires).UTC()
 	}
-
-	// 5. Create a pointer file containing: storage ID and file key (will be encrypted with share password)
-	pointerData := map[string]string{
-		"storageID": entry.RealName,
-		"fileKey":   fmt.Sprintf("%x", fileKeyBytes),
-	}
-	pointerJSON, err := json.Marshal(pointerData)
+	pointer, err := buildSharePointer(vaultPath, entry, session, expiresAt)
 	if err != nil {
-		return "", fmt.Errorf("failed to create share pointer: %w", err)
+		return ShareLink{}, err
+	}
+	if pointer.IsFolder() {
+		PrintCompletionLine(fmt.Sprintf("%d file key(s) prepared", len(pointer.Files)))
+	} else {
+		PrintCompletionLine("File key prepared")
 	}
 
-	// 6. Encrypt the pointer with the share password
+	// 4. Encrypt the pointer with the share password
 	PrintProgressStep(4, 5, "Encrypting share pointer...")
-	pointerEncrypted, err := Encrypt(pointerJSON, sharePassword)
+	pointerEncrypted, err := pointer.encrypt(sharePassword)
 	if err != nil {
-		return "", fmt.Errorf("failed to encrypt share pointer: %w", err)
+		return ShareLink{}, err
 	}
 	PrintCompletionLine("Share pointer encrypted")
 
-	// 7. Upload pointer to /shared/{ref}
-	PrintProgressStep(5, 5, "Uploading to GitHub...")
-	sharedPath := fmt.Sprintf("shared/%s", ref)
-	filesToPush := map[string][]byte{
-		sharedPath: pointerEncrypted,
-	}
-
-	err = PushFilesWithAuthor(
-		fmt.Sprintf("git@github.com:%s/.zephyrus.git", session.Username),
-		session.RawKey,
-		filesToPush,
-		session.Settings.CommitMessage,
-		session.Settings.CommitAuthorName,
-		session.Settings.CommitAuthorEmail,
-	)
-	if err != nil {
-		return "", fmt.Errorf("failed to upload share pointer: %w", err)
-	}
-	PrintCompletionLine("Share pointer uploaded to GitHub")
-
-	// 8. Add entry to shared index
+	// 5. Upload the pointer to /shared/{ref} with the updated shared index
+	PrintProgressStep(5, 5, "Uploading to vault...")
 	if session.SharedIndex == nil {
 		session.SharedIndex = NewSharedIndex()
 	}
@@ -108,35 +155,160 @@ func ShareFile(vaultPath string, sharePassword string, session *Session) (string
 		Password:     sharePassword,
 		SharedAt:     time.Now(),
 		OriginalPath: vaultPath,
+		ExpiresAt:    expiresAt,
+	}
+	filesToPush := map[string][]byte{
+		"shared/" + ref: pointerEncrypted,
+	}
+
+	// Shares for another user are sealed to their outbox instead of handed out
+	if recipient != nil {
+		indexEntry.Recipient = recipient.Username
+		msg := inboxMessage{
+			Reference: ref,
+			Password:  sharePassword,
+			Name:      path.Base(vaultPath),
+			SharedAt:  indexEntry.SharedAt.UTC(),
+			ExpiresAt: expiresAt,
+		}
+		if err := stageOutboxMessage(recipient.Username, recipient.PublicKey, msg, session, filesToPush); err != nil {
+			return ShareLink{}, err
+		}
 	}
-	session.SharedIndex.AddEntry(indexEntry)
 
-	// 9. Upload the updated shared index
+	session.SharedIndex.AddEntry(indexEntry)
 	indexJSON, err := session.SharedIndex.EncryptForRemote(session.Password)
 	if err != nil {
-		return "", fmt.Errorf("failed to encrypt shared index: %w", err)
+		return ShareLink{}, fmt.Errorf("failed to encrypt shared index: %w", err)
+	}
+	filesToPush["shared/.config/index"] = indexJSON
+
+	err = session.Push(filesToPush, nil)
+	if err != nil {
+		session.SharedIndex.RemoveEntry(ref)
+		return ShareLink{}, fmt.Errorf("failed to upload share pointer: %w", err)
+	}
+	PrintCompletionLine("Share pointer uploaded to vault")
+
+	// 6. Generate the share link
+	return indexEntry.Link(session.Username), nil
+}
+
+// sharePointer is the content of shared/<ref>, encrypted with the share
+// password. A file share holds the file's storage ID (and chunk IDs) and its raw
+// file key; a folder share holds a mini-index of every file below the folder.
+type sharePointer struct {
+	Type      string             `json:"type,omitempty"`      // "folder" for folder shares, empty for files
+	StorageID string             `json:"storageID,omitempty"` // Single-blob object, or first chunk
+	FileKey   string             `json:"fileKey,omitempty"`   // Raw file key, hex-encoded
+	Chunks    string             `json:"chunks,omitempty"`    // Comma-separated chunk IDs of chunked files
+	Files     []sharedFolderFile `json:"files,omitempty"`     // Folder shares only
+	Expires   string             `json:"expires,omitempty"`   // RFC 3339, empty if the share never expires
+}
+
+// IsFolder reports whether the pointer is a folder share
+func (p *sharePointer) IsFolder() bool {
+	return p.Type == "folder"
+}
+
+// buildSharePointer creates the pointer for the file or folder entry at
+// vaultPath. File keys are unwrapped, so the pointer must only ever be stored
+// encrypted with the share password.
+func buildSharePointer(vaultPath string, entry *Entry, session *Session, expiresAt time.Time) (*sharePointer, error) {
+	pointer := &sharePointer{}
+	if !expiresAt.IsZero() {
+		pointer.Expires = expiresAt.UTC().Format(time.RFC3339)
+	}
+
+	if entry.Type == "folder" {
+		pointer.Type = "folder"
+		files, err := collectSharedFolderFiles(entry.Contents, "", session)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("'%s' is an empty directory, there is nothing to share", vaultPath)
+		}
+		pointer.Files = files
+		return pointer, nil
+	}
+
+	fileKey, err := session.UnwrapFileKey(entry.FileKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt file key: %w", err)
+	}
+	pointer.StorageID = entry.RealName
+	pointer.FileKey = fmt.Sprintf("%x", fileKey)
+	if entry.IsChunked() {
+		pointer.Chunks = strings.Join(entry.Chunks, ",")
+	}
+	return pointer, nil
+}
+
+// encrypt serializes the pointer and encrypts it with the share password. The
+// share page only derives PBKDF2 keys, hence ShareKDF.
+func (p *sharePointer) encrypt(sharePassword string) ([]byte, error) {
+	pointerJSON, err := json.Marshal(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create share pointer: %w", err)
+	}
+	pointerEncrypted, err := EncryptWithKDF(pointerJSON, sharePassword, ShareKDF)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt share pointer: %w", err)
 	}
+	return pointerEncrypted, nil
+}
 
-	indexFilesToPush := map[string][]byte{
-		"shared/.config/index": indexJSON,
+// decryptSharePointer decrypts and parses a pointer fetched from shared/<ref>
+func decryptSharePointer(data []byte, sharePassword string) (*sharePointer, error) {
+	decrypted, err := Decrypt(data, sharePassword)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid share password", ErrAuth)
 	}
+	var pointer sharePointer
+	if err := json.Unmarshal(decrypted, &pointer); err != nil {
+		return nil, fmt.Errorf("invalid share pointer format: %w", err)
+	}
+	return &pointer, nil
+}
 
-	err = PushFilesWithAuthor(
-		fmt.Sprintf("git@github.com:%s/.zephyrus.git", session.Username),
-		session.RawKey,
-		indexFilesToPush,
-		session.Settings.CommitMessage,
-		session.Settings.CommitAuthorName,
-		session.Settings.CommitAuthorEmail,
-	)
+// fileReader opens the file of a file share. The pointer holds the raw file
+// key, hex-encoded.
+func (p *sharePointer) fileReader(backend Backend) (io.Reader, error) {
+	if p.StorageID == "" {
+		return nil, fmt.Errorf("share pointer missing storageID")
+	}
+	if p.FileKey == "" {
+		return nil, fmt.Errorf("share pointer missing fileKey")
+	}
+	fileKey, err := hex.DecodeString(p.FileKey)
 	if err != nil {
-		return "", fmt.Errorf("failed to upload shared index: %w", err)
+		return nil, fmt.Errorf("invalid file key encoding: %w", err)
 	}
 
-	// 10. Generate the share string: username:reference:sharepassword:base64filename
-	filename := filepath.Base(vaultPath)
-	encodedFilename := base64.StdEncoding.EncodeToString([]byte(filename))
-	shareString := fmt.Sprintf("%s:%s:%s:%s", session.Username, ref, sharePassword, encodedFilename)
+	// Chunked files list their chunk objects in order
+	entry := Entry{Type: "file", RealName: p.StorageID}
+	if p.Chunks != "" {
+		entry.Chunks = strings.Split(p.Chunks, ",")
+	}
+	reader, err := NewEntryReader(&entry, fileKey, backend.Fetch)
+	if err != nil {
+		return nil, fmt.Errorf("file decryption failed: %w", err)
+	}
+	return reader, nil
+}
 
-	return shareString, nil
+// checkExpiry refuses a pointer whose expiry has passed
+func (p *sharePointer) checkExpiry() error {
+	if p.Expires == "" {
+		return nil
+	}
+	expiresAt, err := time.Parse(time.RFC3339, p.Expires)
+	if err != nil {
+		return fmt.Errorf("invalid share pointer expiry: %w", err)
+	}
+	if time.Now().After(expiresAt) {
+		return fmt.Errorf("%w (on %s)", ErrShareExpired, expiresAt.Local().Format("2006-01-02 15:04"))
+	}
+	return nil
 }
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// sharedFolderFile is one file in the mini-index of a folder share. Path is
+// relative to the shared folder and always uses forward slashes.
+type sharedFolderFile struct {
+	Path      string   `json:"path"`
+	StorageID string   `json:"storageID"`
+	Chunks    []string `json:"chunks,omitempty"`
+	FileKey   string   `json:"fileKey"` // Raw file key, hex-encoded
+	FileMetadata
+}
+
+// entry returns an index entry for the file, enough to fetch and decrypt it
+func (f sharedFolderFile) entry() Entry {
+	return Entry{Type: "file", RealName: f.StorageID, Chunks: f.Chunks, FileMetadata: f.FileMetadata}
+}
+
+// collectSharedFolderFiles lists every file below a folder's contents with
+// its unwrapped key, in path order. Paths are relative to the folder
+// (prefix "" for the folder itself).
+func collectSharedFolderFiles(contents VaultIndex, prefix string, session *Session) ([]sharedFolderFile, error) {
+	var files []sharedFolderFile
+	for _, file := range IndexFiles(contents, prefix) {
+		fileKey, err := session.UnwrapFileKey(file.Entry.FileKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt file key for %s: %w", file.Path, err)
+		}
+		files = append(files, sharedFolderFile{
+			Path:         file.Path,
+			StorageID:    file.Entry.RealName,
+			Chunks:       file.Entry.Chunks,
+			FileKey:      hex.EncodeToString(fileKey),
+			FileMetadata: file.Entry.FileMetadata,
+		})
+	}
+	return files, nil
+}
+
+// sharedFolderTarget resolves a path from a folder share below outputDir. The
+// pointer was written by someone else, so absolute paths and paths leaving
+// outputDir are refused.
+func sharedFolderTarget(outputDir string, relPath string) (string, error) {
+	local := filepath.FromSlash(path.Clean(relPath))
+	if relPath == "" || strings.Contains(relPath, "\\") || !filepath.IsLocal(local) {
+		return "", fmt.Errorf("share pointer contains an unsafe path: %q", relPath)
+	}
+	return filepath.Join(outputDir, local), nil
+}
+
+// downloadSharedFolder recreates the subtree of a folder share in outputDir
+func downloadSharedFolder(pointer *sharePointer, outputDir string, backend Backend) error {
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	for i, file := range pointer.Files {
+		target, err := sharedFolderTarget(outputDir, file.Path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Downloading file (%d/%d): %s\n", i+1, len(pointer.Files), file.Path)
+
+		fileKey, err := hex.DecodeString(file.FileKey)
+		if err != nil {
+			return fmt.Errorf("invalid file key for %s: %w", file.Path, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", file.Path, err)
+		}
+
+		entry := file.entry()
+		reader, err := NewEntryReader(&entry, fileKey, backend.Fetch)
+		if err != nil {
+			return fmt.Errorf("failed to fetch file %s: %w", file.Path, err)
+		}
+		if err := saveStream(reader, target); err != nil {
+			return fmt.Errorf("failed to save file %s: %w", target, err)
+		}
+		applyFileMetadata(target, &entry)
+		fmt.Printf("  → Saved: %s\n", target)
+	}
+
+	fmt.Printf("Downloaded %d files to %s\n", len(pointer.Files), outputDir)
+	return nil
+}
+
+// printSharedFolder lists the files of a folder share
+func printSharedFolder(pointer *sharePointer, out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tSIZE\tMODIFIED")
+	var total int64
+	for _, file := range pointer.Files {
+		size, modified := "-", "-"
+		if file.Size > 0 {
+			size = FormatSize(file.Size)
+			total += file.Size
+		}
+		if !file.Modified.IsZero() {
+			modified = file.Modified.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", file.Path, size, modified)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(out, "\n%d files, %s\n", len(pointer.Files), FormatSize(total))
+	return err
+}
@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// shareLinkPrefix marks an encoded share link, as opposed to the older
+// colon-separated share strings
+const shareLinkPrefix = "zep_"
+
+// ShareLinkVersion is the version of the share link encoding written by String
+const ShareLinkVersion = 1
+
+// ShareWebURL is the web share page; the share link goes after the '#', so it
+// never reaches the server
+const ShareWebURL = "https://zep.ftp.sh/shared/#"
+
+// ErrInvalidShareLink is returned for share links that cannot be parsed
+var ErrInvalidShareLink = errors.New("invalid share link")
+
+// ShareLink is everything a recipient needs to open a share: whose vault, which
+// pointer, and the password the pointer is encrypted with.
+//
+// Encoded, it is "zep_" followed by unpadded base64url of
+//
+//	[version 1][u16 len][username][u16 len][reference][u16 len][password][u16 len][name][CRC-32]
+//
+// with big-endian lengths and the CRC-32 (IEEE) of all bytes before it, so a
+// link damaged in copy and paste is reported as such rather than as a wrong
+// password.
+type ShareLink struct {
+	Username  string
+	Reference string
+	Password  string
+	Name      string // Name of the shared file or folder, may be empty
+}
+
+// String returns the encoded share link
+func (l ShareLink) String() string {
+	buf := []byte{ShareLinkVersion}
+	for _, field := range []string{l.Username, l.Reference, l.Password, l.Name} {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(field)))
+		buf = append(buf, field...)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+	return shareLinkPrefix + base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// URL returns the link to the web share page
+func (l ShareLink) URL() string {
+	return ShareWebURL + l.String()
+}
+
+// DefaultName is the local name to save the share as when none is given. The
+// name comes from the link, so only its last element is used.
+func (l ShareLink) DefaultName() string {
+	name := path.Base(strings.ReplaceAll(l.Name, "\\", "/"))
+	if l.Name == "" || name == "." || name == ".." || name == "/" {
+		return l.Reference
+	}
+	return name
+}
+
+// ParseShareLink parses a share link in any of its forms: an encoded link, a
+// web share URL containing one, or an older share string
+// (username:reference:sharepassword[:base64filename])
+func ParseShareLink(s string) (ShareLink, error) {
+	s = strings.TrimSpace(s)
+
+	// Web share URLs carry the link in the fragment
+	if strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://") {
+		_, fragment, ok := strings.Cut(s, "#")
+		if !ok || fragment == "" {
+			return ShareLink{}, fmt.Errorf("%w: the URL has no share link after '#'", ErrInvalidShareLink)
+		}
+		if strings.Contains(fragment, "%") {
+			if unescaped, err := url.PathUnescape(fragment); err == nil {
+				fragment = unescaped
+			}
+		}
+		s = fragment
+	}
+
+	var link ShareLink
+	var err error
+	if strings.HasPrefix(s, shareLinkPrefix) {
+		link, err = decodeShareLink(strings.TrimPrefix(s, shareLinkPrefix))
+	} else {
+		link, err = parseLegacyShareString(s)
+	}
+	if err != nil {
+		return ShareLink{}, err
+	}
+
+	if link.Username == "" || link.Reference == "" || link.Password == "" {
+		return ShareLink{}, fmt.Errorf("%w: missing username, reference or password", ErrInvalidShareLink)
+	}
+	return link, nil
+}
+
+// decodeShareLink decodes the base64url part of an encoded link
+func decodeShareLink(encoded string) (ShareLink, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return ShareLink{}, fmt.Errorf("%w: %v", ErrInvalidShareLink, err)
+	}
+	if len(data) < 1+4 {
+		return ShareLink{}, fmt.Errorf("%w: too short", ErrInvalidShareLink)
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return ShareLink{}, fmt.Errorf("%w: checksum mismatch, the link may be incomplete", ErrInvalidShareLink)
+	}
+	if body[0] != ShareLinkVersion {
+		return ShareLink{}, fmt.Errorf("%w: unsupported version %d, update zep", ErrInvalidShareLink, body[0])
+	}
+
+	rest := body[1:]
+	fields := make([]string, 4)
+	for i := range fields {
+		if len(rest) < 2 {
+			return ShareLink{}, fmt.Errorf("%w: truncated", ErrInvalidShareLink)
+		}
+		n := int(binary.BigEndian.Uint16(rest))
+		rest = rest[2:]
+		if len(rest) < n {
+			return ShareLink{}, fmt.Errorf("%w: truncated", ErrInvalidShareLink)
+		}
+		fields[i] = string(rest[:n])
+		rest = rest[n:]
+	}
+	if len(rest) != 0 {
+		return ShareLink{}, fmt.Errorf("%w: unexpected trailing data", ErrInvalidShareLink)
+	}
+	return ShareLink{Username: fields[0], Reference: fields[1], Password: fields[2], Name: fields[3]}, nil
+}
+
+// parseLegacyShareString parses the colon-separated share strings of older
+// versions, with or without the base64 file name
+func parseLegacyShareString(s string) (ShareLink, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 3 || len(parts) > 4 {
+		return ShareLink{}, fmt.Errorf("%w: expected a zep_ link, a share URL or 'username:reference:sharepassword[:base64filename]'", ErrInvalidShareLink)
+	}
+
+	link := ShareLink{Username: parts[0], Reference: parts[1], Password: parts[2]}
+	if len(parts) == 4 {
+		decoded, err := base64.StdEncoding.DecodeString(parts[3])
+		if err != nil {
+			return ShareLink{}, fmt.Errorf("%w: invalid filename encoding: %v", ErrInvalidShareLink, err)
+		}
+		link.Name = string(decoded)
+	}
+	return link, nil
+}
+
+// openShareLink fetches the pointer the link refers to from the sharer's vault
+// and decrypts it, refusing expired links
+func openShareLink(link ShareLink) (*sharePointer, Backend, error) {
+	backend, err := OpenBackend(ActiveBackendSpec(), link.Username, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := backend.Fetch("shared/" + link.Reference)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch share pointer from remote: %w", err)
+	}
+	pointer, err := decryptSharePointer(data, link.Password)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := pointer.checkExpiry(); err != nil {
+		return nil, nil, err
+	}
+	return pointer, backend, nil
+}
@@ -1,8 +1,11 @@
 package utils
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"path"
+	"sort"
 	"time"
 )
 
@@ -13,6 +16,35 @@ type SharedFileEntry struct {
 	Password     string    `json:"password"`
 	SharedAt     time.Time `json:"shared_at"`
 	OriginalPath string    `json:"original_path"`
+	ExpiresAt    time.Time `json:"expires_at,omitzero"` // Zero for shares that never expire
+	Recipient    string    `json:"recipient,omitempty"` // Set for shares sealed to another user's inbox
+}
+
+// Expired reports whether the share has an expiry and it has passed
+func (e SharedFileEntry) Expired() bool {
+	return !e.ExpiresAt.IsZero() && time.Now().After(e.ExpiresAt)
+}
+
+// Link returns the share link of the entry, for the vault of username
+func (e SharedFileEntry) Link(username string) ShareLink {
+	return ShareLink{Username: username, Reference: e.Reference, Password: e.Password, Name: path.Base(e.Name)}
+}
+
+// ExpiryString describes when the share expires, for listings
+func (e SharedFileEntry) ExpiryString() string {
+	return expiryString(e.ExpiresAt)
+}
+
+// expiryString formats an expiry time for listings; zero means never
+func expiryString(expiresAt time.Time) string {
+	if expiresAt.IsZero() {
+		return "never"
+	}
+	expiry := expiresAt.Local().Format("2006-01-02 15:04")
+	if time.Now().After(expiresAt) {
+		return expiry + " (expired)"
+	}
+	return expiry
 }
 
 // SharedIndex stores all shared files with encryption
@@ -59,6 +91,55 @@ func (si *SharedIndex) ListEntries() []SharedFileEntry {
 	return entries
 }
 
+// MergeSharedIndex performs a three-way merge of two shared indexes that diverged
+// from base, keyed by share reference. It returns the merged index and the
+// references that were changed differently on both sides (where ours is kept).
+func MergeSharedIndex(base, ours, theirs *SharedIndex) (*SharedIndex, []string) {
+	merged := NewSharedIndex()
+	var conflicts []string
+
+	refs := make(map[string]bool)
+	for _, si := range []*SharedIndex{base, ours, theirs} {
+		for ref := range si.Files {
+			refs[ref] = true
+		}
+	}
+
+	same := func(a, b *SharedIndex, ref string) bool {
+		ea, inA := a.Files[ref]
+		eb, inB := b.Files[ref]
+		if inA != inB {
+			return false
+		}
+		aJSON, _ := json.Marshal(ea)
+		bJSON, _ := json.Marshal(eb)
+		return bytes.Equal(aJSON, bJSON)
+	}
+
+	for ref := range refs {
+		o, inOurs := ours.Files[ref]
+		t, inTheirs := theirs.Files[ref]
+		switch {
+		case same(ours, theirs, ref), same(theirs, base, ref):
+			if inOurs {
+				merged.Files[ref] = o
+			}
+		case same(ours, base, ref):
+			if inTheirs {
+				merged.Files[ref] = t
+			}
+		default:
+			conflicts = append(conflicts, ref)
+			if inOurs {
+				merged.Files[ref] = o
+			}
+		}
+	}
+
+	sort.Strings(conflicts)
+	return merged, conflicts
+}
+
 // ToJSON encodes the index as JSON
 func (si *SharedIndex) ToJSON() ([]byte, error) {
 	return json.MarshalIndent(si, "", "  ")
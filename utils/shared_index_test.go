@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+// testSharedIndex builds a shared index holding a share of each reference's
+// path, shared with the given password
+func testSharedIndex(shares map[string]string) *SharedIndex {
+	si := NewSharedIndex()
+	for ref, password := range shares {
+		si.AddEntry(SharedFileEntry{Name: "file", Reference: ref, Password: password, OriginalPath: "docs/" + ref})
+	}
+	return si
+}
+
+func sharePasswords(si *SharedIndex) map[string]string {
+	passwords := make(map[string]string)
+	for ref, entry := range si.Files {
+		passwords[ref] = entry.Password
+	}
+	return passwords
+}
+
+func TestMergeSharedIndex(t *testing.T) {
+	base := map[string]string{"aaa": "p1", "bbb": "p1"}
+	for _, tt := range []struct {
+		name      string
+		ours      map[string]string
+		theirs    map[string]string
+		want      map[string]string
+		conflicts []string
+	}{
+		{
+			name:   "shared on each side",
+			ours:   map[string]string{"aaa": "p1", "bbb": "p1", "ccc": "p1"},
+			theirs: map[string]string{"aaa": "p1", "bbb": "p1", "ddd": "p1"},
+			want:   map[string]string{"aaa": "p1", "bbb": "p1", "ccc": "p1", "ddd": "p1"},
+		},
+		{
+			name:   "revoked on one side, rotated on the other",
+			ours:   map[string]string{"bbb": "p1"},
+			theirs: map[string]string{"aaa": "p1", "bbb": "p2"},
+			want:   map[string]string{"bbb": "p2"},
+		},
+		{
+			name:   "revoked on both sides",
+			ours:   map[string]string{"bbb": "p1"},
+			theirs: map[string]string{"bbb": "p1"},
+			want:   map[string]string{"bbb": "p1"},
+		},
+		{
+			name:      "rotated differently on both sides",
+			ours:      map[string]string{"aaa": "p2", "bbb": "p1"},
+			theirs:    map[string]string{"aaa": "p3", "bbb": "p1"},
+			want:      map[string]string{"aaa": "p2", "bbb": "p1"},
+			conflicts: []string{"aaa"},
+		},
+		{
+			name:      "rotated on one side, revoked on the other",
+			ours:      map[string]string{"aaa": "p1"},
+			theirs:    map[string]string{"aaa": "p1", "bbb": "p2"},
+			want:      map[string]string{"aaa": "p1"},
+			conflicts: []string{"bbb"},
+		},
+		{
+			name:      "same reference taken on both sides",
+			ours:      map[string]string{"aaa": "p1", "bbb": "p1", "ccc": "p2"},
+			theirs:    map[string]string{"aaa": "p1", "bbb": "p1", "ccc": "p3"},
+			want:      map[string]string{"aaa": "p1", "bbb": "p1", "ccc": "p2"},
+			conflicts: []string{"ccc"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, conflicts := MergeSharedIndex(testSharedIndex(base), testSharedIndex(tt.ours), testSharedIndex(tt.theirs))
+			if got := sharePasswords(merged); !maps.Equal(got, tt.want) {
+				t.Errorf("merged = %v, want %v", got, tt.want)
+			}
+			if !slices.Equal(conflicts, tt.conflicts) {
+				t.Errorf("conflicts = %v, want %v", conflicts, tt.conflicts)
+			}
+		})
+	}
+}
@@ -2,51 +2,242 @@ package utils
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 )
 
-// RevokeSharedFile removes a shared file by reference
-func RevokeSharedFile(reference string, session *Session) error {
+// RevokeSharedFile removes a shared file by reference. The shared/<ref> pointer
+// is deleted in the same commit as the shared index update, so the link stops
+// working. With rotate, the file (or every file of a shared folder) is also
+// re-encrypted with a new file key into new storage objects, so a key already
+// extracted from the pointer no longer opens it; other shares that include the
+// re-keyed files are re-issued with the new keys.
+func RevokeSharedFile(reference string, rotate bool, session *Session) error {
 	// Ensure SharedIndex is initialized
 	if session.SharedIndex == nil {
 		session.SharedIndex = NewSharedIndex()
 	}
+	steps := 2
+	if rotate {
+		steps = 3
+	}
 
-	// 1. Remove from the shared index
-	err := session.SharedIndex.RemoveEntry(reference)
+	// 1. Remove from the shared index, and the pointer from the vault
+	PrintProgressStep(1, steps, "Removing share...")
+	shared, err := session.SharedIndex.GetEntry(reference)
 	if err != nil {
 		return err
 	}
+	session.SharedIndex.RemoveEntry(reference)
+	batch := newUploadBatch(session)
+	batch.deletes = append(batch.deletes, "shared/"+reference)
+	if shared.Recipient != "" {
+		if err := stageOutboxRemoval(shared.Recipient, []string{reference}, session, batch.files, &batch.deletes); err != nil {
+			return fmt.Errorf("failed to update outbox for %s: %w", shared.Recipient, err)
+		}
+	}
+	PrintCompletionLine("Share " + reference + " removed")
 
-	// 2. Delete the actual shared file from GitHub
-	// We'll use PushFiles with an empty map to trigger a delete
-	// Actually, we need to handle this by removing from the git tree
-	// For now, we'll just update the index which is the main thing
+	// 2. Re-key the file and re-issue its remaining shares
+	if rotate {
+		PrintProgressStep(2, steps, "Re-encrypting file with a new key...")
+		if err := rotateSharedFile(shared.OriginalPath, session, batch); err != nil {
+			return err
+		}
+	}
 
-	// 3. Upload the updated shared index
+	// 3. Push the updated shared index (and index) and the deletions in one commit
+	PrintProgressStep(steps, steps, "Updating vault...")
 	indexJSON, err := session.SharedIndex.EncryptForRemote(session.Password)
 	if err != nil {
 		return fmt.Errorf("failed to encrypt shared index: %w", err)
 	}
+	batch.files["shared/.config/index"] = indexJSON
 
-	indexFilesToPush := map[string][]byte{
-		"shared/.config/index": indexJSON,
+	if rotate {
+		indexBytes, err := session.Index.ToBytes(session.Password)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt index: %w", err)
+		}
+		err = batch.commit(indexBytes)
+	} else {
+		err = session.Push(batch.files, batch.deletes)
 	}
-
-	err = PushFilesWithAuthor(
-		fmt.Sprintf("git@github.com:%s/.zephyrus.git", session.Username),
-		session.RawKey,
-		indexFilesToPush,
-		session.Settings.CommitMessage,
-		session.Settings.CommitAuthorName,
-		session.Settings.CommitAuthorEmail,
-	)
 	if err != nil {
 		return fmt.Errorf("failed to update shared index: %w", err)
 	}
+	PrintCompletionLine("Share pointer deleted from vault")
 
 	return nil
 }
 
+// rotateSharedFile re-encrypts the file at vaultPath (every file below it, for
+// a folder share) with new keys and rewrites the pointers of the shares left
+// that include any of those files
+func rotateSharedFile(vaultPath string, session *Session, batch *uploadBatch) error {
+	entry, err := session.Index.FindEntry(vaultPath)
+	if err != nil {
+		return fmt.Errorf("could not find file in vault: %w", err)
+	}
+	paths := []string{vaultPath}
+	if entry.Type == "folder" {
+		paths = nil
+		for _, file := range IndexFiles(entry.Contents, strings.Trim(vaultPath, "/")) {
+			paths = append(paths, file.Path)
+		}
+	}
+
+	copies := 0
+	var rotated *Entry
+	for _, path := range paths {
+		var stillShared bool
+		rotated, stillShared, err = rotateFileKey(path, session, batch)
+		if err != nil {
+			return fmt.Errorf("failed to rotate key of %s: %w", path, err)
+		}
+		if stillShared {
+			copies++
+		}
+	}
+
+	reissued := 0
+	for ref, other := range session.SharedIndex.Files {
+		if !sharePathsOverlap(other.OriginalPath, vaultPath) {
+			continue
+		}
+		otherEntry, err := session.Index.FindEntry(other.OriginalPath)
+		if err != nil {
+			// The shared path no longer exists, there is nothing to re-issue
+			continue
+		}
+		pointer, err := buildSharePointer(other.OriginalPath, otherEntry, session, other.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		pointerEncrypted, err := pointer.encrypt(other.Password)
+		if err != nil {
+			return err
+		}
+		batch.files["shared/"+ref] = pointerEncrypted
+		reissued++
+	}
+
+	switch {
+	case entry.Type == "folder":
+		PrintCompletionLine(fmt.Sprintf("%d files re-encrypted, %d other share(s) updated", len(paths), reissued))
+	case rotated.IsChunked():
+		PrintCompletionLine(fmt.Sprintf("File re-encrypted into %d new chunks, %d other share(s) updated", len(rotated.Chunks), reissued))
+	default:
+		PrintCompletionLine(fmt.Sprintf("File re-encrypted as %s, %d other share(s) updated", rotated.RealName, reissued))
+	}
+	if copies > 0 {
+		fmt.Println("⚠️  Copies of these files (made with 'cp') still use the old keys; rotate or delete them too.")
+	}
+	return nil
+}
+
+// sharePathsOverlap reports whether two shared paths are the same or one
+// contains the other, i.e. whether a share of a includes files of b
+func sharePathsOverlap(a, b string) bool {
+	a, b = strings.Trim(a, "/"), strings.Trim(b, "/")
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// rotateFileKey re-encrypts a file with a new file key into freshly named
+// objects and stages the removal of the old ones. Objects that copies of the
+// file still use are kept; stillShared reports whether there were any.
+func rotateFileKey(vaultPath string, session *Session, batch *uploadBatch) (rotated *Entry, stillShared bool, err error) {
+	entry, err := session.Index.FindEntry(vaultPath)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not find file in vault: %w", err)
+	}
+	if entry.Type != "file" {
+		return nil, false, fmt.Errorf("'%s' is a directory", vaultPath)
+	}
+	previous := entry.Clone()
+
+	oldKey, err := session.UnwrapFileKey(previous.FileKey)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to decrypt file key: %w", err)
+	}
+	reader, err := NewEntryReader(&previous, oldKey, session.Fetch)
+	if err != nil {
+		return nil, false, err
+	}
+	newKey := GenerateFileKey()
+	encryptedKeyHex, err := session.WrapFileKey(newKey)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Without a previous entry stageStream always picks new storage names.
+	// Entries from before sizes were recorded report 0, so keep chunked files chunked.
+	size := previous.Size
+	if previous.IsChunked() && size <= ChunkSize {
+		size = ChunkSize + 1
+	}
+	if err := stageStream(reader, size, vaultPath, previous.FileMetadata, newKey, encryptedKeyHex, nil, session, batch); err != nil {
+		return nil, false, err
+	}
+
+	rotated, err = session.Index.FindEntry(vaultPath)
+	if err != nil {
+		return nil, false, err
+	}
+	if !previous.Created.IsZero() {
+		rotated.Created = previous.Created
+		session.Index.SetFileMetadata(vaultPath, rotated.FileMetadata)
+	}
+
+	oldIDs := previous.StorageIDs()
+	unreferenced := session.Index.Unreferenced(oldIDs)
+	batch.deletes = append(batch.deletes, unreferenced...)
+	return rotated, len(unreferenced) < len(oldIDs), nil
+}
+
+// PruneExpiredShares removes every expired share from the shared index and
+// deletes their pointers (and outbox messages), all in one commit. It returns
+// the pruned shares.
+func PruneExpiredShares(session *Session) ([]SharedFileEntry, error) {
+	if session.SharedIndex == nil {
+		session.SharedIndex = NewSharedIndex()
+	}
+
+	var pruned []SharedFileEntry
+	var deletes []string
+	byRecipient := make(map[string][]string)
+	for ref, entry := range session.SharedIndex.Files {
+		if entry.Expired() {
+			pruned = append(pruned, entry)
+			deletes = append(deletes, "shared/"+ref)
+			if entry.Recipient != "" {
+				byRecipient[entry.Recipient] = append(byRecipient[entry.Recipient], ref)
+			}
+			delete(session.SharedIndex.Files, ref)
+		}
+	}
+	if len(pruned) == 0 {
+		return nil, nil
+	}
+	sort.Slice(pruned, func(i, j int) bool { return pruned[i].ExpiresAt.Before(pruned[j].ExpiresAt) })
+
+	files := make(map[string][]byte)
+	for recipient, refs := range byRecipient {
+		if err := stageOutboxRemoval(recipient, refs, session, files, &deletes); err != nil {
+			return nil, fmt.Errorf("failed to update outbox for %s: %w", recipient, err)
+		}
+	}
+	indexJSON, err := session.SharedIndex.EncryptForRemote(session.Password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt shared index: %w", err)
+	}
+	files["shared/.config/index"] = indexJSON
+	if err := session.Push(files, deletes); err != nil {
+		return nil, fmt.Errorf("failed to update shared index: %w", err)
+	}
+	return pruned, nil
+}
+
 // GetSharedFileInfo retrieves info about a shared file
 func GetSharedFileInfo(reference string, session *Session) (SharedFileEntry, error) {
 	if session.SharedIndex == nil {
@@ -2,7 +2,9 @@ package utils
 
 import (
 	"fmt"
+	"path"
 	"strings"
+	"time"
 )
 
 // SharedFileMatch represents a match result when searching for shared files
@@ -69,7 +71,7 @@ func FindSharedFilesByName(nameQuery string, session *Session) ([]SharedFileMatc
 }
 
 // RevokeSharedFileByName revokes a shared file using its name (with search if ambiguous)
-func RevokeSharedFileByName(nameQuery string, session *Session) (string, error) {
+func RevokeSharedFileByName(nameQuery string, rotate bool, session *Session) (string, error) {
 	matches, err := FindSharedFilesByName(nameQuery, session)
 	if err != nil {
 		return "", err
@@ -90,7 +92,7 @@ func RevokeSharedFileByName(nameQuery string, session *Session) (string, error)
 
 	// Exactly one match - revoke it
 	reference := matches[0].Reference
-	err = RevokeSharedFile(reference, session)
+	err = RevokeSharedFile(reference, rotate, session)
 	if err != nil {
 		return "", err
 	}
@@ -98,30 +100,130 @@ func RevokeSharedFileByName(nameQuery string, session *Session) (string, error)
 	return reference, nil
 }
 
-// PrintSharedFilesFormatted lists all shared files with formatted output
-func PrintSharedFilesFormatted(session *Session) error {
-	entries := session.SharedIndex.ListEntries()
-	if len(entries) == 0 {
-		fmt.Println("No files have been shared yet.")
+// SharedRecord describes one share in the output of shared ls and shared info
+type SharedRecord struct {
+	Reference string    `json:"reference"`
+	Name      string    `json:"name"` // File or folder name
+	Path      string    `json:"path"` // Vault path when it was shared
+	SharedAt  time.Time `json:"shared_at"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"` // Absent for shares that never expire
+	Expired   bool      `json:"expired"`
+	Recipient string    `json:"recipient,omitempty"` // Set for shares sent to another user's inbox
+	Match     string    `json:"match,omitempty"`     // shared ls with a pattern: "exact", "prefix" or "substring"
+	Password  string    `json:"password,omitempty"`  // shared info only
+	Link      string    `json:"link,omitempty"`      // shared info only
+	WebLink   string    `json:"web_link,omitempty"`  // shared info only
+}
+
+// newSharedRecord describes a share without its secrets
+func newSharedRecord(entry SharedFileEntry) SharedRecord {
+	return SharedRecord{
+		Reference: entry.Reference,
+		Name:      path.Base(entry.OriginalPath),
+		Path:      entry.OriginalPath,
+		SharedAt:  entry.SharedAt.UTC(),
+		ExpiresAt: entry.ExpiresAt.UTC(),
+		Expired:   entry.Expired(),
+		Recipient: entry.Recipient,
+	}
+}
+
+// matchType names a SharedFileMatch score
+func (m SharedFileMatch) matchType() string {
+	switch {
+	case m.MatchScore == 0:
+		return "exact"
+	case m.MatchScore < 50:
+		return "prefix"
+	}
+	return "substring"
+}
+
+// PrintSharedFilesFormatted lists all shared files, or those whose name
+// matches nameQuery (see FindSharedFilesByName), in the given output format
+func PrintSharedFilesFormatted(nameQuery string, session *Session, format string) error {
+	if nameQuery == "" {
+		var records []SharedRecord
+		for _, entry := range ListSharedFiles(session) {
+			records = append(records, newSharedRecord(entry))
+		}
+		if format != OutputTable {
+			return writeRecords(format, records)
+		}
+		if len(records) == 0 {
+			fmt.Println("No shared files.")
+			return nil
+		}
+
+		fmt.Println("\n📤 SHARED FILES")
+		fmt.Println("REFERENCE  FILE NAME              SHARED AT         EXPIRES")
+		fmt.Println("---------  ----------              ---------         -------")
+		for _, r := range records {
+			fmt.Printf("%-9s %-24s %-17s %s\n", r.Reference, r.Path, r.SharedAt.Local().Format("2006-01-02 15:04"), expiryString(r.ExpiresAt))
+		}
+		fmt.Println()
 		return nil
 	}
 
-	fmt.Println("\n╔════════════════════════════════════════════════════════════════╗")
-	fmt.Println("║            SHARED FILES                                         ║")
-	fmt.Println("╚════════════════════════════════════════════════════════════════╝")
+	matches, err := FindSharedFilesByName(nameQuery, session)
+	if err != nil {
+		return err
+	}
+	if format != OutputTable {
+		var records []SharedRecord
+		for _, match := range matches {
+			record := newSharedRecord(session.SharedIndex.Files[match.Reference])
+			record.Match = match.matchType()
+			records = append(records, record)
+		}
+		return writeRecords(format, records)
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("no shared files found matching '%s'", nameQuery)
+	}
 
-	for i, entry := range entries {
-		// Extract filename from path
-		parts := strings.Split(entry.OriginalPath, "/")
-		fileName := parts[len(parts)-1]
+	fmt.Printf("\n📂 Found %d match(es) for '%s':\n\n", len(matches), nameQuery)
+	for i, match := range matches {
+		fmt.Printf("[%d] %s\n", i+1, match.FileName)
+		fmt.Printf("    Vault Path: %s\n", match.OriginalPath)
+		fmt.Printf("    Reference:  %s\n", match.Reference)
+		fmt.Printf("    Match Type: ")
+		switch match.matchType() {
+		case "exact":
+			fmt.Println("Exact match")
+		case "prefix":
+			fmt.Println("Prefix match")
+		default:
+			fmt.Println("Substring match")
+		}
+		fmt.Println()
+	}
+	return nil
+}
 
-		fmt.Printf("\n[%d] %s\n", i+1, fileName)
-		fmt.Printf("    Vault Path:     %s\n", entry.OriginalPath)
-		fmt.Printf("    Share Ref:      %s\n", entry.Reference)
-		fmt.Printf("    Shared At:      %s\n", entry.SharedAt.Format("2006-01-02 15:04:05"))
+// PrintSharedFileInfo prints one share, including its password and links,
+// in the given output format
+func PrintSharedFileInfo(entry SharedFileEntry, session *Session, format string) error {
+	link := entry.Link(session.Username)
+	if format != OutputTable {
+		record := newSharedRecord(entry)
+		record.Password = entry.Password
+		record.Link = link.String()
+		record.WebLink = link.URL()
+		return writeRecord(format, record)
 	}
 
-	fmt.Println()
+	fmt.Printf("\n📄 SHARED FILE INFO\n")
+	fmt.Printf("Reference:     %s\n", entry.Reference)
+	fmt.Printf("File Name:     %s\n", entry.OriginalPath)
+	fmt.Printf("Shared At:     %s\n", entry.SharedAt.Format("2006-01-02 15:04:05"))
+	fmt.Printf("Expires:       %s\n", entry.ExpiryString())
+	if entry.Recipient != "" {
+		fmt.Printf("Shared With:   %s (via their inbox)\n", entry.Recipient)
+	}
+	fmt.Printf("Password:      %s\n", entry.Password)
+	fmt.Printf("\nShare Link:    %s\n", link)
+	fmt.Printf("\nWeb Share Link: %s\n\n", link.URL())
 	return nil
 }
 
@@ -0,0 +1,475 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SyncMode selects which side of a sync may be changed
+type SyncMode string
+
+const (
+	SyncPush   SyncMode = "push" // Local folder -> vault
+	SyncPull   SyncMode = "pull" // Vault -> local folder
+	SyncTwoWay SyncMode = "both" // Changes travel in both directions
+)
+
+// SyncStateFile is kept in the local folder and records the content hash of
+// every file as of the last sync, so two-way syncs can tell which side changed
+const SyncStateFile = ".zephyrus-sync"
+
+// ParseSyncMode validates a --mode flag value
+func ParseSyncMode(mode string) (SyncMode, error) {
+	switch SyncMode(mode) {
+	case SyncPush, SyncPull, SyncTwoWay:
+		return SyncMode(mode), nil
+	case "two-way":
+		return SyncTwoWay, nil
+	}
+	return "", fmt.Errorf("unknown sync mode '%s' (use push, pull or both)", mode)
+}
+
+// ErrSyncCancelled is returned by SyncFolder when Confirm declines the plan
+var ErrSyncCancelled = errors.New("sync cancelled")
+
+// SyncOptions controls SyncFolder
+type SyncOptions struct {
+	Mode   SyncMode
+	Delete bool // Propagate deletions instead of restoring missing files
+	DryRun bool // Only print the plan
+
+	// Confirm is asked before a plan that deletes files is carried out, with
+	// the number of deletions; returning false cancels the sync. Nil means
+	// no confirmation.
+	Confirm func(deletions int) bool
+}
+
+// SyncAction is one step of a sync plan
+type SyncAction struct {
+	Op     string // "upload", "download", "delete-vault" or "delete-local"
+	Path   string // Path relative to both folders, with forward slashes
+	Size   int64  // Bytes transferred (0 for deletions)
+	Reason string
+}
+
+// syncFile is what is known about one path on both sides
+type syncFile struct {
+	local     os.FileInfo // nil if missing locally
+	localHash string      // Computed lazily
+	vault     *Entry      // nil if missing in the vault
+	vaultHash string      // SHA256 from metadata, or computed for legacy entries
+}
+
+// SyncFolder brings a local folder and a vault folder in line with each
+// other. Files are compared by size and modification time first and by
+// content hash when those differ, so unchanged files are never transferred.
+// All vault changes go out in a single commit.
+func SyncFolder(localDir string, vaultDir string, opts SyncOptions, session *Session) error {
+	vaultDir = strings.Trim(vaultDir, "/")
+
+	// 1. Scan both sides
+	PrintProgressStep(1, 4, "Scanning local folder and vault...")
+	files, err := scanSyncFolders(localDir, vaultDir, opts.Mode, session)
+	if err != nil {
+		return err
+	}
+	state := loadSyncState(localDir)
+	base := state[vaultDir]
+	PrintCompletionLine(fmt.Sprintf("%d paths found", len(files)))
+
+	// 2. Compare and build the plan
+	PrintProgressStep(2, 4, "Comparing files...")
+	plan, err := planSync(localDir, files, base, opts, session)
+	if err != nil {
+		return err
+	}
+	PrintCompletionLine(fmt.Sprintf("%d changes planned", len(plan)))
+	PrintSyncPlan(plan)
+
+	if opts.DryRun {
+		fmt.Println("Dry run: no changes were made.")
+		return nil
+	}
+	if deletions := countDeletions(plan); deletions > 0 && opts.Confirm != nil && !opts.Confirm(deletions) {
+		return ErrSyncCancelled
+	}
+
+	// 3. Upload changes and remove deleted files from the vault in one commit
+	PrintProgressStep(3, 4, "Updating vault...")
+	batch := newUploadBatch(session)
+	vaultChanged := false
+	var removedPaths []string
+	for _, action := range plan {
+		vaultPath := joinVaultPath(vaultDir, action.Path)
+		switch action.Op {
+		case "upload":
+			previous, fileKey, encryptedKeyHex, err := fileKeyFor(vaultPath, session)
+			if err != nil {
+				return err
+			}
+			localPath := filepath.Join(localDir, filepath.FromSlash(action.Path))
+			if err := stageFile(localPath, vaultPath, fileKey, encryptedKeyHex, previous, session, batch); err != nil {
+				return fmt.Errorf("failed to encrypt %s: %w", vaultPath, err)
+			}
+			updated, _ := session.Index.FindEntry(vaultPath)
+			files[action.Path].vaultHash = updated.SHA256
+			vaultChanged = true
+		case "delete-vault":
+			removed, err := session.Index.RemoveEntry(vaultPath)
+			if err != nil {
+				return err
+			}
+			batch.deletes = append(batch.deletes, removed.StorageIDs()...)
+			files[action.Path].vault = nil
+			removedPaths = append(removedPaths, vaultPath)
+			vaultChanged = true
+		}
+	}
+	if vaultChanged {
+		pruneEmptiedFolders(session.Index, vaultDir, removedPaths)
+		batch.deletes = session.Index.Unreferenced(batch.deletes)
+		indexBytes, err := session.Index.ToBytes(session.Password)
+		if err != nil {
+			return err
+		}
+		if err := batch.commit(indexBytes); err != nil {
+			return err
+		}
+		PrintCompletionLine("Vault updated")
+	} else {
+		PrintCompletionLine("Nothing to upload")
+	}
+
+	// 4. Download changes and remove deleted files locally
+	PrintProgressStep(4, 4, "Updating local folder...")
+	localChanged := 0
+	for _, action := range plan {
+		localPath := filepath.Join(localDir, filepath.FromSlash(action.Path))
+		switch action.Op {
+		case "download":
+			if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+				return err
+			}
+			f := files[action.Path]
+			if err := downloadEntry(f.vault, joinVaultPath(vaultDir, action.Path), localPath, session); err != nil {
+				return err
+			}
+			f.localHash = f.vaultHash
+			localChanged++
+		case "delete-local":
+			if err := os.Remove(localPath); err != nil {
+				return err
+			}
+			files[action.Path].local = nil
+			files[action.Path].localHash = ""
+			localChanged++
+		}
+	}
+	PrintCompletionLine(fmt.Sprintf("%d local changes applied", localChanged))
+
+	// Remember what both sides now hold for the next two-way sync
+	synced := make(map[string]string)
+	for path, f := range files {
+		if f.vault != nil && f.vaultHash != "" && (f.local != nil || f.localHash != "") {
+			synced[path] = f.vaultHash
+		}
+	}
+	state[vaultDir] = synced
+	if err := saveSyncState(localDir, state); err != nil {
+		fmt.Printf("Warning: could not save sync state: %v\n", err)
+	}
+	return nil
+}
+
+// scanSyncFolders lists the files below localDir and vaultDir by relative path
+func scanSyncFolders(localDir string, vaultDir string, mode SyncMode, session *Session) (map[string]*syncFile, error) {
+	files := make(map[string]*syncFile)
+
+	info, err := os.Stat(localDir)
+	switch {
+	case err == nil && !info.IsDir():
+		return nil, fmt.Errorf("path is not a directory: %s", localDir)
+	case err != nil && (mode != SyncPull || !os.IsNotExist(err)):
+		return nil, err
+	case err == nil:
+		err = filepath.Walk(localDir, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(localDir, filePath)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			if rel == SyncStateFile {
+				return nil
+			}
+			files[rel] = &syncFile{local: info}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("directory walk failed: %w", err)
+		}
+	}
+
+	contents := map[string]Entry(session.Index)
+	if vaultDir != "" {
+		entry, err := session.Index.FindEntry(vaultDir)
+		if err != nil {
+			if mode == SyncPull {
+				return nil, fmt.Errorf("could not find directory in vault: %w", err)
+			}
+			return files, nil
+		}
+		if entry.Type != "folder" {
+			return nil, fmt.Errorf("'%s' is a file, not a directory", vaultDir)
+		}
+		contents = entry.Contents
+	}
+
+	for _, file := range IndexFiles(contents, "") {
+		f, ok := files[file.Path]
+		if !ok {
+			f = &syncFile{}
+			files[file.Path] = f
+		}
+		f.vault = &file.Entry
+		f.vaultHash = file.Entry.SHA256
+	}
+	return files, nil
+}
+
+// planSync decides what happens to every path. base holds the content hashes
+// recorded by the previous sync; in two-way mode a file that changed on one
+// side only is copied to the other, and a file changed on both sides goes to
+// whichever side has the newer copy.
+func planSync(localDir string, files map[string]*syncFile, base map[string]string, opts SyncOptions, session *Session) ([]SyncAction, error) {
+	var plan []SyncAction
+	upload := func(path string, reason string) {
+		plan = append(plan, SyncAction{Op: "upload", Path: path, Size: files[path].local.Size(), Reason: reason})
+	}
+	download := func(path string, reason string) {
+		plan = append(plan, SyncAction{Op: "download", Path: path, Size: files[path].vault.Size, Reason: reason})
+	}
+
+	for path, f := range files {
+		localPath := filepath.Join(localDir, filepath.FromSlash(path))
+		synced, wasSynced := base[path]
+
+		switch {
+		case f.local != nil && f.vault != nil:
+			// Same size and modification time: unchanged, no need to hash
+			if f.vault.HasMetadata() && f.local.Size() == f.vault.Size && f.local.ModTime().Equal(f.vault.Modified) {
+				f.localHash = f.vaultHash
+				continue
+			}
+			if err := hashSyncFile(f, localPath, session); err != nil {
+				return nil, err
+			}
+			if f.localHash == f.vaultHash {
+				continue
+			}
+
+			switch opts.Mode {
+			case SyncPush:
+				upload(path, "changed")
+			case SyncPull:
+				download(path, "changed")
+			default:
+				localEdited := !wasSynced || f.localHash != synced
+				vaultEdited := !wasSynced || f.vaultHash != synced
+				switch {
+				case localEdited && !vaultEdited:
+					upload(path, "changed locally")
+				case vaultEdited && !localEdited:
+					download(path, "changed in vault")
+				case f.local.ModTime().After(f.vault.Modified):
+					upload(path, "conflict, local copy is newer")
+				default:
+					download(path, "conflict, vault copy is newer")
+				}
+			}
+
+		case f.local != nil:
+			switch {
+			case opts.Mode == SyncPush:
+				upload(path, "new")
+			case opts.Mode == SyncPull:
+				if opts.Delete {
+					plan = append(plan, SyncAction{Op: "delete-local", Path: path, Reason: "not in vault"})
+				}
+			case opts.Delete && wasSynced:
+				// Deleted in the vault since the last sync, unless edited locally meanwhile
+				if err := hashSyncFile(f, localPath, session); err != nil {
+					return nil, err
+				}
+				if f.localHash == synced {
+					plan = append(plan, SyncAction{Op: "delete-local", Path: path, Reason: "deleted in vault"})
+				} else {
+					upload(path, "deleted in vault but changed locally")
+				}
+			default:
+				upload(path, "new")
+			}
+
+		case f.vault != nil:
+			switch {
+			case opts.Mode == SyncPull:
+				download(path, "new")
+			case opts.Mode == SyncPush:
+				if opts.Delete {
+					plan = append(plan, SyncAction{Op: "delete-vault", Path: path, Reason: "not in local folder"})
+				}
+			case opts.Delete && wasSynced:
+				// Deleted locally since the last sync, unless edited in the vault meanwhile
+				if err := hashSyncFile(f, "", session); err != nil {
+					return nil, err
+				}
+				if f.vaultHash == synced {
+					plan = append(plan, SyncAction{Op: "delete-vault", Path: path, Reason: "deleted locally"})
+				} else {
+					download(path, "deleted locally but changed in vault")
+				}
+			default:
+				download(path, "new")
+			}
+		}
+	}
+
+	sort.Slice(plan, func(i, j int) bool { return plan[i].Path < plan[j].Path })
+	return plan, nil
+}
+
+// hashSyncFile fills in the content hashes of whichever sides exist. Vault
+// entries uploaded before metadata was recorded are decrypted and hashed.
+func hashSyncFile(f *syncFile, localPath string, session *Session) error {
+	if f.local != nil && f.localHash == "" {
+		file, err := os.Open(localPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		hash := sha256.New()
+		if _, err := io.Copy(hash, file); err != nil {
+			return err
+		}
+		f.localHash = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	if f.vault != nil && f.vaultHash == "" {
+		fileKey, err := session.UnwrapFileKey(f.vault.FileKey)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt file key: %w", err)
+		}
+		reader, err := NewEntryReader(f.vault, fileKey, session.Fetch)
+		if err != nil {
+			return err
+		}
+		hash := sha256.New()
+		if _, err := io.Copy(hash, reader); err != nil {
+			return err
+		}
+		f.vaultHash = hex.EncodeToString(hash.Sum(nil))
+	}
+	return nil
+}
+
+// PrintSyncPlan prints the planned actions, one per line
+func PrintSyncPlan(plan []SyncAction) {
+	if len(plan) == 0 {
+		fmt.Println("\nEverything is up to date.")
+		return
+	}
+
+	symbols := map[string]string{
+		"upload":       "↑ upload  ",
+		"download":     "↓ download",
+		"delete-vault": "✗ del vault",
+		"delete-local": "✗ del local",
+	}
+	var bytes int64
+	fmt.Println("\nSync plan:")
+	for _, action := range plan {
+		fmt.Printf("  %-12s %s (%s)\n", symbols[action.Op], action.Path, action.Reason)
+		bytes += action.Size
+	}
+	noun := "changes"
+	if len(plan) == 1 {
+		noun = "change"
+	}
+	fmt.Printf("\n%d %s, %s to transfer\n\n", len(plan), noun, FormatSize(bytes))
+}
+
+// joinVaultPath appends a relative path to a vault folder ("" is the root)
+func joinVaultPath(vaultDir string, rel string) string {
+	if vaultDir == "" {
+		return rel
+	}
+	return vaultDir + "/" + rel
+}
+
+// pruneEmptiedFolders removes the folders that removing paths left empty,
+// walking up from each removed path but stopping at vaultDir. Folders that
+// were empty before the sync are left alone.
+func pruneEmptiedFolders(index VaultIndex, vaultDir string, paths []string) {
+	for _, removed := range paths {
+		for dir := path.Dir(removed); dir != "." && dir != vaultDir; dir = path.Dir(dir) {
+			entry, err := index.FindEntry(dir)
+			if err != nil || entry.Type != "folder" || len(entry.Contents) > 0 {
+				break
+			}
+			index.RemoveEntry(dir)
+		}
+	}
+}
+
+// countDeletions returns the number of deletions in a sync plan
+func countDeletions(plan []SyncAction) int {
+	n := 0
+	for _, action := range plan {
+		if action.Op == "delete-vault" || action.Op == "delete-local" {
+			n++
+		}
+	}
+	return n
+}
+
+// loadSyncState reads the sync state of a local folder, keyed by vault folder
+func loadSyncState(localDir string) map[string]map[string]string {
+	state := make(map[string]map[string]string)
+	data, err := os.ReadFile(filepath.Join(localDir, SyncStateFile))
+	if err == nil {
+		json.Unmarshal(data, &state)
+	}
+	return state
+}
+
+// saveSyncState writes the sync state of a local folder
+func saveSyncState(localDir string, state map[string]map[string]string) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(localDir, 0755); err != nil {
+		return err
+	}
+	statePath := filepath.Join(localDir, SyncStateFile)
+	if err := os.WriteFile(statePath, data, 0600); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of an existing file, so tighten state files
+	// written by older versions
+	return os.Chmod(statePath, 0600)
+}
@@ -1,151 +1,710 @@
 package utils
 
 import (
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
-// TransferVault copies all files from a source vault to a destination vault
-func TransferVault(sourceUsername string, sourcePassword string, destUsername string, destPassword string) error {
-	destRepoURL := fmt.Sprintf("git@github.com:%s/.zephyrus.git", destUsername)
+// Conflict policies for source files whose path already exists in the
+// destination vault. A destination file with the same contents (SHA-256) as
+// the source file is never a conflict: it is left alone under every policy.
+const (
+	ConflictSkip      = "skip"      // Keep the destination's file (default)
+	ConflictOverwrite = "overwrite" // Replace the destination's file with the source's
+	ConflictRename    = "rename"    // Keep both; the source's file gets a " (2)" style suffix
+)
+
+// A transfer commits the destination index after at most this many files or
+// plaintext bytes, so an interrupted transfer only redoes the files of one
+// batch. Re-encrypted objects are pushed early once maxBatchBytes of them are
+// pending (see uploadBatch), so memory stays bounded however large the files.
+const (
+	transferBatchFiles = 50
+	transferBatchBytes = 64 << 20
+)
+
+// TransferOptions controls what TransferVault copies and how
+type TransferOptions struct {
+	Path     string // Source file or folder to transfer ("" for the whole vault)
+	Conflict string // ConflictSkip, ConflictOverwrite or ConflictRename
+	Settings bool   // Also replace the destination's settings with the source's
+	Jobs     int    // Files to re-encrypt at once
+}
+
+// TransferVault copies files from a source vault into a destination vault,
+// merging them into the files already there. Files are re-encrypted up to
+// opts.Jobs at once and pushed in batches; progress is kept in a checkpoint
+// file so an interrupted transfer resumes where it stopped when run again.
+// Shares of the transferred files and folders are recreated in the destination
+// once every file is there; a share whose files would not arrive unchanged
+// stops the transfer before anything is written.
+func TransferVault(sourceUsername string, sourcePassword string, destUsername string, destPassword string, opts TransferOptions) error {
+	if opts.Conflict == "" {
+		opts.Conflict = ConflictSkip
+	}
+	if opts.Conflict != ConflictSkip && opts.Conflict != ConflictOverwrite && opts.Conflict != ConflictRename {
+		return fmt.Errorf("unknown conflict policy '%s' (use skip, overwrite or rename)", opts.Conflict)
+	}
+	opts.Path = strings.Trim(opts.Path, "/")
 
 	fmt.Printf("🔄 Starting vault transfer from %s to %s\n", sourceUsername, destUsername)
 
 	// 1. Authenticate with source vault
-	PrintProgressStep(1, 5, "Authenticating with source vault...")
+	PrintProgressStep(1, 4, "Authenticating with source vault...")
 	sourceSession, err := FetchSessionStateless(sourceUsername, sourcePassword)
 	if err != nil {
 		return fmt.Errorf("failed to authenticate with source vault: %w", err)
 	}
 	PrintCompletionLine("Source vault authenticated")
 
-	// 2. Fetch destination vault SSH key (to push with)
-	PrintProgressStep(2, 5, "Fetching destination vault key...")
-	encryptedDestKey, err := FetchRaw(destUsername, ".config/key")
+	// 2. Authenticate with destination vault; its index is merged into, not replaced
+	PrintProgressStep(2, 4, "Authenticating with destination vault...")
+	destSession, err := FetchSessionStateless(destUsername, destPassword)
 	if err != nil {
-		return fmt.Errorf("destination vault not found: %w", err)
-	}
-	destRawKey, err := Decrypt(encryptedDestKey, destPassword)
-	if err != nil {
-		return fmt.Errorf("failed to decrypt destination vault key (invalid password): %w", err)
+		return fmt.Errorf("destination vault: %w", err)
 	}
 	PrintCompletionLine("Destination vault authenticated")
 
-	// 3. Prepare destination index and collect files to transfer
-	PrintProgressStep(3, 5, "Scanning source vault...")
-	destIndex := NewIndex()
-	filesToTransfer := make(map[string][]byte)
-	fileCount := 0
-
-	// Walk through source vault and collect all files
-	err = transferFilesRecursive(sourceSession, destIndex, filesToTransfer, sourceSession.Index, "", &fileCount, sourcePassword, destPassword)
+	// 3. Collect the source files and drop those a previous run already pushed
+	PrintProgressStep(3, 4, "Scanning source vault...")
+	matches, err := sourceSession.Index.FilesBelow(opts.Path)
 	if err != nil {
-		return fmt.Errorf("failed to process files: %w", err)
+		return fmt.Errorf("source vault: %w", err)
+	}
+	files := make([]transferFile, 0, len(matches))
+	for _, m := range matches {
+		files = append(files, transferFile{path: m.Path, entry: m.Entry})
+	}
+
+	checkpoint, resumed := loadTransferCheckpoint(sourceUsername, destUsername, opts)
+	done := make(map[string]bool, len(checkpoint.Done))
+	for _, h := range checkpoint.Done {
+		done[h] = true
+	}
+	total := len(files)
+	files = slices.DeleteFunc(files, func(f transferFile) bool { return done[transferPathHash(f.path)] })
+	PrintCompletionLine(fmt.Sprintf("Found %d files", total))
+	if resumed {
+		fmt.Printf("Resuming previous transfer: %d of %d files already transferred\n", total-len(files), total)
 	}
-	PrintCompletionLine(fmt.Sprintf("Found %d files to transfer", fileCount))
 
-	if fileCount == 0 {
+	if total == 0 && !opts.Settings {
 		return fmt.Errorf("no files found in source vault")
 	}
 
-	// 4. Encrypt destination index with destination password
-	PrintProgressStep(4, 5, "Preparing transfer package...")
-	destIndexBytes, err := destIndex.ToBytes(destPassword)
+	t := &vaultTransfer{
+		source:       sourceSession,
+		dest:         destSession,
+		opts:         opts,
+		checkpoint:   checkpoint,
+		failures:     &FileErrors{Total: len(files)},
+		pushSettings: opts.Settings,
+	}
+	shares := t.sharesToTransfer()
+	if err := t.checkShares(shares, done); err != nil {
+		return err
+	}
+
+	// 4. Re-encrypt and push batch by batch
+	PrintProgressStep(4, 4, "Transferring files to destination vault...\n")
+	if opts.Settings {
+		// The destination's new objects and commits follow the copied settings too
+		destSession.Settings = sourceSession.Settings
+	}
+	if err := t.run(files); err != nil {
+		return fmt.Errorf("%w\nProgress is saved; run the same command again to resume", err)
+	}
+
+	fmt.Printf("Transferred %d of %d files (%d renamed, %d skipped, %d failed, %d done by an earlier run)\n",
+		t.transferred, total, t.renamed, t.skipped, len(t.failures.Errors), total-len(files))
+	if len(t.failures.Errors) > 0 {
+		// The checkpoint stays, so running the transfer again only retries these
+		// and then moves the shares
+		if len(shares) > 0 {
+			fmt.Printf("%d share(s) will be moved once every file has been transferred\n", len(shares))
+		}
+		return t.failures
+	}
+	if err := t.pushShares(shares); err != nil {
+		return fmt.Errorf("%w\nProgress is saved; run the same command again to resume", err)
+	}
+	if t.shares > 0 {
+		fmt.Printf("Moved %d share(s); their links now name %s, see 'zep shared ls' there. Links to %s keep working until revoked there\n", t.shares, destUsername, sourceUsername)
+	}
+	removeTransferCheckpoint(sourceUsername, destUsername)
+	fmt.Printf("✔ Successfully transferred files from %s to %s\n", sourceUsername, destUsername)
+	return nil
+}
+
+// transferFile is one file of a vault transfer, re-encrypted for the destination
+type transferFile struct {
+	path      string
+	entry     Entry
+	target    string   // Path in the destination vault
+	replaced  *Entry   // Destination file overwritten, if any
+	keyHex    string   // New file key, wrapped with the destination KEK
+	storageID string   // Single-blob object, or first chunk
+	chunkIDs  []string // Chunked files only
+	staged    []string // New encrypted objects handed to the upload batch
+}
+
+// vaultTransfer is the state of a running TransferVault
+type vaultTransfer struct {
+	source       *Session
+	dest         *Session
+	opts         TransferOptions
+	checkpoint   *transferCheckpoint
+	failures     *FileErrors
+	pushSettings bool // Settings not pushed yet
+
+	mu    sync.Mutex   // Guards batch and the destination session while workers stage objects
+	batch *uploadBatch // Objects of the batch being transferred
+
+	transferred, skipped, renamed, shares int
+}
+
+// run plans each file against the destination index and pushes the files to
+// transfer in batches. A file that fails does not stop the others; it is added
+// to t.failures and retried by the next run. A failed push stops the transfer.
+func (t *vaultTransfer) run(files []transferFile) error {
+	// Derive both key-encryption keys and open both backends once, before the
+	// workers share the sessions
+	for _, session := range []*Session{t.source, t.dest} {
+		if _, err := session.kek(); err != nil {
+			return err
+		}
+		if _, err := session.Backend(); err != nil {
+			return err
+		}
+	}
+
+	var batch []transferFile
+	var batchBytes int64
+	targets := make(map[string]bool) // Destination paths claimed by the batch
+	for _, file := range files {
+		skip, err := t.plan(&file, targets)
+		if err != nil {
+			fmt.Printf("✗ Cannot transfer %s: %v\n", file.path, err)
+			t.failures.Errors = append(t.failures.Errors, fmt.Errorf("%s: %w", file.path, err))
+			continue
+		}
+		if skip != "" {
+			fmt.Printf("Skipping %s (%s)\n", file.path, skip)
+			t.skipped++
+			continue
+		}
+		targets[file.target] = true
+		batch = append(batch, file)
+		batchBytes += file.entry.Size
+		if len(batch) >= transferBatchFiles || batchBytes >= transferBatchBytes {
+			if err := t.push(batch); err != nil {
+				return err
+			}
+			batch, batchBytes = nil, 0
+			clear(targets)
+		}
+	}
+	if len(batch) > 0 || t.pushSettings {
+		return t.push(batch)
+	}
+	return nil
+}
+
+// plan decides where file goes in the destination under the conflict policy,
+// setting file.target (and file.replaced when overwriting). It returns why the
+// file is skipped, or "" when it is to be transferred.
+func (t *vaultTransfer) plan(file *transferFile, targets map[string]bool) (string, error) {
+	file.target = file.path
+	existing, blocker := destinationEntry(t.dest.Index, file.path)
+	if blocker != "" {
+		return "", fmt.Errorf("'%s' is a file in the destination vault", blocker)
+	}
+	if existing == nil && !targets[file.path] {
+		return "", nil
+	}
+
+	if sameContents(existing, file.entry) {
+		return "identical in destination", nil
+	}
+	switch t.opts.Conflict {
+	case ConflictOverwrite:
+		if existing != nil && existing.Type != "file" {
+			return "", fmt.Errorf("'%s' is a folder in the destination vault", file.path)
+		}
+		file.replaced = existing
+		return "", nil
+	case ConflictRename:
+		// A renamed copy from an earlier transfer counts as identical too
+		dir, name := path.Split(file.path)
+		ext := path.Ext(name)
+		if ext == name {
+			ext = "" // Dotfiles such as ".env"
+		}
+		stem := strings.TrimSuffix(name, ext)
+		for n := 2; ; n++ {
+			candidate := fmt.Sprintf("%s%s (%d)%s", dir, stem, n, ext)
+			existing, _ := destinationEntry(t.dest.Index, candidate)
+			if sameContents(existing, file.entry) {
+				return "identical copy at " + candidate, nil
+			}
+			if existing == nil && !targets[candidate] {
+				file.target = candidate
+				return "", nil
+			}
+		}
+	default:
+		return "exists in destination", nil
+	}
+}
+
+// sameContents reports whether existing is a file with the same recorded
+// contents as entry
+func sameContents(existing *Entry, entry Entry) bool {
+	return existing != nil && existing.Type == "file" && existing.HasMetadata() && existing.SHA256 == entry.SHA256
+}
+
+// push re-encrypts a batch and commits the updated destination index (and
+// settings, the first time), then records the batch in the checkpoint. The
+// workers stream their objects into an upload batch that pushes them early
+// once enough are pending; the index never refers to an object that was not
+// pushed with it or before it.
+func (t *vaultTransfer) push(batch []transferFile) error {
+	hashByteLength := t.dest.Settings.FileHashLength / 2
+	t.batch = newUploadBatch(t.dest)
+	var deletes []string
+	var pushed []string
+
+	err := runJobs(len(batch), t.opts.Jobs, func(i int) error {
+		return batch[i].reencrypt(t.source, t.dest, hashByteLength, t.stage)
+	}, func(i int, err error) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		file := &batch[i]
+		fmt.Printf("Transferring file (%d/%d): %s\n", i+1, len(batch), file.path)
+		if err != nil {
+			fmt.Printf("  ✗ Failed: %v\n", err)
+			t.batch.drop(file.staged)
+			return
+		}
+		entry := Entry{Type: "file", RealName: file.storageID, FileKey: file.keyHex, Chunks: file.chunkIDs, FileMetadata: file.entry.FileMetadata}
+		if err := t.dest.Index.PutEntry(file.target, entry); err != nil {
+			fmt.Printf("  ✗ Failed: %v\n", err)
+			t.batch.drop(file.staged)
+			return
+		}
+		if file.replaced != nil {
+			deletes = append(deletes, file.replaced.StorageIDs()...)
+		}
+		pushed = append(pushed, file.path)
+		if file.target != file.path {
+			t.renamed++
+			fmt.Printf("  → Transferred as: %s (%s)\n", file.target, file.storageID)
+		} else {
+			fmt.Printf("  → Transferred: %s (%s)\n", file.target, file.storageID)
+		}
+	})
+	var fileErrors *FileErrors
+	if err != nil && !errors.As(err, &fileErrors) {
+		return err
+	}
+	if fileErrors != nil {
+		t.failures.Errors = append(t.failures.Errors, fileErrors.Errors...)
+	}
+	// An early push has to be committed even if every file failed, to remove
+	// its pending upload manifest
+	if len(pushed) == 0 && !t.pushSettings && t.batch.manifest == "" {
+		return nil
+	}
+
+	// Overwritten objects still used by a copy elsewhere in the vault are kept
+	t.batch.deletes = t.dest.Index.Unreferenced(deletes)
+	indexBytes, err := t.dest.Index.ToBytes(t.dest.Password)
 	if err != nil {
 		return fmt.Errorf("failed to encrypt destination index: %w", err)
 	}
-	filesToTransfer[".config/index"] = destIndexBytes
-	PrintCompletionLine("Transfer package ready")
+	if t.pushSettings {
+		settingsBytes, err := t.dest.Settings.ToBytes(t.dest.Password)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt settings: %w", err)
+		}
+		t.batch.files[".config/settings"] = settingsBytes
+	}
 
-	// 5. Push all files to destination vault
-	PrintProgressStep(5, 5, "Uploading files to destination vault...")
-	err = PushFilesWithAuthor(destRepoURL, destRawKey, filesToTransfer, "Zephyrus: Vault Transfer", "Zephyrus", "auchrio@proton.me")
-	if err != nil {
+	if len(pushed) > 0 {
+		fmt.Printf("Uploading %d files to destination vault...\n", len(pushed))
+	} else {
+		fmt.Println("Uploading settings to destination vault...")
+	}
+	if err := t.batch.commit(indexBytes); err != nil {
 		return fmt.Errorf("failed to upload to destination vault: %w", err)
 	}
-	PrintCompletionLine("Upload complete")
+	PrintCompletionLine("Batch uploaded")
+	t.pushSettings = false
+	t.transferred += len(pushed)
 
-	fmt.Printf("✔ Successfully transferred %d files from %s to %s\n", fileCount, sourceUsername, destUsername)
+	for _, p := range pushed {
+		t.checkpoint.Done = append(t.checkpoint.Done, transferPathHash(p))
+	}
+	if err := t.checkpoint.save(); err != nil {
+		fmt.Printf("⚠️  Could not save transfer checkpoint: %v\n", err)
+	}
 	return nil
 }
 
-// transferFilesRecursive walks through the source index and transfers files
-func transferFilesRecursive(
-	sourceSession *Session,
-	destIndex VaultIndex,
-	filesToTransfer map[string][]byte,
-	sourceEntries VaultIndex,
-	currentPath string,
-	fileCount *int,
-	sourcePassword string,
-	destPassword string,
-) error {
-	for name, entry := range sourceEntries {
-		var nextPath string
-		if currentPath == "" {
-			nextPath = name
-		} else {
-			nextPath = currentPath + "/" + name
-		}
+// stage hands a re-encrypted object to the upload batch. Workers call it
+// concurrently; a flush it triggers holds up the others until it is pushed.
+func (t *vaultTransfer) stage(storageID string, data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.batch.add(storageID, data)
+}
 
-		if entry.Type == "file" {
-			*fileCount++
-			fmt.Printf("Transferring file (%d): %s\n", *fileCount, nextPath)
+// sharesToTransfer returns the source vault's shares of files and folders
+// inside opts.Path. Expired shares and shares of paths no longer in the source
+// vault are left behind.
+func (t *vaultTransfer) sharesToTransfer() []SharedFileEntry {
+	if t.source.SharedIndex == nil {
+		return nil
+	}
+	var shares []SharedFileEntry
+	for _, share := range t.source.SharedIndex.ListEntries() {
+		sharedPath := strings.Trim(share.OriginalPath, "/")
+		if t.opts.Path != "" && sharedPath != t.opts.Path && !strings.HasPrefix(sharedPath, t.opts.Path+"/") {
+			continue
+		}
+		if share.Expired() {
+			fmt.Printf("Not moving share %s of %s: it has expired\n", share.Reference, sharedPath)
+			continue
+		}
+		if _, err := t.source.Index.FindEntry(sharedPath); err != nil {
+			fmt.Printf("Not moving share %s: %s is no longer in the source vault\n", share.Reference, sharedPath)
+			continue
+		}
+		shares = append(shares, share)
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].OriginalPath < shares[j].OriginalPath })
+	return shares
+}
 
-			// 1. Fetch encrypted file from source
-			encryptedFileData, err := FetchRaw(sourceSession.Username, entry.RealName)
-			if err != nil {
-				return fmt.Errorf("failed to fetch file %s: %w", nextPath, err)
+// checkShares makes sure every file below each share ends up at the same path
+// in the destination with the source's contents, and that a shared folder has
+// no other files there, so the moved share serves what the original did and
+// nothing more. done holds the files an earlier run transferred.
+func (t *vaultTransfer) checkShares(shares []SharedFileEntry, done map[string]bool) error {
+	for _, share := range shares {
+		matches, err := t.source.Index.FilesBelow(share.OriginalPath)
+		if err != nil {
+			return fmt.Errorf("share %s: %w", share.Reference, err)
+		}
+		sourcePaths := make(map[string]bool, len(matches))
+		for _, m := range matches {
+			sourcePaths[m.Path] = true
+		}
+		if destMatches, err := t.dest.Index.FilesBelow(share.OriginalPath); err == nil {
+			for _, m := range destMatches {
+				if !sourcePaths[m.Path] {
+					return fmt.Errorf("share %s of '%s' cannot be moved: the destination vault's '%s' would be shared too. Nothing was transferred; revoke the share first", share.Reference, share.OriginalPath, m.Path)
+				}
+			}
+		}
+		for _, m := range matches {
+			existing, _ := destinationEntry(t.dest.Index, m.Path)
+			if done[transferPathHash(m.Path)] {
+				if existing == nil || existing.Type != "file" {
+					return fmt.Errorf("share %s of '%s' cannot be moved: '%s' is missing from the destination vault", share.Reference, share.OriginalPath, m.Path)
+				}
+				continue
 			}
 
-			// 2. Decrypt file key with source password
-			encryptedKey, err := hex.DecodeString(entry.FileKey)
-			if err != nil {
-				return fmt.Errorf("invalid file key for %s: %w", nextPath, err)
+			file := transferFile{path: m.Path, entry: m.Entry}
+			skip, err := t.plan(&file, map[string]bool{})
+			var problem string
+			switch {
+			case err != nil:
+				problem = err.Error()
+			case file.target != file.path:
+				problem = fmt.Sprintf("'%s' would be transferred as '%s'", m.Path, file.target)
+			case skip != "" && !sameContents(existing, m.Entry):
+				problem = fmt.Sprintf("'%s' would keep the destination's version (%s)", m.Path, skip)
 			}
-			fileKey, err := Decrypt(encryptedKey, sourcePassword)
-			if err != nil {
-				return fmt.Errorf("failed to decrypt file key for %s: %w", nextPath, err)
+			if problem != "" {
+				return fmt.Errorf("share %s of '%s' cannot be moved: %s. Nothing was transferred; use --on-conflict overwrite, or revoke the share first", share.Reference, share.OriginalPath, problem)
 			}
+		}
+	}
+	return nil
+}
 
-			// 3. Decrypt file data with the file key
-			decryptedFileData, err := DecryptWithKey(encryptedFileData, fileKey)
+// pushShares recreates the shares in the destination vault in one commit.
+// Pointers are rebuilt for the destination's objects and file keys; each share
+// keeps its password, and its reference unless the destination already uses
+// it. Shares sealed to another user are sealed to them again from the
+// destination's outbox.
+func (t *vaultTransfer) pushShares(shares []SharedFileEntry) error {
+	if len(shares) == 0 {
+		return nil
+	}
+	if t.dest.SharedIndex == nil {
+		t.dest.SharedIndex = NewSharedIndex()
+	}
+	added := t.dest.SharedIndex.ListEntries()
+	filesToPush := make(map[string][]byte)
+	var moved []string
+
+	for _, share := range shares {
+		// Share passwords are random, so a match is the same share moved by
+		// an earlier run whose checkpoint was not removed
+		if slices.ContainsFunc(added, func(e SharedFileEntry) bool {
+			return e.Password == share.Password && e.OriginalPath == share.OriginalPath
+		}) {
+			continue
+		}
+		if _, taken := t.dest.SharedIndex.Files[share.Reference]; taken {
+			ref, err := GenerateShareReferenceWithLength(t.dest.Settings.ShareHashLength)
 			if err != nil {
-				return fmt.Errorf("failed to decrypt file data for %s: %w", nextPath, err)
+				return fmt.Errorf("failed to generate share reference: %w", err)
 			}
+			fmt.Printf("Share reference %s is taken in %s; %s is shared there as %s\n", share.Reference, t.dest.Username, share.OriginalPath, ref)
+			share.Reference = ref
+		}
 
-			// 4. Generate new storage name and file key for destination
-			hashByteLength := sourceSession.Settings.FileHashLength / 2
-			newStorageName := GenerateRandomNameWithLength(hashByteLength)
-			newFileKey := GenerateFileKey()
+		entry, err := t.dest.Index.FindEntry(share.OriginalPath)
+		if err != nil {
+			return fmt.Errorf("share %s: %w", share.Reference, err)
+		}
+		pointer, err := buildSharePointer(share.OriginalPath, entry, t.dest, share.ExpiresAt)
+		if err != nil {
+			return fmt.Errorf("share %s: %w", share.Reference, err)
+		}
+		pointerEncrypted, err := pointer.encrypt(share.Password)
+		if err != nil {
+			return err
+		}
+		filesToPush["shared/"+share.Reference] = pointerEncrypted
 
-			// 5. Encrypt new file key with destination password
-			newEncryptedKey, err := Encrypt(newFileKey, destPassword)
+		if share.Recipient != "" {
+			recipientPub, err := FetchPublicKey(share.Recipient)
 			if err != nil {
-				return fmt.Errorf("failed to encrypt new file key for %s: %w", nextPath, err)
+				return fmt.Errorf("share %s for %s: %w", share.Reference, share.Recipient, err)
 			}
-			newEncryptedKeyHex := hex.EncodeToString(newEncryptedKey)
-
-			// 6. Encrypt file data with new file key
-			newEncryptedFileData, err := EncryptWithKey(decryptedFileData, newFileKey)
-			if err != nil {
-				return fmt.Errorf("failed to re-encrypt file data for %s: %w", nextPath, err)
+			msg := inboxMessage{
+				Reference: share.Reference,
+				Password:  share.Password,
+				Name:      path.Base(share.OriginalPath),
+				SharedAt:  share.SharedAt.UTC(),
+				ExpiresAt: share.ExpiresAt,
+			}
+			if err := stageOutboxMessage(share.Recipient, recipientPub, msg, t.dest, filesToPush); err != nil {
+				return err
 			}
+		}
 
-			// 7. Add to destination index
-			destIndex.AddFile(nextPath, newStorageName, newEncryptedKeyHex)
+		t.dest.SharedIndex.AddEntry(share)
+		moved = append(moved, share.Reference)
+	}
+	if len(moved) == 0 {
+		return nil
+	}
 
-			// 8. Collect encrypted file for transfer
-			filesToTransfer[newStorageName] = newEncryptedFileData
-			fmt.Printf("  → Transferred: %s (%s)\n", nextPath, newStorageName)
+	indexJSON, err := t.dest.SharedIndex.EncryptForRemote(t.dest.Password)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt shared index: %w", err)
+	}
+	filesToPush["shared/.config/index"] = indexJSON
 
-		} else if entry.Type == "folder" && entry.Contents != nil {
-			// Recurse into subdirectories
-			err := transferFilesRecursive(sourceSession, destIndex, filesToTransfer, entry.Contents, nextPath, fileCount, sourcePassword, destPassword)
-			if err != nil {
-				return err
-			}
+	fmt.Printf("Moving %d share(s) to destination vault...\n", len(moved))
+	if err := t.dest.Push(filesToPush, nil); err != nil {
+		for _, ref := range moved {
+			t.dest.SharedIndex.RemoveEntry(ref)
 		}
+		return fmt.Errorf("failed to move shares: %w", err)
 	}
+	PrintCompletionLine("Shares moved")
+	t.shares = len(moved)
 	return nil
 }
+
+// destinationEntry returns the entry at vaultPath in index (nil if missing),
+// or the path of a file that sits where one of its parent folders should be
+func destinationEntry(index VaultIndex, vaultPath string) (*Entry, string) {
+	parts := strings.Split(vaultPath, "/")
+	currentMap := index
+	for i, part := range parts {
+		entry, exists := currentMap[part]
+		if !exists {
+			return nil, ""
+		}
+		if i == len(parts)-1 {
+			return &entry, ""
+		}
+		if entry.Type != "folder" {
+			return nil, strings.Join(parts[:i+1], "/")
+		}
+		currentMap = entry.Contents
+	}
+	return nil, ""
+}
+
+// reencrypt decrypts the file from the source vault and encrypts it with a new
+// file key for the destination, keeping the source's chunking. Each new object
+// is handed to stage as soon as it is sealed.
+func (f *transferFile) reencrypt(sourceSession *Session, destSession *Session, hashByteLength int, stage func(storageID string, data []byte) error) error {
+	// 1. Unwrap the file key in the source vault
+	fileKey, err := sourceSession.UnwrapFileKey(f.entry.FileKey)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt file key for %s: %w", f.path, err)
+	}
+
+	// 2. Fetch the encrypted file from source and decrypt it with the file key
+	reader, err := NewEntryReader(&f.entry, fileKey, sourceSession.Fetch)
+	if err != nil {
+		return fmt.Errorf("failed to fetch file %s: %w", f.path, err)
+	}
+
+	// 3. Generate new file key for destination
+	newFileKey := GenerateFileKey()
+
+	// 4. Wrap the new file key with the destination vault's key-encryption key
+	f.keyHex, err = destSession.WrapFileKey(newFileKey)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt new file key for %s: %w", f.path, err)
+	}
+
+	// 5. Re-encrypt file data with new file key
+	if f.entry.IsChunked() {
+		writer, err := NewChunkWriter(newFileKey, func(index int, sealed []byte) error {
+			id := GenerateRandomNameWithLength(hashByteLength)
+			f.chunkIDs = append(f.chunkIDs, id)
+			f.staged = append(f.staged, id)
+			return stage(id, sealed)
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(writer, reader); err != nil {
+			return fmt.Errorf("failed to re-encrypt file data for %s: %w", f.path, err)
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		f.storageID = f.chunkIDs[0]
+		return nil
+	}
+
+	decryptedFileData, err := io.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt file data for %s: %w", f.path, err)
+	}
+	newEncryptedFileData, err := EncryptWithKey(decryptedFileData, newFileKey)
+	if err != nil {
+		return fmt.Errorf("failed to re-encrypt file data for %s: %w", f.path, err)
+	}
+	f.storageID = GenerateRandomNameWithLength(hashByteLength)
+	f.staged = append(f.staged, f.storageID)
+	return stage(f.storageID, newEncryptedFileData)
+}
+
+// transferCheckpoint is the progress of a transfer, kept in the config
+// directory until the transfer completes. Paths are stored hashed so the
+// checkpoint does not reveal file names.
+type transferCheckpoint struct {
+	Source   string    `json:"source"`
+	Dest     string    `json:"dest"`
+	Backend  string    `json:"backend,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Conflict string    `json:"conflict"`
+	Started  time.Time `json:"started"`
+	Done     []string  `json:"done"` // transferPathHash of each source file pushed
+}
+
+// transferCheckpointPath returns where the checkpoint of a transfer from
+// source to dest is kept
+func transferCheckpointPath(source string, dest string) (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("transfer-%s-%s.json", source, dest)
+	return filepath.Join(dir, strings.ReplaceAll(name, "/", "_")), nil
+}
+
+// transferPathHash identifies a source path in the checkpoint
+func transferPathHash(vaultPath string) string {
+	sum := sha256.Sum256([]byte(vaultPath))
+	return hex.EncodeToString(sum[:16])
+}
+
+// loadTransferCheckpoint returns the checkpoint of an unfinished transfer with
+// the same vaults, backend and options, or a new one. The bool reports
+// whether a previous transfer is being resumed.
+func loadTransferCheckpoint(source string, dest string, opts TransferOptions) (*transferCheckpoint, bool) {
+	fresh := &transferCheckpoint{
+		Source:   source,
+		Dest:     dest,
+		Backend:  ActiveBackendSpec(),
+		Path:     opts.Path,
+		Conflict: opts.Conflict,
+		Started:  time.Now().UTC(),
+	}
+	checkpointPath, err := transferCheckpointPath(source, dest)
+	if err != nil {
+		return fresh, false
+	}
+	data, err := os.ReadFile(checkpointPath)
+	if err != nil {
+		return fresh, false
+	}
+	var saved transferCheckpoint
+	if json.Unmarshal(data, &saved) != nil || saved.Source != source || saved.Dest != dest ||
+		saved.Backend != fresh.Backend || saved.Path != fresh.Path || saved.Conflict != fresh.Conflict {
+		fmt.Println("⚠️  Ignoring checkpoint of an earlier transfer with different options")
+		return fresh, false
+	}
+	return &saved, len(saved.Done) > 0
+}
+
+// save writes the checkpoint atomically
+func (c *transferCheckpoint) save() error {
+	if dryRun {
+		return nil // Nothing was transferred
+	}
+	checkpointPath, err := transferCheckpointPath(c.Source, c.Dest)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(checkpointPath), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := checkpointPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, checkpointPath)
+}
+
+// removeTransferCheckpoint deletes the checkpoint of a finished transfer
+func removeTransferCheckpoint(source string, dest string) {
+	if dryRun {
+		return
+	}
+	if checkpointPath, err := transferCheckpointPath(source, dest); err == nil {
+		os.Remove(checkpointPath)
+	}
+}
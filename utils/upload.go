@@ -1,68 +1,50 @@
 package utils
 
 import (
-	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
-	"time"
 )
 
 func UploadFile(sourcePath string, vaultPath string, session *Session) error {
-	repoURL := fmt.Sprintf("git@github.com:%s/.zephyrus.git", session.Username)
-
-	// 1. Read source
+	// 1. Check source
 	PrintProgressStep(1, 5, "Reading file...")
-	data, err := os.ReadFile(sourcePath)
+	info, err := os.Stat(sourcePath)
 	if err != nil {
 		return err
 	}
-	PrintCompletionLine("File read successfully")
+	if info.IsDir() {
+		return fmt.Errorf("path is a directory: %s", sourcePath)
+	}
+	PrintCompletionLine(fmt.Sprintf("File read successfully (%d bytes)", info.Size()))
 
-	// 2. Determine Storage Name and File Key
+	// 2. Determine File Key
 	PrintProgressStep(2, 5, "Validating vault...")
-	var realName string
-	var fileKey []byte
-
-	entry, err := session.Index.FindEntry(vaultPath)
-	if err == nil && entry.Type == "file" {
-		// Existing file: reuse storage name, decrypt existing key
-		realName = entry.RealName
-		fmt.Printf("Updating existing file: %s (%s)\n", vaultPath, realName)
-
-		// Decrypt the existing file key
-		encryptedKey, _ := hex.DecodeString(entry.FileKey)
-		fileKey, err = Decrypt(encryptedKey, session.Password)
-		if err != nil {
-			return fmt.Errorf("failed to decrypt file key: %w", err)
-		}
+	// Existing files keep their key; new files get a new one
+	previous, fileKey, encryptedKeyHex, err := fileKeyFor(vaultPath, session)
+	if err != nil {
+		return err
+	}
+	if previous != nil {
+		fmt.Printf("Updating existing file: %s (%s)\n", vaultPath, previous.RealName)
 	} else {
-		// New file: generate new storage name and file key
-		// Use configurable hash length from settings
-		hashByteLength := session.Settings.FileHashLength / 2 // Convert hex chars to bytes
-		realName = GenerateRandomNameWithLength(hashByteLength)
-		fileKey = GenerateFileKey()
-
-		// Encrypt the file key with the vault password
-		encryptedKey, err := Encrypt(fileKey, session.Password)
-		if err != nil {
-			return fmt.Errorf("failed to encrypt file key: %w", err)
-		}
-		encryptedKeyHex := hex.EncodeToString(encryptedKey)
-
-		session.Index.AddFile(vaultPath, realName, encryptedKeyHex)
-		fmt.Printf("Uploading new file: %s as %s\n", vaultPath, realName)
+		fmt.Printf("Uploading new file: %s\n", vaultPath)
 	}
 	PrintCompletionLine("File validated")
 
-	// 3. Encrypt file data with the per-file key
+	// 3. Encrypt file data with the per-file key (large files are streamed in chunks)
 	PrintProgressStep(3, 5, "Encrypting file...")
-	time.Sleep(time.Millisecond * 100) // Simulate work for visibility
-	encryptedData, err := EncryptWithKey(data, fileKey)
+	batch := newUploadBatch(session)
+	err = stageFile(sourcePath, vaultPath, fileKey, encryptedKeyHex, previous, session, batch)
 	if err != nil {
 		return err
 	}
-	PrintCompletionLine("File encrypted")
+	updated, _ := session.Index.FindEntry(vaultPath)
+	if updated.IsChunked() {
+		PrintCompletionLine(fmt.Sprintf("File encrypted into %d chunks", len(updated.Chunks)))
+	} else {
+		PrintCompletionLine("File encrypted as " + updated.RealName)
+	}
 
 	// 4. Encrypt updated index
 	PrintProgressStep(4, 5, "Updating vault index...")
@@ -72,18 +54,13 @@ func UploadFile(sourcePath string, vaultPath string, session *Session) error {
 	}
 	PrintCompletionLine("Vault index updated")
 
-	// 5. Push to Git
-	PrintProgressStep(5, 5, "Uploading to GitHub...")
-	filesToPush := map[string][]byte{
-		realName:        encryptedData,
-		".config/index": indexBytes,
-	}
-
-	err = PushFilesWithAuthor(repoURL, session.RawKey, filesToPush, session.Settings.CommitMessage, session.Settings.CommitAuthorName, session.Settings.CommitAuthorEmail)
+	// 5. Push to the vault backend
+	PrintProgressStep(5, 5, "Uploading to vault...")
+	err = batch.commit(indexBytes)
 	if err != nil {
 		return err
 	}
-	PrintCompletionLine("Upload to GitHub completed")
+	PrintCompletionLine("Upload to vault completed")
 
 	// 6. Save updated index to local session to bypass cache
 	return nil
@@ -91,8 +68,6 @@ func UploadFile(sourcePath string, vaultPath string, session *Session) error {
 
 // UploadDirectory uploads an entire directory recursively to the vault
 func UploadDirectory(sourceDirPath string, vaultPath string, session *Session) error {
-	repoURL := fmt.Sprintf("git@github.com:%s/.zephyrus.git", session.Username)
-
 	// 1. Verify directory exists
 	fileInfo, err := os.Stat(sourceDirPath)
 	if err != nil {
@@ -102,7 +77,7 @@ func UploadDirectory(sourceDirPath string, vaultPath string, session *Session) e
 		return fmt.Errorf("path is not a directory: %s", sourceDirPath)
 	}
 
-	filesToPush := make(map[string][]byte)
+	batch := newUploadBatch(session)
 	fileCount := 0
 
 	fmt.Printf("Scanning directory: %s\n", sourceDirPath)
@@ -129,53 +104,22 @@ func UploadDirectory(sourceDirPath string, vaultPath string, session *Session) e
 
 		fmt.Printf("Processing file (%d): %s\n", fileCount+1, relPath)
 
-		// 3. Read source file
-		data, err := os.ReadFile(filePath)
+		// 3. Determine File Key
+		previous, fileKey, encryptedKeyHex, err := fileKeyFor(currentVaultPath, session)
 		if err != nil {
 			return err
 		}
-
-		// 4. Determine Storage Name and File Key
-		var realName string
-		var fileKey []byte
-
-		entry, err := session.Index.FindEntry(currentVaultPath)
-		if err == nil && entry.Type == "file" {
-			// Existing file: reuse storage name, decrypt existing key
-			realName = entry.RealName
-			fmt.Printf("  → Updating: %s (%s)\n", currentVaultPath, realName)
-
-			// Decrypt the existing file key
-			encryptedKey, _ := hex.DecodeString(entry.FileKey)
-			fileKey, err = Decrypt(encryptedKey, session.Password)
-			if err != nil {
-				return fmt.Errorf("failed to decrypt file key for %s: %w", currentVaultPath, err)
-			}
+		if previous != nil {
+			fmt.Printf("  → Updating: %s (%s)\n", currentVaultPath, previous.RealName)
 		} else {
-			// New file: generate new storage name and file key
-			hashByteLength := session.Settings.FileHashLength / 2
-			realName = GenerateRandomNameWithLength(hashByteLength)
-			fileKey = GenerateFileKey()
-
-			// Encrypt the file key with the vault password
-			encryptedKey, err := Encrypt(fileKey, session.Password)
-			if err != nil {
-				return fmt.Errorf("failed to encrypt file key for %s: %w", currentVaultPath, err)
-			}
-			encryptedKeyHex := hex.EncodeToString(encryptedKey)
-
-			session.Index.AddFile(currentVaultPath, realName, encryptedKeyHex)
-			fmt.Printf("  → New file: %s as %s\n", currentVaultPath, realName)
+			fmt.Printf("  → New file: %s\n", currentVaultPath)
 		}
 
-		// 5. Encrypt file data with the per-file key
-		encryptedData, err := EncryptWithKey(data, fileKey)
+		// 4. Encrypt file data with the per-file key and collect it for the batch push
+		err = stageFile(filePath, currentVaultPath, fileKey, encryptedKeyHex, previous, session, batch)
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to encrypt %s: %w", currentVaultPath, err)
 		}
-
-		// Collect encrypted file for batch push
-		filesToPush[realName] = encryptedData
 		fileCount++
 
 		return nil
@@ -191,7 +135,7 @@ func UploadDirectory(sourceDirPath string, vaultPath string, session *Session) e
 
 	fmt.Printf("\nUploading %d files to vault...\n", fileCount)
 
-	// 6. Encrypt updated index
+	// 5. Encrypt updated index
 	PrintProgressStep(1, 2, "Encrypting vault index...")
 	indexBytes, err := session.Index.ToBytes(session.Password)
 	if err != nil {
@@ -199,17 +143,41 @@ func UploadDirectory(sourceDirPath string, vaultPath string, session *Session) e
 	}
 	PrintCompletionLine("Vault index updated")
 
-	// 7. Add index to push
-	filesToPush[".config/index"] = indexBytes
-
-	// 8. Push all files to Git in a single operation
-	PrintProgressStep(2, 2, "Uploading to GitHub...")
-	err = PushFilesWithAuthor(repoURL, session.RawKey, filesToPush, session.Settings.CommitMessage, session.Settings.CommitAuthorName, session.Settings.CommitAuthorEmail)
+	// 6. Push remaining files and the index to the vault in a single commit
+	PrintProgressStep(2, 2, "Uploading to vault...")
+	err = batch.commit(indexBytes)
 	if err != nil {
 		return err
 	}
-	PrintCompletionLine("Upload to GitHub completed")
+	PrintCompletionLine("Upload to vault completed")
 
 	fmt.Printf("✔ Successfully uploaded %d files from directory\n", fileCount)
 	return nil
 }
+
+// fileKeyFor returns the key to encrypt vaultPath with: the existing file's key
+// when the path is already a file (returned as previous), or a new key. A key
+// still encrypted with the vault password is re-wrapped with the KEK on the way.
+func fileKeyFor(vaultPath string, session *Session) (previous *Entry, fileKey []byte, encryptedKeyHex string, err error) {
+	entry, err := session.Index.FindEntry(vaultPath)
+	if err == nil && entry.Type == "file" {
+		fileKey, err = session.UnwrapFileKey(entry.FileKey)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("failed to decrypt file key for %s: %w", vaultPath, err)
+		}
+		encryptedKeyHex = entry.FileKey
+		if !IsKEKWrapped(encryptedKeyHex) {
+			if encryptedKeyHex, err = session.WrapFileKey(fileKey); err != nil {
+				return nil, nil, "", fmt.Errorf("failed to wrap file key for %s: %w", vaultPath, err)
+			}
+		}
+		return entry, fileKey, encryptedKeyHex, nil
+	}
+
+	fileKey = GenerateFileKey()
+	encryptedKeyHex, err = session.WrapFileKey(fileKey)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to wrap file key for %s: %w", vaultPath, err)
+	}
+	return nil, fileKey, encryptedKeyHex, nil
+}
@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Outcomes of verifying one file
+const (
+	VerifyOK         = "ok"         // Decrypted and matched its recorded SHA-256 and size
+	VerifyUnverified = "unverified" // Decrypted and authenticated, but no checksum was recorded
+	VerifyFailed     = "failed"     // Could not be fetched, unwrapped or decrypted, or did not match
+)
+
+// VerifyResult is the outcome for one file
+type VerifyResult struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Size   int64  `json:"size"` // Plaintext bytes read
+	Error  string `json:"error,omitempty"`
+}
+
+// VerifySummary counts the outcomes of a verification
+type VerifySummary struct {
+	Files      int   `json:"files"`
+	OK         int   `json:"ok"`
+	Unverified int   `json:"unverified"`
+	Failed     int   `json:"failed"`
+	Bytes      int64 `json:"bytes"`
+}
+
+// VerifyReport is the result of VerifyVault
+type VerifyReport struct {
+	Username string         `json:"username"`
+	Path     string         `json:"path"` // Folder or file verified; "" for the whole vault
+	Head     string         `json:"head,omitempty"`
+	Started  time.Time      `json:"started"`
+	Duration float64        `json:"duration_seconds"`
+	Summary  VerifySummary  `json:"summary"`
+	Results  []VerifyResult `json:"results"`
+}
+
+// VerifyVault proves that every file below vaultPath ("" for the whole vault)
+// can still be restored: each file's objects are fetched, its key unwrapped,
+// its contents decrypted (which authenticates every block) and compared with
+// the SHA-256 and size recorded at upload. Up to jobs files are verified at
+// once; progress, if not nil, is called for each file in path order.
+func VerifyVault(vaultPath string, jobs int, progress func(i int, n int, result VerifyResult), session *Session) (*VerifyReport, error) {
+	report := &VerifyReport{
+		Username: session.Username,
+		Path:     vaultPath,
+		Head:     session.Head,
+		Started:  time.Now().UTC(),
+		Results:  []VerifyResult{},
+	}
+
+	files, err := session.Index.FilesBelow(vaultPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return report, nil
+	}
+
+	// Derive the key-encryption key and open the backend once, before the
+	// workers share the session
+	if _, err := session.kek(); err != nil {
+		return nil, err
+	}
+	if _, err := session.Backend(); err != nil {
+		return nil, err
+	}
+
+	results := make([]VerifyResult, len(files))
+	runJobs(len(files), jobs, func(i int) error {
+		results[i] = verifyFile(files[i].Path, &files[i].Entry, session, session.Fetch)
+		if results[i].Status == VerifyFailed {
+			return fmt.Errorf("%s: %s", results[i].Path, results[i].Error)
+		}
+		return nil
+	}, func(i int, err error) {
+		result := results[i]
+		report.Results = append(report.Results, result)
+		report.Summary.Files++
+		report.Summary.Bytes += result.Size
+		switch result.Status {
+		case VerifyOK:
+			report.Summary.OK++
+		case VerifyUnverified:
+			report.Summary.Unverified++
+		default:
+			report.Summary.Failed++
+		}
+		if progress != nil {
+			progress(i, len(files), result)
+		}
+	})
+
+	report.Duration = time.Since(report.Started).Seconds()
+	return report, nil
+}
+
+// PrintVerifyReport prints the outcome of VerifyVault in the given output
+// format (see output.go): a summary line for table (the per-file lines are
+// printed as progress), the whole report for json, or one result per line
+// for jsonl
+func PrintVerifyReport(report *VerifyReport, format string) error {
+	switch format {
+	case OutputJSON:
+		return writeRecord(format, report)
+	case OutputJSONL:
+		return writeRecords(format, report.Results)
+	}
+	sum := report.Summary
+	fmt.Printf("\nVerified %d files (%s) in %.1fs: %d ok, %d unverified, %d failed\n",
+		sum.Files, FormatSize(sum.Bytes), report.Duration, sum.OK, sum.Unverified, sum.Failed)
+	return nil
+}
+
+// verifyFile decrypts one file, reading its objects with fetch, and checks it
+// against its metadata
+func verifyFile(vaultPath string, entry *Entry, session *Session, fetch func(string) ([]byte, error)) VerifyResult {
+	result := VerifyResult{Path: vaultPath, Status: VerifyFailed}
+
+	fileKey, err := session.UnwrapFileKey(entry.FileKey)
+	if err != nil {
+		result.Error = fmt.Sprintf("file key does not decrypt: %v", err)
+		return result
+	}
+	reader, err := NewEntryReader(entry, fileKey, fetch)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	hash := sha256.New()
+	result.Size, err = io.Copy(hash, reader)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	if !entry.HasMetadata() {
+		result.Status = VerifyUnverified
+		return result
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != entry.SHA256 {
+		result.Error = fmt.Sprintf("checksum mismatch: expected %s, got %s", entry.SHA256, sum)
+		return result
+	}
+	if result.Size != entry.Size {
+		result.Error = fmt.Sprintf("size mismatch: expected %d bytes, got %d", entry.Size, result.Size)
+		return result
+	}
+	result.Status = VerifyOK
+	return result
+}
@@ -0,0 +1,245 @@
+package utils
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// WalkIndex calls fn for every entry below entries, depth first and in name
+// order, so paths come out sorted with each folder before its contents.
+// prefix is the vault path of entries ("" for the root). Like
+// filepath.WalkDir, returning fs.SkipDir for a folder skips its contents and
+// fs.SkipAll ends the walk; any other error, including fs.SkipDir for a
+// file, ends the walk and is returned.
+func WalkIndex(entries map[string]Entry, prefix string, fn func(vaultPath string, entry *Entry) error) error {
+	err := walkIndex(entries, prefix, fn)
+	if err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func walkIndex(entries map[string]Entry, prefix string, fn func(vaultPath string, entry *Entry) error) error {
+	for _, name := range slices.Sorted(maps.Keys(entries)) {
+		entry := entries[name]
+		vaultPath := joinVaultPath(prefix, name)
+		err := fn(vaultPath, &entry)
+		if err == fs.SkipDir && entry.Type == "folder" {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if entry.Type == "folder" {
+			if err := walkIndex(entry.Contents, vaultPath, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SearchOptions selects entries of the vault index. The zero value matches
+// every entry.
+type SearchOptions struct {
+	Pattern        string    // Substring, glob or regular expression (see Regex); empty matches every path
+	Regex          bool      // Pattern is a regular expression matched against the full path
+	Type           string    // "file" or "folder"; empty for both
+	MinSize        int64     // Only files of at least this many bytes (0: no minimum)
+	MaxSize        int64     // Only files of at most this many bytes (0: no maximum)
+	ModifiedAfter  time.Time // Only files modified at or after this time
+	ModifiedBefore time.Time // Only files modified before this time
+	Limit          int       // Stop after this many matches (0: no limit)
+}
+
+// IndexMatch is an entry found by FindEntries
+type IndexMatch struct {
+	Path  string
+	Entry Entry
+}
+
+// FindEntries returns the entries below entries (at vault path prefix) that
+// match opts, in path order. Size and date filters need file metadata:
+// folders and files uploaded before metadata was recorded never pass them.
+func FindEntries(entries map[string]Entry, prefix string, opts SearchOptions) ([]IndexMatch, error) {
+	match, err := opts.matcher()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []IndexMatch
+	err = WalkIndex(entries, prefix, func(vaultPath string, entry *Entry) error {
+		if !match(vaultPath, entry) {
+			return nil
+		}
+		matches = append(matches, IndexMatch{Path: vaultPath, Entry: *entry})
+		if opts.Limit > 0 && len(matches) >= opts.Limit {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return matches, err
+}
+
+// IndexFiles returns every file below entries (at vault path prefix) in path order
+func IndexFiles(entries map[string]Entry, prefix string) []IndexMatch {
+	var files []IndexMatch
+	WalkIndex(entries, prefix, func(vaultPath string, entry *Entry) error {
+		if entry.Type == "file" {
+			files = append(files, IndexMatch{Path: vaultPath, Entry: *entry})
+		}
+		return nil
+	})
+	return files
+}
+
+// FilesBelow returns the files at or below vaultPath in path order: every
+// file for "", the file itself for a file path, or the files in a folder
+func (vi VaultIndex) FilesBelow(vaultPath string) ([]IndexMatch, error) {
+	if vaultPath == "" {
+		return IndexFiles(vi, ""), nil
+	}
+	entry, err := vi.FindEntry(vaultPath)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' not found in vault: %w", vaultPath, err)
+	}
+	if entry.Type == "file" {
+		return []IndexMatch{{Path: vaultPath, Entry: *entry}}, nil
+	}
+	return IndexFiles(entry.Contents, vaultPath), nil
+}
+
+// filtersMetadata reports whether opts filter on size or modification time
+func (opts SearchOptions) filtersMetadata() bool {
+	return opts.MinSize > 0 || opts.MaxSize > 0 || !opts.ModifiedAfter.IsZero() || !opts.ModifiedBefore.IsZero()
+}
+
+// matcher compiles opts into a test for one entry
+func (opts SearchOptions) matcher() (func(vaultPath string, entry *Entry) bool, error) {
+	if opts.MaxSize > 0 && opts.MinSize > opts.MaxSize {
+		return nil, fmt.Errorf("minimum size %s is larger than maximum size %s", FormatSize(opts.MinSize), FormatSize(opts.MaxSize))
+	}
+
+	var pattern *regexp.Regexp
+	var err error
+	switch {
+	case opts.Pattern == "":
+	case opts.Regex:
+		if pattern, err = regexp.Compile(opts.Pattern); err != nil {
+			return nil, fmt.Errorf("invalid regular expression '%s': %w", opts.Pattern, err)
+		}
+	case isGlob(opts.Pattern):
+		if pattern, err = globRegexp(opts.Pattern); err != nil {
+			return nil, err
+		}
+	default:
+		pattern = regexp.MustCompile("(?i)" + regexp.QuoteMeta(opts.Pattern))
+	}
+
+	return func(vaultPath string, entry *Entry) bool {
+		if opts.Type != "" && entry.Type != opts.Type {
+			return false
+		}
+		if pattern != nil && !pattern.MatchString(vaultPath) {
+			return false
+		}
+		if !opts.filtersMetadata() {
+			return true
+		}
+		if entry.Type != "file" || !entry.HasMetadata() {
+			return false
+		}
+		if entry.Size < opts.MinSize || (opts.MaxSize > 0 && entry.Size > opts.MaxSize) {
+			return false
+		}
+		if !opts.ModifiedAfter.IsZero() && entry.Modified.Before(opts.ModifiedAfter) {
+			return false
+		}
+		if !opts.ModifiedBefore.IsZero() && !entry.Modified.Before(opts.ModifiedBefore) {
+			return false
+		}
+		return true
+	}, nil
+}
+
+// isGlob reports whether a search pattern uses glob syntax
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// globRegexp translates a glob into a case-insensitive regular expression for
+// full vault paths. * and ? stay within one path element, ** spans folders
+// ("**/" also matches no folder at all) and [...] is a character class ([!...]
+// negates it). A glob without a slash matches the name at any depth, so *.pdf
+// finds every PDF like **/*.pdf does.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("(?i)^")
+	if !strings.Contains(glob, "/") {
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case c == '*' && strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case c == '*' && strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end <= 0 {
+				return nil, fmt.Errorf("invalid glob '%s': unterminated [", glob)
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid glob '%s': %w", glob, err)
+	}
+	return re, nil
+}
+
+// ParseEntryType validates a --type flag value and returns the index entry type
+func ParseEntryType(value string) (string, error) {
+	switch value {
+	case "":
+		return "", nil
+	case "file", "f":
+		return "file", nil
+	case "dir", "d", "folder":
+		return "folder", nil
+	}
+	return "", fmt.Errorf("unknown type '%s' (use file or dir)", value)
+}
+
+// ParseTimeBound parses a date (2006-01-02, local time) or an age such as
+// "30d", "2w" or "12h" (see ParseShareExpiry), which means that long ago
+func ParseTimeBound(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := ParseShareExpiry(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("'%s' is not a date (2006-01-02) or an age such as 30d, 2w or 12h", value)
+}